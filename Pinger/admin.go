@@ -0,0 +1,531 @@
+package Pinger
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin API lets ops act on a running backend. All requests and replies are JSON.
+//
+//   GET  /admin/sessions?user=&context=&device=&status=&protocol=&server=&offset=&limit=   list and search the sessions
+//   POST /admin/sessions/stop    {"UserId":..., "ClientContext":..., "DeviceId":...}   force-stop a session
+//   POST /admin/sessions/defer   {"UserId":..., "ClientContext":..., "DeviceId":..., "Timeout":<ms>}   force-defer a session
+//   POST /admin/push             {"UserId":..., "ClientContext":..., "DeviceId":..., "Message":"new"|"reg"}   send a test push
+//   POST /admin/reregister       {"UserId":..., "ClientContext":..., "Pinger":...}   push 'register' to the matching devices, in the background
+//   GET  /admin/reregister?job=<id>   the progress of a reregister job, or of all the recent ones without job
+//   GET  /admin/loglevel, PUT /admin/loglevel {"Level":"DEBUG"}   get or set the level of the log file
+//
+// It listens on admin-address, which is either a unix socket (unix:/path/to/socket), only accessible to
+// the user the backend runs as, or host:port, in which case a token (Authorization: Bearer <admin-token>)
+// is required, and the caller's address has to be in one of the admin-ip ranges, if any are configured.
+
+const adminUnixPrefix = "unix:"
+
+const defaultAdminSessionLimit = 100
+
+// maxAdminJobs is the number of finished jobs we keep around for their results.
+const maxAdminJobs = 20
+
+type adminServer struct {
+	backend   BackendPoller
+	pollMap   *pollMapType
+	db        Storage
+	aws       AWS.AWSHandler
+	logger    *Logging.Logger
+	getConfig func() *BackendConfiguration
+	unix      bool // on a unix socket, the file permissions are the authentication
+
+	jobMutex  sync.Mutex
+	jobs      []*AdminJob
+	lastJobId int
+}
+
+func newAdminServer(backend BackendPoller, pollMap *pollMapType, db Storage, aws AWS.AWSHandler, logger *Logging.Logger) *adminServer {
+	return &adminServer{
+		backend:   backend,
+		pollMap:   pollMap,
+		db:        db,
+		aws:       aws,
+		logger:    logger,
+		getConfig: globals.getConfig,
+	}
+}
+
+func (admin *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", admin.sessions)
+	mux.HandleFunc("/admin/sessions/stop", admin.stopSession)
+	mux.HandleFunc("/admin/sessions/defer", admin.deferSession)
+	mux.HandleFunc("/admin/push", admin.testPush)
+	mux.HandleFunc("/admin/reregister", admin.reregister)
+	mux.HandleFunc("/admin/loglevel", admin.logLevel)
+	return admin.authenticate(mux)
+}
+
+// serve serves the admin API on the admin-address. It only returns on error.
+func (admin *adminServer) serve(address string) error {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(address, adminUnixPrefix) {
+		path := strings.TrimPrefix(address, adminUnixPrefix)
+		if exists(path) {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+		}
+		listener, err = listenPrivateUnix(path)
+		if err != nil {
+			return err
+		}
+		admin.unix = true
+	} else {
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+	}
+	admin.logger.Info("Serving the admin API on %s", address)
+	return http.Serve(listener, admin.handler())
+}
+
+// listenPrivateUnix listens on a unix socket only the current user can connect to. The socket is
+// created in a private (0700) directory, and only moved to its path once its permissions are set,
+// so there's no window in which someone else can connect to it.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".pinger-admin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// the path changes under the listener, so it can't clean up after itself.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, 0700)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (admin *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !admin.unix {
+			config := admin.getConfig()
+			// no X-Forwarded-For here. The admin API is not meant to be behind a proxy.
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !config.checkAdminIP(ip) {
+				admin.logger.Warning("Admin request from %s denied: bad IP|msgCode=ADMIN_DENIED", r.RemoteAddr)
+				admin.reply(w, http.StatusForbidden, adminError("BAD IP"))
+				return
+			}
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !config.checkAdminToken(token) {
+				admin.logger.Warning("Admin request from %s denied: bad token|msgCode=ADMIN_DENIED", r.RemoteAddr)
+				admin.reply(w, http.StatusForbidden, adminError("TOKEN MISMATCH"))
+				return
+			}
+		}
+		admin.logger.Info("Admin request %s %s|msgCode=ADMIN_REQUEST", r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cfg *BackendConfiguration) checkAdminIP(ip net.IP) bool {
+	if len(cfg.adminCidrList) == 0 {
+		return true
+	}
+	for _, ipnet := range cfg.adminCidrList {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *BackendConfiguration) checkAdminToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, tok := range cfg.AdminToken {
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+type adminResponse struct {
+	Code    PollingReplyType
+	Message string
+}
+
+func adminError(message string) *adminResponse {
+	return &adminResponse{Code: PollingReplyError, Message: message}
+}
+
+func (admin *adminServer) reply(w http.ResponseWriter, status int, response interface{}) {
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		admin.logger.Error("Could not json encode admin reply: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseJson)
+	w.Write([]byte("\n"))
+}
+
+// decode reads the JSON request body into v. It writes the error reply and returns false if it can't.
+func (admin *adminServer) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" && r.Method != "PUT" {
+		admin.reply(w, http.StatusMethodNotAllowed, adminError("UNKNOWN METHOD"))
+		return false
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(v)
+	if err != nil {
+		admin.reply(w, http.StatusBadRequest, adminError(fmt.Sprintf("Could not parse json: %s", err)))
+		return false
+	}
+	return true
+}
+
+// pollingReply turns the reply of the RPC functions into the HTTP reply.
+func (admin *adminServer) pollingReply(w http.ResponseWriter, reply *PollingResponse, err error) {
+	switch {
+	case err != nil:
+		admin.reply(w, http.StatusInternalServerError, adminError(err.Error()))
+	case reply.Code == PollingReplyError:
+		admin.reply(w, http.StatusNotFound, &adminResponse{Code: reply.Code, Message: reply.Message})
+	default:
+		admin.reply(w, http.StatusOK, &adminResponse{Code: reply.Code, Message: reply.Message})
+	}
+}
+
+type AdminSessionsResponse struct {
+	Code     PollingReplyType
+	Message  string
+	Total    int // the number of matching sessions
+	Offset   int
+	Sessions []ClientSessionInfo
+}
+
+// sessions lists the active sessions matching the given criteria, sorted by user, context
+// and device, a page at a time. The criteria match the way they do for pinger-sessions (see
+// FindSessionsArgs.matches).
+func (admin *adminServer) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		admin.reply(w, http.StatusMethodNotAllowed, adminError("UNKNOWN METHOD"))
+		return
+	}
+	query := r.URL.Query()
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAdminSessionLimit
+	}
+	args := FindSessionsArgs{
+		UserId:        query.Get("user"),
+		ClientContext: query.Get("context"),
+		DeviceId:      query.Get("device"),
+		Status:        query.Get("status"), // e.g. Pinging, Waiting, Error
+		Protocol:      query.Get("protocol"),
+		MailServer:    query.Get("server"),
+	}
+	err = args.validate()
+	if err != nil {
+		admin.reply(w, http.StatusBadRequest, adminError(err.Error()))
+		return
+	}
+
+	matching := make([]ClientSessionInfo, 0)
+	admin.backend.LockMap()
+	for _, poll := range *admin.pollMap {
+		if poll == nil {
+			continue
+		}
+		session, err := poll.getSessionInfo()
+		if err != nil || session == nil {
+			continue
+		}
+		if args.matches(session) {
+			matching = append(matching, *session)
+		}
+	}
+	admin.backend.UnlockMap()
+	sort.Sort(bySessionKey(matching))
+
+	reply := AdminSessionsResponse{Code: PollingReplyOK, Total: len(matching), Offset: offset}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		reply.Sessions = matching[offset:end]
+	}
+	admin.reply(w, http.StatusOK, &reply)
+}
+
+type adminSessionArgs struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	Timeout       uint64 // for defer, in milliseconds
+}
+
+func (admin *adminServer) decodeSession(w http.ResponseWriter, r *http.Request) (*adminSessionArgs, bool) {
+	args := adminSessionArgs{}
+	if !admin.decode(w, r, &args) {
+		return nil, false
+	}
+	if args.UserId == "" || args.ClientContext == "" || args.DeviceId == "" {
+		admin.reply(w, http.StatusBadRequest, adminError("UserId, ClientContext and DeviceId are required"))
+		return nil, false
+	}
+	return &args, true
+}
+
+func (admin *adminServer) stopSession(w http.ResponseWriter, r *http.Request) {
+	args, ok := admin.decodeSession(w, r)
+	if !ok {
+		return
+	}
+	reply := PollingResponse{}
+	err := admin.backend.Stop(&StopPollArgs{UserId: args.UserId, ClientContext: args.ClientContext, DeviceId: args.DeviceId}, &reply)
+	admin.pollingReply(w, &reply, err)
+}
+
+func (admin *adminServer) deferSession(w http.ResponseWriter, r *http.Request) {
+	args, ok := admin.decodeSession(w, r)
+	if !ok {
+		return
+	}
+	reply := PollingResponse{}
+	err := admin.backend.Defer(&DeferPollArgs{UserId: args.UserId, ClientContext: args.ClientContext, DeviceId: args.DeviceId, Timeout: args.Timeout}, &reply)
+	admin.pollingReply(w, &reply, err)
+}
+
+type adminPushArgs struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	Message       PingerNotification // 'new' (the default) or 'reg'
+}
+
+type AdminPushResponse struct {
+	Code    PollingReplyType
+	Message string
+	Pushes  int // the number of pushes sent
+}
+
+// testPush sends a push to a device, for each of its sessions in the DB.
+func (admin *adminServer) testPush(w http.ResponseWriter, r *http.Request) {
+	args := adminPushArgs{}
+	if !admin.decode(w, r, &args) {
+		return
+	}
+	if args.UserId == "" || args.ClientContext == "" || args.DeviceId == "" {
+		admin.reply(w, http.StatusBadRequest, adminError("UserId, ClientContext and DeviceId are required"))
+		return
+	}
+	if args.Message == "" {
+		args.Message = PingerNotificationNewMail
+	}
+	if args.Message != PingerNotificationNewMail && args.Message != PingerNotificationRegister {
+		admin.reply(w, http.StatusBadRequest, adminError(fmt.Sprintf("Unknown Message '%s'. Use '%s' or '%s'", args.Message, PingerNotificationNewMail, PingerNotificationRegister)))
+		return
+	}
+	devices, err := findDevices(admin.db, admin.aws, &deviceFilter{UserId: args.UserId, ClientContext: args.ClientContext, DeviceId: args.DeviceId}, admin.logger)
+	if err != nil {
+		admin.reply(w, http.StatusInternalServerError, adminError(err.Error()))
+		return
+	}
+	if len(devices) == 0 {
+		admin.reply(w, http.StatusNotFound, adminError("No such device"))
+		return
+	}
+	reply := AdminPushResponse{Code: PollingReplyOK}
+	for _, di := range devices {
+		if args.Message == PingerNotificationRegister {
+			err = di.PushRegister()
+		} else {
+			// a test push, for no mail in particular
+			err = di.PushNewMail(time.Time{})
+		}
+		if err != nil {
+			di.Warning("Could not send test push: %s|msgCode=ADMIN_PUSH_FAILED", err)
+			reply.Code = PollingReplyWarn
+			reply.Message = err.Error()
+			continue
+		}
+		reply.Pushes++
+	}
+	admin.reply(w, http.StatusOK, &reply)
+}
+
+type adminReregisterArgs struct {
+	UserId        string
+	ClientContext string
+	Pinger        string // the pinger the devices belong to. This pinger if empty, '*' for any.
+}
+
+// AdminJob is a request that runs in the background, like a reregister.
+type AdminJob struct {
+	Id       int
+	Running  bool
+	Pushes   int    // the number of pushes sent, once done
+	Error    string // why it failed, if it did
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+}
+
+type AdminJobResponse struct {
+	Code    PollingReplyType
+	Message string
+	Jobs    []AdminJob
+}
+
+// startJob runs fn, with the id of its job, in the background, and returns the job that keeps track of it.
+func (admin *adminServer) startJob(fn func(id int) (int, error)) AdminJob {
+	admin.jobMutex.Lock()
+	admin.lastJobId++
+	job := &AdminJob{Id: admin.lastJobId, Running: true, Started: time.Now()}
+	// forget the oldest finished jobs
+	for i := 0; len(admin.jobs) >= maxAdminJobs && i < len(admin.jobs); {
+		if admin.jobs[i].Running {
+			i++
+			continue
+		}
+		admin.jobs = append(admin.jobs[:i], admin.jobs[i+1:]...)
+	}
+	admin.jobs = append(admin.jobs, job)
+	started := *job
+	admin.jobMutex.Unlock()
+
+	go func() {
+		pushes, err := fn(started.Id)
+		admin.jobMutex.Lock()
+		defer admin.jobMutex.Unlock()
+		job.Running = false
+		job.Pushes = pushes
+		if err != nil {
+			job.Error = err.Error()
+		}
+		job.Finished = time.Now()
+	}()
+	return started
+}
+
+// getJobs returns a copy of the job with the given id, or of all the jobs if id is 0.
+func (admin *adminServer) getJobs(id int) []AdminJob {
+	admin.jobMutex.Lock()
+	defer admin.jobMutex.Unlock()
+	jobs := make([]AdminJob, 0, len(admin.jobs))
+	for _, job := range admin.jobs {
+		if id == 0 || job.Id == id {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+// reregister pushes 'register' to the devices matching all the given criteria, e.g. the devices
+// of a pinger that went away, instead of all of them like on startup. There can be lots of them, so
+// the pushes go out in the background, and the reply is the job to check on with a GET.
+func (admin *adminServer) reregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		id := 0
+		if job := r.URL.Query().Get("job"); job != "" {
+			var err error
+			id, err = strconv.Atoi(job)
+			if err != nil || id <= 0 {
+				admin.reply(w, http.StatusBadRequest, adminError(fmt.Sprintf("Bad job id '%s'", job)))
+				return
+			}
+		}
+		jobs := admin.getJobs(id)
+		if id != 0 && len(jobs) == 0 {
+			admin.reply(w, http.StatusNotFound, adminError("No such job"))
+			return
+		}
+		admin.reply(w, http.StatusOK, &AdminJobResponse{Code: PollingReplyOK, Jobs: jobs})
+		return
+	}
+	args := adminReregisterArgs{}
+	if !admin.decode(w, r, &args) {
+		return
+	}
+	filter := deviceFilter{UserId: args.UserId, ClientContext: args.ClientContext, Pinger: args.Pinger}
+	switch args.Pinger {
+	case "":
+		filter.Pinger = pingerHostId
+	case "*":
+		filter.Pinger = ""
+	}
+	job := admin.startJob(func(id int) (int, error) {
+		pushes, err := alertDevices(admin.db, admin.aws, &filter, admin.logger)
+		if err != nil {
+			admin.logger.Error("Reregister job %d failed after %d pushes: %s|msgCode=ADMIN_REREGISTER_FAILED", id, pushes, err)
+		} else {
+			admin.logger.Info("Sent %d register pushes|job=%d|user=%s|context=%s|pinger=%s|msgCode=ADMIN_REREGISTER",
+				pushes, id, filter.UserId, filter.ClientContext, filter.Pinger)
+		}
+		return pushes, err
+	})
+	admin.reply(w, http.StatusAccepted, &AdminJobResponse{Code: PollingReplyOK, Jobs: []AdminJob{job}})
+}
+
+type AdminLogLevel struct {
+	Level string
+}
+
+// logLevel gets or sets the level of the log file, until the next config reload.
+func (admin *adminServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		args := AdminLogLevel{}
+		if !admin.decode(w, r, &args) {
+			return
+		}
+		level, err := Logging.LogLevel(args.Level)
+		if err != nil {
+			admin.reply(w, http.StatusBadRequest, adminError(err.Error()))
+			return
+		}
+		Logging.SetFileLevel(admin.logger, level)
+	}
+	level, ok := Logging.GetFileLevel(admin.logger)
+	if !ok {
+		admin.reply(w, http.StatusNotFound, adminError("No log file"))
+		return
+	}
+	admin.reply(w, http.StatusOK, &AdminLogLevel{Level: level.String()})
+}
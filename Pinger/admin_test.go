@@ -0,0 +1,345 @@
+package Pinger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type adminTester struct {
+	suite.Suite
+	dbm     *gorp.DbMap
+	logger  *Logging.Logger
+	aws     *AWS.TestAwsHandler
+	backend *TestingBackend
+	config  *BackendConfiguration
+	admin   *adminServer
+	logDir  string
+}
+
+func TestAdmin(t *testing.T) {
+	s := new(adminTester)
+	suite.Run(t, s)
+}
+
+func (s *adminTester) SetupSuite() {
+	var err error
+	s.logDir, err = ioutil.TempDir("", "admintest")
+	s.NoError(err)
+	s.logger = Logging.InitLogging("admintest", path.Join(s.logDir, "admintest.log"), Logging.INFO, true, Logging.DEBUG, nil, true)
+	dbconfig := DBConfiguration{Type: "sqlite", Filename: ":memory:"}
+	s.dbm, err = initDB(&dbconfig, true, s.logger)
+	if err != nil {
+		panic("Could not create DB")
+	}
+}
+
+func (s *adminTester) TearDownSuite() {
+	os.RemoveAll(s.logDir)
+}
+
+func (s *adminTester) SetupTest() {
+	s.dbm.TruncateTables()
+	s.aws = AWS.NewTestAwsHandler()
+	globals = nil
+	setGlobal(NewBackendConfiguration())
+	s.config = NewBackendConfiguration()
+	s.config.AdminAddress = "127.0.0.1:8081"
+	s.config.AdminToken = []string{"sometoken"}
+	s.config.AdminIPList = []string{"127.0.0.0/8"}
+	s.NoError(s.config.validate())
+	s.backend = &TestingBackend{BackendPolling{
+		db:          newSqlStorage(s.dbm),
+		logger:      s.logger,
+		loggerLevel: -1,
+		debug:       true,
+		pollMap:     make(pollMapType),
+	}}
+	s.admin = newAdminServer(s.backend, &s.backend.pollMap, s.backend.db, s.aws, s.logger)
+	s.admin.getConfig = func() *BackendConfiguration { return s.config }
+}
+
+func (s *adminTester) TearDownTest() {
+	globals = nil
+}
+
+func (s *adminTester) request(method, url string, body interface{}, reply interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		s.NoError(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	s.NoError(err)
+	req.RemoteAddr = "127.0.0.1:54321"
+	req.Header.Set("Authorization", "Bearer sometoken")
+	w := httptest.NewRecorder()
+	s.admin.handler().ServeHTTP(w, req)
+	if reply != nil {
+		s.NoError(json.Unmarshal(w.Body.Bytes(), reply), w.Body.String())
+	}
+	return w.Code
+}
+
+func (s *adminTester) addSession(userId, clientContext, deviceId string, status MailClientStatus) {
+	s.backend.pollMap[pollMapKeyFor(userId, clientContext, deviceId)] = &testingMailClientContext{
+		logger: s.logger,
+		status: status,
+		session: &ClientSessionInfo{
+			UserId:        userId,
+			ClientContext: clientContext,
+			DeviceId:      deviceId,
+			Status:        status,
+		},
+	}
+}
+
+// addDevice adds a device. Pushes go to a push token, which is shared by all the contexts on a device.
+func (s *adminTester) addDevice(userId, clientContext, deviceId string) {
+	pushToken := fmt.Sprintf("%064x", []byte(userId+deviceId))[:64]
+	di, err := newDeviceInfo(userId, clientContext, deviceId, pushToken, "APNS", "ios", "8.1", "0.9", "(dev) Foo", "12345678", s.aws, newDeviceInfoSqlHandler(s.dbm), s.logger)
+	s.NoError(err)
+	di.AWSEndpointArn = "12345"
+	s.NoError(di.insert(nil))
+}
+
+func (s *adminTester) TestAuthentication() {
+	for _, test := range []struct {
+		remoteAddr string
+		token      string
+		status     int
+	}{
+		{"127.0.0.1:54321", "Bearer sometoken", http.StatusOK},
+		{"127.0.0.1:54321", "", http.StatusForbidden},
+		{"127.0.0.1:54321", "Bearer othertoken", http.StatusForbidden},
+		{"10.1.2.3:54321", "Bearer sometoken", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("GET", "/admin/sessions", nil)
+		s.NoError(err)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("Authorization", test.token)
+		w := httptest.NewRecorder()
+		s.admin.handler().ServeHTTP(w, req)
+		s.Equal(test.status, w.Code, fmt.Sprintf("%s %s", test.remoteAddr, test.token))
+	}
+
+	// any address if there are no admin-ip ranges
+	s.config.AdminIPList = nil
+	s.NoError(s.config.validate())
+	req, err := http.NewRequest("GET", "/admin/sessions", nil)
+	s.NoError(err)
+	req.RemoteAddr = "10.1.2.3:54321"
+	req.Header.Set("Authorization", "Bearer sometoken")
+	w := httptest.NewRecorder()
+	s.admin.handler().ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	// on a unix socket, the socket permissions are the authentication
+	s.admin.unix = true
+	req, err = http.NewRequest("GET", "/admin/sessions", nil)
+	s.NoError(err)
+	w = httptest.NewRecorder()
+	s.admin.handler().ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+}
+
+func (s *adminTester) TestConfig() {
+	config := NewBackendConfiguration()
+	config.AdminAddress = "127.0.0.1:8081"
+	s.Error(config.validate(), "a token is required on a TCP address")
+	config.AdminAddress = "unix:/tmp/pinger-admin.sock"
+	s.NoError(config.validate())
+	config.AdminIPList = []string{"not-a-cidr"}
+	s.Error(config.validate())
+}
+
+func (s *adminTester) TestSessions() {
+	s.addSession("user2", "context1", "device1", MailClientStatusPinging)
+	s.addSession("user1", "context2", "device1", MailClientStatusDeferred)
+	s.addSession("user1", "context1", "device1", MailClientStatusPinging)
+
+	reply := AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions", nil, &reply))
+	s.Equal(3, reply.Total)
+	s.Len(reply.Sessions, 3)
+	s.Equal("user1", reply.Sessions[0].UserId)
+	s.Equal("context1", reply.Sessions[0].ClientContext)
+	s.Equal("user2", reply.Sessions[2].UserId)
+
+	reply = AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions?user=user1", nil, &reply))
+	s.Equal(2, reply.Total)
+
+	reply = AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions?user=user1&status="+MailClientStatusDeferred.String(), nil, &reply))
+	s.Equal(1, reply.Total)
+	s.Equal("context2", reply.Sessions[0].ClientContext)
+
+	reply = AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions?status=waiting", nil, &reply))
+	s.Equal(1, reply.Total)
+
+	// a typo is an error, not an empty list
+	s.Equal(http.StatusBadRequest, s.request("GET", "/admin/sessions?status=Deferred", nil, nil))
+
+	reply = AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions?offset=1&limit=1", nil, &reply))
+	s.Equal(3, reply.Total)
+	s.Equal(1, reply.Offset)
+	s.Len(reply.Sessions, 1)
+	s.Equal("context2", reply.Sessions[0].ClientContext)
+
+	reply = AdminSessionsResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/sessions?offset=10", nil, &reply))
+	s.Equal(3, reply.Total)
+	s.Empty(reply.Sessions)
+
+	s.Equal(http.StatusMethodNotAllowed, s.request("POST", "/admin/sessions", nil, nil))
+}
+
+func (s *adminTester) TestStopAndDefer() {
+	s.addSession("user1", "context1", "device1", MailClientStatusPinging)
+	session := adminSessionArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device1", Timeout: 1000}
+
+	reply := adminResponse{}
+	s.Equal(http.StatusOK, s.request("POST", "/admin/sessions/defer", &session, &reply))
+	s.Equal(PollingReplyOK, reply.Code)
+
+	reply = adminResponse{}
+	s.Equal(http.StatusOK, s.request("POST", "/admin/sessions/stop", &session, &reply))
+	s.Equal(PollingReplyOK, reply.Code)
+	s.Empty(s.backend.pollMap)
+
+	reply = adminResponse{}
+	s.Equal(http.StatusNotFound, s.request("POST", "/admin/sessions/stop", &session, &reply))
+	s.Equal(PollingReplyError, reply.Code)
+
+	s.Equal(http.StatusBadRequest, s.request("POST", "/admin/sessions/stop", &adminSessionArgs{UserId: "user1"}, nil))
+	s.Equal(http.StatusMethodNotAllowed, s.request("GET", "/admin/sessions/stop", nil, nil))
+}
+
+func (s *adminTester) TestPush() {
+	s.addDevice("user1", "context1", "device1")
+
+	reply := AdminPushResponse{}
+	s.Equal(http.StatusOK, s.request("POST", "/admin/push", &adminPushArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device1"}, &reply))
+	s.Equal(PollingReplyOK, reply.Code)
+	s.Equal(1, reply.Pushes)
+
+	reply = AdminPushResponse{}
+	s.Equal(http.StatusOK, s.request("POST", "/admin/push", &adminPushArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device1", Message: PingerNotificationRegister}, &reply))
+	s.Equal(1, reply.Pushes)
+
+	s.Equal(http.StatusNotFound, s.request("POST", "/admin/push", &adminPushArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device2"}, nil))
+	s.Equal(http.StatusBadRequest, s.request("POST", "/admin/push", &adminPushArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device1", Message: "foo"}, nil))
+}
+
+// reregister starts a reregister job, waits for it and returns the number of pushes it sent.
+func (s *adminTester) reregister(args *adminReregisterArgs) int {
+	reply := AdminJobResponse{}
+	s.Equal(http.StatusAccepted, s.request("POST", "/admin/reregister", args, &reply))
+	s.Equal(PollingReplyOK, reply.Code)
+	s.Len(reply.Jobs, 1)
+	url := fmt.Sprintf("/admin/reregister?job=%d", reply.Jobs[0].Id)
+	for i := 0; i < 100; i++ {
+		reply = AdminJobResponse{}
+		s.Equal(http.StatusOK, s.request("GET", url, nil, &reply))
+		s.Len(reply.Jobs, 1)
+		if !reply.Jobs[0].Running {
+			s.Empty(reply.Jobs[0].Error)
+			return reply.Jobs[0].Pushes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Fail("reregister job did not finish")
+	return -1
+}
+
+func (s *adminTester) TestReregister() {
+	s.addDevice("user1", "context1", "device1")
+	s.addDevice("user1", "context2", "device1")
+	s.addDevice("user2", "context3", "device2")
+
+	s.Equal(1, s.reregister(&adminReregisterArgs{UserId: "user1"})) // both contexts are on the same device
+	s.Equal(1, s.reregister(&adminReregisterArgs{UserId: "user1", ClientContext: "context2"}))
+	s.Equal(0, s.reregister(&adminReregisterArgs{Pinger: "some-other-pinger"}))
+	s.Equal(2, s.reregister(&adminReregisterArgs{Pinger: "*"}))
+
+	reply := AdminJobResponse{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/reregister", nil, &reply))
+	s.Len(reply.Jobs, 4)
+	s.Equal(http.StatusNotFound, s.request("GET", "/admin/reregister?job=1000", nil, nil))
+	s.Equal(http.StatusBadRequest, s.request("GET", "/admin/reregister?job=foo", nil, nil))
+}
+
+func (s *adminTester) running() int {
+	running := 0
+	for _, job := range s.admin.getJobs(0) {
+		if job.Running {
+			running++
+		}
+	}
+	return running
+}
+
+func (s *adminTester) TestJobs() {
+	for i := 0; i < maxAdminJobs+5; i++ {
+		s.admin.startJob(func(id int) (int, error) { return id, nil })
+	}
+	for i := 0; i < 100 && s.running() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Equal(0, s.running())
+	job := s.admin.startJob(func(id int) (int, error) { return id, nil })
+	jobs := s.admin.getJobs(0)
+	s.Len(jobs, maxAdminJobs)
+	s.Equal(job.Id, jobs[len(jobs)-1].Id)
+	s.Equal(job.Id-maxAdminJobs+1, jobs[0].Id) // the oldest are gone
+}
+
+func (s *adminTester) TestUnixSocket() {
+	path := path.Join(s.logDir, "admin.sock")
+	listener, err := listenPrivateUnix(path)
+	s.NoError(err)
+	defer listener.Close()
+	info, err := os.Stat(path)
+	s.NoError(err)
+	s.Equal(os.FileMode(0700), info.Mode().Perm())
+	s.True(info.Mode()&os.ModeSocket != 0)
+	conn, err := net.Dial("unix", path)
+	s.NoError(err)
+	conn.Close()
+	// nothing left behind but the socket
+	files, err := ioutil.ReadDir(s.logDir)
+	s.NoError(err)
+	for _, f := range files {
+		s.False(strings.HasPrefix(f.Name(), ".pinger-admin"), f.Name())
+	}
+}
+
+func (s *adminTester) TestLogLevel() {
+	reply := AdminLogLevel{}
+	s.Equal(http.StatusOK, s.request("GET", "/admin/loglevel", nil, &reply))
+	s.Equal("INFO", reply.Level)
+
+	reply = AdminLogLevel{}
+	s.Equal(http.StatusOK, s.request("PUT", "/admin/loglevel", &AdminLogLevel{Level: "DEBUG"}, &reply))
+	s.Equal("DEBUG", reply.Level)
+
+	s.Equal(http.StatusBadRequest, s.request("PUT", "/admin/loglevel", &AdminLogLevel{Level: "CHATTY"}, nil))
+	Logging.SetFileLevel(s.logger, Logging.INFO)
+}
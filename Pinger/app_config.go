@@ -0,0 +1,132 @@
+package Pinger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AppConfiguration is the push setup of one of the (white-label) apps that share the pinger. It is
+// read from the [app "<app id>"] sections of the config file. Devices say which app they are when
+// they register. Those that don't use the settings in [backend] and [aws].
+//
+// The credentials are the app's own: APNSKeyFile and APNSCertFile to push to APNS directly, and/or
+// SnsIOSPlatformArn to push through SNS. The notification settings that are not set default to the
+// ones in [backend].
+type AppConfiguration struct {
+	APNSSandbox           bool
+	APNSKeyFile           string
+	APNSCertFile          string
+	SnsIOSPlatformArn     string
+	APNSAlert             *bool
+	APNSSound             *string
+	APNSContentAvailable  *int
+	APNSExpirationSeconds *int64
+}
+
+func (app *AppConfiguration) validate(appId string) error {
+	if appId == "" {
+		return fmt.Errorf("app: the app id can not be empty")
+	}
+	if app.APNSKeyFile != "" && !exists(app.APNSKeyFile) {
+		return fmt.Errorf("app %s: Key file %s does not exist", appId, app.APNSKeyFile)
+	}
+	if app.APNSCertFile != "" && !exists(app.APNSCertFile) {
+		return fmt.Errorf("app %s: Cert file %s does not exist", appId, app.APNSCertFile)
+	}
+	if (app.APNSKeyFile == "") != (app.APNSCertFile == "") {
+		return fmt.Errorf("app %s: APNSKeyFile and APNSCertFile go together", appId)
+	}
+	if app.APNSCertFile == "" && app.SnsIOSPlatformArn == "" {
+		return fmt.Errorf("app %s: needs APNSKeyFile and APNSCertFile, or SnsIOSPlatformArn", appId)
+	}
+	return nil
+}
+
+// pushConfig is what the pushes to the devices of an app are sent with.
+type pushConfig struct {
+	AppId                 string
+	APNSSandbox           bool
+	APNSKeyFile           string
+	APNSCertFile          string
+	SnsIOSPlatformArn     string // empty for the one in [aws]
+	APNSAlert             bool
+	APNSSound             string
+	APNSContentAvailable  int
+	APNSExpirationSeconds int64
+}
+
+// pushConfig returns the push config of the app, or of [backend] for the empty app id.
+func (cfg *BackendConfiguration) pushConfig(appId string) (*pushConfig, error) {
+	push := &pushConfig{
+		AppId:                 appId,
+		APNSSandbox:           cfg.APNSSandbox,
+		APNSKeyFile:           cfg.APNSKeyFile,
+		APNSCertFile:          cfg.APNSCertFile,
+		APNSAlert:             cfg.APNSAlert,
+		APNSSound:             cfg.APNSSound,
+		APNSContentAvailable:  cfg.APNSContentAvailable,
+		APNSExpirationSeconds: cfg.APNSExpirationSeconds,
+	}
+	if appId == "" {
+		return push, nil
+	}
+	app, ok := cfg.apps[appId]
+	if !ok {
+		return nil, fmt.Errorf("AppId %s is not known", appId)
+	}
+	push.APNSSandbox = app.APNSSandbox
+	push.APNSKeyFile = app.APNSKeyFile
+	push.APNSCertFile = app.APNSCertFile
+	push.SnsIOSPlatformArn = app.SnsIOSPlatformArn
+	if app.APNSAlert != nil {
+		push.APNSAlert = *app.APNSAlert
+	}
+	if app.APNSSound != nil {
+		push.APNSSound = *app.APNSSound
+	}
+	if app.APNSContentAvailable != nil {
+		push.APNSContentAvailable = *app.APNSContentAvailable
+	}
+	if app.APNSExpirationSeconds != nil {
+		push.APNSExpirationSeconds = *app.APNSExpirationSeconds
+	}
+	return push, nil
+}
+
+// apnsPushConfigs returns the push configs that push to APNS directly, [backend]'s first.
+func (cfg *BackendConfiguration) apnsPushConfigs() []*pushConfig {
+	appIds := make([]string, 0, len(cfg.apps)+1)
+	appIds = append(appIds, "")
+	for appId := range cfg.apps {
+		appIds = append(appIds, appId)
+	}
+	sort.Strings(appIds[1:])
+	configs := make([]*pushConfig, 0, len(appIds))
+	for _, appId := range appIds {
+		push, _ := cfg.pushConfig(appId)
+		if push.APNSCertFile != "" && push.APNSKeyFile != "" {
+			configs = append(configs, push)
+		}
+	}
+	return configs
+}
+
+// directAPNS is true if pushes to the service go to APNS directly, rather than through SNS.
+func (push *pushConfig) directAPNS(service string) bool {
+	return strings.EqualFold(service, PushServiceAPNS) && push.APNSCertFile != "" && push.APNSKeyFile != ""
+}
+
+// alert is the alert text for the message, if the app shows alerts.
+func (push *pushConfig) alert(message PingerNotification) string {
+	if !push.APNSAlert {
+		return ""
+	}
+	switch message {
+	case PingerNotificationRegister:
+		return "Nacho says: Reregister!"
+	case PingerNotificationNewMail:
+		return "Nacho says: You have mail!"
+	}
+	return ""
+}
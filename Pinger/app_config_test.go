@@ -0,0 +1,177 @@
+package Pinger
+
+import (
+	"bytes"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type appConfigTester struct {
+	suite.Suite
+	dir    string
+	logger *Logging.Logger
+}
+
+func (s *appConfigTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *appConfigTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pinger-app-config")
+	s.NoError(err)
+	globals = nil
+}
+
+func (s *appConfigTester) TearDownTest() {
+	os.RemoveAll(s.dir)
+	globals = nil
+}
+
+func TestAppConfig(t *testing.T) {
+	s := new(appConfigTester)
+	suite.Run(t, s)
+}
+
+func (s *appConfigTester) writeFile(name, data string) string {
+	filename := path.Join(s.dir, name)
+	err := ioutil.WriteFile(filename, []byte(data), 0600)
+	s.NoError(err)
+	return filename
+}
+
+func (s *appConfigTester) readConfig() *Configuration {
+	key := s.writeFile("brandy.key", "key")
+	cert := s.writeFile("brandy.crt", "cert")
+	filename := s.writeFile("pinger.cfg", `
+[server]
+TokenAuthKey = "0123456789abcdef"
+
+[backend]
+APNSSound = "silent.wav"
+APNSExpirationSeconds = 3600
+
+[db]
+type = "memory"
+
+[aws]
+regionName = "us-west-2"
+accessKey = "foo"
+secretKey = "bar"
+
+[app "brandx"]
+SnsIOSPlatformArn = "arn:aws:sns:us-west-2:1234:app/APNS/brandx"
+APNSAlert = false
+APNSSound =
+
+[app "brandy"]
+APNSSandbox = true
+APNSKeyFile = `+key+`
+APNSCertFile = `+cert+`
+APNSExpirationSeconds = 60
+`)
+	config, err := ReadConfig(filename)
+	require.NoError(s.T(), err)
+	return config
+}
+
+func (s *appConfigTester) TestPushConfig() {
+	config := s.readConfig()
+
+	push, err := config.Backend.pushConfig("")
+	s.NoError(err)
+	s.True(push.APNSAlert)
+	s.Equal("silent.wav", push.APNSSound)
+	s.Equal(int64(3600), push.APNSExpirationSeconds)
+	s.Equal("", push.SnsIOSPlatformArn)
+	s.False(push.directAPNS(PushServiceAPNS))
+
+	push, err = config.Backend.pushConfig("brandx")
+	s.NoError(err)
+	s.Equal("brandx", push.AppId)
+	s.False(push.APNSAlert)
+	s.Equal("", push.alert(PingerNotificationNewMail))
+	s.Equal("", push.APNSSound)
+	s.Equal(int64(3600), push.APNSExpirationSeconds)
+	s.Equal("arn:aws:sns:us-west-2:1234:app/APNS/brandx", push.SnsIOSPlatformArn)
+	s.False(push.directAPNS(PushServiceAPNS))
+
+	push, err = config.Backend.pushConfig("brandy")
+	s.NoError(err)
+	s.True(push.APNSAlert)
+	s.NotEqual("", push.alert(PingerNotificationNewMail))
+	s.Equal("silent.wav", push.APNSSound)
+	s.Equal(int64(60), push.APNSExpirationSeconds)
+	s.True(push.APNSSandbox)
+	s.True(push.directAPNS(PushServiceAPNS))
+	s.False(push.directAPNS("GCM"))
+
+	_, err = config.Backend.pushConfig("brandz")
+	s.EqualError(err, "AppId brandz is not known")
+
+	apns := config.Backend.apnsPushConfigs()
+	require.Len(s.T(), apns, 1)
+	s.Equal("brandy", apns[0].AppId)
+}
+
+func (s *appConfigTester) TestWriteRedacted() {
+	config := s.readConfig()
+	buf := new(bytes.Buffer)
+	s.NoError(config.WriteRedacted(buf))
+	out := buf.String()
+	s.Contains(out, "[app \"brandx\"]\nAPNSSandbox = false\nAPNSKeyFile = \"\"\nAPNSCertFile = \"\"\nSnsIOSPlatformArn = arn:aws:sns:us-west-2:1234:app/APNS/brandx\nAPNSAlert = false\nAPNSSound = \"\"\n\n")
+
+	written := NewConfiguration()
+	s.NoError(written.Read(s.writeFile("written.cfg", out)))
+	s.Equal(config.App["brandx"].SnsIOSPlatformArn, written.App["brandx"].SnsIOSPlatformArn)
+	s.Equal(*config.App["brandy"].APNSExpirationSeconds, *written.App["brandy"].APNSExpirationSeconds)
+	s.Nil(written.App["brandy"].APNSAlert)
+}
+
+func (s *appConfigTester) TestValidate() {
+	app := &AppConfiguration{}
+	s.EqualError(app.validate(""), "app: the app id can not be empty")
+	s.EqualError(app.validate("brandx"), "app brandx: needs APNSKeyFile and APNSCertFile, or SnsIOSPlatformArn")
+	app.APNSKeyFile = s.writeFile("brandx.key", "key")
+	s.EqualError(app.validate("brandx"), "app brandx: APNSKeyFile and APNSCertFile go together")
+	app.APNSCertFile = path.Join(s.dir, "nosuchfile")
+	s.Error(app.validate("brandx"))
+	app.APNSCertFile = s.writeFile("brandx.crt", "cert")
+	s.NoError(app.validate("brandx"))
+}
+
+func (s *appConfigTester) TestDevice() {
+	config := s.readConfig()
+	setGlobal(&config.Backend)
+	aws := AWS.NewTestAwsHandler()
+	aws.SetReturnRegisteredEndpoint("arn:aws:sns:us-west-2:1234:endpoint/APNS/brandx/1", nil)
+	db, closeStorage := newTestStorage("memory", aws, s.logger)
+	defer closeStorage()
+
+	pushToken := "AEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEF"
+	di, err := newDeviceInfo("user1", "context1", "device1", pushToken, "APNS", "ios", "8.1", "0.9", "", "session1", aws, db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.AppId = "brandz"
+	s.EqualError(di.validate(), "AppId brandz is not known")
+
+	di.AppId = "brandx"
+	s.NoError(di.insert(nil))
+	s.NoError(di.validateClient())
+	s.Equal("arn:aws:sns:us-west-2:1234:app/APNS/brandx", aws.RegisteredPlatformArn())
+	s.Equal("arn:aws:sns:us-west-2:1234:endpoint/APNS/brandx/1", di.AWSEndpointArn)
+
+	// the endpoint is in brandx's platform application, so it has to go when the app changes
+	changed, err := di.updateDeviceInfo("", di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
+	s.NoError(err)
+	s.True(changed)
+	s.Equal("", di.AppId)
+	s.Equal("", di.AWSEndpointArn)
+	s.NoError(di.validateClient())
+	s.Equal("", aws.RegisteredPlatformArn())
+}
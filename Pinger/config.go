@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/nachocove/Pinger/Utils/Redact"
 	"github.com/nachocove/Pinger/Utils/Telemetry"
 	"gopkg.in/gcfg.v1"
-	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"strings"
 )
 
 type Configuration struct {
@@ -20,6 +22,12 @@ type Configuration struct {
 	Telemetry Telemetry.TelemetryConfiguration
 	Backend   BackendConfiguration
 	Server    ServerConfiguration
+	TLSPolicy map[string]*TLSPolicyConfiguration `gcfg:"tls-policy"`
+	App       map[string]*AppConfiguration       `gcfg:"app"`
+
+	// private
+	filename  string
+	overrides map[string]string // config key -> the env variable that overrode it
 }
 
 type BackendConfiguration struct {
@@ -35,6 +43,24 @@ type BackendConfiguration struct {
 	APNSSound             string
 	APNSContentAvailable  int
 	APNSExpirationSeconds int64
+	HostRateLimit         float64  `gcfg:"host-rate-limit"`
+	HostRateBurst         int      `gcfg:"host-rate-burst"`
+	HostBreakerThreshold  int      `gcfg:"host-breaker-threshold"`
+	HostBreakerTimeout    int      `gcfg:"host-breaker-timeout"`
+	HostBreakerMaxTimeout int      `gcfg:"host-breaker-max-timeout"`
+	ExtraCADir            string   `gcfg:"extra-ca-dir"`
+	MetricsAddress        string   `gcfg:"metrics-address"`
+	SessionHistorySize    int      `gcfg:"session-history-size"`
+	AdminAddress          string   `gcfg:"admin-address"` // host:port, or unix:/path/to/socket. Empty to disable the admin API
+	AdminIPList           []string `gcfg:"admin-ip"`
+	AdminToken            []string `gcfg:"admin-token" secret:"true"`
+	DeviceExpiry          int      `gcfg:"device-expiry"`         // days without contact after which a device is deleted. 0 keeps them forever
+	DeviceJanitorPeriod   int      `gcfg:"device-janitor-period"` // minutes between looking for expired devices
+
+	// private
+	tlsPolicies   map[string]*TLSPolicyConfiguration
+	apps          map[string]*AppConfiguration
+	adminCidrList []*net.IPNet
 }
 
 var days_28 int64 = 28 * 24 * 60 * 60
@@ -58,6 +84,13 @@ func NewBackendConfiguration() *BackendConfiguration {
 		APNSSound:             "silent.wav",
 		APNSContentAvailable:  1,
 		APNSExpirationSeconds: days_28,
+		HostRateLimit:         defaultHostRateLimit,
+		HostRateBurst:         defaultHostRateBurst,
+		HostBreakerThreshold:  defaultHostBreakerThreshold,
+		HostBreakerTimeout:    defaultHostBreakerTimeout,
+		HostBreakerMaxTimeout: defaultHostBreakerMaxTimeout,
+		SessionHistorySize:    defaultSessionHistorySize,
+		DeviceJanitorPeriod:   defaultDeviceJanitorPeriod,
 	}
 }
 
@@ -71,44 +104,67 @@ func (cfg *BackendConfiguration) validate() error {
 	if cfg.APNSKeyFile != "" && cfg.APNSCertFile != "" && cfg.APNSFeedbackPeriod <= 0 {
 		return fmt.Errorf("APNSFeedbackPeriod can not be <= 0 if APNS cert and keys are configured")
 	}
-	return nil
-}
-
-var rootCAs *x509.CertPool
-
-// Read the certs in OsTrustStore, then add in the additional
-// certs, then return that CertPool structure for use in TlsConfig's
-func (cfg *BackendConfiguration) RootCerts() *x509.CertPool {
-	if rootCAs == nil {
-		roots := x509.NewCertPool()
-		data, err := ioutil.ReadFile(OsTrustStore)
-		if err != nil {
-			panic(err.Error())
+	if cfg.ExtraCADir != "" {
+		if !exists(cfg.ExtraCADir) {
+			return fmt.Errorf("extra-ca-dir %s does not exist", cfg.ExtraCADir)
 		}
-		if !roots.AppendCertsFromPEM(data) {
-			panic(fmt.Sprintf("Could not read PEM file %s", OsTrustStore))
-		}
-
-		for i, cert := range extra_certs {
-			if !roots.AppendCertsFromPEM([]byte(cert)) {
-				panic(fmt.Sprintf("Could not parse PEM cert %s", i))
-			}
+		_, err := loadExtraCADir(cfg.ExtraCADir, x509.NewCertPool())
+		if err != nil {
+			return err
 		}
-		for _, c := range roots.Subjects() {
-			fmt.Println("Cert: %v", c)
+	}
+	if cfg.HostRateLimit < 0 {
+		return fmt.Errorf("host-rate-limit can not be < 0")
+	}
+	if cfg.HostRateLimit > 0 && cfg.HostRateBurst < 1 {
+		return fmt.Errorf("host-rate-burst must be >= 1 if host-rate-limit is set")
+	}
+	if cfg.SessionHistorySize < 0 {
+		return fmt.Errorf("session-history-size can not be < 0")
+	}
+	if cfg.DeviceExpiry < 0 {
+		return fmt.Errorf("device-expiry can not be < 0")
+	}
+	if cfg.DeviceExpiry > 0 && cfg.DeviceJanitorPeriod <= 0 {
+		return fmt.Errorf("device-janitor-period must be > 0 if device-expiry is set")
+	}
+	if cfg.HostBreakerThreshold > 0 && cfg.HostBreakerTimeout <= 0 {
+		return fmt.Errorf("host-breaker-timeout must be > 0 if host-breaker-threshold is set")
+	}
+	cfg.adminCidrList = nil
+	badIP := make([]string, 0, 5)
+	for _, cidr := range cfg.AdminIPList {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			badIP = append(badIP, err.Error())
+		} else {
+			cfg.adminCidrList = append(cfg.adminCidrList, ipnet)
 		}
-		rootCAs = roots
 	}
-	return rootCAs
+	if len(badIP) > 0 {
+		return fmt.Errorf("admin-ip: %s", strings.Join(badIP, ", "))
+	}
+	if cfg.AdminAddress != "" && !strings.HasPrefix(cfg.AdminAddress, adminUnixPrefix) && len(cfg.AdminToken) == 0 {
+		return fmt.Errorf("admin-token is required if the admin-address is not a unix socket")
+	}
+	return nil
 }
 
 type LoggingConfiguration struct {
 	LogDir       string
 	LogFileName  string
 	LogFileLevel string
+	ScreenLevel  string // if set, log to the screen at this level, unless -d or -v say otherwise
+	LogFormat    string // text or json
+
+	RedactDisable []string // builtin redaction rules to turn off, see Redact.RuleNames()
+	RedactPattern []string // additional regular expressions to redact from log messages
 
 	// private
 	logFileLevel Logging.Level
+	screenLevel  Logging.Level
+	logFormat    Logging.Format
+	redactor     *Redact.Redactor
 }
 
 const (
@@ -117,9 +173,20 @@ const (
 	defaultLogDir             = "./log"
 	defaultLogFileName        = ""
 	defaultLogFileLevel       = "INFO"
+	defaultLogFormat          = "text"
 	defaultPingerUpdater      = 0
 	defaultAPNSFeedbackPeriod = 10
 	defaultReArmTimeout       = 10
+
+	defaultHostRateLimit         = 0 // off. See host-rate-limit in the example config
+	defaultHostRateBurst         = 20
+	defaultHostBreakerThreshold  = 5
+	defaultHostBreakerTimeout    = 30
+	defaultHostBreakerMaxTimeout = 600
+
+	defaultSessionHistorySize = 50
+
+	defaultDeviceJanitorPeriod = 60
 )
 
 func NewLoggingConfiguration() *LoggingConfiguration {
@@ -127,6 +194,7 @@ func NewLoggingConfiguration() *LoggingConfiguration {
 		LogDir:       defaultLogDir,
 		LogFileName:  defaultLogFileName,
 		LogFileLevel: defaultLogFileLevel,
+		LogFormat:    defaultLogFormat,
 	}
 }
 
@@ -148,6 +216,11 @@ func (config *Configuration) Read(filename string) error {
 	if err != nil {
 		return err
 	}
+	err = config.applyOverrides(os.Environ())
+	if err != nil {
+		return err
+	}
+	config.filename = filename
 	return nil
 }
 
@@ -171,6 +244,23 @@ func (cfg *LoggingConfiguration) Validate() error {
 		return err
 	}
 	cfg.logFileLevel = level
+	if cfg.ScreenLevel != "" {
+		level, err = Logging.LogLevel(cfg.ScreenLevel)
+		if err != nil {
+			return err
+		}
+		cfg.screenLevel = level
+	}
+	format, err := Logging.LogFormat(cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+	cfg.logFormat = format
+	redactor, err := Redact.NewRedactor(cfg.RedactDisable, cfg.RedactPattern)
+	if err != nil {
+		return err
+	}
+	cfg.redactor = redactor
 	return nil
 }
 
@@ -182,8 +272,13 @@ func (cfg *LoggingConfiguration) InitLogging(screen bool, screenLevel Logging.Le
 	if !exists(cfg.LogDir) {
 		return nil, fmt.Errorf("Logging directory %s does not exist.", cfg.LogDir)
 	}
+	Redact.Set(cfg.redactor)
+	if !screen && cfg.ScreenLevel != "" {
+		screen = true
+		screenLevel = cfg.screenLevel
+	}
 	loggerName := path.Base(os.Args[0])
-	logger := Logging.InitLogging(loggerName, path.Join(cfg.LogDir, cfg.LogFileName), cfg.logFileLevel, screen, screenLevel, telemetryWriter, debug)
+	logger := Logging.InitLoggingFormat(loggerName, path.Join(cfg.LogDir, cfg.LogFileName), cfg.logFileLevel, cfg.logFormat, screen, screenLevel, telemetryWriter, debug)
 	return logger, nil
 }
 
@@ -207,8 +302,7 @@ func ReadConfig(filename string) (*Configuration, error) {
 	}
 	err = config.Server.validate()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error validate server config:\n%v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error validate server config: %v", err)
 	}
 	err = config.Telemetry.Validate()
 	if err != nil {
@@ -218,5 +312,24 @@ func ReadConfig(filename string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.Backend.tlsPolicies = make(map[string]*TLSPolicyConfiguration)
+	for domain, policy := range config.TLSPolicy {
+		err = policy.validate(domain)
+		if err != nil {
+			return nil, err
+		}
+		config.Backend.tlsPolicies[strings.ToLower(domain)] = policy
+	}
+	config.Backend.apps = make(map[string]*AppConfiguration)
+	for appId, app := range config.App {
+		err = app.validate(appId)
+		if err != nil {
+			return nil, err
+		}
+		if app.APNSCertFile != "" && config.Backend.APNSFeedbackPeriod <= 0 {
+			return nil, fmt.Errorf("APNSFeedbackPeriod can not be <= 0 if APNS cert and keys are configured")
+		}
+		config.Backend.apps[appId] = app
+	}
 	return config, nil
 }
@@ -0,0 +1,258 @@
+package Pinger
+
+import (
+	"fmt"
+	"gopkg.in/gcfg.v1/types"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Any key in the config file can be overridden from the environment, with a variable named
+// PINGER_<SECTION>_<KEY>, upper-cased, with '-' replaced by '_'. For example
+// PINGER_SERVER_TOKENAUTHKEY or PINGER_BACKEND_REARM_TIMEOUT. Multi-valued keys (e.g.
+// alive-check-ip) take a comma-separated list, which replaces the values from the file.
+//
+// Any secret (the values 'pinger-config check' redacts), whether from the file or from the
+// environment, can be a reference to a secrets file, in the form file:///path/to/secret. The
+// value is then the content of the file, with trailing whitespace removed. Other values are
+// taken as they are, since some of them are file:// URLs (e.g. UploadLocationPrefix).
+//
+// Sub-sections (e.g. [tls-policy "example.com"]) can not be overridden.
+const (
+	configEnvPrefix  = "PINGER_"
+	configFilePrefix = "file://"
+	redactedValue    = "<redacted>"
+)
+
+// configKey is a key in one of the config sections, and the struct field it is read into.
+type configKey struct {
+	section string
+	name    string
+	field   reflect.Value
+	secret  bool
+}
+
+// id returns the key as <section>.<key>, lower-cased.
+func (key *configKey) id() string {
+	return strings.ToLower(key.section + "." + key.name)
+}
+
+// envName returns the name of the env variable that overrides the key.
+func (key *configKey) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(key.section+"_"+key.name, "-", "_", -1))
+}
+
+func gcfgName(field reflect.StructField) string {
+	name := field.Tag.Get("gcfg")
+	if name == "" {
+		name = field.Name
+	}
+	return name
+}
+
+// configKeys returns all the keys in the (non-sub-section) sections of the config, in order.
+func (config *Configuration) configKeys() []*configKey {
+	keys := make([]*configKey, 0, 64)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		section := v.Type().Field(i)
+		if section.PkgPath != "" || section.Type.Kind() != reflect.Struct || section.Tag.Get("gcfg") == "-" {
+			continue
+		}
+		sv := v.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			field := sv.Type().Field(j)
+			if field.PkgPath != "" || field.Tag.Get("gcfg") == "-" {
+				continue
+			}
+			keys = append(keys, &configKey{
+				section: strings.ToLower(gcfgName(section)),
+				name:    gcfgName(field),
+				field:   sv.Field(j),
+				secret:  field.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	return keys
+}
+
+// readSecretFile returns the value, or if the value is a file:// reference, the content of the file.
+func readSecretFile(value string) (string, error) {
+	if !strings.HasPrefix(value, configFilePrefix) {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(strings.TrimPrefix(value, configFilePrefix))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), " \t\r\n"), nil
+}
+
+func setConfigValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := types.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return types.ParseInt(field.Addr().Interface(), value, types.Dec+types.Hex)
+	case reflect.Float32, reflect.Float64:
+		return types.ScanFully(field.Addr().Interface(), value, 'v')
+	case reflect.Slice:
+		values := make([]string, 0, 2)
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			err := setConfigValue(slice.Index(i), v)
+			if err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("Unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// applyOverrides applies the env variable overrides in environ (as returned by os.Environ())
+// to the config, and resolves the file:// references of the secrets.
+func (config *Configuration) applyOverrides(environ []string) error {
+	env := make(map[string]string)
+	for _, e := range environ {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], configEnvPrefix) {
+			env[kv[0]] = kv[1]
+		}
+	}
+	config.overrides = make(map[string]string)
+	for _, key := range config.configKeys() {
+		name := key.envName()
+		if value, ok := env[name]; ok {
+			err := setConfigValue(key.field, value)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			config.overrides[key.id()] = name
+		}
+		if !key.secret {
+			continue
+		}
+		switch key.field.Kind() {
+		case reflect.String:
+			value, err := readSecretFile(key.field.String())
+			if err != nil {
+				return fmt.Errorf("%s.%s: %s", key.section, key.name, err)
+			}
+			key.field.SetString(value)
+		case reflect.Slice:
+			if key.field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			for i := 0; i < key.field.Len(); i++ {
+				value, err := readSecretFile(key.field.Index(i).String())
+				if err != nil {
+					return fmt.Errorf("%s.%s: %s", key.section, key.name, err)
+				}
+				key.field.Index(i).SetString(value)
+			}
+		}
+	}
+	return nil
+}
+
+// quoteConfigValue quotes a value so that gcfg reads it back as the same string.
+func quoteConfigValue(value string) string {
+	if value != "" && strings.TrimSpace(value) == value && !strings.ContainsAny(value, ";#\"\\\n\t") {
+		return value
+	}
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	value = strings.Replace(value, "\n", "\\n", -1)
+	value = strings.Replace(value, "\t", "\\t", -1)
+	return "\"" + value + "\""
+}
+
+func formatConfigValue(field reflect.Value, secret bool) []string {
+	if field.Kind() == reflect.Slice {
+		values := make([]string, 0, field.Len())
+		for i := 0; i < field.Len(); i++ {
+			values = append(values, formatConfigValue(field.Index(i), secret)...)
+		}
+		return values
+	}
+	if secret && field.Kind() == reflect.String && field.String() != "" {
+		return []string{redactedValue}
+	}
+	if field.Kind() == reflect.String {
+		return []string{quoteConfigValue(field.String())}
+	}
+	return []string{fmt.Sprintf("%v", field.Interface())}
+}
+
+// WriteRedacted writes the effective configuration, i.e. after the env overrides and secret
+// files have been applied, in config file format, with the secrets redacted.
+func (config *Configuration) WriteRedacted(w io.Writer) error {
+	section := ""
+	for _, key := range config.configKeys() {
+		if key.section != section {
+			if section != "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", key.section)
+			section = key.section
+		}
+		if env, ok := config.overrides[key.id()]; ok {
+			fmt.Fprintf(w, "# from %s\n", env)
+		}
+		for _, value := range formatConfigValue(key.field, key.secret) {
+			fmt.Fprintf(w, "%s = %s\n", key.name, value)
+		}
+	}
+	writeSubsections(w, "tls-policy", reflect.ValueOf(config.TLSPolicy))
+	writeSubsections(w, "app", reflect.ValueOf(config.App))
+	return nil
+}
+
+// writeSubsections writes the [name "<subsection>"] sections of a map of them, sorted by subsection.
+// Values that are not set (nil pointers) are left out.
+func writeSubsections(w io.Writer, name string, sections reflect.Value) {
+	subsections := make([]string, 0, sections.Len())
+	for _, key := range sections.MapKeys() {
+		subsections = append(subsections, key.String())
+	}
+	sort.Strings(subsections)
+	for _, subsection := range subsections {
+		fmt.Fprintf(w, "\n[%s \"%s\"]\n", name, subsection)
+		v := sections.MapIndex(reflect.ValueOf(subsection)).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			value := v.Field(i)
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			for _, s := range formatConfigValue(value, field.Tag.Get("secret") == "true") {
+				fmt.Fprintf(w, "%s = %s\n", gcfgName(field), s)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package Pinger
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type configOverridesTester struct {
+	suite.Suite
+	dir string
+}
+
+func (s *configOverridesTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pinger-config")
+	s.NoError(err)
+}
+
+func (s *configOverridesTester) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func TestConfigOverrides(t *testing.T) {
+	s := new(configOverridesTester)
+	suite.Run(t, s)
+}
+
+func (s *configOverridesTester) writeFile(name, data string) string {
+	filename := path.Join(s.dir, name)
+	err := ioutil.WriteFile(filename, []byte(data), 0600)
+	s.NoError(err)
+	return filename
+}
+
+func (s *configOverridesTester) TestEnvOverrides() {
+	config := NewConfiguration()
+	config.Backend.APNSSound = "silent.wav"
+	err := config.applyOverrides([]string{
+		"PINGER_BACKEND_APNSSOUND=loud.wav",
+		"PINGER_BACKEND_REARM_TIMEOUT=5",
+		"PINGER_BACKEND_APNSALERT=no",
+		"PINGER_BACKEND_HOST_RATE_LIMIT=2.5",
+		"PINGER_SERVER_ALIVE_CHECK_IP=10.0.0.0/8, 192.168.0.0/16",
+		"PINGER_CONFIG=/some/file.cfg",
+		"PINGER_NOSUCH_KEY=1",
+		"HOME=/root",
+	})
+	s.NoError(err)
+	s.Equal("loud.wav", config.Backend.APNSSound)
+	s.Equal(5, config.Backend.ReArmTimeout)
+	s.False(config.Backend.APNSAlert)
+	s.Equal(2.5, config.Backend.HostRateLimit)
+	s.Equal([]string{"10.0.0.0/8", "192.168.0.0/16"}, config.Server.AliveCheckIPList)
+	s.Equal("PINGER_BACKEND_REARM_TIMEOUT", config.overrides["backend.rearm-timeout"])
+
+	err = NewConfiguration().applyOverrides([]string{"PINGER_BACKEND_REARM_TIMEOUT=soon"})
+	s.Error(err)
+	err = NewConfiguration().applyOverrides([]string{"PINGER_BACKEND_APNSALERT=maybe"})
+	s.Error(err)
+}
+
+func (s *configOverridesTester) TestSecretFiles() {
+	secret := s.writeFile("secret", "0123456789abcdef\n")
+	password := s.writeFile("password", "hunter2")
+	config := NewConfiguration()
+	config.Server.TokenAuthKey = "file://" + secret
+	config.Server.AliveCheckToken = []string{"12345", "file://" + password}
+	err := config.applyOverrides([]string{"PINGER_DB_PASSWORD=file://" + password})
+	s.NoError(err)
+	s.Equal("0123456789abcdef", config.Server.TokenAuthKey)
+	s.Equal([]string{"12345", "hunter2"}, config.Server.AliveCheckToken)
+	s.Equal("hunter2", config.Db.Password)
+
+	config = NewConfiguration()
+	err = config.applyOverrides([]string{"PINGER_AWS_SECRETKEY=file://" + path.Join(s.dir, "nosuchfile")})
+	s.Error(err)
+}
+
+func (s *configOverridesTester) TestFileURLs() {
+	out := path.Join(s.dir, "telemetry-out")
+	filename := s.writeFile("pinger.cfg", `
+[server]
+TokenAuthKey = "0123456789abcdef"
+
+[db]
+type = "memory"
+
+[aws]
+regionName = "us-west-2"
+accessKey = "foo"
+secretKey = "bar"
+
+[telemetry]
+UploadLocationPrefix = file://`+out+`
+UploadUser = pinger
+UploadPassword = file://`+s.writeFile("upload", "hunter2\n")+`
+`)
+	config, err := ReadConfig(filename)
+	s.NoError(err)
+	// only secrets are read from files
+	s.Equal("file://"+out, config.Telemetry.UploadLocationPrefix)
+	s.Equal("hunter2", config.Telemetry.UploadPassword)
+
+	buf := new(bytes.Buffer)
+	s.NoError(config.WriteRedacted(buf))
+	s.Contains(buf.String(), "UploadPassword = <redacted>\n")
+	s.NotContains(buf.String(), "hunter2")
+}
+
+func (s *configOverridesTester) TestReadConfig() {
+	filename := s.writeFile("pinger.cfg", `
+[server]
+TokenAuthKey = "0123456789abcdef"
+alive-check-token = "12345"
+session-secret = "secret; with a comment char"
+
+[db]
+type = "sqlite"
+filename = ":memory:"
+
+[aws]
+regionName = "us-west-2"
+accessKey = "foo"
+secretKey = "bar"
+
+[tls-policy "example.com"]
+min-version = 1.2
+`)
+	os.Setenv("PINGER_AWS_SECRETKEY", "file://"+s.writeFile("aws", "supersecret\n"))
+	defer os.Unsetenv("PINGER_AWS_SECRETKEY")
+	config, err := ReadConfig(filename)
+	s.NoError(err)
+	s.Equal("supersecret", config.Aws.SecretKey)
+
+	buf := new(bytes.Buffer)
+	err = config.WriteRedacted(buf)
+	s.NoError(err)
+	out := buf.String()
+	s.NotContains(out, "supersecret")
+	s.NotContains(out, "0123456789abcdef")
+	s.NotContains(out, "12345")
+	s.NotContains(out, "bar")
+	s.Contains(out, "[aws]\n")
+	s.Contains(out, "# from PINGER_AWS_SECRETKEY\nSecretKey = <redacted>\n")
+	s.Contains(out, "TokenAuthKey = <redacted>\n")
+	s.Contains(out, "RegionName = us-west-2\n")
+	s.Contains(out, "[tls-policy \"example.com\"]\nmin-version = 1.2\n")
+
+	// the output is itself a valid config file
+	written := NewConfiguration()
+	err = written.Read(s.writeFile("written.cfg", out))
+	s.NoError(err)
+	s.Equal(config.Server.Port, written.Server.Port)
+	s.Equal(config.Db.Filename, written.Db.Filename)
+	s.Equal(redactedValue, written.Server.SessionSecret)
+	s.Equal(config.TLSPolicy["example.com"].MinVersion, written.TLSPolicy["example.com"].MinVersion)
+}
@@ -0,0 +1,65 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/Logging"
+)
+
+// Reload re-reads and validates the config file the configuration was read from. It returns
+// a copy of config with the settings that are safe to change at runtime taken from the file:
+//
+//   [logging]: LogFileLevel, ScreenLevel
+//   [telemetry]: IncludeDebug
+//   [backend]: APNSAlert, APNSSound, APNSExpirationSeconds, rearm-timeout, admin-ip, admin-token,
+//              host-rate-limit, host-rate-burst, host-breaker-threshold, host-breaker-timeout, host-breaker-max-timeout
+//   [server]: imap-folder-name, alive-check-ip, alive-check-token, TokenAuthKey, TokenAuthOldKey
+//
+// Everything else keeps its current value. config itself is not modified, so the caller can
+// swap in the result, and anyone still using the old configuration sees a consistent set of values.
+func (config *Configuration) Reload() (*Configuration, error) {
+	if config.filename == "" {
+		return nil, fmt.Errorf("Configuration was not read from a file. Can not reload")
+	}
+	fileConfig, err := ReadConfig(config.filename)
+	if err != nil {
+		return nil, err
+	}
+	newConfig := *config
+
+	newConfig.Logging.LogFileLevel = fileConfig.Logging.LogFileLevel
+	newConfig.Logging.logFileLevel = fileConfig.Logging.logFileLevel
+	newConfig.Logging.ScreenLevel = fileConfig.Logging.ScreenLevel
+	newConfig.Logging.screenLevel = fileConfig.Logging.screenLevel
+	newConfig.Telemetry.IncludeDebug = fileConfig.Telemetry.IncludeDebug
+
+	newConfig.Backend.APNSAlert = fileConfig.Backend.APNSAlert
+	newConfig.Backend.APNSSound = fileConfig.Backend.APNSSound
+	newConfig.Backend.APNSExpirationSeconds = fileConfig.Backend.APNSExpirationSeconds
+	newConfig.Backend.ReArmTimeout = fileConfig.Backend.ReArmTimeout
+	newConfig.Backend.AdminIPList = fileConfig.Backend.AdminIPList
+	newConfig.Backend.AdminToken = fileConfig.Backend.AdminToken
+	newConfig.Backend.adminCidrList = fileConfig.Backend.adminCidrList
+	newConfig.Backend.HostRateLimit = fileConfig.Backend.HostRateLimit
+	newConfig.Backend.HostRateBurst = fileConfig.Backend.HostRateBurst
+	newConfig.Backend.HostBreakerThreshold = fileConfig.Backend.HostBreakerThreshold
+	newConfig.Backend.HostBreakerTimeout = fileConfig.Backend.HostBreakerTimeout
+	newConfig.Backend.HostBreakerMaxTimeout = fileConfig.Backend.HostBreakerMaxTimeout
+
+	newConfig.Server.IMAPFolderNames = fileConfig.Server.IMAPFolderNames
+	newConfig.Server.AliveCheckIPList = fileConfig.Server.AliveCheckIPList
+	newConfig.Server.AliveCheckToken = fileConfig.Server.AliveCheckToken
+	newConfig.Server.aliveCheckCidrList = fileConfig.Server.aliveCheckCidrList
+	newConfig.Server.TokenAuthKey = fileConfig.Server.TokenAuthKey
+	newConfig.Server.TokenAuthOldKey = fileConfig.Server.TokenAuthOldKey
+	return &newConfig, nil
+}
+
+// SetLogLevels applies the (possibly reloaded) log levels to the logger: those of the log file,
+// the screen (if one is configured), and whether the debug messages go to telemetry.
+func (config *Configuration) SetLogLevels(logger *Logging.Logger) {
+	Logging.SetFileLevel(logger, config.Logging.logFileLevel)
+	if config.Logging.ScreenLevel != "" {
+		Logging.SetScreenLevel(logger, config.Logging.screenLevel)
+	}
+	Logging.SetTelemetryDebug(logger, config.Telemetry.IncludeDebug)
+}
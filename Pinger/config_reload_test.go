@@ -0,0 +1,156 @@
+package Pinger
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type configReloadTester struct {
+	suite.Suite
+	filename string
+}
+
+const testConfigTemplate = `
+[logging]
+LogFileLevel = %s
+
+[backend]
+APNSSound = %s
+rearm-timeout = %d
+pinger-updater = %d
+
+[server]
+port = %d
+TokenAuthKey = "0123456789abcdef"
+imap-folder-name = %s
+alive-check-ip = %s
+alive-check-token = %s
+
+[db]
+type = "sqlite"
+filename = ":memory:"
+
+[aws]
+regionName = "us-west-2"
+accessKey = "foo"
+secretKey = "bar"
+`
+
+func (s *configReloadTester) SetupTest() {
+	f, err := ioutil.TempFile("", "pinger-config")
+	s.NoError(err)
+	f.Close()
+	s.filename = f.Name()
+}
+
+func (s *configReloadTester) TearDownTest() {
+	os.Remove(s.filename)
+}
+
+func TestConfigReload(t *testing.T) {
+	s := new(configReloadTester)
+	suite.Run(t, s)
+}
+
+func (s *configReloadTester) writeConfig(level, sound string, rearm, updater, port int, folder, ip, token string, extra ...string) {
+	data := fmt.Sprintf(testConfigTemplate, level, sound, rearm, updater, port, folder, ip, token) + strings.Join(extra, "\n")
+	err := ioutil.WriteFile(s.filename, []byte(data), 0600)
+	s.NoError(err)
+}
+
+func (s *configReloadTester) TestReload() {
+	s.writeConfig("INFO", "silent.wav", 10, 0, 443, "INBOX", "10.0.0.0/8", "12345")
+	config, err := ReadConfig(s.filename)
+	s.NoError(err)
+	s.Equal("silent.wav", config.Backend.APNSSound)
+
+	// the root certs are reloaded separately (see ReloadRootCerts), not with the config
+	roots := rootCAs
+	defer func() { rootCAs = roots }()
+	rootCAs = x509.NewCertPool()
+	loaded := rootCAs
+
+	s.writeConfig("DEBUG", "loud.wav", 5, 10, 8443, "Inbox2", "192.168.0.0/16", "67890",
+		"[logging]", "ScreenLevel = WARNING", "[telemetry]", "IncludeDebug = true",
+		"[backend]", "host-rate-limit = 5", "host-breaker-threshold = 2")
+	newConfig, err := config.Reload()
+	s.NoError(err)
+	s.True(rootCAs == loaded, "Reload should not re-read the root certs")
+
+	// the old one is untouched
+	s.Equal("INFO", config.Logging.LogFileLevel)
+	s.Equal("silent.wav", config.Backend.APNSSound)
+	s.Equal(10, config.Backend.ReArmTimeout)
+	s.NotContains(config.Server.IMAPFolderNames, "Inbox2")
+	s.True(config.Server.CheckToken("12345"))
+
+	// safe settings are reloaded
+	s.Equal("DEBUG", newConfig.Logging.LogFileLevel)
+	s.Equal("WARNING", newConfig.Logging.ScreenLevel)
+	s.Equal(Logging.WARNING, newConfig.Logging.screenLevel)
+	s.True(newConfig.Telemetry.IncludeDebug)
+	s.Equal("loud.wav", newConfig.Backend.APNSSound)
+	s.Equal(5, newConfig.Backend.ReArmTimeout)
+	s.Equal(5.0, newConfig.Backend.HostRateLimit)
+	s.Equal(2, newConfig.Backend.HostBreakerThreshold)
+	s.Contains(newConfig.Server.IMAPFolderNames, "Inbox2")
+	s.True(newConfig.Server.CheckToken("67890"))
+	s.False(newConfig.Server.CheckToken("12345"))
+	s.True(newConfig.Server.CheckIP([]byte{192, 168, 1, 1}))
+	s.False(newConfig.Server.CheckIP([]byte{10, 1, 1, 1}))
+
+	// everything else is not
+	s.Equal(0, newConfig.Backend.PingerUpdater)
+	s.Equal(443, newConfig.Server.Port)
+
+	// a broken config doesn't replace anything
+	s.writeConfig("DEBUG", "loud.wav", 5, 10, 8443, "Inbox2", "192.168.0.0/16", "67890", "[logging]", "ScreenLevel = LOUD")
+	_, err = newConfig.Reload()
+	s.Error(err)
+	s.writeConfig("NOSUCHLEVEL", "loud.wav", 5, 10, 8443, "Inbox2", "192.168.0.0/16", "67890")
+	_, err = newConfig.Reload()
+	s.Error(err)
+	s.writeConfig("DEBUG", "loud.wav", 5, 10, 8443, "Inbox2", "not-an-ip", "67890")
+	_, err = newConfig.Reload()
+	s.Error(err)
+}
+
+func (s *configReloadTester) TestReloadTokenKeys() {
+	s.writeConfig("INFO", "silent.wav", 10, 0, 443, "INBOX", "10.0.0.0/8", "12345")
+	config, err := ReadConfig(s.filename)
+	s.NoError(err)
+	token, err := config.Server.CreateAuthToken("us-east-1:12345", "context", "NCHOXfherekgrgr", "session")
+	s.NoError(err)
+
+	// rotate the key, keeping the old one
+	s.writeConfig("INFO", "silent.wav", 10, 0, 443, "INBOX", "10.0.0.0/8", "12345",
+		"[server]", `TokenAuthKey = "abcdefghijabcdef"`, `TokenAuthOldKey = "0123456789abcdef"`)
+	newConfig, err := config.Reload()
+	s.NoError(err)
+	s.Equal("0123456789abcdef", config.Server.TokenAuthKey)
+	s.Equal("abcdefghijabcdef", newConfig.Server.TokenAuthKey)
+	s.Equal([]string{"0123456789abcdef"}, newConfig.Server.TokenAuthOldKey)
+	sessionId, err := newConfig.Server.ValidateAuthToken("us-east-1:12345", "context", "NCHOXfherekgrgr", token)
+	s.NoError(err)
+	s.Equal("session", sessionId)
+
+	// and drop the old one
+	s.writeConfig("INFO", "silent.wav", 10, 0, 443, "INBOX", "10.0.0.0/8", "12345",
+		"[server]", `TokenAuthKey = "abcdefghijabcdef"`)
+	newConfig, err = newConfig.Reload()
+	s.NoError(err)
+	s.Empty(newConfig.Server.TokenAuthOldKey)
+	_, err = newConfig.Server.ValidateAuthToken("us-east-1:12345", "context", "NCHOXfherekgrgr", token)
+	s.Error(err)
+}
+
+func (s *configReloadTester) TestNoFile() {
+	_, err := NewConfiguration().Reload()
+	s.Error(err)
+}
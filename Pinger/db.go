@@ -1,6 +1,7 @@
 package Pinger
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"github.com/coopernurse/gorp"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nachocove/Pinger/Utils/Logging"
+	"strings"
 )
 
 type DBConfiguration struct {
@@ -19,8 +21,10 @@ type DBConfiguration struct {
 	Host        string
 	Port        int
 	Username    string
-	Password    string
+	Password    string `secret:"true"`
 	Certificate string // for SSL protected communication with the DB
+	SSLMode     string // for postgres: disable, require, verify-ca or verify-full. verify-full if there's a Certificate, otherwise require.
+	TablePrefix string // for dynamo: prepended to the table names, e.g. alpha.pinger.
 	DebugSql    bool
 }
 
@@ -37,6 +41,28 @@ func (dbconfig *DBConfiguration) Validate() error {
 		}
 		break
 
+	case dbconfig.Type == "postgres":
+		if dbconfig.Username == "" || dbconfig.Password == "" || dbconfig.Host == "" ||
+			dbconfig.Port == 0 || dbconfig.Name == "" {
+			return errors.New("Missing parameters for postgres. All are required: Username, Password, Host, Port, Name")
+		}
+		switch dbconfig.postgresSSLMode() {
+		case "disable", "require":
+		case "verify-ca", "verify-full":
+			if dbconfig.Certificate == "" {
+				return fmt.Errorf("SSLMode %s needs the Certificate of the CA", dbconfig.SSLMode)
+			}
+		default:
+			return fmt.Errorf("Unknown SSLMode %s. Use disable, require, verify-ca or verify-full", dbconfig.SSLMode)
+		}
+
+	case dbconfig.Type == "dynamo":
+		// the region and credentials are in the aws section
+		break
+
+	case dbconfig.Type == "memory":
+		break
+
 	default:
 		return fmt.Errorf("Unknown/Unsupported db type %s", dbconfig.Type)
 	}
@@ -65,6 +91,15 @@ func initDB(dbconfig *DBConfiguration, init bool, logger *Logging.Logger) (*gorp
 	case dbconfig.Type == "sqlite" || dbconfig.Type == "sqlite3":
 		dbmap, err = initDbSqlite(dbconfig)
 
+	case dbconfig.Type == "postgres":
+		dbmap, err = initDbPostgres(dbconfig)
+
+	case dbconfig.Type == "dynamo":
+		return nil, errors.New("dynamo is not a SQL DB. It has no schema to migrate, and the pinger creates missing tables on startup")
+
+	case dbconfig.Type == "memory":
+		return nil, errors.New("memory is not a SQL DB. It has no schema to migrate")
+
 	default:
 		return nil, fmt.Errorf("Unknown db type %s", dbconfig.Type)
 	}
@@ -89,11 +124,10 @@ func initDB(dbconfig *DBConfiguration, init bool, logger *Logging.Logger) (*gorp
 	addPingerInfoTable(dbmap)
 
 	if init {
-		// create the tables. in a production system you'd generally
-		// use a migration tool, or create the tables via scripts
-		err := dbmap.CreateTablesIfNotExists()
+		// create or update the tables. See migrations.go
+		_, _, err := migrateDB(dbmap, logger)
 		if err != nil {
-			return nil, fmt.Errorf("Create tables failed: %s", err)
+			return nil, err
 		}
 	}
 
@@ -136,3 +170,72 @@ func initDbMySql(dbConfig *DBConfiguration) (*gorp.DbMap, error) {
 	}
 	return &gorp.DbMap{Db: db, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}, nil
 }
+
+func (dbConfig *DBConfiguration) postgresSSLMode() string {
+	switch {
+	case dbConfig.SSLMode != "":
+		return dbConfig.SSLMode
+	case dbConfig.Certificate != "":
+		return "verify-full"
+	}
+	return "require"
+}
+
+// postgresQuote quotes a value in a postgres connection string.
+func postgresQuote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// postgresDataSource returns the connection string for lib/pq, with the password replaced by
+// password, so the caller can log it with a fake one.
+func (dbConfig *DBConfiguration) postgresDataSource(password string) string {
+	dataSource := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
+		postgresQuote(dbConfig.Host), dbConfig.Port, postgresQuote(dbConfig.Name), postgresQuote(dbConfig.Username),
+		postgresQuote(password), dbConfig.postgresSSLMode())
+	if dbConfig.Certificate != "" && dbConfig.postgresSSLMode() != "disable" {
+		dataSource += " sslrootcert=" + postgresQuote(dbConfig.Certificate)
+	}
+	return dataSource
+}
+
+func initDbPostgres(dbConfig *DBConfiguration) (*gorp.DbMap, error) {
+	db, err := sql.Open("postgres", dbConfig.postgresDataSource(dbConfig.Password))
+	if err != nil {
+		// DO NOT LOG THE PASSWORD!
+		return nil, fmt.Errorf("Failed to open DB: %s\n%v", dbConfig.postgresDataSource("XXXXXXX"), err)
+	}
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("Could not ping database: %v", err)
+	}
+	return &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}, nil
+}
+
+// rebind replaces the '?' placeholders in the query with the bind variables of the dialect, e.g. $1, $2
+// for postgres. All our SQL uses '?', like mysql and sqlite.
+func rebind(dbmap *gorp.DbMap, query string) string {
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); !ok {
+		return query
+	}
+	var buf bytes.Buffer
+	i := 0
+	quote := rune(0)
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			buf.WriteString(dbmap.Dialect.BindVar(i))
+			i++
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
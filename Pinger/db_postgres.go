@@ -0,0 +1,6 @@
+package Pinger
+
+import (
+	// blank import to register the postgres driver.
+	_ "github.com/lib/pq"
+)
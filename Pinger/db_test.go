@@ -0,0 +1,65 @@
+package Pinger
+
+import (
+	"database/sql"
+	"github.com/coopernurse/gorp"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type dbTester struct {
+	suite.Suite
+}
+
+func TestDb(t *testing.T) {
+	s := new(dbTester)
+	suite.Run(t, s)
+}
+
+func (s *dbTester) postgresConfig() *DBConfiguration {
+	return &DBConfiguration{Type: "postgres", Name: "pinger", Host: "db.example.com", Port: 5432, Username: "pinger", Password: "it's a secret"}
+}
+
+func (s *dbTester) TestPostgresConfig() {
+	dbconfig := s.postgresConfig()
+	s.NoError(dbconfig.Validate())
+	s.Equal(`host='db.example.com' port=5432 dbname='pinger' user='pinger' password='it\'s a secret' sslmode=require`, dbconfig.postgresDataSource(dbconfig.Password))
+
+	dbconfig.Certificate = "/etc/pinger/db-ca.pem"
+	s.NoError(dbconfig.Validate())
+	s.Equal(`host='db.example.com' port=5432 dbname='pinger' user='pinger' password='XXXXXXX' sslmode=verify-full sslrootcert='/etc/pinger/db-ca.pem'`, dbconfig.postgresDataSource("XXXXXXX"))
+
+	dbconfig.SSLMode = "disable"
+	s.NoError(dbconfig.Validate())
+	s.NotContains(dbconfig.postgresDataSource(""), "sslrootcert")
+
+	dbconfig.SSLMode = "sometimes"
+	s.Error(dbconfig.Validate())
+
+	dbconfig = s.postgresConfig()
+	dbconfig.SSLMode = "verify-ca"
+	s.Error(dbconfig.Validate(), "verify-ca needs a Certificate")
+
+	dbconfig = s.postgresConfig()
+	dbconfig.Host = ""
+	s.Error(dbconfig.Validate())
+}
+
+func (s *dbTester) TestPostgresDriver() {
+	s.Contains(sql.Drivers(), "postgres")
+	// lib/pq can parse our connection strings, quotes and all
+	dbconfig := s.postgresConfig()
+	_, err := pq.NewConnector(dbconfig.postgresDataSource(dbconfig.Password))
+	s.NoError(err)
+	dbconfig.SSLMode = "disable"
+	_, err = pq.NewConnector(dbconfig.postgresDataSource(dbconfig.Password))
+	s.NoError(err)
+}
+
+func (s *dbTester) TestRebind() {
+	query := "select * from device_info where user_id=? and pinger=? and push_token<>'?'"
+	s.Equal(query, rebind(&gorp.DbMap{Dialect: gorp.SqliteDialect{}}, query))
+	s.Equal(query, rebind(&gorp.DbMap{Dialect: gorp.MySQLDialect{}}, query))
+	s.Equal("select * from device_info where user_id=$1 and pinger=$2 and push_token<>'?'", rebind(&gorp.DbMap{Dialect: gorp.PostgresDialect{}}, query))
+}
@@ -18,6 +18,7 @@ type deviceContact struct {
 	Updated            int64  `db:"updated"`
 	LastContact        int64  `db:"last_contact"`
 	LastContactRequest int64  `db:"last_contact_request"`
+	LastNewMailPush    int64  `db:"last_new_mail_push"`
 	UserId             string `db:"user_id"` // us-east-1a-XXXXXXXX
 	ClientContext      string `db:"client_context"`
 	DeviceId           string `db:"device_id"` // NCHO348348384384.....
@@ -52,6 +53,13 @@ func newDeviceContact(db DeviceContactDbHandler, userId, clientContext, deviceId
 	return &dc
 }
 
+// beforeInsert sets the timestamps of a new contact. The SQL handler calls it from the gorp hook.
+func (dc *deviceContact) beforeInsert() {
+	dc.Created = time.Now().UnixNano()
+	dc.Updated = dc.Created
+	dc.LastContact = dc.Created
+}
+
 func (dc *deviceContact) insert() error {
 	return dc.db.insert(dc)
 }
@@ -73,3 +81,14 @@ func (dc *deviceContact) updateLastContactRequest() error {
 	}
 	return nil
 }
+
+// updateLastNewMailPush records a new mail push. Like every push, it's also a contact request.
+func (dc *deviceContact) updateLastNewMailPush() error {
+	dc.LastContactRequest = time.Now().UnixNano()
+	dc.LastNewMailPush = dc.LastContactRequest
+	_, err := dc.db.update(dc)
+	if err != nil {
+		return err
+	}
+	return nil
+}
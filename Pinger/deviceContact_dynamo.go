@@ -0,0 +1,61 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/AWS"
+)
+
+type DeviceContactDynamoDbHandler struct {
+	DeviceContactDbHandler
+	storage   *dynamoStorage
+	tableName string
+}
+
+func newDeviceContactDynamoDbHandler(storage *dynamoStorage) *DeviceContactDynamoDbHandler {
+	return &DeviceContactDynamoDbHandler{
+		storage:   storage,
+		tableName: storage.tableName(deviceContactTableName),
+	}
+}
+
+func (dc *deviceContact) toMap() map[string]interface{} {
+	dcMap := dynamoItem(dc)
+	dcMap[dynamoKeyAttribute] = dc.storageKey()
+	return dcMap
+}
+
+// get takes the user, context and device, in that order.
+func (h *DeviceContactDynamoDbHandler) get(keys []AWS.DBKeyValue) (*deviceContact, error) {
+	key, err := keyFromValues(keys)
+	if err != nil {
+		return nil, err
+	}
+	dcMap, err := h.storage.dynamo.Get(h.tableName, []AWS.DBKeyValue{
+		{Key: dynamoKeyAttribute, Value: key, Comparison: AWS.KeyComparisonEq},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dcMap == nil {
+		return nil, nil
+	}
+	dc := deviceContact{}
+	fromDynamoItem(*dcMap, &dc)
+	dc.db = h
+	return &dc, nil
+}
+
+func (h *DeviceContactDynamoDbHandler) insert(dc *deviceContact) error {
+	dc.beforeInsert()
+	if dc.Id == 0 {
+		dc.Id = 1
+	}
+	return h.storage.insertItem(h.tableName, dc.toMap(), dynamoKeyAttribute)
+}
+
+func (h *DeviceContactDynamoDbHandler) update(dc *deviceContact) (int64, error) {
+	return h.storage.updateVersioned(h.tableName, &dc.Id, dc.toMap)
+}
+
+func (h *DeviceContactDynamoDbHandler) delete(dc *deviceContact) (int64, error) {
+	return h.storage.deleteVersioned(h.tableName, dc.storageKey(), dc.Id)
+}
@@ -0,0 +1,75 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+)
+
+type DeviceContactMemoryHandler struct {
+	DeviceContactDbHandler
+	storage *memoryStorage
+}
+
+func (h *DeviceContactMemoryHandler) stored(dc *deviceContact) deviceContact {
+	stored := *dc
+	stored.db = nil
+	return stored
+}
+
+func (h *DeviceContactMemoryHandler) insert(dc *deviceContact) error {
+	dc.beforeInsert()
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := dc.storageKey()
+	if _, ok := h.storage.contacts[key]; ok {
+		return fmt.Errorf("%s: %s already exists", deviceContactTableName, key)
+	}
+	if dc.Id == 0 {
+		dc.Id = 1
+	}
+	h.storage.contacts[key] = h.stored(dc)
+	return nil
+}
+
+func (h *DeviceContactMemoryHandler) update(dc *deviceContact) (int64, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := dc.storageKey()
+	stored, ok := h.storage.contacts[key]
+	n, err := checkVersion(deviceContactTableName, key, ok, stored.Id, dc.Id)
+	if n != 1 {
+		return n, err
+	}
+	dc.Id++
+	h.storage.contacts[key] = h.stored(dc)
+	return 1, nil
+}
+
+func (h *DeviceContactMemoryHandler) delete(dc *deviceContact) (int64, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := dc.storageKey()
+	stored, ok := h.storage.contacts[key]
+	n, err := checkVersion(deviceContactTableName, key, ok, stored.Id, dc.Id)
+	if n != 1 {
+		return n, err
+	}
+	delete(h.storage.contacts, key)
+	return 1, nil
+}
+
+// get takes the user, context and device, in that order.
+func (h *DeviceContactMemoryHandler) get(keys []AWS.DBKeyValue) (*deviceContact, error) {
+	key, err := keyFromValues(keys)
+	if err != nil {
+		return nil, err
+	}
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	stored, ok := h.storage.contacts[key]
+	if !ok {
+		return nil, nil
+	}
+	stored.db = h
+	return &stored, nil
+}
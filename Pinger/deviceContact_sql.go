@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
-	"time"
 )
 
 type deviceContactSqlDbHandler struct {
@@ -86,8 +85,6 @@ func (h *deviceContactSqlDbHandler) get(keys []AWS.DBKeyValue) (*deviceContact,
 }
 
 func (dc *deviceContact) PreInsert(s gorp.SqlExecutor) error {
-	dc.Created = time.Now().UnixNano()
-	dc.Updated = dc.Created
-	dc.LastContact = dc.Created
+	dc.beforeInsert()
 	return nil
 }
@@ -1,7 +1,6 @@
 package Pinger
 
 import (
-	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"github.com/stretchr/testify/require"
@@ -11,7 +10,8 @@ import (
 
 type deviceContactTester struct {
 	suite.Suite
-	dbm               *gorp.DbMap
+	dbType            string
+	closeStorage      func()
 	aws               *AWS.TestAwsHandler
 	db                DeviceContactDbHandler
 	logger            *Logging.Logger
@@ -21,30 +21,31 @@ type deviceContactTester struct {
 }
 
 func (s *deviceContactTester) SetupSuite() {
-	var err error
 	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
-	dbconfig := DBConfiguration{Type: "sqlite", Filename: ":memory:"}
-	s.dbm, err = initDB(&dbconfig, true, s.logger)
-	if err != nil {
-		panic("Could not create DB")
-	}
-	s.db = newDeviceContactSqlDbHandler(s.dbm)
 	s.testUserId = "sometestUserId"
 	s.testClientContext = "sometestclientContext"
 	s.testDeviceId = "NCHOXfherekgrgr"
 }
 
 func (s *deviceContactTester) SetupTest() {
-	s.dbm.TruncateTables()
+	var storage Storage
+	s.aws = AWS.NewTestAwsHandler()
+	storage, s.closeStorage = newTestStorage(s.dbType, s.aws, s.logger)
+	s.db = storage.deviceContact()
 }
 
 func (s *deviceContactTester) TearDownTest() {
+	s.closeStorage()
 	globals = nil
 }
 
 func TestDeviceContact(t *testing.T) {
-	s := new(deviceContactTester)
-	suite.Run(t, s)
+	for _, dbType := range testStorageTypes {
+		t.Run(dbType, func(t *testing.T) {
+			s := &deviceContactTester{dbType: dbType}
+			suite.Run(t, s)
+		})
+	}
 }
 
 func (s *deviceContactTester) TestDeviceContactCreate() {
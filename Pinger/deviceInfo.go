@@ -9,6 +9,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type DeviceInfoDbHandler interface {
@@ -17,6 +18,8 @@ type DeviceInfoDbHandler interface {
 	delete(di *DeviceInfo) (int64, error)
 	get(keys []AWS.DBKeyValue) (*DeviceInfo, error)
 	findByPingerId(pingerId string) ([]*DeviceInfo, error)
+	find(filter *deviceFilter) ([]*DeviceInfo, error)
+	deviceContactHandler() DeviceContactDbHandler
 }
 
 type DeviceInfo struct {
@@ -35,6 +38,12 @@ type DeviceInfo struct {
 	AppBuildNumber  string `db:"build_number"`
 	AWSEndpointArn  string `db:"aws_endpoint_arn"`
 	Pinger          string `db:"pinger"`
+	AppId           string `db:"app_id"`    // the app (tenant) whose push credentials and settings to use. See AppConfiguration
+	TimeZone        string `db:"time_zone"` // the notification preferences. See NotificationPreferences
+	QuietHoursStart string `db:"quiet_hours_start"`
+	QuietHoursEnd   string `db:"quiet_hours_end"`
+	PushStyle       string `db:"push_style"`
+	MinPushInterval int64  `db:"min_push_interval"`
 
 	db        DeviceInfoDbHandler `db:"-"`
 	logger    *Logging.Logger     `db:"-"`
@@ -74,7 +83,13 @@ func (di *DeviceInfo) validate() error {
 			return fmt.Errorf("Platform %s is not known", di.Platform)
 		}
 	}
-	return nil
+	if di.AppId != "" {
+		_, err := globals.getConfig().pushConfig(di.AppId)
+		if err != nil {
+			return err
+		}
+	}
+	return di.notificationPreferences().Validate()
 }
 
 func newDeviceInfo(
@@ -112,7 +127,11 @@ func newDeviceInfo(
 }
 
 func (di *DeviceInfo) SetLogger(logger *Logging.Logger) {
-	di.logger = logger.Copy()
+	di.logger = logger.WithFields(
+		Logging.String("device", di.DeviceId),
+		Logging.String("client", di.UserId),
+		Logging.String("context", di.ClientContext),
+		Logging.String("session", di.SessionId))
 	di.logger.SetCallDepth(1)
 }
 
@@ -124,19 +143,39 @@ func (di *DeviceInfo) getLogPrefix() string {
 }
 
 func (di *DeviceInfo) Debug(format string, args ...interface{}) {
-	di.logger.Debug(fmt.Sprintf("%s: %s", di.getLogPrefix(), format), args...)
+	di.logger.Debug(format, args...)
 }
 
 func (di *DeviceInfo) Info(format string, args ...interface{}) {
-	di.logger.Info(fmt.Sprintf("%s: %s", di.getLogPrefix(), format), args...)
+	di.logger.Info(format, args...)
 }
 
 func (di *DeviceInfo) Error(format string, args ...interface{}) {
-	di.logger.Error(fmt.Sprintf("%s: %s", di.getLogPrefix(), format), args...)
+	di.logger.Error(format, args...)
 }
 
 func (di *DeviceInfo) Warning(format string, args ...interface{}) {
-	di.logger.Warning(fmt.Sprintf("%s: %s", di.getLogPrefix(), format), args...)
+	di.logger.Warning(format, args...)
+}
+
+// beforeInsert and beforeUpdate set the timestamps and the pinger, and validate the device, before
+// it is written. The SQL handlers call them from the gorp hooks, the others themselves.
+func (di *DeviceInfo) beforeInsert() error {
+	di.Created = time.Now().UnixNano()
+	di.Updated = di.Created
+
+	if di.Pinger == "" {
+		di.Pinger = pingerHostId
+	}
+	return di.validate()
+}
+
+func (di *DeviceInfo) beforeUpdate() error {
+	di.Updated = time.Now().UnixNano()
+	if di.Pinger == "" {
+		di.Pinger = pingerHostId
+	}
+	return di.validate()
 }
 
 func (di *DeviceInfo) delete() (int64, error) {
@@ -207,10 +246,46 @@ func getAllMyDeviceInfo(db DeviceInfoDbHandler, aws AWS.AWSHandler, logger *Logg
 	return devices, nil
 }
 
-func (di *DeviceInfo) updateDeviceInfo(pushService, pushToken, platform, osVersion, appBuildVersion, appBuildNumber string) (bool, error) {
+// deviceFilter selects devices by user, context, device and pinger. Empty fields match any value.
+type deviceFilter struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	Pinger        string
+}
+
+func (f *deviceFilter) matches(di *DeviceInfo) bool {
+	return (f.UserId == "" || f.UserId == di.UserId) &&
+		(f.ClientContext == "" || f.ClientContext == di.ClientContext) &&
+		(f.DeviceId == "" || f.DeviceId == di.DeviceId) &&
+		(f.Pinger == "" || f.Pinger == di.Pinger)
+}
+
+// findDevices returns the devices matching the filter.
+func findDevices(db Storage, aws AWS.AWSHandler, filter *deviceFilter, logger *Logging.Logger) ([]*DeviceInfo, error) {
+	devices, err := db.deviceInfo().find(filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, di := range devices {
+		di.aws = aws
+		di.SetLogger(logger)
+	}
+	return devices, nil
+}
+
+func (di *DeviceInfo) updateDeviceInfo(appId, pushService, pushToken, platform, osVersion, appBuildVersion, appBuildNumber string, prefs *NotificationPreferences) (bool, error) {
 	changed := false
 	deleteAWSEndpoint := false
 
+	if di.AppId != appId {
+		// the endpoint is in the old app's platform application
+		di.Warning("App changed from '%s' to '%s'. Resetting AWSEndpointArn ('%s')", di.AppId, appId, di.AWSEndpointArn)
+		di.AppId = appId
+		di.AWSEndpointArn = ""
+		changed = true
+		deleteAWSEndpoint = true
+	}
 	if di.OSVersion != osVersion {
 		di.OSVersion = osVersion
 		changed = true
@@ -247,6 +322,9 @@ func (di *DeviceInfo) updateDeviceInfo(pushService, pushToken, platform, osVersi
 		changed = true
 		deleteAWSEndpoint = true
 	}
+	if di.setNotificationPreferences(prefs) {
+		changed = true
+	}
 	if changed {
 		n, err := di.update()
 		if err != nil {
@@ -263,6 +341,30 @@ func (di *DeviceInfo) updateDeviceInfo(pushService, pushToken, platform, osVersi
 	return changed, nil
 }
 
+// notificationPreferences returns the device's notification preferences.
+func (di *DeviceInfo) notificationPreferences() *NotificationPreferences {
+	return &NotificationPreferences{
+		TimeZone:        di.TimeZone,
+		QuietHoursStart: di.QuietHoursStart,
+		QuietHoursEnd:   di.QuietHoursEnd,
+		PushStyle:       di.PushStyle,
+		MinPushInterval: di.MinPushInterval,
+	}
+}
+
+// setNotificationPreferences sets the device's notification preferences, and returns whether they changed.
+func (di *DeviceInfo) setNotificationPreferences(prefs *NotificationPreferences) bool {
+	if *di.notificationPreferences() == *prefs {
+		return false
+	}
+	di.TimeZone = prefs.TimeZone
+	di.QuietHoursStart = prefs.QuietHoursStart
+	di.QuietHoursEnd = prefs.QuietHoursEnd
+	di.PushStyle = prefs.PushStyle
+	di.MinPushInterval = prefs.MinPushInterval
+	return true
+}
+
 func (di *DeviceInfo) update() (int64, error) {
 	if di.db == nil {
 		panic("Can not update device info without having fetched it")
@@ -302,13 +404,7 @@ func (di *DeviceInfo) getContactInfoObj(insert bool) (*deviceContact, error) {
 	if di.db == nil {
 		panic("Must have fetched di first")
 	}
-	var db DeviceContactDbHandler
-	diSql, ok := di.db.(*DeviceInfoSqlHandler)
-	if ok {
-		db = newDeviceContactSqlDbHandler(diSql.dbm)
-	} else {
-		db = newDeviceContactDynamoDbHandler(di.aws)
-	}
+	db := di.db.deviceContactHandler()
 	dc, err := deviceContactGet(db, di.UserId, di.ClientContext, di.DeviceId)
 	if err != nil {
 		return nil, err
@@ -351,6 +447,14 @@ func (di *DeviceInfo) updateLastContactRequest() error {
 	return dc.updateLastContactRequest()
 }
 
+func (di *DeviceInfo) updateLastNewMailPush() error {
+	dc, err := di.getContactInfoObj(false)
+	if err != nil {
+		return err
+	}
+	return dc.updateLastNewMailPush()
+}
+
 type PingerNotification string
 
 const (
@@ -359,27 +463,64 @@ const (
 )
 
 func (di *DeviceInfo) PushRegister() error {
-	var alert string
-	if globals.config.APNSAlert {
-		alert = "Nacho says: Reregister!"
-	}
-	return di.Push(PingerNotificationRegister, alert, globals.config.APNSSound, globals.config.APNSContentAvailable)
+	return di.Push(PingerNotificationRegister, time.Time{})
 }
 
-func (di *DeviceInfo) PushNewMail() error {
-	var alert string
-	if globals.config.APNSAlert {
-		alert = "Nacho says: You have mail!"
-	}
-	return di.Push(PingerNotificationNewMail, alert, globals.config.APNSSound, globals.config.APNSContentAvailable)
+// PushNewMail tells the device about the new mail we noticed at mailArrived.
+func (di *DeviceInfo) PushNewMail(mailArrived time.Time) error {
+	return di.Push(PingerNotificationNewMail, mailArrived)
 }
 
-func (di *DeviceInfo) Push(message PingerNotification, alert, sound string, contentAvailable int) error {
-	pingerMap := pingerPushMessageMapV2([](*contextMessage){newContextMessage(message, di.ClientContext)})
-	ttl := globals.config.APNSExpirationSeconds
-	err := Push(di.aws, di.Platform, di.PushService, di.PushToken, di.AWSEndpointArn, alert, sound, contentAvailable, ttl, pingerMap, di.OSVersion, di.logger)
+// Push sends the message, with the notification settings of the device's app. New mail pushes also
+// honour the device's notification preferences: they go out silently during the quiet hours, and
+// one that comes too soon after the previous push returns a *pushDeferredError instead. Sent
+// pushes wait for the device's acknowledgement in the push receipts.
+func (di *DeviceInfo) Push(message PingerNotification, mailArrived time.Time) error {
+	push, err := globals.getConfig().pushConfig(di.AppId)
+	if err != nil {
+		return err
+	}
+	alert := push.alert(message)
+	sound := push.APNSSound
+	contentAvailable := push.APNSContentAvailable
+	if message == PingerNotificationNewMail {
+		prefs := di.notificationPreferences()
+		now := time.Now()
+		// only new mail pushes count. Register pushes and the like don't hold back the next one.
+		dc, err := di.getContactInfoObj(false)
+		if err != nil {
+			return err
+		}
+		if wait := prefs.pushDelay(dc.LastNewMailPush, now); wait > 0 {
+			return &pushDeferredError{wait: wait}
+		}
+		if prefs.silent(now) {
+			di.Info("Sending a silent push|pushStyle=%s|quietHours=%t", prefs.PushStyle, prefs.quietHours(now))
+			alert = ""
+			sound = ""
+			contentAvailable = 1
+		}
+	}
+	pushId := newPushId()
+	pingerMap := pingerPushMessageMapV2(pushId, [](*contextMessage){newContextMessage(message, di.ClientContext)})
+	err = Push(di.aws, push, di.Platform, di.PushService, di.PushToken, di.AWSEndpointArn,
+		alert, sound, contentAvailable, push.APNSExpirationSeconds, pingerMap, di.OSVersion, di.logger)
 	if err == nil {
-		err = di.updateLastContactRequest()
+		receipts.sent(pushId, &sentPush{
+			UserId:        di.UserId,
+			ClientContext: di.ClientContext,
+			DeviceId:      di.DeviceId,
+			Service:       di.PushService,
+			Platform:      di.Platform,
+			Message:       message,
+			MailArrived:   mailArrived,
+			Sent:          time.Now(),
+		}, di.logger)
+		if message == PingerNotificationNewMail {
+			err = di.updateLastNewMailPush()
+		} else {
+			err = di.updateLastContactRequest()
+		}
 	}
 	return err
 }
@@ -424,8 +565,12 @@ func (di *DeviceInfo) registerAws() error {
 			return fmt.Errorf("Unsupported push service %s:%s", di.PushService, di.PushToken)
 		}
 
+		push, err := globals.getConfig().pushConfig(di.AppId)
+		if err != nil {
+			return err
+		}
 		di.Debug("Registering %s:%s with AWS.", di.PushService, di.PushToken)
-		arn, registerErr := di.aws.RegisterEndpointArn(di.PushService, pushToken, di.customerData())
+		arn, registerErr := di.aws.RegisterEndpointArn(push.SnsIOSPlatformArn, di.PushService, pushToken, di.customerData())
 		if registerErr != nil {
 			if alreadyRegisted.MatchString(registerErr.Error()) == true {
 				replaceString := fmt.Sprintf("${%s}", alreadyRegisted.SubexpNames()[1])
@@ -496,7 +641,11 @@ func getMajorVersion(OSVersion string) int {
 }
 
 func (di *DeviceInfo) validateClient() error {
-	if strings.EqualFold(di.PushService, PushServiceAPNS) == false || globals.config.APNSCertFile == "" || globals.config.APNSKeyFile == "" {
+	push, err := globals.getConfig().pushConfig(di.AppId)
+	if err != nil {
+		return err
+	}
+	if !push.directAPNS(di.PushService) {
 		// TODO Can we cache the validation results here? Can they change once a userId has been invalidated? How do we even invalidate one?
 		err := di.registerAws()
 		if err != nil {
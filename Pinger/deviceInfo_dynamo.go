@@ -1,115 +1,114 @@
 package Pinger
 
 import (
-	"fmt"
 	"github.com/nachocove/Pinger/Utils/AWS"
-	"time"
 )
 
-type DeviceContactDynamoDbHandler struct {
-	DeviceContactDbHandler
-	dynamo    *AWS.DynamoDb
+type DeviceInfoDynamoDbHandler struct {
+	DeviceInfoDbHandler
+	storage   *dynamoStorage
 	tableName string
 }
 
-const (
-	dynamoDeviceInfoTableName = "alpha.pinger.device_info"
-)
-
-func newDeviceContactDynamoDbHandler(aws AWS.AWSHandler) *DeviceContactDynamoDbHandler {
-	return &DeviceContactDynamoDbHandler{
-		dynamo:    aws.GetDynamoDbSession(),
-		tableName: dynamoDeviceInfoTableName,
+func newDeviceInfoDynamoDbHandler(storage *dynamoStorage) *DeviceInfoDynamoDbHandler {
+	return &DeviceInfoDynamoDbHandler{
+		storage:   storage,
+		tableName: storage.tableName(deviceTableName),
 	}
 }
 
-func (h *DeviceContactDynamoDbHandler) get(keys []AWS.DBKeyValue) (*deviceContact, error) {
-	dcMap, err := h.dynamo.Get(dynamoDeviceInfoTableName, keys)
-	if err != nil {
-		return nil, err
-	}
-	return fromDeviceInfoMap(dcMap), nil
+func (di *DeviceInfo) toMap() map[string]interface{} {
+	diMap := dynamoItem(di)
+	diMap[dynamoKeyAttribute] = di.storageKey()
+	return diMap
 }
 
-func fromDeviceInfoMap(dcMap *map[string]interface{}) *deviceContact {
-	dc := deviceContact{}
-	for k, v := range *dcMap {
-		switch v := v.(type) {
-		case string:
-			switch k {
-			case "user":
-				dc.UserId = v
-
-			case "device":
-				dc.DeviceId = v
-
-			case "context":
-				dc.ClientContext = v
-			}
-		case int64:
-			switch k {
-			case "created":
-				dc.Created = v
-
-			case "updated":
-				dc.Updated = v
-
-			case "last_contact":
-				dc.LastContact = v
-
-			case "id":
-				dc.Id = v
-			}
-		case int:
-			switch k {
-			case "created":
-				dc.Created = int64(v)
-
-			case "updated":
-				dc.Updated = int64(v)
+func (h *DeviceInfoDynamoDbHandler) fromMap(diMap map[string]interface{}) *DeviceInfo {
+	di := DeviceInfo{}
+	fromDynamoItem(diMap, &di)
+	di.db = h
+	return &di
+}
 
-			case "last_contact":
-				dc.LastContact = int64(v)
+func (h *DeviceInfoDynamoDbHandler) insert(di *DeviceInfo) error {
+	err := di.beforeInsert()
+	if err != nil {
+		return err
+	}
+	if di.Id == 0 {
+		di.Id = 1
+	}
+	return h.storage.insertItem(h.tableName, di.toMap(), dynamoKeyAttribute)
+}
 
-			case "id":
-				dc.Id = int64(v)
-			}
-		}
+func (h *DeviceInfoDynamoDbHandler) update(di *DeviceInfo) (int64, error) {
+	err := di.beforeUpdate()
+	if err != nil {
+		return -1, err
 	}
-	return &dc
+	return h.storage.updateVersioned(h.tableName, &di.Id, di.toMap)
 }
-func (dc *deviceContact) toMap() map[string]interface{} {
-	dcMap := make(map[string]interface{})
-	dcMap["user"] = dc.UserId
-	dcMap["context"] = dc.ClientContext
-	dcMap["device"] = dc.DeviceId
-	dcMap["created"] = dc.Created
-	dcMap["updated"] = dc.Updated
-	dcMap["last_contact"] = dc.LastContact
-	dcMap["last_contact_request"] = dc.LastContactRequest
-	return dcMap
+
+func (h *DeviceInfoDynamoDbHandler) delete(di *DeviceInfo) (int64, error) {
+	return h.storage.deleteVersioned(h.tableName, di.storageKey(), di.Id)
 }
 
-func (h *DeviceContactDynamoDbHandler) insert(dc *deviceContact) error {
-	if dc.Created == 0 {
-		dc.Created = time.Now().UnixNano()
+// get takes the user, context, device and session, in that order.
+func (h *DeviceInfoDynamoDbHandler) get(keys []AWS.DBKeyValue) (*DeviceInfo, error) {
+	key, err := keyFromValues(keys)
+	if err != nil {
+		return nil, err
+	}
+	diMap, err := h.storage.dynamo.Get(h.tableName, []AWS.DBKeyValue{
+		{Key: dynamoKeyAttribute, Value: key, Comparison: AWS.KeyComparisonEq},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if diMap == nil {
+		return nil, nil
 	}
-	dc.Updated = dc.Created
-	dc.LastContact = dc.Created
-	return h.dynamo.Insert(dynamoDeviceInfoTableName, dc.toMap())
+	return h.fromMap(*diMap), nil
 }
 
-func (h *DeviceContactDynamoDbHandler) update(dc *deviceContact) (int64, error) {
-	dc.Updated = time.Now().UnixNano()
-	err := h.dynamo.Update(dynamoDeviceInfoTableName, dc.toMap())
+func (h *DeviceInfoDynamoDbHandler) findByPingerId(pingerId string) ([]*DeviceInfo, error) {
+	return h.find(&deviceFilter{Pinger: pingerId})
+}
+
+// find uses the pinger index if the filter has a pinger, and scans the table otherwise.
+func (h *DeviceInfoDynamoDbHandler) find(filter *deviceFilter) ([]*DeviceInfo, error) {
+	var items []map[string]interface{}
+	var err error
+	if filter.Pinger != "" {
+		items, err = h.storage.dynamo.SearchIndex(h.tableName, dynamoDeviceInfoPingerIndex, []AWS.DBKeyValue{
+			{Key: pingerColumn, Value: filter.Pinger, Comparison: AWS.KeyComparisonEq},
+		})
+	} else {
+		scanFilter := make([]AWS.DBKeyValue, 0, 3)
+		for _, c := range []struct{ column, value string }{
+			{userIdColumn, filter.UserId},
+			{clientContextColumn, filter.ClientContext},
+			{deviceIdColumn, filter.DeviceId},
+		} {
+			if c.value != "" {
+				scanFilter = append(scanFilter, AWS.DBKeyValue{Key: c.column, Value: c.value, Comparison: AWS.KeyComparisonEq})
+			}
+		}
+		items, err = h.storage.dynamo.Scan(h.tableName, scanFilter)
+	}
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	devices := make([]*DeviceInfo, 0, len(items))
+	for _, item := range items {
+		di := h.fromMap(item)
+		if filter.matches(di) {
+			devices = append(devices, di)
+		}
 	}
-	return 1, nil
+	return devices, nil
 }
 
-func (h *DeviceContactDynamoDbHandler) delete(dc *deviceContact) (int64, error) {
-	err := fmt.Errorf("Not implemented")
-	return 0, err
-
+func (h *DeviceInfoDynamoDbHandler) deviceContactHandler() DeviceContactDbHandler {
+	return h.storage.deviceContact()
 }
@@ -0,0 +1,114 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"sort"
+)
+
+type DeviceInfoMemoryHandler struct {
+	DeviceInfoDbHandler
+	storage *memoryStorage
+}
+
+// stored is the copy of di that the storage keeps, without the handler, aws and logger.
+func (h *DeviceInfoMemoryHandler) stored(di *DeviceInfo) DeviceInfo {
+	stored := *di
+	stored.db = nil
+	stored.aws = nil
+	stored.logger = nil
+	return stored
+}
+
+func (h *DeviceInfoMemoryHandler) insert(di *DeviceInfo) error {
+	err := di.beforeInsert()
+	if err != nil {
+		return err
+	}
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := di.storageKey()
+	if _, ok := h.storage.devices[key]; ok {
+		return fmt.Errorf("%s: %s already exists", deviceTableName, key)
+	}
+	if di.Id == 0 {
+		di.Id = 1
+	}
+	h.storage.devices[key] = h.stored(di)
+	return nil
+}
+
+func (h *DeviceInfoMemoryHandler) update(di *DeviceInfo) (int64, error) {
+	err := di.beforeUpdate()
+	if err != nil {
+		return -1, err
+	}
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := di.storageKey()
+	stored, ok := h.storage.devices[key]
+	n, err := checkVersion(deviceTableName, key, ok, stored.Id, di.Id)
+	if n != 1 {
+		return n, err
+	}
+	di.Id++
+	h.storage.devices[key] = h.stored(di)
+	return 1, nil
+}
+
+func (h *DeviceInfoMemoryHandler) delete(di *DeviceInfo) (int64, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	key := di.storageKey()
+	stored, ok := h.storage.devices[key]
+	n, err := checkVersion(deviceTableName, key, ok, stored.Id, di.Id)
+	if n != 1 {
+		return n, err
+	}
+	delete(h.storage.devices, key)
+	return 1, nil
+}
+
+// get takes the user, context, device and session, in that order.
+func (h *DeviceInfoMemoryHandler) get(keys []AWS.DBKeyValue) (*DeviceInfo, error) {
+	key, err := keyFromValues(keys)
+	if err != nil {
+		return nil, err
+	}
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	stored, ok := h.storage.devices[key]
+	if !ok {
+		return nil, nil
+	}
+	stored.db = h
+	return &stored, nil
+}
+
+func (h *DeviceInfoMemoryHandler) findByPingerId(pingerId string) ([]*DeviceInfo, error) {
+	return h.find(&deviceFilter{Pinger: pingerId})
+}
+
+// find returns the matching devices in the order of their keys, so that the results are stable.
+func (h *DeviceInfoMemoryHandler) find(filter *deviceFilter) ([]*DeviceInfo, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	keys := make([]string, 0, len(h.storage.devices))
+	for key := range h.storage.devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	devices := make([]*DeviceInfo, 0)
+	for _, key := range keys {
+		di := h.storage.devices[key]
+		if filter.matches(&di) {
+			di.db = h
+			devices = append(devices, &di)
+		}
+	}
+	return devices, nil
+}
+
+func (h *DeviceInfoMemoryHandler) deviceContactHandler() DeviceContactDbHandler {
+	return h.storage.deviceContact()
+}
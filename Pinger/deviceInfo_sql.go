@@ -5,7 +5,7 @@ import (
 	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"reflect"
-	"time"
+	"strings"
 )
 
 type DeviceInfoSqlHandler struct {
@@ -52,10 +52,14 @@ func (h *DeviceInfoSqlHandler) get(keys []AWS.DBKeyValue) (*DeviceInfo, error) {
 	return di, nil
 }
 
+func (h *DeviceInfoSqlHandler) deviceContactHandler() DeviceContactDbHandler {
+	return newDeviceContactSqlDbHandler(h.dbm)
+}
+
 func (h *DeviceInfoSqlHandler) findByPingerId(pingerId string) ([]*DeviceInfo, error) {
 	var devices []*DeviceInfo
 	var err error
-	_, err = h.dbm.Select(&devices, getAllMyDeviceInfoSql, pingerHostId)
+	_, err = h.dbm.Select(&devices, rebind(h.dbm, getAllMyDeviceInfoSql), pingerId)
 	if err != nil {
 		return nil, err
 	}
@@ -113,9 +117,11 @@ func addDeviceInfoTable(dbmap *gorp.DbMap) {
 	cMap.SetNotNull(true)
 }
 
+// the SQL uses '?' placeholders. See rebind().
 var getAllMyDeviceInfoSql string
-var distinctPushServiceTokenSql string
-var clientContextsSql string
+
+// the columns a deviceFilter selects on
+var userIdColumn, clientContextColumn, deviceIdColumn, pingerColumn string
 
 func init() {
 	var ok bool
@@ -124,56 +130,65 @@ func init() {
 	if ok == false {
 		panic("Could not get Pinger Field information")
 	}
-	pushServiceField, ok := deviceInfoReflection.FieldByName("PushService")
-	if ok == false {
-		panic("Could not get PushService Field information")
-	}
-	pushTokenField, ok := deviceInfoReflection.FieldByName("PushToken")
-	if ok == false {
-		panic("Could not get PushToken Field information")
-	}
-	platformField, ok := deviceInfoReflection.FieldByName("Platform")
-	if ok == false {
-		panic("Could not get Platform Field information")
-	}
-	OSVersionField, ok := deviceInfoReflection.FieldByName("OSVersion")
+	clientContextField, ok := deviceInfoReflection.FieldByName("ClientContext")
 	if ok == false {
-		panic("Could not get OsVersion Field information")
+		panic("Could not get ClientContext Field information")
 	}
-	awsEndpointField, ok := deviceInfoReflection.FieldByName("AWSEndpointArn")
+	userIdField, ok := deviceInfoReflection.FieldByName("UserId")
 	if ok == false {
-		panic("Could not get AWSEndpointArn Field information")
+		panic("Could not get UserId Field information")
 	}
-	clientContextField, ok := deviceInfoReflection.FieldByName("ClientContext")
+	deviceIdField, ok := deviceInfoReflection.FieldByName("DeviceId")
 	if ok == false {
-		panic("Could not get ClientContext Field information")
+		panic("Could not get DeviceId Field information")
 	}
+	userIdColumn = userIdField.Tag.Get("db")
+	clientContextColumn = clientContextField.Tag.Get("db")
+	deviceIdColumn = deviceIdField.Tag.Get("db")
+	pingerColumn = pingerField.Tag.Get("db")
 	getAllMyDeviceInfoSql = fmt.Sprintf("select * from %s where %s=?",
 		deviceTableName,
 		pingerField.Tag.Get("db"))
-	distinctPushServiceTokenSql = fmt.Sprintf("select distinct %s, %s, %s, %s, %s from %s where %s=?",
-		pushServiceField.Tag.Get("db"), pushTokenField.Tag.Get("db"), OSVersionField.Tag.Get("db"), platformField.Tag.Get("db"), awsEndpointField.Tag.Get("db"),
-		deviceTableName,
-		pingerField.Tag.Get("db"),
-	)
-	clientContextsSql = fmt.Sprintf("select distinct %s from %s where %s=? and %s=?",
-		clientContextField.Tag.Get("db"), deviceTableName, pushServiceField.Tag.Get("db"), pushTokenField.Tag.Get("db"))
 }
 
 func (di *DeviceInfo) PreUpdate(s gorp.SqlExecutor) error {
-	di.Updated = time.Now().UnixNano()
-	if di.Pinger == "" {
-		di.Pinger = pingerHostId
-	}
-	return di.validate()
+	return di.beforeUpdate()
 }
 
 func (di *DeviceInfo) PreInsert(s gorp.SqlExecutor) error {
-	di.Created = time.Now().UnixNano()
-	di.Updated = di.Created
+	return di.beforeInsert()
+}
 
-	if di.Pinger == "" {
-		di.Pinger = pingerHostId
+// where returns the sql condition for the filter and its arguments.
+func (f *deviceFilter) where() (string, []interface{}) {
+	conditions := make([]string, 0, 4)
+	args := make([]interface{}, 0, 4)
+	for _, c := range []struct{ column, value string }{
+		{userIdColumn, f.UserId},
+		{clientContextColumn, f.ClientContext},
+		{deviceIdColumn, f.DeviceId},
+		{pingerColumn, f.Pinger},
+	} {
+		if c.value != "" {
+			conditions = append(conditions, c.column+"=?")
+			args = append(args, c.value)
+		}
 	}
-	return di.validate()
+	if len(conditions) == 0 {
+		return "1=1", args
+	}
+	return strings.Join(conditions, " and "), args
+}
+
+func (h *DeviceInfoSqlHandler) find(filter *deviceFilter) ([]*DeviceInfo, error) {
+	where, args := filter.where()
+	devices := make([]*DeviceInfo, 0, 5)
+	_, err := h.dbm.Select(&devices, rebind(h.dbm, fmt.Sprintf("select * from %s where %s", deviceTableName, where)), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, di := range devices {
+		di.db = h
+	}
+	return devices, nil
 }
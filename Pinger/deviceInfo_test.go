@@ -2,7 +2,6 @@ package Pinger
 
 import (
 	"fmt"
-	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"github.com/stretchr/testify/require"
@@ -12,7 +11,9 @@ import (
 
 type deviceInfoTester struct {
 	suite.Suite
-	dbm               *gorp.DbMap
+	dbType            string
+	storage           Storage
+	closeStorage      func()
 	db                DeviceInfoDbHandler
 	logger            *Logging.Logger
 	testUserId        string
@@ -30,14 +31,7 @@ type deviceInfoTester struct {
 }
 
 func (s *deviceInfoTester) SetupSuite() {
-	var err error
 	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
-	dbconfig := DBConfiguration{Type: "sqlite", Filename: ":memory:"}
-	s.dbm, err = initDB(&dbconfig, true, s.logger)
-	if err != nil {
-		panic("Could not create DB")
-	}
-	s.db = newDeviceInfoSqlHandler(s.dbm)
 	s.testUserId = "sometestUserId"
 	s.testClientContext = "sometestclientContext"
 	s.testDeviceId = "NCHOXfherekgrgr"
@@ -51,19 +45,25 @@ func (s *deviceInfoTester) SetupSuite() {
 }
 
 func (s *deviceInfoTester) SetupTest() {
-	s.dbm.TruncateTables()
 	s.aws = AWS.NewTestAwsHandler()
+	s.storage, s.closeStorage = newTestStorage(s.dbType, s.aws, s.logger)
+	s.db = s.storage.deviceInfo()
 	globals = nil
 	setGlobal(NewBackendConfiguration())
 }
 
 func (s *deviceInfoTester) TearDownTest() {
+	s.closeStorage()
 	globals = nil
 }
 
 func TestDeviceInfo(t *testing.T) {
-	s := new(deviceInfoTester)
-	suite.Run(t, s)
+	for _, dbType := range testStorageTypes {
+		t.Run(dbType, func(t *testing.T) {
+			s := &deviceInfoTester{dbType: dbType}
+			suite.Run(t, s)
+		})
+	}
 }
 
 func (s *deviceInfoTester) TestDeviceInfoValidate() {
@@ -294,19 +294,19 @@ func (s *deviceInfoTester) TestDeviceInfoUpdate() {
 	di2.AWSEndpointArn = "yet another endpoint"
 	s.Panics(func() { di2.update() })
 
-	changed, err := di.updateDeviceInfo(di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber)
+	changed, err := di.updateDeviceInfo("", di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.False(changed)
 
 	newToken := "some updated token"
-	changed, err = di.updateDeviceInfo(di.PushService, newToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber)
+	changed, err = di.updateDeviceInfo("", di.PushService, newToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newToken, di.PushToken)
 	s.Equal("", di.AWSEndpointArn)
 
 	newService := "GCM"
-	changed, err = di.updateDeviceInfo(newService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber)
+	changed, err = di.updateDeviceInfo("", newService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newService, di.PushService)
@@ -314,7 +314,7 @@ func (s *deviceInfoTester) TestDeviceInfoUpdate() {
 	s.Equal("", di.AWSEndpointArn)
 
 	newPlatform := "android"
-	changed, err = di.updateDeviceInfo(di.PushService, di.PushToken, newPlatform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber)
+	changed, err = di.updateDeviceInfo("", di.PushService, di.PushToken, newPlatform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newPlatform, di.Platform)
@@ -323,19 +323,19 @@ func (s *deviceInfoTester) TestDeviceInfoUpdate() {
 	s.Equal("", di.AWSEndpointArn)
 
 	newOsVersion := "11111"
-	changed, err = di.updateDeviceInfo(di.PushService, di.PushToken, di.Platform, newOsVersion, di.AppBuildVersion, di.AppBuildNumber)
+	changed, err = di.updateDeviceInfo("", di.PushService, di.PushToken, di.Platform, newOsVersion, di.AppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newOsVersion, di.OSVersion)
 
 	newAppBuildVersion := "22222"
-	changed, err = di.updateDeviceInfo(di.PushService, di.PushToken, di.Platform, di.OSVersion, newAppBuildVersion, di.AppBuildNumber)
+	changed, err = di.updateDeviceInfo("", di.PushService, di.PushToken, di.Platform, di.OSVersion, newAppBuildVersion, di.AppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newAppBuildVersion, di.AppBuildVersion)
 
 	newAppBuildNumber := "33333"
-	changed, err = di.updateDeviceInfo(di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, newAppBuildNumber)
+	changed, err = di.updateDeviceInfo("", di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, newAppBuildNumber, di.notificationPreferences())
 	s.NoError(err)
 	s.True(changed)
 	s.Equal(newAppBuildNumber, di.AppBuildNumber)
@@ -494,7 +494,7 @@ func (s *deviceInfoTester) TestSendToAll() {
 	deviceList, err := getAllMyDeviceInfo(s.db, s.aws, s.logger)
 	s.Equal(2, len(deviceList))
 
-	n := alertAllDevices(s.dbm, s.aws, s.logger)
+	n := alertAllDevices(s.storage, s.aws, s.logger)
 	s.Equal(1, n)
 }
 
@@ -519,6 +519,7 @@ func (s *deviceInfoTester) TestPingerStealing() {
 	di.insert(nil)
 	s.Equal(pingerHostId, di.Pinger)
 
+	defer func(hostId string) { pingerHostId = hostId }(pingerHostId)
 	pingerHostId = "12345"
 
 	d1, err := getDeviceInfo(s.db, s.aws, di.UserId, di.ClientContext, di.DeviceId, di.SessionId, s.logger)
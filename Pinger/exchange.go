@@ -2,7 +2,6 @@ package Pinger
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"github.com/nachocove/Pinger/Utils"
@@ -10,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httputil"
@@ -32,6 +32,7 @@ type ExchangeClient struct {
 	mutex      *sync.Mutex
 	httpClient *http.Client
 	cancelled  bool
+	limiter    *hostLimiter
 }
 
 const (
@@ -44,36 +45,32 @@ func NewExchangeClient(pi *MailPingInformation, wg *sync.WaitGroup, debug bool,
 	// TODO check that fields we actually look at are used and fields we don't use are ignored.
 	ex := &ExchangeClient{
 		debug:     debug,
-		logger:    logger.Copy(),
+		logger:    logger.WithFields(append(pi.logFields(), Logging.String("protocol", "EAS"))...),
 		pi:        pi,
 		wg:        wg,
 		mutex:     &sync.Mutex{},
 		cancelled: false,
+		limiter:   hostLimiters.get(pi.MailServerUrl),
 	}
 	ex.logger.SetCallDepth(1)
-	ex.Info("Created new Exchange client %s|msgCode=EAS_CLIENT_CREATED", ex.getLogPrefix())
+	ex.Info("Created new Exchange client|msgCode=EAS_CLIENT_CREATED")
 	return ex, nil
 }
 
-func (ex *ExchangeClient) getLogPrefix() (prefix string) {
-	prefix = ex.pi.getLogPrefix() + "|protocol=EAS"
-	return
-}
-
 func (ex *ExchangeClient) Debug(format string, args ...interface{}) {
-	ex.logger.Debug(fmt.Sprintf("%s|message=%s", ex.getLogPrefix(), format), args...)
+	ex.logger.Debug(format, args...)
 }
 
 func (ex *ExchangeClient) Info(format string, args ...interface{}) {
-	ex.logger.Info(fmt.Sprintf("%s|message=%s", ex.getLogPrefix(), format), args...)
+	ex.logger.Info(format, args...)
 }
 
 func (ex *ExchangeClient) Error(format string, args ...interface{}) {
-	ex.logger.Error(fmt.Sprintf("%s|message=%s", ex.getLogPrefix(), format), args...)
+	ex.logger.Error(format, args...)
 }
 
 func (ex *ExchangeClient) Warning(format string, args ...interface{}) {
-	ex.logger.Warning(fmt.Sprintf("%s|message=%s", ex.getLogPrefix(), format), args...)
+	ex.logger.Warning(format, args...)
 }
 
 func (ex *ExchangeClient) maxResponseSize() (size int) {
@@ -167,7 +164,7 @@ func (ex *ExchangeClient) doRequestResponse(responseCh chan *http.Response, errC
 
 	ex.Debug("Making Connection to server")
 	// Make the request and wait for response; this could take a while
-	// TODO Can we and how do we validate the server certificate?
+	// The server certificate is validated according to the tls-policy for the server's domain (see tlsConfig()).
 	// TODO Can we guard against bogus SSL negotiation from a hacked server?
 	// TODO Perhaps we need to read and assess the Go SSL/TLS implementation
 	response, err := ex.httpClient.Do(ex.request)
@@ -191,6 +188,10 @@ func (ex *ExchangeClient) doRequestResponse(responseCh chan *http.Response, errC
 			ex.Error(redactedError)
 			errCh <- UnknownCertificateAuthority
 			return
+		} else if strings.Contains(redactedError, CertificatePinMismatch.Error()) {
+			ex.Error(redactedError)
+			errCh <- CertificatePinMismatch
+			return
 		} else {
 			ex.Info("Post failed: %s. Will retry", redactedError)
 		}
@@ -249,7 +250,7 @@ func (ex *ExchangeClient) doRequestResponse(responseCh chan *http.Response, errC
 
 	ex.Debug("reply WBXML %s", base64.StdEncoding.EncodeToString(responseBytes[:n]))
 
-	if globals.config.DumpRequests || response.StatusCode >= 500 {
+	if globals.getConfig().DumpRequests || response.StatusCode >= 500 {
 		headerBytes, _ := httputil.DumpResponse(response, false)
 		if err != nil {
 			ex.Error("Could not dump response %+v", response)
@@ -316,13 +317,22 @@ func (ex *ExchangeClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan er
 	reqTimeout := ex.pi.ResponseTimeout
 	reqTimeout += uint64(float64(reqTimeout) * 0.1) // add 10% so we don't step on the HeartbeatInterval inside the ping
 
+	serverUrl, err := url.Parse(ex.pi.MailServerUrl)
+	if err != nil {
+		ex.sendError(errCh, err)
+		return
+	}
+	host := serverUrl.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	tlsConfig, err := globals.getConfig().tlsConfig(host, ex.pi.MailServerCertificate)
 	if err != nil {
+		ex.sendError(errCh, err)
+		return
 	}
 	ex.transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: false,
-			RootCAs:            globals.config.RootCerts(),
-		},
+		TLSClientConfig:       tlsConfig,
 		ResponseHeaderTimeout: time.Duration(reqTimeout) * time.Millisecond,
 	}
 
@@ -363,6 +373,12 @@ func (ex *ExchangeClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan er
 			ex.Info("Sleeping %s before retry", s)
 			time.Sleep(s)
 		}
+		// all clients talking to this server share the limiter, so that if the server
+		// is down, we back off together instead of each client hammering it.
+		if !ex.limiter.wait(stopPollCh, stopAllCh) {
+			ex.Debug("Was told to stop while waiting on the mail server limiter. Stopping")
+			return
+		}
 		if responseErrCh != nil {
 			close(responseErrCh)
 		}
@@ -378,7 +394,7 @@ func (ex *ExchangeClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan er
 		go ex.doRequestResponse(responseCh, responseErrCh)
 		select {
 		case err = <-responseErrCh:
-			if err == NoSuchHostError || err == UnknownCertificateAuthority {
+			if err == NoSuchHostError || err == UnknownCertificateAuthority || err == CertificatePinMismatch {
 				errCh <- LongPollReRegister
 			} else {
 				ex.sendError(errCh, err)
@@ -388,9 +404,13 @@ func (ex *ExchangeClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan er
 		case response := <-responseCh:
 			if response == retryResponse {
 				ex.Debug("Retry-response from response reader.")
+				// below the breaker's threshold, only the backoff keeps us from retrying at the
+				// rate of the host's token bucket.
+				ex.limiter.failure()
 				sleepTime = ex.exponentialBackoff(sleepTime)
 				continue
 			}
+			metricMailServerLatency.With(MailClientActiveSync).ObserveSince(timeSent)
 			// the response body tends to be pretty short (and we've capped it anyway). Let's just read it all.
 			responseBody, err := ioutil.ReadAll(response.Body)
 			if err != nil {
@@ -403,6 +423,11 @@ func (ex *ExchangeClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan er
 				ex.sendError(errCh, err)
 				return
 			}
+			if response.StatusCode >= 500 {
+				ex.limiter.failure()
+			} else {
+				ex.limiter.success()
+			}
 			switch {
 			case response.StatusCode != 200:
 				switch {
@@ -482,6 +507,7 @@ func (ex *ExchangeClient) Cleanup() {
 	ex.Debug("Cleaning up")
 	ex.pi.cleanup()
 	ex.pi = nil
+	hostLimiters.release(ex.limiter)
 	if ex.transport != nil {
 		ex.transport.CloseIdleConnections()
 	}
@@ -1,8 +1,11 @@
 package Pinger
 
-import ()
+import (
+	"sync"
+)
 
 type globalStuff struct {
+	mutex  sync.RWMutex
 	config *BackendConfiguration
 }
 
@@ -16,3 +19,18 @@ func setGlobal(config *BackendConfiguration) {
 		config: config,
 	}
 }
+
+// getConfig returns the current backend configuration. A config reload swaps in a new
+// configuration rather than modifying the current one, so anything that needs several
+// values should call getConfig() once, to get a consistent set.
+func (g *globalStuff) getConfig() *BackendConfiguration {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.config
+}
+
+func (g *globalStuff) swapConfig(config *BackendConfiguration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.config = config
+}
@@ -0,0 +1,317 @@
+package Pinger
+
+import (
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimiterState is the state of the circuit breaker for a mail server.
+type HostLimiterState string
+
+const (
+	HostLimiterClosed   HostLimiterState = "Closed"   // all good. Requests are only limited by the token bucket.
+	HostLimiterOpen     HostLimiterState = "Open"     // the server is considered down. Nobody talks to it.
+	HostLimiterHalfOpen HostLimiterState = "HalfOpen" // a single probe is allowed through to see if the server is back.
+)
+
+// hostLimiter is a per-mail-server token bucket and circuit breaker. All MailClientContexts
+// talking to the same mail server share one, so that an outage trips the breaker once and
+// all polls back off together, instead of each client doing its own backoff. The limits are
+// read from the config each time, so that a config reload takes effect right away.
+type hostLimiter struct {
+	mutex         sync.Mutex
+	host          string
+	config        func() *BackendConfiguration
+	users         int // the mail clients using the limiter. See hostLimiterMap.get and release.
+	lastUsed      time.Time
+	tokens        float64
+	lastRefill    time.Time
+	state         HostLimiterState
+	failures      int
+	openFor       time.Duration
+	openUntil     time.Time
+	probing       bool
+	probeStarted  time.Time
+	totalFailures uint64
+	trips         uint64
+}
+
+// HostLimiterInfo is a snapshot of a hostLimiter, used in the RPC session API.
+type HostLimiterInfo struct {
+	Host          string
+	State         HostLimiterState
+	Failures      int
+	TotalFailures uint64
+	Trips         uint64
+	OpenUntil     time.Time
+}
+
+type hostLimiterMap struct {
+	mutex      sync.Mutex
+	limiters   map[string]*hostLimiter
+	lastExpire time.Time
+}
+
+// hostLimiterIdle is how long a limiter nobody uses is kept, before it is forgotten.
+const hostLimiterIdle = 10 * time.Minute
+
+var hostLimiters *hostLimiterMap
+
+func init() {
+	hostLimiters = newHostLimiterMap()
+}
+
+func newHostLimiterMap() *hostLimiterMap {
+	return &hostLimiterMap{
+		limiters:   make(map[string]*hostLimiter),
+		lastExpire: time.Now(),
+	}
+}
+
+// currentBackendConfig returns the backend configuration in effect, or the default one
+// if there is none (yet).
+func currentBackendConfig() *BackendConfiguration {
+	if globals != nil && globals.getConfig() != nil {
+		return globals.getConfig()
+	}
+	return NewBackendConfiguration()
+}
+
+// mailServerHost returns the host:port of the mail server, which is the key for the hostLimiters.
+func mailServerHost(mailServerUrl string) string {
+	u, err := url.Parse(mailServerUrl)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Host)
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		switch u.Scheme {
+		case "http":
+			host = net.JoinHostPort(host, "80")
+		case "https":
+			host = net.JoinHostPort(host, "443")
+		}
+	}
+	return host
+}
+
+func newHostLimiter(host string, config func() *BackendConfiguration) *hostLimiter {
+	now := time.Now()
+	return &hostLimiter{
+		host:       host,
+		config:     config,
+		lastUsed:   now,
+		tokens:     float64(config().HostRateBurst),
+		lastRefill: now,
+		state:      HostLimiterClosed,
+	}
+}
+
+// breakerTimeouts returns how long the breaker stays open the first time, and the cap on it.
+func breakerTimeouts(cfg *BackendConfiguration) (time.Duration, time.Duration) {
+	minOpen := time.Duration(cfg.HostBreakerTimeout) * time.Second
+	maxOpen := time.Duration(cfg.HostBreakerMaxTimeout) * time.Second
+	if maxOpen < minOpen {
+		maxOpen = minOpen
+	}
+	return minOpen, maxOpen
+}
+
+// get returns the limiter for the mail server, creating it if need be. The caller
+// must release it when done with it.
+func (m *hostLimiterMap) get(mailServerUrl string) *hostLimiter {
+	host := mailServerHost(mailServerUrl)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expireLocked(time.Now())
+	hl, ok := m.limiters[host]
+	if !ok {
+		hl = newHostLimiter(host, currentBackendConfig)
+		m.limiters[host] = hl
+	}
+	hl.mutex.Lock()
+	hl.users++
+	hl.mutex.Unlock()
+	return hl
+}
+
+// release tells the map that a user of the limiter is done with it, so that it can be
+// forgotten once nobody uses it.
+func (m *hostLimiterMap) release(hl *hostLimiter) {
+	if hl == nil {
+		return
+	}
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	hl.users--
+	hl.lastUsed = time.Now()
+}
+
+// expireLocked forgets the limiters that nobody has used for hostLimiterIdle, and whose breaker
+// is closed, since a new limiter would be just the same. It looks at most once a minute.
+func (m *hostLimiterMap) expireLocked(now time.Time) {
+	if now.Sub(m.lastExpire) < time.Minute {
+		return
+	}
+	m.lastExpire = now
+	for host, hl := range m.limiters {
+		hl.mutex.Lock()
+		idle := hl.users <= 0 && hl.state == HostLimiterClosed && hl.failures == 0 && now.Sub(hl.lastUsed) >= hostLimiterIdle
+		hl.mutex.Unlock()
+		if idle {
+			delete(m.limiters, host)
+		}
+	}
+}
+
+// info returns the state of the limiter for the mail server host (see mailServerHost), if there is one.
+func (m *hostLimiterMap) info(host string) *HostLimiterInfo {
+	m.mutex.Lock()
+	hl, ok := m.limiters[host]
+	m.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return hl.info()
+}
+
+// jitter returns a random duration in [0, d), used to stagger the recovery of the clients.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(prng.Int63n(int64(d)))
+}
+
+// reserve tries to take a token. It returns 0 if the caller may proceed, or
+// how long the caller should wait before asking again.
+func (hl *hostLimiter) reserve() time.Duration {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	now := time.Now()
+	hl.lastUsed = now
+	switch hl.state {
+	case HostLimiterOpen:
+		if now.Before(hl.openUntil) {
+			return hl.openUntil.Sub(now) + jitter(hl.openFor)
+		}
+		hl.state = HostLimiterHalfOpen
+		hl.probing = false
+		fallthrough
+
+	case HostLimiterHalfOpen:
+		// Only one probe at a time. If the prober went away without telling
+		// us how it went, let someone else try after a while.
+		if hl.probing && now.Sub(hl.probeStarted) < hl.openFor {
+			return jitter(hl.openFor) + time.Second
+		}
+		hl.probing = true
+		hl.probeStarted = now
+		return 0
+	}
+
+	cfg := hl.config()
+	rate := cfg.HostRateLimit
+	burst := float64(cfg.HostRateBurst)
+	if rate <= 0 {
+		return 0
+	}
+	hl.tokens = math.Min(burst, hl.tokens+now.Sub(hl.lastRefill).Seconds()*rate)
+	hl.lastRefill = now
+	if hl.tokens >= 1 {
+		hl.tokens--
+		return 0
+	}
+	return time.Duration((1 - hl.tokens) / rate * float64(time.Second))
+}
+
+// wait blocks until the caller is allowed to talk to the mail server. Returns
+// false if we were told to stop while waiting.
+func (hl *hostLimiter) wait(stopPollCh, stopAllCh chan int) bool {
+	for {
+		d := hl.reserve()
+		if d <= 0 {
+			return true
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-stopPollCh:
+			timer.Stop()
+			return false
+		case <-stopAllCh:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// success records a successful exchange with the mail server, closing the breaker.
+func (hl *hostLimiter) success() {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	hl.failures = 0
+	hl.probing = false
+	hl.openFor = 0
+	hl.state = HostLimiterClosed
+}
+
+// failure records a failed exchange with the mail server (i.e. the server is unreachable
+// or misbehaving), and opens the breaker if there have been too many in a row. The caller
+// still does its own backoff, since below the threshold nothing else slows it down.
+func (hl *hostLimiter) failure() {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	hl.failures++
+	hl.totalFailures++
+	cfg := hl.config()
+	if cfg.HostBreakerThreshold <= 0 {
+		return
+	}
+	minOpen, maxOpen := breakerTimeouts(cfg)
+	switch hl.state {
+	case HostLimiterClosed:
+		if hl.failures < cfg.HostBreakerThreshold {
+			return
+		}
+		hl.openFor = minOpen
+
+	case HostLimiterHalfOpen:
+		// the probe failed. Back off some more.
+		hl.openFor *= 2
+		if hl.openFor < minOpen {
+			hl.openFor = minOpen
+		}
+		if hl.openFor > maxOpen {
+			hl.openFor = maxOpen
+		}
+
+	case HostLimiterOpen:
+		// someone who was already in flight when we tripped. Nothing to do.
+		return
+	}
+	hl.state = HostLimiterOpen
+	hl.probing = false
+	hl.openUntil = time.Now().Add(hl.openFor)
+	hl.trips++
+}
+
+func (hl *hostLimiter) info() *HostLimiterInfo {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	info := HostLimiterInfo{
+		Host:          hl.host,
+		State:         hl.state,
+		Failures:      hl.failures,
+		TotalFailures: hl.totalFailures,
+		Trips:         hl.trips,
+	}
+	if hl.state == HostLimiterOpen {
+		info.OpenUntil = hl.openUntil
+	}
+	return &info
+}
@@ -0,0 +1,171 @@
+package Pinger
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type hostLimiterTester struct {
+	suite.Suite
+	cfg *BackendConfiguration
+}
+
+func (s *hostLimiterTester) SetupTest() {
+	s.cfg = NewBackendConfiguration()
+	s.cfg.HostRateLimit = 1
+	s.cfg.HostRateBurst = 2
+	s.cfg.HostBreakerThreshold = 3
+	s.cfg.HostBreakerTimeout = 10
+	s.cfg.HostBreakerMaxTimeout = 25
+}
+
+func (s *hostLimiterTester) config() *BackendConfiguration {
+	return s.cfg
+}
+
+func TestHostLimiter(t *testing.T) {
+	s := new(hostLimiterTester)
+	suite.Run(t, s)
+}
+
+func (s *hostLimiterTester) TestMailServerHost() {
+	s.Equal("mail.example.com:443", mailServerHost("https://Mail.Example.com/Microsoft-Server-ActiveSync?Cmd=Ping&User=foo"))
+	s.Equal("mail.example.com:80", mailServerHost("http://mail.example.com/Microsoft-Server-ActiveSync"))
+	s.Equal("imap.example.com:993", mailServerHost("imap://imap.example.com:993"))
+	s.Equal("", mailServerHost("not a url"))
+}
+
+func (s *hostLimiterTester) TestTokenBucket() {
+	hl := newHostLimiter("mail.example.com:443", s.config)
+	s.Equal(time.Duration(0), hl.reserve())
+	s.Equal(time.Duration(0), hl.reserve())
+	d := hl.reserve()
+	s.True(d > 0)
+	s.True(d <= time.Second)
+}
+
+func (s *hostLimiterTester) TestOffByDefault() {
+	hl := newHostLimiter("mail.example.com:443", NewBackendConfiguration)
+	for i := 0; i < 100; i++ {
+		s.Equal(time.Duration(0), hl.reserve())
+	}
+}
+
+func (s *hostLimiterTester) TestConfigChange() {
+	hl := newHostLimiter("mail.example.com:443", s.config)
+	s.Equal(time.Duration(0), hl.reserve())
+	s.Equal(time.Duration(0), hl.reserve())
+	s.True(hl.reserve() > 0)
+
+	// a reloaded config takes effect right away
+	s.cfg = NewBackendConfiguration()
+	s.cfg.HostRateLimit = 0
+	s.Equal(time.Duration(0), hl.reserve())
+	s.cfg.HostBreakerThreshold = 1
+	hl.failure()
+	s.Equal(HostLimiterOpen, hl.info().State)
+}
+
+func (s *hostLimiterTester) TestBreaker() {
+	hl := newHostLimiter("mail.example.com:443", s.config)
+	hl.failure()
+	hl.failure()
+	s.Equal(HostLimiterClosed, hl.info().State)
+	hl.success()
+	hl.failure()
+	hl.failure()
+	s.Equal(HostLimiterClosed, hl.info().State, "success should reset the failure count")
+	hl.failure()
+	info := hl.info()
+	s.Equal(HostLimiterOpen, info.State)
+	s.Equal(uint64(1), info.Trips)
+	s.Equal(uint64(5), info.TotalFailures)
+
+	d := hl.reserve()
+	s.True(d >= 9*time.Second, "should wait at least until the breaker closes")
+	s.True(d < 20*time.Second, "jitter should be less than the open period")
+
+	// pretend the open period is over. One probe gets through, the rest wait.
+	hl.openUntil = time.Now().Add(-time.Second)
+	s.Equal(time.Duration(0), hl.reserve())
+	s.Equal(HostLimiterHalfOpen, hl.info().State)
+	s.True(hl.reserve() > 0)
+
+	// the probe failed. The breaker backs off further, up to the max.
+	hl.failure()
+	s.Equal(HostLimiterOpen, hl.info().State)
+	s.Equal(20*time.Second, hl.openFor)
+	hl.openUntil = time.Now().Add(-time.Second)
+	s.Equal(time.Duration(0), hl.reserve())
+	hl.failure()
+	s.Equal(25*time.Second, hl.openFor)
+
+	// the probe succeeded. Back to normal.
+	hl.openUntil = time.Now().Add(-time.Second)
+	s.Equal(time.Duration(0), hl.reserve())
+	hl.success()
+	info = hl.info()
+	s.Equal(HostLimiterClosed, info.State)
+	s.Equal(0, info.Failures)
+	s.Equal(uint64(3), info.Trips)
+}
+
+func (s *hostLimiterTester) TestBreakerDisabled() {
+	s.cfg.HostBreakerThreshold = 0
+	hl := newHostLimiter("mail.example.com:443", s.config)
+	for i := 0; i < 10; i++ {
+		hl.failure()
+	}
+	s.Equal(HostLimiterClosed, hl.info().State)
+}
+
+func (s *hostLimiterTester) TestWaitStop() {
+	hl := newHostLimiter("mail.example.com:443", s.config)
+	for i := 0; i < s.cfg.HostBreakerThreshold; i++ {
+		hl.failure()
+	}
+	stopPollCh := make(chan int)
+	stopAllCh := make(chan int)
+	close(stopPollCh)
+	s.False(hl.wait(stopPollCh, stopAllCh))
+}
+
+func (s *hostLimiterTester) TestSharedPerHost() {
+	a := hostLimiters.get("https://shared.example.com/Microsoft-Server-ActiveSync?User=a")
+	b := hostLimiters.get("https://shared.example.com/Microsoft-Server-ActiveSync?User=b")
+	c := hostLimiters.get("https://other.example.com/Microsoft-Server-ActiveSync?User=a")
+	s.True(a == b)
+	s.False(a == c)
+	s.NotNil(hostLimiters.info("shared.example.com:443"))
+	s.Nil(hostLimiters.info("nosuch.example.com:443"))
+	hostLimiters.release(a)
+	hostLimiters.release(b)
+	hostLimiters.release(c)
+}
+
+func (s *hostLimiterTester) TestExpire() {
+	m := newHostLimiterMap()
+	used := m.get("https://used.example.com/Microsoft-Server-ActiveSync")
+	idle := m.get("https://idle.example.com/Microsoft-Server-ActiveSync")
+	broken := m.get("https://broken.example.com/Microsoft-Server-ActiveSync")
+	m.release(idle)
+	m.release(broken)
+	broken.failure()
+	s.Len(m.limiters, 3)
+
+	// nothing is forgotten until it has been idle for a while
+	m.lastExpire = time.Now().Add(-time.Minute)
+	m.get("https://other.example.com/Microsoft-Server-ActiveSync")
+	s.Len(m.limiters, 4)
+
+	for _, hl := range []*hostLimiter{used, idle, broken} {
+		hl.lastUsed = time.Now().Add(-hostLimiterIdle)
+	}
+	m.lastExpire = time.Now().Add(-time.Minute)
+	m.get("https://other.example.com/Microsoft-Server-ActiveSync")
+	s.Len(m.limiters, 3)
+	s.Nil(m.info("idle.example.com:443"))
+	s.NotNil(m.info("used.example.com:443"), "a limiter in use is kept")
+	s.NotNil(m.info("broken.example.com:443"), "a limiter with failures is kept")
+}
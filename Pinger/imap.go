@@ -58,6 +58,11 @@ type IMAPClient struct {
 	tag         *cmdTag
 	isIdling    bool
 	hasNewEmail bool
+	limiter     *hostLimiter
+
+	taggedMutex  sync.Mutex
+	taggedLogger *Logging.Logger // logger with the tag of command taggedSeq. See tagLogger()
+	taggedSeq    uint64
 }
 
 var prng *rand.Rand
@@ -70,35 +75,45 @@ func init() {
 	IOTimeoutError = fmt.Errorf("I/O Timeout Error")
 }
 
-func (imap *IMAPClient) getLogPrefix() string {
-	return imap.pi.getLogPrefix() + "|protocol=IMAP" + "|tag=" + string(imap.tag.id) + ":" + strconv.FormatUint(imap.tag.seq, 10)
+// tagLogger adds the current command tag to the log messages. The logger is only copied
+// when the tag changes, not for every message.
+func (imap *IMAPClient) tagLogger() *Logging.Logger {
+	imap.taggedMutex.Lock()
+	defer imap.taggedMutex.Unlock()
+	seq := imap.tag.seq
+	if imap.taggedLogger == nil || imap.taggedSeq != seq {
+		imap.taggedLogger = imap.logger.With("tag", string(imap.tag.id)+":"+strconv.FormatUint(seq, 10))
+		imap.taggedSeq = seq
+	}
+	return imap.taggedLogger
 }
 
 func (imap *IMAPClient) Debug(format string, args ...interface{}) {
-	imap.logger.Debug(fmt.Sprintf("%s|message=%s", imap.getLogPrefix(), format), args...)
+	imap.tagLogger().Debug(format, args...)
 }
 
 func (imap *IMAPClient) Info(format string, args ...interface{}) {
-	imap.logger.Info(fmt.Sprintf("%s|message=%s", imap.getLogPrefix(), format), args...)
+	imap.tagLogger().Info(format, args...)
 }
 
 func (imap *IMAPClient) Error(format string, args ...interface{}) {
-	imap.logger.Error(fmt.Sprintf("%s|message=%s", imap.getLogPrefix(), format), args...)
+	imap.tagLogger().Error(format, args...)
 }
 
 func (imap *IMAPClient) Warning(format string, args ...interface{}) {
-	imap.logger.Warning(fmt.Sprintf("%s|message=%s", imap.getLogPrefix(), format), args...)
+	imap.tagLogger().Warning(format, args...)
 }
 
 func NewIMAPClient(pi *MailPingInformation, wg *sync.WaitGroup, debug bool, logger *Logging.Logger) (*IMAPClient, error) {
 	imap := IMAPClient{
 		debug:     debug,
-		logger:    logger.Copy(),
+		logger:    logger.WithFields(append(pi.logFields(), Logging.String("protocol", "IMAP"))...),
 		pi:        pi,
 		wg:        wg,
 		mutex:     &sync.Mutex{},
 		cancelled: false,
 		tag:       genNewCmdTag(0),
+		limiter:   hostLimiters.get(pi.MailServerUrl),
 	}
 	imap.logger.SetCallDepth(1)
 	imap.Info("Created new IMAP Client|msgCode=IMAP_CLIENT_CREATED")
@@ -541,18 +556,21 @@ func (imap *IMAPClient) setupConn() error {
 	if imap.url == nil {
 		imapUrl, err := url.Parse(imap.pi.MailServerUrl)
 		if err != nil {
-			imap.Warning("err %s", err)
+			imap.Warning("Could not parse mail server URL: %s|msgCode=IMAP_CONN_FAIL", err)
 			return err
 		}
 		imap.url = imapUrl
 	}
 
 	host, _, _ := net.SplitHostPort(imap.url.Host)
+	policyName := globals.getConfig().tlsPolicyName(host)
 	if imap.tlsConfig == nil {
-		imap.tlsConfig = &tls.Config{
-			ServerName: host,
-			RootCAs:    globals.config.RootCerts(),
+		tlsConfig, err := globals.getConfig().tlsConfig(host, imap.pi.MailServerCertificate)
+		if err != nil {
+			imap.Warning("Could not set up TLS for %s|tlsPolicy=%s|err=%s|msgCode=IMAP_TLS_CONFIG_FAIL", imap.url.Host, policyName, err)
+			return err
 		}
+		imap.tlsConfig = tlsConfig
 	}
 	conn, err := net.DialTimeout("tcp", imap.url.Host, netTimeout)
 	if err == nil {
@@ -563,14 +581,14 @@ func (imap *IMAPClient) setupConn() error {
 		}
 	}
 	if err != nil {
-		imap.Warning("err %s", err)
+		imap.Warning("Could not connect to %s|tlsPolicy=%s|err=%s|msgCode=IMAP_CONN_FAIL", imap.url.Host, policyName, err)
 		return err
 	}
 	imap.setupScanner()
 
 	err = imap.handleGreeting()
 	if err != nil {
-		imap.Warning("err %s", err)
+		imap.Warning("No greeting from %s|tlsPolicy=%s|err=%s|msgCode=IMAP_GREETING_FAIL", imap.url.Host, policyName, err)
 		return err
 	}
 	return nil
@@ -603,13 +621,21 @@ func (imap *IMAPClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan erro
 			time.Sleep(s)
 		}
 		sleepTime = POLLING_INTERVAL
+		// all clients talking to this server share the limiter, so that if the server
+		// is down, we back off together instead of each client hammering it.
+		if !imap.limiter.wait(stopPollCh, stopAllCh) {
+			imap.Info("Was told to stop while waiting on the mail server limiter. Stopping")
+			return
+		}
 		if imap.tlsConn == nil {
 			err := imap.setupConn()
 			if err != nil {
 				imap.Error("Connection setup error: %v", err)
+				imap.limiter.failure()
 				errCh <- LongPollReRegister
 				return
 			}
+			imap.limiter.success()
 			authSuccess, err := imap.doImapAuth()
 			if err != nil {
 				imap.Warning("Authentication error (%s). Telling client to re-register|msgCode=IMAP_AUTH_FAIL_REREGISTER", err)
@@ -642,6 +668,7 @@ func (imap *IMAPClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan erro
 			command = fmt.Sprintf("%s %s %s %s", imap.tag.Next(), IMAP_STATUS, imap.pi.IMAPFolderName, IMAP_STATUS_QUERY)
 		}
 
+		timeSent := time.Now()
 		go imap.doRequestResponse(command, responseCh, responseErrCh)
 		select {
 		case <-requestTimer.C:
@@ -653,6 +680,7 @@ func (imap *IMAPClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan erro
 
 		case err := <-responseErrCh:
 			if err == IOTimeoutError {
+				// the IDLE expired, which is normal, so not a failure of the server.
 				// just retry on an I/O Timeout. No need for the device to re-register
 				sleepTime = 1
 			} else {
@@ -663,6 +691,8 @@ func (imap *IMAPClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan erro
 			return
 
 		case <-responseCh:
+			metricMailServerLatency.With(MailClientIMAP).ObserveSince(timeSent)
+			imap.limiter.success()
 			if imap.hasNewEmail {
 				imap.Info("Got mail. Sending LongPollNewMail|msgCode=IMAP_NEW_EMAIL")
 				imap.hasNewEmail = false
@@ -713,4 +743,5 @@ func (imap *IMAPClient) Cleanup() {
 	imap.cancel()
 	imap.pi.cleanup()
 	imap.pi = nil
+	hostLimiters.release(imap.limiter)
 }
@@ -0,0 +1,199 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"time"
+)
+
+// deviceJanitor deletes the devices that have not been in touch for device-expiry days. Devices
+// only go away when their session ends cleanly, so without it, every device that went silent (app
+// deleted, pinger restarted, ...) stays around, and alertAllDevices pushes to it forever.
+//
+// A device's last contact is the later of its last update and the LastContact of its contact
+// record. Devices of this pinger with a session in the poll map are in use, and never expire. The
+// devices of other live pingers are left to their own janitor. Those of pingers that have not
+// updated their pinger_info (see pinger-updater) since the cutoff are gone, and expire like ours.
+// With the last session of a device gone, the janitor also deletes its contact record, and the
+// SNS endpoints that no remaining session uses.
+type deviceJanitor struct {
+	db     Storage
+	aws    AWS.AWSHandler
+	active func(di *DeviceInfo) bool
+	logger *Logging.Logger
+}
+
+// janitorReport is what a run of the janitor deleted, and how many deletes failed.
+type janitorReport struct {
+	Devices   int
+	Contacts  int
+	Endpoints int
+	Errors    int
+}
+
+func newDeviceJanitor(db Storage, aws AWS.AWSHandler, active func(di *DeviceInfo) bool, logger *Logging.Logger) *deviceJanitor {
+	if active == nil {
+		active = func(di *DeviceInfo) bool { return false }
+	}
+	return &deviceJanitor{
+		db:     db,
+		aws:    aws,
+		active: active,
+		logger: logger,
+	}
+}
+
+// Runner runs the janitor every so many minutes. The expiry is read from the config on every run,
+// so a config reload can change it, and 0 turns the janitor off.
+func (j *deviceJanitor) Runner(minutes int) {
+	ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+	for {
+		<-ticker.C
+		days := globals.getConfig().DeviceExpiry
+		if days <= 0 {
+			continue
+		}
+		_, err := j.run(time.Now().Add(-time.Duration(days) * 24 * time.Hour))
+		if err != nil {
+			j.logger.Error("Device janitor failed: %s|msgCode=DEVICE_JANITOR_FAILED", err)
+		}
+	}
+}
+
+// lastContact returns when we last heard from the device, in unix nanoseconds.
+func (j *deviceJanitor) lastContact(di *DeviceInfo) (int64, error) {
+	last := di.Updated
+	dc, err := deviceContactGet(j.db.deviceContact(), di.UserId, di.ClientContext, di.DeviceId)
+	if err != nil {
+		return 0, err
+	}
+	if dc != nil && dc.LastContact > last {
+		last = dc.LastContact
+	}
+	return last, nil
+}
+
+// pingerAlive tells whether another pinger updated its pinger_info since the cutoff. The answers
+// are cached in alive, for the length of a run.
+func (j *deviceJanitor) pingerAlive(pinger string, cutoff time.Time, alive map[string]bool) (bool, error) {
+	if ok, found := alive[pinger]; found {
+		return ok, nil
+	}
+	keys := []AWS.DBKeyValue{
+		AWS.DBKeyValue{Key: "pinger", Value: pinger, Comparison: AWS.KeyComparisonEq},
+	}
+	info, err := j.db.pingerInfo().get(keys)
+	if err != nil {
+		return false, err
+	}
+	alive[pinger] = info != nil && info.Updated >= cutoff.UnixNano()
+	return alive[pinger], nil
+}
+
+// run deletes the devices not heard from since the cutoff, of this pinger and of the pingers that
+// went away.
+func (j *deviceJanitor) run(cutoff time.Time) (*janitorReport, error) {
+	report := &janitorReport{}
+	devices, err := findDevices(j.db, j.aws, &deviceFilter{}, j.logger)
+	if err != nil {
+		return nil, err
+	}
+	alive := make(map[string]bool)
+	// the expired devices, grouped by their contact record, in the order we found them.
+	expired := make(map[string][]*DeviceInfo)
+	order := make([]string, 0)
+	for _, di := range devices {
+		if di.Pinger == pingerHostId {
+			if j.active(di) {
+				continue
+			}
+		} else {
+			ok, err := j.pingerAlive(di.Pinger, cutoff, alive)
+			if err != nil {
+				j.logger.Warning("Could not get the pinger info of %s: %s", di.Pinger, err)
+				report.Errors++
+				alive[di.Pinger] = true // don't touch its devices this time around
+				continue
+			}
+			if ok {
+				continue
+			}
+		}
+		last, err := j.lastContact(di)
+		if err != nil {
+			j.logger.Warning("Could not get the last contact of device %s: %s", di.DeviceId, err)
+			report.Errors++
+			continue
+		}
+		if last >= cutoff.UnixNano() {
+			continue
+		}
+		n, err := di.delete()
+		if err != nil || n <= 0 {
+			// someone else updated or deleted it since we read it.
+			j.logger.Warning("Could not delete expired device %s (%d): %v", di.DeviceId, n, err)
+			report.Errors++
+			continue
+		}
+		di.Info("Deleted expired device|lastContact=%s|pinger=%s|AWSEndpointArn=%s|msgCode=DEVICE_EXPIRED",
+			time.Unix(0, last).UTC().Format(time.RFC3339), di.Pinger, di.AWSEndpointArn)
+		report.Devices++
+		key := joinKey(di.UserId, di.ClientContext, di.DeviceId)
+		if _, ok := expired[key]; !ok {
+			order = append(order, key)
+		}
+		expired[key] = append(expired[key], di)
+	}
+	for _, key := range order {
+		j.cleanupDevice(expired[key], report)
+	}
+	metricJanitorDeletes.With("device").Add(float64(report.Devices))
+	metricJanitorDeletes.With("contact").Add(float64(report.Contacts))
+	metricJanitorDeletes.With("endpoint").Add(float64(report.Endpoints))
+	j.logger.Info("Device janitor deleted %d devices, %d contacts and %d endpoints, with %d errors|cutoff=%s|msgCode=DEVICE_JANITOR",
+		report.Devices, report.Contacts, report.Endpoints, report.Errors, cutoff.UTC().Format(time.RFC3339))
+	return report, nil
+}
+
+// cleanupDevice deletes the endpoints of the deleted sessions of a device that no remaining session
+// uses, and, if no session remains, the device's contact record.
+func (j *deviceJanitor) cleanupDevice(deleted []*DeviceInfo, report *janitorReport) {
+	first := deleted[0]
+	remaining, err := j.db.deviceInfo().find(&deviceFilter{UserId: first.UserId, ClientContext: first.ClientContext, DeviceId: first.DeviceId})
+	if err != nil {
+		j.logger.Warning("Could not look for other sessions of device %s: %s", first.DeviceId, err)
+		report.Errors++
+		return
+	}
+	inUse := make(map[string]bool)
+	for _, di := range remaining {
+		inUse[di.AWSEndpointArn] = true
+	}
+	for _, di := range deleted {
+		if di.AWSEndpointArn == "" || inUse[di.AWSEndpointArn] {
+			continue
+		}
+		inUse[di.AWSEndpointArn] = true
+		err = j.aws.DeleteEndpointArn(di.AWSEndpointArn)
+		if err != nil {
+			j.logger.Warning("Could not delete endpoint %s: %s", di.AWSEndpointArn, err)
+			report.Errors++
+			continue
+		}
+		report.Endpoints++
+	}
+	if len(remaining) > 0 {
+		return
+	}
+	dc, err := deviceContactGet(j.db.deviceContact(), first.UserId, first.ClientContext, first.DeviceId)
+	if err == nil && dc != nil {
+		_, err = dc.db.delete(dc)
+		if err == nil {
+			report.Contacts++
+		}
+	}
+	if err != nil {
+		j.logger.Warning("Could not delete the contact of device %s: %s", first.DeviceId, err)
+		report.Errors++
+	}
+}
@@ -0,0 +1,179 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"sort"
+	"testing"
+	"time"
+)
+
+type janitorTester struct {
+	suite.Suite
+	dbType       string
+	db           Storage
+	closeStorage func()
+	aws          *AWS.TestAwsHandler
+	logger       *Logging.Logger
+}
+
+func TestDeviceJanitor(t *testing.T) {
+	for _, dbType := range testStorageTypes {
+		t.Run(dbType, func(t *testing.T) {
+			s := &janitorTester{dbType: dbType}
+			suite.Run(t, s)
+		})
+	}
+}
+
+func (s *janitorTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *janitorTester) SetupTest() {
+	s.aws = AWS.NewTestAwsHandler()
+	s.db, s.closeStorage = newTestStorage(s.dbType, s.aws, s.logger)
+	globals = nil
+	setGlobal(NewBackendConfiguration())
+}
+
+func (s *janitorTester) TearDownTest() {
+	s.closeStorage()
+	globals = nil
+}
+
+func (s *janitorTester) newDevice(deviceId, sessionId, pinger, endpointArn string) *DeviceInfo {
+	pushToken := fmt.Sprintf("%064x", []byte(deviceId))[:64]
+	di, err := newDeviceInfo("user1", "context1", deviceId, pushToken, "APNS", "ios", "8.1", "0.9", "", sessionId, s.aws, s.db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.Pinger = pinger
+	di.AWSEndpointArn = endpointArn
+	s.NoError(di.insert(nil))
+	return di
+}
+
+func (s *janitorTester) devices() []string {
+	devices, err := s.db.deviceInfo().find(&deviceFilter{})
+	require.NoError(s.T(), err)
+	keys := make([]string, 0, len(devices))
+	for _, di := range devices {
+		keys = append(keys, fmt.Sprintf("%s/%s", di.DeviceId, di.SessionId))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *janitorTester) contact(deviceId string) *deviceContact {
+	dc, err := deviceContactGet(s.db.deviceContact(), "user1", "context1", deviceId)
+	require.NoError(s.T(), err)
+	return dc
+}
+
+func (s *janitorTester) deletedEndpoints() []string {
+	endpoints := s.aws.DeletedEndpoints()
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func (s *janitorTester) TestNothingExpired() {
+	s.newDevice("device1", "session1", pingerHostId, "arn1")
+	janitor := newDeviceJanitor(s.db, s.aws, nil, s.logger)
+	report, err := janitor.run(time.Now().Add(-time.Hour))
+	s.NoError(err)
+	s.Equal(janitorReport{}, *report)
+	s.Equal([]string{"device1/session1"}, s.devices())
+	s.Empty(s.aws.DeletedEndpoints())
+}
+
+// newPinger adds the pinger info of another pinger, last updated at the given time.
+func (s *janitorTester) newPinger(pinger string, updated time.Time) {
+	info := &PingerInfo{Pinger: pinger}
+	require.NoError(s.T(), s.db.pingerInfo().insert(info))
+	info.Updated = updated.UnixNano()
+	n, err := s.db.pingerInfo().update(info)
+	require.NoError(s.T(), err)
+	s.Equal(int64(1), n)
+}
+
+func (s *janitorTester) TestExpire() {
+	s.newDevice("device1", "session1", pingerHostId, "arn1")
+	s.newDevice("device1", "session2", pingerHostId, "arn1")
+	s.newDevice("device2", "session1", pingerHostId, "arn2")
+	s.newDevice("device3", "session1", "someotherpinger", "arn3")
+	s.newPinger("someotherpinger", time.Now().Add(2*time.Hour))
+
+	janitor := newDeviceJanitor(s.db, s.aws, nil, s.logger)
+	report, err := janitor.run(time.Now().Add(time.Hour))
+	s.NoError(err)
+	s.Equal(janitorReport{Devices: 3, Contacts: 2, Endpoints: 2}, *report)
+	// the other pinger is alive, so its devices are its own business.
+	s.Equal([]string{"device3/session1"}, s.devices())
+	s.Equal([]string{"arn1", "arn2"}, s.deletedEndpoints())
+	s.Nil(s.contact("device1"))
+	s.Nil(s.contact("device2"))
+	s.NotNil(s.contact("device3"))
+}
+
+func (s *janitorTester) TestOtherPingers() {
+	s.newDevice("device1", "session1", "livepinger", "arn1")
+	s.newDevice("device2", "session1", "deadpinger", "arn2")
+	s.newDevice("device3", "session1", "unknownpinger", "arn3")
+	s.newPinger("livepinger", time.Now().Add(2*time.Hour))
+	s.newPinger("deadpinger", time.Now().Add(-time.Hour))
+	// only our own sessions are checked against the poll map
+	active := func(di *DeviceInfo) bool { return true }
+
+	janitor := newDeviceJanitor(s.db, s.aws, active, s.logger)
+	report, err := janitor.run(time.Now().Add(time.Hour))
+	s.NoError(err)
+	s.Equal(janitorReport{Devices: 2, Contacts: 2, Endpoints: 2}, *report)
+	s.Equal([]string{"device1/session1"}, s.devices())
+	s.Equal([]string{"arn2", "arn3"}, s.deletedEndpoints())
+}
+
+func (s *janitorTester) TestLastContact() {
+	di := s.newDevice("device1", "session1", pingerHostId, "arn1")
+	dc := s.contact(di.DeviceId)
+	require.NotNil(s.T(), dc)
+	dc.LastContact = time.Now().Add(2 * time.Hour).UnixNano()
+	_, err := dc.db.update(dc)
+	require.NoError(s.T(), err)
+
+	janitor := newDeviceJanitor(s.db, s.aws, nil, s.logger)
+	report, err := janitor.run(time.Now().Add(time.Hour))
+	s.NoError(err)
+	s.Equal(janitorReport{}, *report)
+	s.Equal([]string{"device1/session1"}, s.devices())
+}
+
+func (s *janitorTester) TestActiveSessions() {
+	s.newDevice("device1", "session1", pingerHostId, "arn1")
+	s.newDevice("device1", "session2", pingerHostId, "arn1")
+	s.newDevice("device2", "session1", pingerHostId, "arn2")
+	active := func(di *DeviceInfo) bool { return di.SessionId == "session2" }
+
+	janitor := newDeviceJanitor(s.db, s.aws, active, s.logger)
+	report, err := janitor.run(time.Now().Add(time.Hour))
+	s.NoError(err)
+	// device1's endpoint and contact are still in use by session2.
+	s.Equal(janitorReport{Devices: 2, Contacts: 1, Endpoints: 1}, *report)
+	s.Equal([]string{"device1/session2"}, s.devices())
+	s.Equal([]string{"arn2"}, s.deletedEndpoints())
+	s.NotNil(s.contact("device1"))
+	s.Nil(s.contact("device2"))
+}
+
+func (s *janitorTester) TestEndpointErrors() {
+	s.newDevice("device1", "session1", pingerHostId, "arn1")
+	s.newDevice("device2", "session1", pingerHostId, "")
+	s.aws.SetReturnDeleteAttributes(fmt.Errorf("no such endpoint"))
+
+	janitor := newDeviceJanitor(s.db, s.aws, nil, s.logger)
+	report, err := janitor.run(time.Now().Add(time.Hour))
+	s.NoError(err)
+	s.Equal(janitorReport{Devices: 2, Contacts: 2, Errors: 1}, *report)
+	s.Empty(s.devices())
+}
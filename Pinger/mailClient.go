@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"github.com/coopernurse/gorp"
 	"github.com/looplab/fsm"
 	"github.com/nachocove/Pinger/Utils"
 	"github.com/nachocove/Pinger/Utils/AWS"
@@ -24,6 +23,8 @@ type MailClientContextType interface {
 	setStatus(MailClientStatus, error)
 	Action(action PingerCommand) error
 	getSessionInfo() (*ClientSessionInfo, error)
+	getSessionHistory() *ClientSessionHistory
+	getSessionId() string
 }
 
 type MailClientContext struct {
@@ -40,23 +41,17 @@ type MailClientContext struct {
 	DeviceId        string
 	Protocol        string
 	sessionId       string
+	mailServer      string // host:port of the mail server. Used to look up the hostLimiter.
 	WaitBeforeUse   uint64 // in milliseconds
 	MaxPollTimeout  uint64 // max polling lifetime in milliseconds. Default 2 days.
 	ResponseTimeout uint64 // in milliseconds
 	wg              sync.WaitGroup
 	status          MailClientStatus
-	logPrefix       string
 	fsm             *fsm.FSM
 	deferTimer      *time.Timer
 	maxPollTime     time.Duration
 	maxPollTimer    *time.Timer
-}
-
-func (client *MailClientContext) getLogPrefix() string {
-	if client.logPrefix == "" {
-		client.logPrefix = fmt.Sprintf("|device=%s|client=%s|context=%s|session=%s", client.DeviceId, client.UserId, client.ClientContext, client.sessionId)
-	}
-	return client.logPrefix
+	history         *sessionHistory
 }
 
 func (client *MailClientContext) setStatus(status MailClientStatus, err error) {
@@ -117,13 +112,23 @@ func (status MailClientStatus) String() string {
 	panic(fmt.Sprintf("Unknown status %d", status))
 }
 
+// ParseMailClientStatus returns the status with the given name (see String()), ignoring case.
+func ParseMailClientStatus(name string) (MailClientStatus, error) {
+	for status := MailClientStatusError; status <= MailClientStatusReDeferred; status++ {
+		if strings.EqualFold(name, status.String()) {
+			return status, nil
+		}
+	}
+	return MailClientStatusError, fmt.Errorf("Unknown status '%s'", name)
+}
+
 const (
 	DefaultMaxPollTimeout uint64 = 2 * 24 * 60 * 60 * 1000 // 2 days in milliseconds
 )
 
-func NewMailClientContext(dbm *gorp.DbMap, aws AWS.AWSHandler, pi *MailPingInformation, debug, doStats bool, logger *Logging.Logger) (*MailClientContext, error) {
+func NewMailClientContext(db Storage, aws AWS.AWSHandler, pi *MailPingInformation, debug, doStats bool, logger *Logging.Logger) (*MailClientContext, error) {
 	client := &MailClientContext{
-		logger:          logger.Copy(),
+		logger:          logger.WithFields(pi.logFields()...),
 		stopAllCh:       make(chan int),
 		command:         make(chan PingerCommand, 10),
 		stats:           nil,
@@ -136,7 +141,13 @@ func NewMailClientContext(dbm *gorp.DbMap, aws AWS.AWSHandler, pi *MailPingInfor
 		MaxPollTimeout:  pi.MaxPollTimeout,
 		ResponseTimeout: pi.ResponseTimeout,
 		sessionId:       pi.SessionId,
+		mailServer:      mailServerHost(pi.MailServerUrl),
 	}
+	historySize := defaultSessionHistorySize
+	if globals != nil {
+		historySize = globals.getConfig().SessionHistorySize
+	}
+	client.history = newSessionHistory(historySize)
 	err := aws.ValidateCognitoID(pi.UserId)
 	if err != nil {
 		client.Info("Could not validate user id:%s|userId=%s|msgCode=INVALID_USERID", err.Error(), pi.UserId)
@@ -145,7 +156,7 @@ func NewMailClientContext(dbm *gorp.DbMap, aws AWS.AWSHandler, pi *MailPingInfor
 
 	client.logger.SetCallDepth(1)
 
-	di, err := pi.newDeviceInfo(newDeviceInfoSqlHandler(dbm), aws, logger)
+	di, err := pi.newDeviceInfo(db.deviceInfo(), aws, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -190,19 +201,19 @@ func NewMailClientContext(dbm *gorp.DbMap, aws AWS.AWSHandler, pi *MailPingInfor
 }
 
 func (client *MailClientContext) Debug(format string, args ...interface{}) {
-	client.logger.Debug(fmt.Sprintf("%s|message=%s", client.getLogPrefix(), format), args...)
+	client.logger.Debug(format, args...)
 }
 
 func (client *MailClientContext) Info(format string, args ...interface{}) {
-	client.logger.Info(fmt.Sprintf("%s|message=%s", client.getLogPrefix(), format), args...)
+	client.logger.Info(format, args...)
 }
 
 func (client *MailClientContext) Error(format string, args ...interface{}) {
-	client.logger.Error(fmt.Sprintf("%s|message=%s", client.getLogPrefix(), format), args...)
+	client.logger.Error(format, args...)
 }
 
 func (client *MailClientContext) Warning(format string, args ...interface{}) {
-	client.logger.Warning(fmt.Sprintf("%s|message=%s", client.getLogPrefix(), format), args...)
+	client.logger.Warning(format, args...)
 }
 
 func (client *MailClientContext) Status() (MailClientStatus, error) {
@@ -270,11 +281,17 @@ func (client *MailClientContext) initFsm() {
 			"leave_pinging":  client.exitPinging,
 			"enter_stopped":  client.enterStopped,
 			"leave_stopped":  client.exitStopped,
+			"enter_state":    client.enterState,
 		},
 	)
 	client.Debug("FSM initialized")
 }
 
+func (client *MailClientContext) enterState(e *fsm.Event) {
+	metricFSMTransitions.With(e.Src, e.Dst).Inc()
+	client.history.add(SessionEventTransition, "%s -> %s (%s)", e.Src, e.Dst, client.status)
+}
+
 func (client *MailClientContext) leaveInit(e *fsm.Event) {
 	client.maxPollTime = time.Duration(client.MaxPollTimeout) * time.Millisecond
 	client.Debug("Setting max poll timer|maxPollTimer=%s", client.maxPollTime)
@@ -286,6 +303,10 @@ func (client *MailClientContext) enterDeferred(e *fsm.Event) {
 	status := e.Args[0].(MailClientStatus)
 	client.deferTimer.Stop()
 	deferTime := time.Duration(client.WaitBeforeUse) * time.Millisecond
+	if len(e.Args) > 1 {
+		// a deferred push, which waits for as long as it is held back
+		deferTime = e.Args[1].(time.Duration)
+	}
 	client.Debug("Enter defer|deferTimer=%s", deferTime)
 	client.deferTimer.Reset(deferTime)
 	client.setStatus(status, nil)
@@ -346,9 +367,11 @@ func (client *MailClientContext) start() {
 
 	errCh := make(chan error)
 	rearmingCount := 0
+	pendingPush := false // a new mail push is deferred until the defer timer expires
+	var mailArrived time.Time
 	tooFastResponse := (time.Duration(client.ResponseTimeout) * time.Millisecond) / 4
 	var timeSent time.Time
-	rearmTimeout := time.Duration(globals.config.ReArmTimeout) * time.Minute
+	rearmTimeout := time.Duration(globals.getConfig().ReArmTimeout) * time.Minute
 
 	client.initFsm()
 	err := client.fsm.Event(FSMDeferred, MailClientStatusDeferred)
@@ -359,7 +382,9 @@ func (client *MailClientContext) start() {
 		select {
 		case <-client.maxPollTimer.C:
 			client.Info("MaxPoll timer expired. Sending ReRegister push message")
+			client.history.add(SessionEventReRegister, "Max poll time %s expired", client.maxPollTime)
 			perr := client.di.PushRegister()
+			client.historyPush("register", perr)
 			if perr != nil {
 				if perr == APNSInvalidToken {
 					client.Warning("Invalid token reported by Apple, deleting device|token=%s||msgCode=INVALID_PUSH_TOKEN", client.di.PushToken)
@@ -376,6 +401,30 @@ func (client *MailClientContext) start() {
 			return
 
 		case <-client.deferTimer.C:
+			if pendingPush {
+				client.Info("Defer timer expired. Sending the deferred push")
+				pendingPush = false
+				err = client.fsm.Event(FSMStopped, "Sending deferred newmail push notification", MailClientStatusStopped, nil)
+				if err != nil {
+					panic(err)
+				}
+				wait, ok := client.pushNewMail(mailArrived)
+				if !ok {
+					return
+				}
+				if wait > 0 {
+					pendingPush = true
+					err = client.fsm.Event(FSMDeferred, MailClientStatusDeferred, wait)
+					if err != nil {
+						panic(err)
+					}
+					continue
+				}
+				if !client.rearm(&rearmingCount, rearmTimeout) {
+					return
+				}
+				continue
+			}
 			client.Info("Defer timer expired. Starting poll")
 			err = client.fsm.Event(FSMPinging, errCh)
 			if err != nil {
@@ -386,35 +435,29 @@ func (client *MailClientContext) start() {
 		case err := <-errCh:
 			switch {
 			case err == LongPollNewMail:
+				mailArrived = time.Now()
 				client.Info("New mail detected, checking notification status|timeSince=%s|rearmingCount=%d|msgCode=NEW_MAIL", time.Since(timeSent), rearmingCount)
+				client.history.add(SessionEventNewMail, "New mail after %s (rearmingCount %d)", time.Since(timeSent), rearmingCount)
 				pushSent := false
+				var pushWait time.Duration
 				if time.Since(timeSent) > tooFastResponse || rearmingCount == 0 {
-					client.Info("Sending push message for new mail")
-					err = client.di.PushNewMail()
-					if err != nil {
-						if client.di.aws.IgnorePushFailures() == false {
-							if err == APNSInvalidToken {
-								client.Warning("Invalid Token reported by Apple for token '%s'.Deleting device|msgCode=INVALID_PUSH_TOKEN", client.di.PushToken)
-								client.di.cleanup()
-								client.di = nil
-							} else {
-								client.Error("Failed to push: %s|msgCode=PUSH_ERROR", err)
-							}
-							logError(err, client.logger)
-							return
-						} else {
-							client.Warning("Push failed but ignored: %s|msgCode=PUSH_ERROR", err.Error())
-						}
+					var ok bool
+					pushWait, ok = client.pushNewMail(mailArrived)
+					if !ok {
+						return
 					}
-					pushSent = true
-					client.Info("Newmail notification sent|msgCode=PUSH_SENT")
+					pushSent = pushWait == 0
 				} else {
 					client.Info("Newmail notification not sent|msgCode=PUSH_NOT_SENT")
+					client.history.add(SessionEventNewMail, "No push sent: the response came back too fast after rearming")
 				}
 				var msg string
-				if pushSent {
+				switch {
+				case pushSent:
 					msg = "Stopping - newmail push notification sent"
-				} else {
+				case pushWait > 0:
+					msg = "Stopping - newmail push notification deferred"
+				default:
 					msg = "Stopping - no push notification sent"
 				}
 				client.Info("Stopping Poll|msgCode=STOP_POLL")
@@ -423,22 +466,24 @@ func (client *MailClientContext) start() {
 				if err != nil {
 					panic(err)
 				}
-				if client.Protocol == MailClientIMAP && rearmingCount < 3 {
-					rearmingCount++
-					client.WaitBeforeUse = uint64(rearmTimeout) / uint64(time.Millisecond)
-					client.Info("Rearming poll|rearmingCount=%d|rearmTimeout=%s|msgCode=REARMED", rearmingCount, rearmTimeout)
-					err = client.fsm.Event(FSMDeferred, MailClientStatusReDeferred)
+				if pushWait > 0 {
+					// the poll resumes once the push is out
+					pendingPush = true
+					err = client.fsm.Event(FSMDeferred, MailClientStatusDeferred, pushWait)
 					if err != nil {
 						panic(err)
 					}
-				} else {
-					client.Info("Rearming count exceeded, stopping|rearmingCount=%d", rearmingCount)
+					continue
+				}
+				if !client.rearm(&rearmingCount, rearmTimeout) {
 					return
 				}
 
 			case err == LongPollReRegister:
 				client.Info("LongPollReRegister message received. Sending ReRegister push message")
+				client.history.add(SessionEventReRegister, "The mail server connection needs the device to re-register")
 				err1 := client.di.PushRegister()
+				client.historyPush("register", err1)
 				if err1 != nil {
 					// don't bother with this error. The real/main error is the http status. Just log it.
 					client.Error("Push failed but ignored|err=%s", err1.Error())
@@ -458,6 +503,7 @@ func (client *MailClientContext) start() {
 
 			default:
 				// the mailClient.LongPoll has thrown an error. note it.
+				client.history.add(SessionEventMailServerError, "%s", err)
 				err = client.fsm.Event(FSMStopped, fmt.Sprintf("Error thrown: %s, stopping poll", err.Error()), MailClientStatusError, err)
 				if err != nil {
 					panic(err)
@@ -468,6 +514,7 @@ func (client *MailClientContext) start() {
 		case cmd := <-client.command:
 			switch {
 			case cmd == PingerStop:
+				client.history.add(SessionEventStop, "Stopped by request")
 				close(client.stopAllCh) // tell all goroutines listening on this channel that they can stop now.
 				err = client.fsm.Event(FSMStopped, "Got PingerStop command", MailClientStatusStopped, nil)
 				if err != nil {
@@ -476,12 +523,15 @@ func (client *MailClientContext) start() {
 				return
 
 			case cmd == PingerDefer:
+				client.history.add(SessionEventDefer, "Deferred by the device for %s", time.Duration(client.WaitBeforeUse)*time.Millisecond)
 				err = client.fsm.Event(FSMStopped, "Got PingerDefer command", MailClientStatusStopped, nil)
 				if err != nil {
 					panic(err)
 				}
-				// this comes from the client, which means we need to reset the count.
+				// this comes from the client, which means we need to reset the count, and that
+				// it is up already, so a deferred push is moot.
 				rearmingCount = 0
+				pendingPush = false
 				err = client.fsm.Event(FSMDeferred, MailClientStatusDeferred)
 				if err != nil {
 					panic(err)
@@ -495,6 +545,53 @@ func (client *MailClientContext) start() {
 	}
 }
 
+// pushNewMail sends the push for the mail that arrived at mailArrived. It returns how long the
+// device's notification preferences defer it, if they do, and false if the session has to stop.
+func (client *MailClientContext) pushNewMail(mailArrived time.Time) (time.Duration, bool) {
+	client.Info("Sending push message for new mail")
+	err := client.di.PushNewMail(mailArrived)
+	if deferred, ok := err.(*pushDeferredError); ok {
+		client.Info("Newmail notification deferred|wait=%s|msgCode=PUSH_DEFERRED", deferred.wait)
+		client.history.add(SessionEventPushDeferred, "Deferred new mail push for %s", deferred.wait)
+		return deferred.wait, true
+	}
+	client.historyPush("new mail", err)
+	if err != nil {
+		if client.di.aws.IgnorePushFailures() == false {
+			if err == APNSInvalidToken {
+				client.Warning("Invalid Token reported by Apple for token '%s'.Deleting device|msgCode=INVALID_PUSH_TOKEN", client.di.PushToken)
+				client.di.cleanup()
+				client.di = nil
+			} else {
+				client.Error("Failed to push: %s|msgCode=PUSH_ERROR", err)
+			}
+			logError(err, client.logger)
+			return 0, false
+		} else {
+			client.Warning("Push failed but ignored: %s|msgCode=PUSH_ERROR", err.Error())
+		}
+	}
+	client.Info("Newmail notification sent|msgCode=PUSH_SENT")
+	return 0, true
+}
+
+// rearm defers the next poll of an IMAP session, after new mail. It returns false if the session
+// is done.
+func (client *MailClientContext) rearm(rearmingCount *int, rearmTimeout time.Duration) bool {
+	if client.Protocol != MailClientIMAP || *rearmingCount >= 3 {
+		client.Info("Rearming count exceeded, stopping|rearmingCount=%d", *rearmingCount)
+		return false
+	}
+	*rearmingCount++
+	client.WaitBeforeUse = uint64(rearmTimeout) / uint64(time.Millisecond)
+	client.Info("Rearming poll|rearmingCount=%d|rearmTimeout=%s|msgCode=REARMED", *rearmingCount, rearmTimeout)
+	err := client.fsm.Event(FSMDeferred, MailClientStatusReDeferred)
+	if err != nil {
+		panic(err)
+	}
+	return true
+}
+
 func (client *MailClientContext) Action(action PingerCommand) error {
 	client.command <- action
 	return nil
@@ -547,8 +644,11 @@ type ClientSessionInfo struct {
 	ClientContext string
 	DeviceId      string
 	SessionId     string
+	Protocol      string
 	Status        MailClientStatus
 	Error         string
+	MailServer    string
+	ServerLimiter *HostLimiterInfo // state of the rate limiter and circuit breaker for MailServer
 }
 
 func (client *MailClientContext) sessionInfo() *ClientSessionInfo {
@@ -558,7 +658,10 @@ func (client *MailClientContext) sessionInfo() *ClientSessionInfo {
 		ClientContext: client.ClientContext,
 		DeviceId:      client.DeviceId,
 		SessionId:     client.sessionId,
+		Protocol:      client.Protocol,
 		Status:        status,
+		MailServer:    client.mailServer,
+		ServerLimiter: hostLimiters.info(client.mailServer),
 	}
 	if err != nil {
 		info.Error = err.Error()
@@ -566,6 +669,29 @@ func (client *MailClientContext) sessionInfo() *ClientSessionInfo {
 	return &info
 }
 
+// historyPush records the result of a push in the session history.
+func (client *MailClientContext) historyPush(what string, err error) {
+	if err != nil {
+		client.history.add(SessionEventPushFailed, "Could not send %s push: %s", what, err)
+	} else {
+		client.history.add(SessionEventPushSent, "Sent %s push", what)
+	}
+}
+
+// getSessionHistory returns the session and its recent events. Unlike getSessionInfo(), this also
+// works for sessions that have stopped, since that is usually when the history is interesting.
+func (client *MailClientContext) getSessionHistory() *ClientSessionHistory {
+	return &ClientSessionHistory{
+		Session: *client.sessionInfo(),
+		Events:  client.history.list(),
+	}
+}
+
+// getSessionId returns the id of the session, which the device's auth token was issued for.
+func (client *MailClientContext) getSessionId() string {
+	return client.sessionId
+}
+
 func (client *MailClientContext) getSessionInfo() (*ClientSessionInfo, error) {
 	switch {
 	case client.mailClient == nil:
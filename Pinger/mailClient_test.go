@@ -5,8 +5,11 @@ import (
 	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mailClientTester struct {
@@ -59,6 +62,9 @@ type testingMailClientContext struct {
 	logger    *Logging.Logger
 	status    MailClientStatus
 	lastError error
+	history   *ClientSessionHistory
+	session   *ClientSessionInfo
+	sessionId string
 }
 
 func (client *testingMailClientContext) stop() {
@@ -81,7 +87,13 @@ func (client *testingMailClientContext) Action(action PingerCommand) error {
 	return nil
 }
 func (client *testingMailClientContext) getSessionInfo() (*ClientSessionInfo, error) {
-	return nil, nil
+	return client.session, nil
+}
+func (client *testingMailClientContext) getSessionHistory() *ClientSessionHistory {
+	return client.history
+}
+func (client *testingMailClientContext) getSessionId() string {
+	return client.sessionId
 }
 
 func (s *mailClientTester) TestMailClient() {
@@ -89,7 +101,7 @@ func (s *mailClientTester) TestMailClient() {
 	pi.SessionId = s.sessionId
 	debug := true
 	doStats := false
-	client, err := NewMailClientContext(s.dbmap, s.aws, pi, debug, doStats, s.logger)
+	client, err := NewMailClientContext(newSqlStorage(s.dbmap), s.aws, pi, debug, doStats, s.logger)
 	s.Nil(client)
 	s.Error(err)
 	s.Equal("UserId can not be empty", err.Error())
@@ -105,7 +117,7 @@ func (s *mailClientTester) TestMailClient() {
 		PushToken:     s.testPushToken,
 		SessionId:     s.sessionId,
 	}
-	client, err = NewMailClientContext(s.dbmap, s.aws, pi, debug, doStats, s.logger)
+	client, err = NewMailClientContext(newSqlStorage(s.dbmap), s.aws, pi, debug, doStats, s.logger)
 	s.Nil(client)
 	s.Error(err)
 
@@ -121,7 +133,7 @@ func (s *mailClientTester) TestMailClient() {
 		Protocol:      "Foo",
 		SessionId:     s.sessionId,
 	}
-	client, err = NewMailClientContext(s.dbmap, s.aws, pi, debug, doStats, s.logger)
+	client, err = NewMailClientContext(newSqlStorage(s.dbmap), s.aws, pi, debug, doStats, s.logger)
 	s.Nil(client)
 	s.Error(err)
 
@@ -136,8 +148,118 @@ func (s *mailClientTester) TestMailClient() {
 		Protocol:      s.testProtocol,
 		SessionId:     s.sessionId,
 	}
-	client, err = NewMailClientContext(s.dbmap, s.aws, pi, debug, doStats, s.logger)
+	client, err = NewMailClientContext(newSqlStorage(s.dbmap), s.aws, pi, debug, doStats, s.logger)
 	s.NotNil(client)
 	s.NoError(err)
 	s.NotNil(client.mailClient)
 }
+
+// testMailClient reports new mail on its first long poll, and then waits to be stopped.
+type testMailClient struct {
+	polls int
+}
+
+func (m *testMailClient) LongPoll(stopPollCh, stopAllCh chan int, errCh chan error) {
+	m.polls++
+	if m.polls == 1 {
+		select {
+		case errCh <- LongPollNewMail:
+		case <-stopPollCh:
+		case <-stopAllCh:
+		}
+		return
+	}
+	select {
+	case <-stopPollCh:
+	case <-stopAllCh:
+	}
+}
+func (m *testMailClient) UpdateRequestData(requestData []byte) {
+	return
+}
+func (m *testMailClient) Cleanup() {
+	return
+}
+
+func (s *mailClientTester) TestDeferredPush() {
+	pi := &MailPingInformation{
+		UserId:         s.testUserId,
+		ClientContext:  s.testClientContext,
+		DeviceId:       "NCHOXdeferredpush",
+		Platform:       s.testPlatform,
+		PushService:    s.testPushService,
+		PushToken:      s.testPushToken,
+		Protocol:       s.testProtocol,
+		SessionId:      "deferredpush",
+		WaitBeforeUse:  10,
+		MaxPollTimeout: 60000,
+	}
+	// NewMailClientContext, without the real mail client, and without starting the session
+	di, err := pi.newDeviceInfo(newSqlStorage(s.dbmap).deviceInfo(), s.aws, s.logger)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), di.validateClient())
+	di.AWSEndpointArn = "arn:aws:sns:us-west-2:1234:endpoint/APNS/pinger/1"
+	client := &MailClientContext{
+		logger:         s.logger.WithFields(pi.logFields()...),
+		stopAllCh:      make(chan int),
+		command:        make(chan PingerCommand, 10),
+		status:         MailClientStatusInitialized,
+		UserId:         pi.UserId,
+		ClientContext:  pi.ClientContext,
+		DeviceId:       pi.DeviceId,
+		Protocol:       pi.Protocol,
+		WaitBeforeUse:  pi.WaitBeforeUse,
+		MaxPollTimeout: pi.MaxPollTimeout,
+		sessionId:      pi.SessionId,
+		history:        newSessionHistory(0),
+		di:             di,
+		mailClient:     &testMailClient{},
+	}
+	require.NoError(s.T(), client.updateLastContact())
+
+	// the previous new mail push went out less than the minimum push interval ago
+	di.MinPushInterval = 1
+	dc, err := di.getContactInfoObj(false)
+	s.NoError(err)
+	dc.LastNewMailPush = time.Now().Add(-700 * time.Millisecond).UnixNano()
+	_, err = dc.db.update(dc)
+	s.NoError(err)
+	pushes := len(s.aws.SentPushMessages())
+
+	done := make(chan bool)
+	go func() {
+		client.start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.Fail("the session did not end")
+		client.Action(PingerStop)
+		<-done
+		return
+	}
+
+	status, err := client.Status()
+	s.NoError(err)
+	s.Equal(MailClientStatusStopped, status)
+	s.Len(s.aws.SentPushMessages(), pushes+1)
+	events := make([]string, 0)
+	for _, event := range client.history.list() {
+		switch event.Type {
+		case SessionEventTransition:
+			events = append(events, event.Message[:strings.Index(event.Message, " (")])
+		case SessionEventPushDeferred, SessionEventPushSent:
+			events = append(events, string(event.Type))
+		}
+	}
+	s.Equal([]string{
+		"init -> deferred",
+		"deferred -> pinging",
+		"push-deferred",
+		"pinging -> stopped",
+		"stopped -> deferred",
+		"deferred -> stopped",
+		"push-sent",
+	}, events)
+}
@@ -34,6 +34,8 @@ type MailPingInformation struct {
 	AppBuildVersion        string
 	AppBuildNumber         string
 	SessionId              string
+	AppId                  string // the app (tenant) the device runs. Empty for the default
+	Notifications          NotificationPreferences
 	IMAPAuthenticationBlob string
 	IMAPFolderName         string
 	IMAPSupportsIdle       bool
@@ -41,20 +43,22 @@ type MailPingInformation struct {
 	IMAPEXISTSCount        uint32
 	IMAPUIDNEXT            uint32
 	ASIsSyncRequest        bool
+	MailServerCertificate  string // optional PEM cert of the mail server, which the device vouched for
 
 	logPrefix string
+	traceId   string // the trace id of the request that started the session. Set by RPCStartPoll
 }
 
 func (pi *MailPingInformation) String() string {
 	redactedUri := strings.Split(pi.MailServerUrl, "?")[0]
 	return fmt.Sprintf("UserId=%s|ClientContext=%s|DeviceId=%s|Platform=%s|MailServerUrl=%s|"+
 		"Protocol=%s|ResponseTimeout=%d|WaitBeforeUse=%d|PushToken=%s|PushServer=%s|MaxPollTimeout=%d|"+
-		"OSVersion=%s|AppBuildVersion=%s|AppBuildNumber=%s|SessionId=%s|IMAPFolderName=%s|IMAPSupportsIdle=%t|"+
-		"IMAPSupportsExpunge=%t|IMAPEXISTSCount=%d|IMAPUIDNEXT=%d|ASIsSyncRequest=%t",
+		"OSVersion=%s|AppBuildVersion=%s|AppBuildNumber=%s|SessionId=%s|AppId=%s|IMAPFolderName=%s|IMAPSupportsIdle=%t|"+
+		"IMAPSupportsExpunge=%t|IMAPEXISTSCount=%d|IMAPUIDNEXT=%d|ASIsSyncRequest=%t|Notifications=%+v",
 		pi.UserId, pi.ClientContext, pi.DeviceId, pi.Platform, redactedUri, pi.Protocol,
 		pi.ResponseTimeout, pi.WaitBeforeUse, pi.PushToken, pi.PushService, pi.MaxPollTimeout, pi.OSVersion,
-		pi.AppBuildVersion, pi.AppBuildNumber, pi.SessionId, pi.IMAPFolderName, pi.IMAPSupportsIdle,
-		pi.IMAPSupportsExpunge, pi.IMAPEXISTSCount, pi.IMAPUIDNEXT, pi.ASIsSyncRequest)
+		pi.AppBuildVersion, pi.AppBuildNumber, pi.SessionId, pi.AppId, pi.IMAPFolderName, pi.IMAPSupportsIdle,
+		pi.IMAPSupportsExpunge, pi.IMAPEXISTSCount, pi.IMAPUIDNEXT, pi.ASIsSyncRequest, pi.Notifications)
 }
 
 func (pi *MailPingInformation) cleanup() {
@@ -81,6 +85,8 @@ func (pi *MailPingInformation) cleanup() {
 	pi.OSVersion = ""
 	pi.AppBuildNumber = ""
 	pi.AppBuildVersion = ""
+	pi.AppId = ""
+	pi.Notifications = NotificationPreferences{}
 	pi.IMAPAuthenticationBlob = ""
 	pi.IMAPFolderName = ""
 	pi.IMAPSupportsIdle = false
@@ -88,6 +94,7 @@ func (pi *MailPingInformation) cleanup() {
 	pi.IMAPEXISTSCount = 0
 	pi.IMAPUIDNEXT = 0
 	pi.ASIsSyncRequest = false
+	pi.MailServerCertificate = ""
 }
 
 // Validate validate the structure/information to make sure required information exists.
@@ -97,6 +104,14 @@ func (pi *MailPingInformation) Validate() bool {
 	if pi.UserId == "" || pi.MailServerUrl == "" {
 		return false
 	}
+	if pi.MailServerCertificate != "" {
+		if _, err := parseDeviceCert(pi.MailServerCertificate); err != nil {
+			return false
+		}
+	}
+	if err := pi.Notifications.Validate(); err != nil {
+		return false
+	}
 	switch {
 	case pi.Protocol == MailClientActiveSync:
 		if len(pi.RequestData) <= 0 || len(pi.HttpHeaders) <= 0 {
@@ -115,6 +130,20 @@ func (pi *MailPingInformation) Validate() bool {
 	return true
 }
 
+// logFields are the fields identifying the session in log messages.
+func (pi *MailPingInformation) logFields() []Logging.Field {
+	fields := []Logging.Field{
+		Logging.String("device", pi.DeviceId),
+		Logging.String("client", pi.UserId),
+		Logging.String("context", pi.ClientContext),
+		Logging.String("session", pi.SessionId),
+	}
+	if pi.traceId != "" {
+		fields = append(fields, Logging.String(traceIdLogKey, pi.traceId))
+	}
+	return fields
+}
+
 func (pi *MailPingInformation) getLogPrefix() string {
 	if pi == nil {
 		panic("pi has been cleaned up or not initialized")
@@ -128,6 +157,8 @@ func (pi *MailPingInformation) getLogPrefix() string {
 
 func (pi *MailPingInformation) newDeviceInfo(db DeviceInfoDbHandler, aws AWS.AWSHandler, logger *Logging.Logger) (*DeviceInfo, error) {
 	var err error
+	// so the pushes can be traced back to the request, too
+	logger = TraceLogger(logger, pi.traceId)
 	di, err := getDeviceInfo(db, aws, pi.UserId, pi.ClientContext, pi.DeviceId, pi.SessionId, logger)
 	if err != nil {
 		return nil, err
@@ -153,12 +184,14 @@ func (pi *MailPingInformation) newDeviceInfo(db DeviceInfoDbHandler, aws AWS.AWS
 		if di == nil {
 			return nil, fmt.Errorf("Could not create DeviceInfo")
 		}
+		di.AppId = pi.AppId
+		di.setNotificationPreferences(&pi.Notifications)
 		err = db.insert(di)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		_, err := di.updateDeviceInfo(pi.PushService, pi.PushToken, pi.Platform, pi.OSVersion, pi.AppBuildVersion, pi.AppBuildNumber)
+		_, err := di.updateDeviceInfo(pi.AppId, pi.PushService, pi.PushToken, pi.Platform, pi.OSVersion, pi.AppBuildVersion, pi.AppBuildNumber, &pi.Notifications)
 		if err != nil {
 			return nil, err
 		}
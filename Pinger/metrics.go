@@ -0,0 +1,80 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/Metrics"
+	"net/http"
+)
+
+// mailServerBuckets are the histogram buckets for the mail server response times. Pings and
+// IDLEs are long-polls, so these go up to the max heartbeat.
+var mailServerBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 900, 1800, 3600}
+
+// pushBuckets are the histogram buckets for the push latencies. Pushes to devices that are
+// offline arrive when the devices are back, so these go up to the ack timeout.
+var pushBuckets = []float64{.25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+var (
+	metricFSMTransitions    *Metrics.CounterVec
+	metricMailServerLatency *Metrics.HistogramVec
+	metricPushes            *Metrics.CounterVec
+	metricRPCServerLatency  *Metrics.HistogramVec
+	metricRPCClientLatency  *Metrics.HistogramVec
+	metricJanitorDeletes    *Metrics.CounterVec
+
+	metricPushMailLatency     *Metrics.HistogramVec
+	metricPushDeliveryLatency *Metrics.HistogramVec
+	metricPushEndToEndLatency *Metrics.HistogramVec
+	metricPushReceipts        *Metrics.CounterVec
+)
+
+func init() {
+	metricFSMTransitions = Metrics.NewCounterVec("pinger_fsm_transitions_total",
+		"Mail client state machine transitions.", "from", "to")
+	metricMailServerLatency = Metrics.NewHistogramVec("pinger_mail_server_response_seconds",
+		"Time until the mail server responded to a request.", mailServerBuckets, "protocol")
+	metricPushes = Metrics.NewCounterVec("pinger_pushes_total",
+		"Push notifications sent, by push service and result (sent or failed).", "service", "result")
+	metricRPCServerLatency = Metrics.NewHistogramVec("pinger_rpc_server_duration_seconds",
+		"Time the backend took to handle an RPC call.", Metrics.DefaultBuckets, "method")
+	metricRPCClientLatency = Metrics.NewHistogramVec("pinger_rpc_client_duration_seconds",
+		"Time an RPC call to the backend took, as seen by the caller.", Metrics.DefaultBuckets, "method")
+	metricJanitorDeletes = Metrics.NewCounterVec("pinger_janitor_deleted_total",
+		"Expired devices, and their contact records and SNS endpoints, deleted by the device janitor.", "kind")
+	metricPushMailLatency = Metrics.NewHistogramVec("pinger_push_mail_latency_seconds",
+		"Time from noticing new mail to sending the push, by push service and platform.", pushBuckets, "service", "platform")
+	metricPushDeliveryLatency = Metrics.NewHistogramVec("pinger_push_delivery_seconds",
+		"Time from sending a push to the device getting it, for the pushes the device acknowledged.", pushBuckets, "service", "platform")
+	metricPushEndToEndLatency = Metrics.NewHistogramVec("pinger_push_end_to_end_seconds",
+		"Time from noticing new mail to the device getting the push, for the pushes the device acknowledged.", pushBuckets, "service", "platform")
+	metricPushReceipts = Metrics.NewCounterVec("pinger_push_receipts_total",
+		"Pushes the device acknowledged (acked), or did not in time (lost), by push service and platform.", "service", "platform", "result")
+	Metrics.NewGaugeFunc("pinger_mail_clients",
+		"Mail client contexts in the poll map, by protocol and status.", []string{"protocol", "status"},
+		collectMailClientMetrics)
+}
+
+// collectMailClientMetrics counts the sessions in the poll map by protocol and status.
+func collectMailClientMetrics(set func(float64, ...string)) {
+	if pollingServer == nil {
+		return
+	}
+	pollingServer.LockMap()
+	defer pollingServer.UnlockMap()
+	for _, client := range pollingServer.pollMap {
+		if client == nil {
+			continue
+		}
+		protocol := "unknown"
+		info, err := client.getSessionInfo()
+		if err == nil {
+			protocol = info.Protocol
+		}
+		status, _ := client.Status()
+		set(1, protocol, status.String())
+	}
+}
+
+// MetricsHandler returns the http.Handler for the /metrics endpoint.
+func MetricsHandler() http.Handler {
+	return Metrics.Handler()
+}
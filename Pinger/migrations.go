@@ -0,0 +1,266 @@
+package Pinger
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"sync"
+	"time"
+)
+
+// The schema of the DB is versioned. Each migration brings it from the previous version to its own,
+// and the versions that were applied are recorded in the schema_version table. A DB created by gorp's
+// CreateTablesIfNotExists, before there were migrations, has no schema_version table, and is at
+// version 0.
+//
+// Never change a migration that was released. To change the schema, e.g. to add a column to DeviceInfo,
+// add a migration to the end of schemaMigrations, with the SQL for sqlite, MySQL and postgres.
+//
+// Every backend migrates the DB on startup, and pingers share the DB, so the migrations run under a
+// lock: GET_LOCK on MySQL, an advisory lock on postgres. A sqlite DB is only used by one pinger.
+
+const schemaVersionTableName = "schema_version"
+
+// schemaLockName is the name of the MySQL lock, and schemaLockId the key of the postgres advisory lock,
+// that serialize the migrations.
+const (
+	schemaLockName = "pinger_schema_migration"
+	schemaLockId   = 0x70696e676572 // "pinger"
+)
+
+// schemaLockTimeout is how long we wait for another pinger to finish migrating the DB.
+const schemaLockTimeout = 5 * time.Minute
+
+// sqliteSchemaMutex serializes the migrations of sqlite DB's, within this process.
+var sqliteSchemaMutex sync.Mutex
+
+type schemaMigration struct {
+	version     int
+	description string
+	sqlite      []string
+	mysql       []string
+	postgres    []string
+}
+
+var schemaMigrations = []schemaMigration{
+	{
+		version:     1,
+		description: "device_info, device_contact and pinger_info",
+		// the tables as gorp created them. 'if not exists', so existing DB's start here, too.
+		sqlite: []string{
+			`create table if not exists "device_info" ("id" integer, "created" integer not null, "updated" integer not null, "user_id" varchar(255) not null, "client_context" varchar(255) not null, "device_id" varchar(255) not null, "session_id" varchar(255) not null, "device_platform" varchar(255) not null, "push_token" varchar(255) not null, "push_service" varchar(255) not null, "os_version" varchar(255), "build_version" varchar(255), "build_number" varchar(255), "aws_endpoint_arn" varchar(255), "pinger" varchar(255) not null, primary key ("user_id", "client_context", "device_id", "session_id"))`,
+			`create table if not exists "device_contact" ("id" integer, "created" integer not null, "updated" integer not null, "last_contact" integer not null, "last_contact_request" integer, "user_id" varchar(255) not null, "client_context" varchar(255) not null, "device_id" varchar(255) not null, primary key ("user_id", "client_context", "device_id"))`,
+			`create table if not exists "pinger_info" ("id" integer, "pinger" varchar(255) not null primary key unique, "created" integer not null, "updated" integer not null)`,
+		},
+		mysql: []string{
+			"create table if not exists `device_info` (`id` bigint, `created` bigint not null, `updated` bigint not null, `user_id` varchar(255) not null, `client_context` varchar(255) not null, `device_id` varchar(255) not null, `session_id` varchar(255) not null, `device_platform` varchar(255) not null, `push_token` varchar(255) not null, `push_service` varchar(255) not null, `os_version` varchar(255), `build_version` varchar(255), `build_number` varchar(255), `aws_endpoint_arn` varchar(255), `pinger` varchar(255) not null, primary key (`user_id`, `client_context`, `device_id`, `session_id`)) engine=InnoDB charset=UTF8",
+			"create table if not exists `device_contact` (`id` bigint, `created` bigint not null, `updated` bigint not null, `last_contact` bigint not null, `last_contact_request` bigint, `user_id` varchar(255) not null, `client_context` varchar(255) not null, `device_id` varchar(255) not null, primary key (`user_id`, `client_context`, `device_id`)) engine=InnoDB charset=UTF8",
+			"create table if not exists `pinger_info` (`id` bigint, `pinger` varchar(255) not null primary key unique, `created` bigint not null, `updated` bigint not null) engine=InnoDB charset=UTF8",
+		},
+		postgres: []string{
+			`create table if not exists "device_info" ("id" bigint, "created" bigint not null, "updated" bigint not null, "user_id" text not null, "client_context" text not null, "device_id" text not null, "session_id" text not null, "device_platform" text not null, "push_token" text not null, "push_service" text not null, "os_version" text, "build_version" text, "build_number" text, "aws_endpoint_arn" text, "pinger" text not null, primary key ("user_id", "client_context", "device_id", "session_id"))`,
+			`create table if not exists "device_contact" ("id" bigint, "created" bigint not null, "updated" bigint not null, "last_contact" bigint not null, "last_contact_request" bigint, "user_id" text not null, "client_context" text not null, "device_id" text not null, primary key ("user_id", "client_context", "device_id"))`,
+			`create table if not exists "pinger_info" ("id" bigint, "pinger" text not null primary key unique, "created" bigint not null, "updated" bigint not null)`,
+		},
+	},
+	{
+		version:     2,
+		description: "index device_info by pinger, for the re-register pushes on startup",
+		sqlite:      []string{`create index "device_info_pinger" on "device_info" ("pinger")`},
+		mysql:       []string{"create index `device_info_pinger` on `device_info` (`pinger`)"},
+		postgres:    []string{`create index "device_info_pinger" on "device_info" ("pinger")`},
+	},
+	{
+		version:     3,
+		description: "device_info.app_id, for the apps with their own push credentials",
+		sqlite:      []string{`alter table "device_info" add column "app_id" varchar(255) not null default ''`},
+		mysql:       []string{"alter table `device_info` add column `app_id` varchar(255) not null default ''"},
+		postgres:    []string{`alter table "device_info" add column "app_id" text not null default ''`},
+	},
+	{
+		version:     4,
+		description: "device_info notification preferences",
+		sqlite: []string{
+			`alter table "device_info" add column "time_zone" varchar(255) not null default ''`,
+			`alter table "device_info" add column "quiet_hours_start" varchar(255) not null default ''`,
+			`alter table "device_info" add column "quiet_hours_end" varchar(255) not null default ''`,
+			`alter table "device_info" add column "push_style" varchar(255) not null default ''`,
+			`alter table "device_info" add column "min_push_interval" integer not null default 0`,
+		},
+		mysql: []string{
+			"alter table `device_info` add column `time_zone` varchar(255) not null default ''",
+			"alter table `device_info` add column `quiet_hours_start` varchar(255) not null default ''",
+			"alter table `device_info` add column `quiet_hours_end` varchar(255) not null default ''",
+			"alter table `device_info` add column `push_style` varchar(255) not null default ''",
+			"alter table `device_info` add column `min_push_interval` bigint not null default 0",
+		},
+		postgres: []string{
+			`alter table "device_info" add column "time_zone" text not null default ''`,
+			`alter table "device_info" add column "quiet_hours_start" text not null default ''`,
+			`alter table "device_info" add column "quiet_hours_end" text not null default ''`,
+			`alter table "device_info" add column "push_style" text not null default ''`,
+			`alter table "device_info" add column "min_push_interval" bigint not null default 0`,
+		},
+	},
+	{
+		version:     5,
+		description: "device_contact.last_new_mail_push, for the minimum push interval",
+		sqlite:      []string{`alter table "device_contact" add column "last_new_mail_push" integer not null default 0`},
+		mysql:       []string{"alter table `device_contact` add column `last_new_mail_push` bigint not null default 0"},
+		postgres:    []string{`alter table "device_contact" add column "last_new_mail_push" bigint not null default 0`},
+	},
+}
+
+// schemaHead is the version of the schema this code expects.
+func schemaHead() int {
+	return schemaMigrations[len(schemaMigrations)-1].version
+}
+
+func (m *schemaMigration) statements(dbmap *gorp.DbMap) ([]string, error) {
+	switch dbmap.Dialect.(type) {
+	case gorp.SqliteDialect:
+		return m.sqlite, nil
+	case gorp.MySQLDialect:
+		return m.mysql, nil
+	case gorp.PostgresDialect:
+		return m.postgres, nil
+	}
+	return nil, fmt.Errorf("No migrations for DB dialect %T", dbmap.Dialect)
+}
+
+func createSchemaVersionTable(dbmap *gorp.DbMap) error {
+	_, err := dbmap.Exec(fmt.Sprintf("create table if not exists %s (version integer not null primary key, description varchar(255) not null, applied bigint not null)",
+		dbmap.Dialect.QuotedTableForQuery("", schemaVersionTableName)))
+	return err
+}
+
+// schemaVersion returns the version of the schema of the DB. 0 if it has none.
+func schemaVersion(dbmap *gorp.DbMap) (int, error) {
+	err := createSchemaVersionTable(dbmap)
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = dbmap.Db.QueryRow(fmt.Sprintf("select max(version) from %s", dbmap.Dialect.QuotedTableForQuery("", schemaVersionTableName))).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// lockSchema takes the lock that keeps other pingers from migrating the DB at the same time, and
+// returns the function that releases it.
+func lockSchema(dbmap *gorp.DbMap) (func(), error) {
+	switch dbmap.Dialect.(type) {
+	case gorp.SqliteDialect:
+		sqliteSchemaMutex.Lock()
+		return sqliteSchemaMutex.Unlock, nil
+	case gorp.MySQLDialect, gorp.PostgresDialect:
+	default:
+		return nil, fmt.Errorf("No schema lock for DB dialect %T", dbmap.Dialect)
+	}
+	// the lock belongs to the DB session, so it has to be taken and released on the same connection.
+	ctx, cancel := context.WithTimeout(context.Background(), schemaLockTimeout)
+	defer cancel()
+	conn, err := dbmap.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var unlockQuery string
+	var unlockArg interface{}
+	if _, ok := dbmap.Dialect.(gorp.PostgresDialect); ok {
+		// waits until the lock is free, or the context times out.
+		_, err = conn.ExecContext(ctx, "select pg_advisory_lock($1)", schemaLockId)
+		unlockQuery, unlockArg = "select pg_advisory_unlock($1)", schemaLockId
+	} else {
+		// 1 if we got the lock, 0 if it timed out, NULL on error.
+		var locked sql.NullInt64
+		err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", schemaLockName, int(schemaLockTimeout.Seconds())).Scan(&locked)
+		if err == nil && locked.Int64 != 1 {
+			err = fmt.Errorf("Timed out after %s waiting for another pinger to migrate the DB", schemaLockTimeout)
+		}
+		unlockQuery, unlockArg = "select release_lock(?)", schemaLockName
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		conn.ExecContext(context.Background(), unlockQuery, unlockArg)
+		conn.Close()
+	}, nil
+}
+
+// migrateDB brings the schema of the DB up to schemaHead(), and returns the versions it was and is at.
+func migrateDB(dbmap *gorp.DbMap, logger *Logging.Logger) (int, int, error) {
+	unlock, err := lockSchema(dbmap)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not lock the DB schema: %s", err)
+	}
+	defer unlock()
+	// read the version with the lock held, so we don't redo what another pinger just did.
+	from, err := schemaVersion(dbmap)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not read the schema version: %s", err)
+	}
+	if from > schemaHead() {
+		// a newer pinger migrated the DB. Hopefully the change was backwards compatible.
+		logger.Warning("DB schema version %d is newer than %d|msgCode=DB_SCHEMA_NEWER", from, schemaHead())
+		return from, from, nil
+	}
+	version := from
+	for i := range schemaMigrations {
+		migration := &schemaMigrations[i]
+		if migration.version <= version {
+			continue
+		}
+		err = applyMigration(dbmap, migration)
+		if err != nil {
+			return from, version, fmt.Errorf("Migration to version %d (%s) failed: %s", migration.version, migration.description, err)
+		}
+		logger.Info("Migrated the DB schema to version %d (%s)|msgCode=DB_MIGRATED", migration.version, migration.description)
+		version = migration.version
+	}
+	return from, version, nil
+}
+
+// applyMigration applies the migration in a transaction. MySQL commits DDL statements right away, so
+// there, a failed migration may be partially applied, and needs fixing by hand.
+func applyMigration(dbmap *gorp.DbMap, migration *schemaMigration) error {
+	statements, err := migration.statements(dbmap)
+	if err != nil {
+		return err
+	}
+	tx, err := dbmap.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf("insert into %s (version, description, applied) values (%s, %s, %s)",
+		dbmap.Dialect.QuotedTableForQuery("", schemaVersionTableName),
+		dbmap.Dialect.BindVar(0), dbmap.Dialect.BindVar(1), dbmap.Dialect.BindVar(2)),
+		migration.version, migration.description, time.Now().UnixNano())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateDB connects to the DB and brings its schema up to date. It returns the versions it was and is at.
+func MigrateDB(dbconfig *DBConfiguration, logger *Logging.Logger) (int, int, error) {
+	dbmap, err := initDB(dbconfig, false, logger)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dbmap.Db.Close()
+	return migrateDB(dbmap, logger)
+}
@@ -0,0 +1,206 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type migrationsTester struct {
+	suite.Suite
+	logger *Logging.Logger
+	dir    string
+	dbmap  *gorp.DbMap
+}
+
+func TestMigrations(t *testing.T) {
+	s := new(migrationsTester)
+	suite.Run(t, s)
+}
+
+func (s *migrationsTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *migrationsTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "migrationstest")
+	s.NoError(err)
+	dbconfig := DBConfiguration{Type: "sqlite", Filename: path.Join(s.dir, "pinger.db")}
+	s.dbmap, err = initDB(&dbconfig, false, s.logger)
+	s.NoError(err)
+}
+
+func (s *migrationsTester) TearDownTest() {
+	s.dbmap.Db.Close()
+	os.RemoveAll(s.dir)
+}
+
+// sqliteColumns returns the columns of the table in the DB.
+func (s *migrationsTester) sqliteColumns(table string) map[string]bool {
+	rows, err := s.dbmap.Db.Query(fmt.Sprintf("pragma table_info(%s)", table))
+	s.NoError(err)
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt interface{}
+		s.NoError(rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk))
+		columns[name] = true
+	}
+	return columns
+}
+
+// checkSchema checks that every column gorp maps is in the DB, so a new field can't be added
+// without a migration.
+func (s *migrationsTester) checkSchema() {
+	for _, t := range []interface{}{DeviceInfo{}, deviceContact{}, PingerInfo{}} {
+		table, err := s.dbmap.TableFor(reflect.TypeOf(t), false)
+		s.NoError(err)
+		columns := s.sqliteColumns(table.TableName)
+		for _, col := range table.Columns {
+			if !col.Transient {
+				s.True(columns[col.ColumnName], fmt.Sprintf("%s.%s has no migration", table.TableName, col.ColumnName))
+			}
+		}
+	}
+}
+
+func (s *migrationsTester) TestMigrateEmpty() {
+	version, err := schemaVersion(s.dbmap)
+	s.NoError(err)
+	s.Equal(0, version)
+
+	from, to, err := migrateDB(s.dbmap, s.logger)
+	s.NoError(err)
+	s.Equal(0, from)
+	s.Equal(schemaHead(), to)
+	s.checkSchema()
+
+	var count int
+	s.NoError(s.dbmap.Db.QueryRow("select count(*) from sqlite_master where type='index' and name='device_info_pinger'").Scan(&count))
+	s.Equal(1, count)
+	s.NoError(s.dbmap.Db.QueryRow("select count(*) from schema_version").Scan(&count))
+	s.Equal(len(schemaMigrations), count)
+
+	// nothing to do the second time
+	from, to, err = migrateDB(s.dbmap, s.logger)
+	s.NoError(err)
+	s.Equal(schemaHead(), from)
+	s.Equal(schemaHead(), to)
+
+	// and the tables work
+	pinger := PingerInfo{Pinger: "somepinger"}
+	s.NoError(s.dbmap.Insert(&pinger))
+}
+
+func (s *migrationsTester) TestMigrateUnversioned() {
+	// a DB from before there were migrations, with the tables as gorp created them then
+	for _, statement := range schemaMigrations[0].sqlite {
+		_, err := s.dbmap.Exec(statement)
+		s.NoError(err)
+	}
+	pinger := PingerInfo{Pinger: "somepinger"}
+	s.NoError(s.dbmap.Insert(&pinger))
+
+	from, to, err := migrateDB(s.dbmap, s.logger)
+	s.NoError(err)
+	s.Equal(0, from)
+	s.Equal(schemaHead(), to)
+	s.checkSchema()
+
+	var count int
+	s.NoError(s.dbmap.Db.QueryRow("select count(*) from pinger_info").Scan(&count))
+	s.Equal(1, count)
+}
+
+func (s *migrationsTester) TestFailedMigration() {
+	migrations := schemaMigrations
+	defer func() { schemaMigrations = migrations }()
+	schemaMigrations = append(append([]schemaMigration{}, migrations...), schemaMigration{
+		version:     schemaHead() + 1,
+		description: "broken",
+		sqlite:      []string{`alter table "pinger_info" add column "foo" integer`, `alter table "no_such_table" add column "bar" integer`},
+	})
+
+	from, to, err := migrateDB(s.dbmap, s.logger)
+	s.Error(err)
+	s.Equal(0, from)
+	s.Equal(migrations[len(migrations)-1].version, to)
+	version, err := schemaVersion(s.dbmap)
+	s.NoError(err)
+	s.Equal(to, version)
+	// sqlite rolls back the whole migration
+	s.False(s.sqliteColumns("pinger_info")["foo"])
+}
+
+func (s *migrationsTester) TestAllDialects() {
+	version := 0
+	for _, migration := range schemaMigrations {
+		s.True(migration.version > version, "migrations have to be in order")
+		version = migration.version
+		for _, dialect := range []gorp.Dialect{gorp.SqliteDialect{}, gorp.MySQLDialect{}, gorp.PostgresDialect{}} {
+			statements, err := migration.statements(&gorp.DbMap{Dialect: dialect})
+			s.NoError(err)
+			s.NotEmpty(statements, fmt.Sprintf("version %d has no %T statements", migration.version, dialect))
+		}
+	}
+}
+
+func (s *migrationsTester) TestConcurrentMigrations() {
+	// several backends starting at the same time, on the same DB
+	const backends = 4
+	errs := make(chan error, backends)
+	for i := 0; i < backends; i++ {
+		dbconfig := DBConfiguration{Type: "sqlite", Filename: path.Join(s.dir, "pinger.db")}
+		dbmap, err := initDB(&dbconfig, false, s.logger)
+		s.NoError(err)
+		defer dbmap.Db.Close()
+		go func() {
+			_, _, err := migrateDB(dbmap, s.logger)
+			errs <- err
+		}()
+	}
+	for i := 0; i < backends; i++ {
+		select {
+		case err := <-errs:
+			s.NoError(err)
+		case <-time.After(30 * time.Second):
+			s.Fail("the migrations are stuck")
+			return
+		}
+	}
+	var count int
+	s.NoError(s.dbmap.Db.QueryRow("select count(*) from schema_version").Scan(&count))
+	s.Equal(len(schemaMigrations), count)
+	s.checkSchema()
+}
+
+func (s *migrationsTester) TestLockSchema() {
+	unlock, err := lockSchema(s.dbmap)
+	s.NoError(err)
+	done := make(chan bool)
+	go func() {
+		_, _, err := migrateDB(s.dbmap, s.logger)
+		s.NoError(err)
+		done <- true
+	}()
+	select {
+	case <-done:
+		s.Fail("migrated without the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-done
+
+	_, err = lockSchema(&gorp.DbMap{Dialect: gorp.SqlServerDialect{}})
+	s.Error(err)
+}
@@ -0,0 +1,117 @@
+package Pinger
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	PushStyleAlert  = "alert"  // alert and sound, if the app has them
+	PushStyleSilent = "silent" // content-available only
+
+	// MaxMinPushInterval is the longest MinPushInterval, in seconds, so new mail is pushed at least once a day.
+	MaxMinPushInterval int64 = 24 * 60 * 60
+)
+
+// NotificationPreferences are how the device wants to be told about new mail. They only change the
+// new mail pushes: during the quiet hours, and for the silent push style, these go out without alert
+// and sound, and if one would follow the previous push to the client context within the minimum
+// interval, it is held back until the interval is over.
+type NotificationPreferences struct {
+	TimeZone        string // IANA name of the device's time zone, e.g. "Europe/Berlin". Empty for UTC
+	QuietHoursStart string // "HH:MM", in the device's time zone. Empty for no quiet hours
+	QuietHoursEnd   string // "HH:MM". Before the start for quiet hours over midnight
+	PushStyle       string // PushStyleAlert, PushStyleSilent, or empty for alert
+	MinPushInterval int64  // minimum seconds between new mail pushes. 0 for no minimum, at most MaxMinPushInterval
+}
+
+// Validate checks the preferences.
+func (prefs *NotificationPreferences) Validate() error {
+	if _, err := time.LoadLocation(prefs.TimeZone); err != nil {
+		return fmt.Errorf("TimeZone %s is not known", prefs.TimeZone)
+	}
+	if (prefs.QuietHoursStart == "") != (prefs.QuietHoursEnd == "") {
+		return fmt.Errorf("QuietHoursStart and QuietHoursEnd go together")
+	}
+	if prefs.QuietHoursStart != "" {
+		if _, err := parseTimeOfDay(prefs.QuietHoursStart); err != nil {
+			return fmt.Errorf("QuietHoursStart: %s", err)
+		}
+		if _, err := parseTimeOfDay(prefs.QuietHoursEnd); err != nil {
+			return fmt.Errorf("QuietHoursEnd: %s", err)
+		}
+	}
+	switch prefs.PushStyle {
+	case "", PushStyleAlert, PushStyleSilent:
+	default:
+		return fmt.Errorf("PushStyle %s is not known", prefs.PushStyle)
+	}
+	if prefs.MinPushInterval < 0 {
+		return fmt.Errorf("MinPushInterval can not be negative")
+	}
+	if prefs.MinPushInterval > MaxMinPushInterval {
+		return fmt.Errorf("MinPushInterval can not be more than %d", MaxMinPushInterval)
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a "HH:MM" time.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// quietHours is true if now is in the quiet hours, which include their start, but not their end.
+func (prefs *NotificationPreferences) quietHours(now time.Time) bool {
+	if prefs.QuietHoursStart == "" {
+		return false
+	}
+	start, err := parseTimeOfDay(prefs.QuietHoursStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseTimeOfDay(prefs.QuietHoursEnd)
+	if err != nil {
+		return false
+	}
+	location, err := time.LoadLocation(prefs.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return start <= minute && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// silent is true if a new mail push sent now goes without alert and sound.
+func (prefs *NotificationPreferences) silent(now time.Time) bool {
+	return prefs.PushStyle == PushStyleSilent || prefs.quietHours(now)
+}
+
+// pushDelay is how much longer the minimum interval holds back a push, after the previous one,
+// sent at lastPush (unix nanoseconds, 0 for never).
+func (prefs *NotificationPreferences) pushDelay(lastPush int64, now time.Time) time.Duration {
+	if prefs.MinPushInterval <= 0 || lastPush == 0 {
+		return 0
+	}
+	next := time.Unix(0, lastPush).Add(time.Duration(prefs.MinPushInterval) * time.Second)
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// pushDeferredError is returned for a push held back by the device's notification preferences.
+type pushDeferredError struct {
+	wait time.Duration
+}
+
+func (e *pushDeferredError) Error() string {
+	return fmt.Sprintf("Push deferred for %s by the device's notification preferences", e.wait)
+}
@@ -0,0 +1,174 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+	"time"
+)
+
+type notificationPreferencesTester struct {
+	suite.Suite
+	logger *Logging.Logger
+}
+
+func (s *notificationPreferencesTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *notificationPreferencesTester) SetupTest() {
+	globals = nil
+	setGlobal(NewBackendConfiguration())
+}
+
+func (s *notificationPreferencesTester) TearDownTest() {
+	globals = nil
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	s := new(notificationPreferencesTester)
+	suite.Run(t, s)
+}
+
+func (s *notificationPreferencesTester) TestValidate() {
+	prefs := &NotificationPreferences{}
+	s.NoError(prefs.Validate())
+
+	prefs.TimeZone = "Mars/Olympus_Mons"
+	s.EqualError(prefs.Validate(), "TimeZone Mars/Olympus_Mons is not known")
+	prefs.TimeZone = "Europe/Berlin"
+	s.NoError(prefs.Validate())
+
+	prefs.QuietHoursStart = "22:00"
+	s.EqualError(prefs.Validate(), "QuietHoursStart and QuietHoursEnd go together")
+	prefs.QuietHoursEnd = "25:00"
+	s.EqualError(prefs.Validate(), "QuietHoursEnd: 25:00 is not a HH:MM time")
+	prefs.QuietHoursEnd = "07:30"
+	s.NoError(prefs.Validate())
+
+	prefs.PushStyle = "loud"
+	s.EqualError(prefs.Validate(), "PushStyle loud is not known")
+	prefs.PushStyle = PushStyleSilent
+	s.NoError(prefs.Validate())
+
+	prefs.MinPushInterval = -1
+	s.EqualError(prefs.Validate(), "MinPushInterval can not be negative")
+	prefs.MinPushInterval = MaxMinPushInterval
+	s.NoError(prefs.Validate())
+	prefs.MinPushInterval = MaxMinPushInterval + 1
+	s.EqualError(prefs.Validate(), "MinPushInterval can not be more than 86400")
+	prefs.MinPushInterval = 1 << 62
+	s.Error(prefs.Validate())
+}
+
+func (s *notificationPreferencesTester) TestQuietHours() {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2015, 6, 1, hour, minute, 0, 0, time.UTC)
+	}
+	prefs := &NotificationPreferences{}
+	s.False(prefs.quietHours(at(3, 0)))
+
+	prefs.QuietHoursStart = "12:00"
+	prefs.QuietHoursEnd = "14:00"
+	s.False(prefs.quietHours(at(11, 59)))
+	s.True(prefs.quietHours(at(12, 0)))
+	s.True(prefs.quietHours(at(13, 59)))
+	s.False(prefs.quietHours(at(14, 0)))
+
+	// over midnight, in a time zone 9 hours ahead of UTC
+	prefs.TimeZone = "Asia/Tokyo"
+	prefs.QuietHoursStart = "22:00"
+	prefs.QuietHoursEnd = "07:00"
+	s.False(prefs.quietHours(at(12, 59)))
+	s.True(prefs.quietHours(at(13, 0)))
+	s.True(prefs.quietHours(at(21, 59)))
+	s.False(prefs.quietHours(at(22, 0)))
+
+	s.True(prefs.silent(at(13, 0)))
+	s.False(prefs.silent(at(3, 0)))
+	prefs.PushStyle = PushStyleSilent
+	s.True(prefs.silent(at(3, 0)))
+}
+
+func (s *notificationPreferencesTester) TestPushDelay() {
+	now := time.Now()
+	prefs := &NotificationPreferences{}
+	s.Equal(time.Duration(0), prefs.pushDelay(now.UnixNano(), now))
+
+	prefs.MinPushInterval = 60
+	s.Equal(time.Duration(0), prefs.pushDelay(0, now))
+	s.Equal(45*time.Second, prefs.pushDelay(now.Add(-15*time.Second).UnixNano(), now))
+	s.Equal(time.Duration(0), prefs.pushDelay(now.Add(-time.Minute).UnixNano(), now))
+}
+
+func (s *notificationPreferencesTester) TestPush() {
+	aws := AWS.NewTestAwsHandler()
+	db, closeStorage := newTestStorage("memory", aws, s.logger)
+	defer closeStorage()
+
+	pushToken := "AEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEF"
+	di, err := newDeviceInfo("user1", "context1", "device1", pushToken, "APNS", "ios", "8.1", "0.9", "", "session1", aws, db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.AWSEndpointArn = "arn:aws:sns:us-west-2:1234:endpoint/APNS/pinger/1"
+	di.setNotificationPreferences(&NotificationPreferences{PushStyle: PushStyleSilent, MinPushInterval: 3600})
+	s.NoError(di.insert(nil))
+
+	// silent: no alert
+	s.NoError(di.PushNewMail(time.Now()))
+	require.Len(s.T(), aws.SentPushMessages(), 1)
+	s.False(strings.Contains(aws.SentPushMessages()[0], "You have mail"))
+
+	// too soon after the previous push
+	err = di.PushNewMail(time.Now())
+	deferred, ok := err.(*pushDeferredError)
+	require.True(s.T(), ok, "not a deferred push: %v", err)
+	s.True(deferred.wait > 59*time.Minute)
+	s.Len(aws.SentPushMessages(), 1)
+
+	// the interval is only for new mail
+	s.NoError(di.PushRegister())
+	require.Len(s.T(), aws.SentPushMessages(), 2)
+	s.True(strings.Contains(aws.SentPushMessages()[1], "Reregister"))
+
+	changed, err := di.updateDeviceInfo(di.AppId, di.PushService, di.PushToken, di.Platform, di.OSVersion, di.AppBuildVersion, di.AppBuildNumber, &NotificationPreferences{})
+	s.NoError(err)
+	s.True(changed)
+	stored, err := getDeviceInfo(db.deviceInfo(), aws, "user1", "context1", "device1", "session1", s.logger)
+	require.NoError(s.T(), err)
+	s.Equal("", stored.PushStyle)
+	s.Equal(int64(0), stored.MinPushInterval)
+
+	s.NoError(di.PushNewMail(time.Now()))
+	require.Len(s.T(), aws.SentPushMessages(), 3)
+	s.True(strings.Contains(aws.SentPushMessages()[2], "You have mail"))
+}
+
+func (s *notificationPreferencesTester) TestIntervalSinceNewMail() {
+	aws := AWS.NewTestAwsHandler()
+	db, closeStorage := newTestStorage("memory", aws, s.logger)
+	defer closeStorage()
+
+	pushToken := "AEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEF"
+	di, err := newDeviceInfo("user1", "context1", "device1", pushToken, "APNS", "ios", "8.1", "0.9", "", "session1", aws, db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.AWSEndpointArn = "arn:aws:sns:us-west-2:1234:endpoint/APNS/pinger/1"
+	di.setNotificationPreferences(&NotificationPreferences{MinPushInterval: 3600})
+	s.NoError(di.insert(nil))
+
+	// the last new mail push was long ago
+	s.NoError(di.PushNewMail(time.Now()))
+	dc, err := di.getContactInfoObj(false)
+	require.NoError(s.T(), err)
+	s.NotEqual(int64(0), dc.LastNewMailPush)
+	dc.LastNewMailPush = time.Now().Add(-2 * time.Hour).UnixNano()
+	_, err = dc.db.update(dc)
+	require.NoError(s.T(), err)
+
+	// a register push since then doesn't hold back the next new mail push
+	s.NoError(di.PushRegister())
+	s.NoError(di.PushNewMail(time.Now()))
+	s.Len(aws.SentPushMessages(), 3)
+}
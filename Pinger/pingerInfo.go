@@ -56,6 +56,12 @@ func (pinger *PingerInfo) UpdateEntry() error {
 	return nil
 }
 
+// beforeInsert sets the timestamps of a new pinger. The SQL handler calls it from the gorp hook.
+func (pinger *PingerInfo) beforeInsert() {
+	pinger.Created = time.Now().UnixNano()
+	pinger.Updated = pinger.Created
+}
+
 func (pinger *PingerInfo) update() (int64, error) {
 	if pinger.db == nil {
 		panic("Can not update pinger info without having fetched it")
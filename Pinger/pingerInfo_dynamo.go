@@ -1,120 +1,45 @@
 package Pinger
 
 import (
-	"fmt"
 	"github.com/nachocove/Pinger/Utils/AWS"
-	"time"
 )
 
 type PingerInfoDynamoDbHandler struct {
 	PingerInfoDbHandler
-	dynamo    *AWS.DynamoDb
+	storage   *dynamoStorage
 	tableName string
 }
 
-const (
-	dynamoPingerInfoTableName = "alpha.pinger.pinger_info"
-)
-
-func newPingerInfoDynamoDbHandler(aws AWS.AWSHandler) (*PingerInfoDynamoDbHandler, error) {
-	dynamo := aws.GetDynamoDbSession()
-	table, err := dynamo.DescribeTable(dynamoPingerInfoTableName)
-	if err != nil {
-		return nil, err
-	}
-	if table == nil {
-		createReq := dynamo.CreateTableReq(dynamoPingerInfoTableName,
-			[]AWS.DBAttrDefinition{
-				{Name: "pinger", Type: AWS.String},
-				{Name: "created", Type: AWS.Number},
-				{Name: "updated", Type: AWS.Number},
-			},
-			[]AWS.DBKeyType{
-				{Name: "pinger", Type: AWS.KeyTypeHash},
-			},
-			AWS.ThroughPut{Read: 10, Write: 10},
-		)
-		err := dynamo.CreateTable(createReq)
-		if err != nil {
-			return nil, err
-		}
-	}
+func newPingerInfoDynamoDbHandler(storage *dynamoStorage) *PingerInfoDynamoDbHandler {
 	return &PingerInfoDynamoDbHandler{
-		dynamo:    dynamo,
-		tableName: dynamoPingerInfoTableName,
-	}, nil
+		storage:   storage,
+		tableName: storage.tableName(PingerTableName),
+	}
 }
 
 func (h *PingerInfoDynamoDbHandler) get(keys []AWS.DBKeyValue) (*PingerInfo, error) {
-	dcMap, err := h.dynamo.Get(dynamoPingerInfoTableName, keys)
+	pingerMap, err := h.storage.dynamo.Get(h.tableName, keys)
 	if err != nil {
 		return nil, err
 	}
-	return fromPingerInfoMap(dcMap), nil
-}
-
-func fromPingerInfoMap(dcMap *map[string]interface{}) *PingerInfo {
-	pinger := PingerInfo{}
-	for k, v := range *dcMap {
-		switch v := v.(type) {
-		case string:
-			switch k {
-			case "pinger":
-				pinger.Pinger = v
-			}
-		case int64:
-			switch k {
-			case "created":
-				pinger.Created = v
-
-			case "updated":
-				pinger.Updated = v
-
-			case "id":
-				pinger.Id = v
-			}
-		case int:
-			switch k {
-			case "created":
-				pinger.Created = int64(v)
-
-			case "updated":
-				pinger.Updated = int64(v)
-
-			case "id":
-				pinger.Id = int64(v)
-			}
-		}
+	if pingerMap == nil {
+		return nil, nil
 	}
-	return &pinger
-}
-
-func (pinger *PingerInfo) toMap() map[string]interface{} {
-	pingerMap := make(map[string]interface{})
-	pingerMap["id"] = pinger.Id
-	pingerMap["pinger"] = pinger.Pinger
-	pingerMap["created"] = pinger.Created
-	pingerMap["updated"] = pinger.UpdateEntry
-	return pingerMap
+	pinger := PingerInfo{}
+	fromDynamoItem(*pingerMap, &pinger)
+	pinger.db = h
+	return &pinger, nil
 }
 
 func (h *PingerInfoDynamoDbHandler) insert(pinger *PingerInfo) error {
-	pinger.Created = time.Now().UnixNano()
-	pinger.Updated = pinger.Created
-	return h.dynamo.Insert(dynamoPingerInfoTableName, pinger.toMap())
+	pinger.beforeInsert()
+	return h.storage.insertItem(h.tableName, dynamoItem(pinger), "pinger")
 }
 
 func (h *PingerInfoDynamoDbHandler) update(pinger *PingerInfo) (int64, error) {
-	pinger.Updated = time.Now().UnixNano()
-	err := h.dynamo.Update(dynamoPingerInfoTableName, pinger.toMap())
-	if err != nil {
-		return 0, err
-	}
-	return 1, nil
+	return h.storage.updateItem(h.tableName, dynamoItem(pinger), "pinger")
 }
 
-func (h *PingerInfoDynamoDbHandler) delete(pinger *PingerInfo) error {
-	err := fmt.Errorf("Not implemented")
-	return err
-
+func (h *PingerInfoDynamoDbHandler) delete(pinger *PingerInfo) (int64, error) {
+	return h.storage.deleteItem(h.tableName, map[string]interface{}{"pinger": pinger.Pinger}, "pinger")
 }
@@ -0,0 +1,65 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+)
+
+type PingerInfoMemoryHandler struct {
+	PingerInfoDbHandler
+	storage *memoryStorage
+}
+
+func (h *PingerInfoMemoryHandler) stored(pinger *PingerInfo) PingerInfo {
+	stored := *pinger
+	stored.db = nil
+	stored.logger = nil
+	return stored
+}
+
+func (h *PingerInfoMemoryHandler) insert(pinger *PingerInfo) error {
+	pinger.beforeInsert()
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	if _, ok := h.storage.pingers[pinger.Pinger]; ok {
+		return fmt.Errorf("%s: %s already exists", PingerTableName, pinger.Pinger)
+	}
+	h.storage.pingers[pinger.Pinger] = h.stored(pinger)
+	return nil
+}
+
+func (h *PingerInfoMemoryHandler) update(pinger *PingerInfo) (int64, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	if _, ok := h.storage.pingers[pinger.Pinger]; !ok {
+		return 0, nil
+	}
+	h.storage.pingers[pinger.Pinger] = h.stored(pinger)
+	return 1, nil
+}
+
+func (h *PingerInfoMemoryHandler) delete(pinger *PingerInfo) (int64, error) {
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	if _, ok := h.storage.pingers[pinger.Pinger]; !ok {
+		return 0, nil
+	}
+	delete(h.storage.pingers, pinger.Pinger)
+	return 1, nil
+}
+
+// get takes the pinger.
+func (h *PingerInfoMemoryHandler) get(keys []AWS.DBKeyValue) (*PingerInfo, error) {
+	key, err := keyFromValues(keys)
+	if err != nil {
+		return nil, err
+	}
+	h.storage.mutex.Lock()
+	defer h.storage.mutex.Unlock()
+	stored, ok := h.storage.pingers[key]
+	if !ok {
+		return nil, nil
+	}
+	stored.db = h
+	return &stored, nil
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"reflect"
-	"time"
 )
 
 func addPingerInfoTable(dbmap *gorp.DbMap) {
@@ -90,7 +89,6 @@ func (h *PingerInfoSqlHandler) get(keys []AWS.DBKeyValue) (*PingerInfo, error) {
 }
 
 func (pinger *PingerInfo) PreInsert(s gorp.SqlExecutor) error {
-	pinger.Created = time.Now().UnixNano()
-	pinger.Updated = pinger.Created
+	pinger.beforeInsert()
 	return nil
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"strings"
@@ -20,11 +19,13 @@ func init() {
 	APNSInvalidToken = fmt.Errorf("APNS message used an invalid token")
 }
 
-func Push(aws AWS.AWSHandler, platform, service, token, endpointArn, alert, sound string, contentAvailable int, ttl int64, pingerMap map[string]interface{}, OSVersion string, logger *Logging.Logger) error {
+// Push sends a push to a device of the app push is the config of, directly to APNS if the app has
+// APNS credentials, and through SNS otherwise.
+func Push(aws AWS.AWSHandler, push *pushConfig, platform, service, token, endpointArn, alert, sound string, contentAvailable int, ttl int64, pingerMap map[string]interface{}, OSVersion string, logger *Logging.Logger) error {
 	var err error
 	retryInterval := time.Duration(1) * time.Second
 	for i := 0; i < 10; i++ {
-		if strings.EqualFold(service, PushServiceAPNS) == false || globals.config.APNSCertFile == "" || globals.config.APNSKeyFile == "" {
+		if !push.directAPNS(service) {
 			if endpointArn == "" {
 				return fmt.Errorf("Endpoint not registered|pushToken=%s:%s", service, token)
 			}
@@ -35,12 +36,12 @@ func Push(aws AWS.AWSHandler, platform, service, token, endpointArn, alert, soun
 				err = aws.SendPushNotification(endpointArn, pushMessage)
 			}
 		} else {
-			err = APNSpushMessage(token, alert, sound, contentAvailable, ttl, pingerMap, OSVersion, logger)
+			err = APNSpushMessage(push, token, alert, sound, contentAvailable, ttl, pingerMap, OSVersion, logger)
 		}
 		if err != nil {
 			// TODO: if the error is APNSMessageTooLarge, then split up the message if possible and try again
 			if err == APNSInvalidToken {
-				return err
+				break
 			} else if err != APNSMessageTooLarge {
 				logger.Warning("message=Push error %s. Retrying attempt %d in %s", err, i, retryInterval)
 				time.Sleep(retryInterval)
@@ -50,6 +51,11 @@ func Push(aws AWS.AWSHandler, platform, service, token, endpointArn, alert, soun
 			break
 		}
 	}
+	if err != nil {
+		metricPushes.With(service, "failed").Inc()
+	} else {
+		metricPushes.With(service, "sent").Inc()
+	}
 	return err
 }
 
@@ -62,12 +68,15 @@ func newContextMessage(message PingerNotification, context string) *contextMessa
 	return &contextMessage{message, context}
 }
 
-func pingerPushMessageMapV2(contexts [](*contextMessage)) map[string]interface{} {
+// pingerPushMessageMapV2 returns the pinger part of a push. The push id is what the device
+// acknowledges the push with (see RPCAckPush).
+func pingerPushMessageMapV2(pushId string, contexts [](*contextMessage)) map[string]interface{} {
 	//"contexts": {"context1": { "command": "new" | "register"},  ... ]\}
-	//"metadata": {"timestamp": "2015-04-10T09:30:00Z, ...}
+	//"metadata": {"timestamp": "2015-04-10T09:30:00Z, "id": "a1b2c3d4e5f60718", ...}
 	pingerMap := make(map[string]interface{})
 	metadataMap := make(map[string]string)
 	metadataMap["time"] = fmt.Sprintf("%d", time.Now().UTC().Unix())
+	metadataMap["id"] = pushId
 	pingerMap["meta"] = metadataMap
 
 	if len(contexts) > 0 {
@@ -149,34 +158,84 @@ func awsPushMessageString(platform, alert, sound string, contentAvailable int, t
 	return string(notificationBytes), nil
 }
 
-func alertAllDevices(dbm *gorp.DbMap, aws AWS.AWSHandler, logger *Logging.Logger) int {
-	servicesAndTokens := make([]DeviceInfo, 0, 100)
-	_, err := dbm.Select(&servicesAndTokens, distinctPushServiceTokenSql, pingerHostId)
+func alertAllDevices(db Storage, aws AWS.AWSHandler, logger *Logging.Logger) int {
+	pushesSent, err := alertDevices(db, aws, &deviceFilter{Pinger: pingerHostId}, logger)
 	if err != nil {
 		panic(err)
 	}
-	var alert string
-	if globals.config.APNSAlert {
-		alert = "Nacho says: Reregister!"
+	return pushesSent
+}
+
+// pushTarget is a push token, and the contexts on the device it belongs to.
+type pushTarget struct {
+	device   *DeviceInfo
+	contexts []string
+}
+
+// pushTargets groups the devices by push service and token, in the order they come in. Contexts on the
+// same device share the token.
+func pushTargets(devices []*DeviceInfo) []*pushTarget {
+	targets := make([]*pushTarget, 0, len(devices))
+	byToken := make(map[string]*pushTarget)
+	for _, di := range devices {
+		key := di.PushService + ":" + di.PushToken
+		target, ok := byToken[key]
+		if !ok {
+			target = &pushTarget{device: di}
+			byToken[key] = target
+			targets = append(targets, target)
+		} else if target.device.AWSEndpointArn == "" && di.AWSEndpointArn != "" {
+			target.device = di
+		}
+		found := false
+		for _, c := range target.contexts {
+			if c == di.ClientContext {
+				found = true
+				break
+			}
+		}
+		if !found {
+			target.contexts = append(target.contexts, di.ClientContext)
+		}
+	}
+	return targets
+}
+
+// alertDevices sends a register push to the devices matching the filter, so they register again.
+// Devices with more than one context get one push for all of them.
+func alertDevices(db Storage, aws AWS.AWSHandler, filter *deviceFilter, logger *Logging.Logger) (int, error) {
+	devices, err := db.deviceInfo().find(filter)
+	if err != nil {
+		return 0, err
 	}
+	config := globals.getConfig()
 	count := 0
 	pushesSent := 0
-	for _, serviceAndToken := range servicesAndTokens {
-		contexts := make([]string, 0, 5)
-		_, err = dbm.Select(&contexts, clientContextsSql, serviceAndToken.PushService, serviceAndToken.PushToken)
-		if err != nil {
-			panic(err)
-		}
-		contextMessages := make([](*contextMessage), 0, 5)
-		for _, c := range contexts {
+	for _, target := range pushTargets(devices) {
+		contextMessages := make([](*contextMessage), 0, len(target.contexts))
+		for _, c := range target.contexts {
 			contextMessages = append(contextMessages, newContextMessage(PingerNotificationRegister, c))
 		}
-		pingerMap := pingerPushMessageMapV2(contextMessages)
-		err = Push(aws, serviceAndToken.Platform, serviceAndToken.PushService, serviceAndToken.PushToken, serviceAndToken.AWSEndpointArn,
-			alert, globals.config.APNSSound, globals.config.APNSContentAvailable, globals.config.APNSExpirationSeconds, pingerMap, serviceAndToken.OSVersion, logger)
+		pushId := newPushId()
+		pingerMap := pingerPushMessageMapV2(pushId, contextMessages)
+		di := target.device
+		push, err := config.pushConfig(di.AppId)
+		if err == nil {
+			err = Push(aws, push, di.Platform, di.PushService, di.PushToken, di.AWSEndpointArn,
+				push.alert(PingerNotificationRegister), push.APNSSound, push.APNSContentAvailable, push.APNSExpirationSeconds, pingerMap, di.OSVersion, logger)
+		}
 		if err != nil {
 			logger.Error("message=Could not send push: %s", err.Error())
 		} else {
+			receipts.sent(pushId, &sentPush{
+				UserId:        di.UserId,
+				ClientContext: strings.Join(target.contexts, ","),
+				DeviceId:      di.DeviceId,
+				Service:       di.PushService,
+				Platform:      di.Platform,
+				Message:       PingerNotificationRegister,
+				Sent:          time.Now(),
+			}, logger)
 			pushesSent++
 			count++
 		}
@@ -185,5 +244,5 @@ func alertAllDevices(dbm *gorp.DbMap, aws AWS.AWSHandler, logger *Logging.Logger
 			time.Sleep(time.Duration(1) * time.Second)
 		}
 	}
-	return pushesSent
+	return pushesSent, nil
 }
@@ -0,0 +1,159 @@
+package Pinger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"sync"
+	"time"
+)
+
+// pushAckTimeout is how long the device has to acknowledge a push (see RPCAckPush), before we
+// count the push as lost.
+const pushAckTimeout = time.Hour
+
+// sentPush is a push waiting for the device to acknowledge it.
+type sentPush struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	Service       string
+	Platform      string
+	Message       PingerNotification
+	MailArrived   time.Time // when we noticed the new mail. Zero for the other pushes
+	Sent          time.Time
+}
+
+func (push *sentPush) logFields(pushId string) []Logging.Field {
+	return []Logging.Field{
+		Logging.String("device", push.DeviceId),
+		Logging.String("client", push.UserId),
+		Logging.String("context", push.ClientContext),
+		Logging.String("pushId", pushId),
+		Logging.String("service", push.Service),
+		Logging.String("platform", push.Platform),
+		Logging.String("cmd", string(push.Message)),
+	}
+}
+
+// pushReceipts are the pushes sent, by their id (the "id" in the push's meta map), until the
+// device acknowledges them, or they time out. The acknowledged ones tell us how long the pushes
+// take to arrive, and the timed out ones how many get lost. They're only kept in memory, so the
+// pushes pending when the backend stops are neither; shutdown logs how many there were.
+type pushReceipts struct {
+	mutex      sync.Mutex
+	pending    map[string]*sentPush
+	timeout    time.Duration
+	lastExpire time.Time
+}
+
+var receipts = newPushReceipts(pushAckTimeout)
+
+func newPushReceipts(timeout time.Duration) *pushReceipts {
+	return &pushReceipts{
+		pending:    make(map[string]*sentPush),
+		timeout:    timeout,
+		lastExpire: time.Now(),
+	}
+}
+
+// newPushId returns a random id for a push. It is short, since it goes into the push payload, of
+// which APNS allows only 256 bytes.
+func newPushId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// sent records the push, to wait for its acknowledgement.
+func (r *pushReceipts) sent(pushId string, push *sentPush, logger *Logging.Logger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending[pushId] = push
+	if !push.MailArrived.IsZero() {
+		metricPushMailLatency.With(push.Service, push.Platform).Observe(push.Sent.Sub(push.MailArrived).Seconds())
+	}
+	r.expireLocked(push.Sent, logger)
+}
+
+// ack records the acknowledgement of the push by the device, which got it at the given time. It
+// returns false for pushes we don't know, or no longer know, and for pushes to other devices.
+func (r *pushReceipts) ack(pushId, userId, deviceId string, received time.Time, logger *Logging.Logger) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	r.expireLocked(now, logger)
+	push, ok := r.pending[pushId]
+	if !ok || push.UserId != userId || push.DeviceId != deviceId {
+		return false
+	}
+	delete(r.pending, pushId)
+	if received.IsZero() || received.After(now) {
+		received = now
+	}
+	// the device's clock is not ours, so this can come out negative
+	delivery := received.Sub(push.Sent)
+	if delivery < 0 {
+		delivery = 0
+	}
+	metricPushReceipts.With(push.Service, push.Platform, "acked").Inc()
+	metricPushDeliveryLatency.With(push.Service, push.Platform).Observe(delivery.Seconds())
+	fields := append(push.logFields(pushId), Logging.Int64("deliveryMs", int64(delivery/time.Millisecond)))
+	if !push.MailArrived.IsZero() {
+		endToEnd := received.Sub(push.MailArrived)
+		if endToEnd < delivery {
+			endToEnd = delivery
+		}
+		metricPushEndToEndLatency.With(push.Service, push.Platform).Observe(endToEnd.Seconds())
+		fields = append(fields, Logging.Int64("endToEndMs", int64(endToEnd/time.Millisecond)))
+	}
+	logger.WithFields(fields...).Info("Push acknowledged by the device|msgCode=PUSH_ACKED")
+	return true
+}
+
+// Runner expires the pushes every so often, so the lost pushes are counted even when no pushes
+// are sent or acknowledged.
+func (r *pushReceipts) Runner(period time.Duration, logger *Logging.Logger) {
+	ticker := time.NewTicker(period)
+	for {
+		<-ticker.C
+		r.expire(time.Now(), logger)
+	}
+}
+
+func (r *pushReceipts) expire(now time.Time, logger *Logging.Logger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expireLocked(now, logger)
+}
+
+// shutdown logs the pushes that are still waiting for their acknowledgement, which we won't know
+// about after a restart.
+func (r *pushReceipts) shutdown(logger *Logging.Logger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[string]int)
+	for _, push := range r.pending {
+		counts[push.Service+"/"+push.Platform]++
+	}
+	logger.Info("%d pushes still waiting for their acknowledgement|byService=%v|msgCode=PUSH_RECEIPTS_PENDING", len(r.pending), counts)
+}
+
+// expireLocked counts the pushes not acknowledged in time as lost. It looks at most once a minute.
+func (r *pushReceipts) expireLocked(now time.Time, logger *Logging.Logger) {
+	if now.Sub(r.lastExpire) < time.Minute {
+		return
+	}
+	r.lastExpire = now
+	for pushId, push := range r.pending {
+		if now.Sub(push.Sent) < r.timeout {
+			continue
+		}
+		delete(r.pending, pushId)
+		metricPushReceipts.With(push.Service, push.Platform, "lost").Inc()
+		logger.WithFields(push.logFields(pushId)...).Info("Push not acknowledged within %s|msgCode=PUSH_LOST", r.timeout)
+	}
+}
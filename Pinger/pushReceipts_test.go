@@ -0,0 +1,135 @@
+package Pinger
+
+import (
+	"encoding/json"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type pushReceiptsTester struct {
+	suite.Suite
+	logger *Logging.Logger
+}
+
+func (s *pushReceiptsTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *pushReceiptsTester) SetupTest() {
+	globals = nil
+	setGlobal(NewBackendConfiguration())
+}
+
+func (s *pushReceiptsTester) TearDownTest() {
+	globals = nil
+}
+
+func TestPushReceipts(t *testing.T) {
+	s := new(pushReceiptsTester)
+	suite.Run(t, s)
+}
+
+func (s *pushReceiptsTester) newSentPush(sent time.Time) *sentPush {
+	return &sentPush{
+		UserId:        "user1",
+		ClientContext: "context1",
+		DeviceId:      "device1",
+		Service:       PushServiceAPNS,
+		Platform:      "ios",
+		Message:       PingerNotificationNewMail,
+		MailArrived:   sent.Add(-time.Second),
+		Sent:          sent,
+	}
+}
+
+func (s *pushReceiptsTester) TestPushId() {
+	id := newPushId()
+	s.Len(id, 16)
+	s.NotEqual(id, newPushId())
+}
+
+func (s *pushReceiptsTester) TestAck() {
+	r := newPushReceipts(time.Hour)
+	r.sent("push1", s.newSentPush(time.Now()), s.logger)
+	s.False(r.ack("nosuchpush", "user1", "device1", time.Time{}, s.logger))
+	s.False(r.ack("push1", "user2", "device1", time.Time{}, s.logger))
+	s.False(r.ack("push1", "user1", "device2", time.Time{}, s.logger))
+	s.True(r.ack("push1", "user1", "device1", time.Now(), s.logger))
+	// only once
+	s.False(r.ack("push1", "user1", "device1", time.Now(), s.logger))
+	s.Empty(r.pending)
+}
+
+func (s *pushReceiptsTester) TestExpire() {
+	r := newPushReceipts(time.Hour)
+	now := time.Now()
+	r.sent("push1", s.newSentPush(now.Add(-2*time.Hour)), s.logger)
+	r.sent("push2", s.newSentPush(now.Add(-time.Minute)), s.logger)
+	s.Len(r.pending, 2)
+
+	// expiring is at most once a minute
+	r.expireLocked(now, s.logger)
+	s.Len(r.pending, 2)
+	r.lastExpire = now.Add(-time.Minute)
+	r.expireLocked(now, s.logger)
+	s.Len(r.pending, 1)
+	s.False(r.ack("push1", "user1", "device1", time.Time{}, s.logger))
+	s.True(r.ack("push2", "user1", "device1", time.Time{}, s.logger))
+}
+
+func (s *pushReceiptsTester) TestDevicePush() {
+	aws := AWS.NewTestAwsHandler()
+	db, closeStorage := newTestStorage("memory", aws, s.logger)
+	defer closeStorage()
+	pushToken := "AEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEEF"
+	di, err := newDeviceInfo("user1", "context1", "device1", pushToken, "APNS", "ios", "8.1", "0.9", "", "session1", aws, db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.AWSEndpointArn = "arn:aws:sns:us-west-2:1234:endpoint/APNS/pinger/1"
+	s.NoError(di.insert(nil))
+
+	s.NoError(di.PushNewMail(time.Now()))
+	require.Len(s.T(), aws.SentPushMessages(), 1)
+	var message map[string]string
+	require.NoError(s.T(), json.Unmarshal([]byte(aws.SentPushMessages()[0]), &message))
+	var pinger struct {
+		Meta map[string]string `json:"meta"`
+	}
+	require.NoError(s.T(), json.Unmarshal([]byte(message["default"]), &pinger))
+	pushId := pinger.Meta["id"]
+	s.Len(pushId, 16)
+
+	args := &AckPushArgs{UserId: "user1", ClientContext: "context1", DeviceId: "device1", PushId: pushId, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+	reply := &PollingResponse{}
+	s.NoError(RPCAckPush(nil, nil, db, args, reply, s.logger))
+	s.Equal(PollingReplyOK, reply.Code)
+
+	reply = &PollingResponse{}
+	s.NoError(RPCAckPush(nil, nil, db, args, reply, s.logger))
+	s.Equal(PollingReplyWarn, reply.Code)
+	s.Equal("Unknown push", reply.Message)
+}
+
+func (s *pushReceiptsTester) TestRunner() {
+	r := newPushReceipts(time.Hour)
+	r.sent("push1", s.newSentPush(time.Now().Add(-2*time.Hour)), s.logger)
+	r.lastExpire = time.Now().Add(-time.Minute)
+	// no sends or acks needed
+	go r.Runner(10*time.Millisecond, s.logger)
+	for i := 0; i < 100; i++ {
+		r.mutex.Lock()
+		pending := len(r.pending)
+		r.mutex.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.mutex.Lock()
+	s.Empty(r.pending)
+	r.mutex.Unlock()
+	r.shutdown(s.logger)
+}
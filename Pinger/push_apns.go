@@ -19,23 +19,25 @@ const (
 	APNSSandboxFeedbackServer = "feedback.sandbox.push.apple.com:2196"
 )
 
+// FeedbackListener listens to the APNS feedback service, for each app that pushes to APNS directly.
 func FeedbackListener(logger *Logging.Logger) {
-	if globals.config.APNSCertFile == "" {
-		return
-	}
-	if globals.config.APNSKeyFile == "" {
-		return
+	config := globals.getConfig()
+	for _, push := range config.apnsPushConfigs() {
+		go feedbackListener(push, config.APNSFeedbackPeriod, logger)
 	}
+}
+
+func feedbackListener(push *pushConfig, period int, logger *Logging.Logger) {
 	var apnsHost string
-	if globals.config.APNSSandbox {
+	if push.APNSSandbox {
 		apnsHost = APNSSandboxFeedbackServer
 	} else {
 		apnsHost = APNSFeedbackServer
 	}
 	for {
-		time.Sleep(time.Duration(globals.config.APNSFeedbackPeriod) * time.Minute)
-		logger.Debug("APNS FEEDBACK: Checking feedback service")
-		client := apns.NewClient(apnsHost, globals.config.APNSCertFile, globals.config.APNSKeyFile)
+		time.Sleep(time.Duration(period) * time.Minute)
+		logger.Debug("APNS FEEDBACK: Checking feedback service|appId=%s", push.AppId)
+		client := apns.NewClient(apnsHost, push.APNSCertFile, push.APNSKeyFile)
 		go client.ListenForFeedback()
 
 		for {
@@ -49,11 +51,11 @@ func FeedbackListener(logger *Logging.Logger) {
 	}
 }
 
-func APNSpushMessage(token string, alert, sound string, contentAvailable int, ttl int64, pingerMap map[string]interface{}, OSVersion string, logger *Logging.Logger) error {
-	if globals.config.APNSCertFile == "" {
+func APNSpushMessage(push *pushConfig, token string, alert, sound string, contentAvailable int, ttl int64, pingerMap map[string]interface{}, OSVersion string, logger *Logging.Logger) error {
+	if push.APNSCertFile == "" {
 		panic("No apns cert set. Can not push to APNS")
 	}
-	if globals.config.APNSKeyFile == "" {
+	if push.APNSKeyFile == "" {
 		panic("No apns key set. Can not push to APNS")
 	}
 	pn := apns.NewPushNotification()
@@ -111,12 +113,12 @@ func APNSpushMessage(token string, alert, sound string, contentAvailable int, tt
 	logger.Debug("Sending push message to APNS: pushToken: %s %s", token, msg)
 
 	var apnsHost string
-	if globals.config.APNSSandbox {
+	if push.APNSSandbox {
 		apnsHost = APNSSandboxServer
 	} else {
 		apnsHost = APNSServer
 	}
-	client := apns.NewClient(apnsHost, globals.config.APNSCertFile, globals.config.APNSKeyFile)
+	client := apns.NewClient(apnsHost, push.APNSCertFile, push.APNSKeyFile)
 	resp := client.Send(pn)
 	if resp.AppleResponse != "" {
 		logger.Debug("Response from apple: %s", resp.AppleResponse)
@@ -31,7 +31,7 @@ func (s *pushTester) TestDevicePushMessageCreateV2() {
 	var days_28 int64 = 2419200
 	context := "context1234567"
 	ctxtMessage := newContextMessage(PingerNotificationRegister, context)
-	pingerMessage := pingerPushMessageMapV2([](*contextMessage){ctxtMessage})
+	pingerMessage := pingerPushMessageMapV2("a1b2c3d4e5f60718", [](*contextMessage){ctxtMessage})
 	s.NotEmpty(pingerMessage)
 	_, ok := pingerMessage["meta"]
 	require.True(s.T(), ok, "meta not in pinger message")
@@ -39,6 +39,7 @@ func (s *pushTester) TestDevicePushMessageCreateV2() {
 	t, ok := meta["time"]
 	s.True(ok, "time not in pinger message['meta']")
 	s.NotEqual("", t)
+	s.Equal("a1b2c3d4e5f60718", meta["id"])
 
 	_, ok = pingerMessage["ctxs"]
 	s.True(ok, "ctxs not in pinger message")
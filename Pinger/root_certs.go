@@ -0,0 +1,109 @@
+package Pinger
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var rootCAs *x509.CertPool
+var rootCAsMutex sync.RWMutex
+
+// loadExtraCADir adds all the .pem and .crt files in dir to roots. Every file must contain
+// at least one valid PEM certificate, so that a broken file is noticed at startup (or at
+// reload) instead of silently being ignored. Returns the number of files loaded.
+func loadExtraCADir(dir string, roots *x509.CertPool) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(f.Name()))
+		if ext == ".pem" || ext == ".crt" {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := path.Join(dir, name)
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return 0, err
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return 0, fmt.Errorf("Could not read PEM file %s", filename)
+		}
+	}
+	return len(names), nil
+}
+
+// loadRootCerts reads the certs in OsTrustStore, and adds in the additional certs
+// and the certs in extraCADir, if given.
+func loadRootCerts(extraCADir string) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	data, err := ioutil.ReadFile(OsTrustStore)
+	if err != nil {
+		return nil, err
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("Could not read PEM file %s", OsTrustStore)
+	}
+
+	for i, cert := range extra_certs {
+		if !roots.AppendCertsFromPEM([]byte(cert)) {
+			return nil, fmt.Errorf("Could not parse PEM cert %d", i)
+		}
+	}
+	if extraCADir != "" {
+		_, err = loadExtraCADir(extraCADir, roots)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// RootCerts returns the root certs for the TlsConfig's: the certs in OsTrustStore, the additional
+// certs and the extra-ca-dir. StartPollingRPCServer loads them, so that a broken file is noticed at
+// startup. Otherwise (e.g. in the tools), they are loaded on first use.
+func (cfg *BackendConfiguration) RootCerts() (*x509.CertPool, error) {
+	rootCAsMutex.RLock()
+	roots := rootCAs
+	rootCAsMutex.RUnlock()
+	if roots != nil {
+		return roots, nil
+	}
+	rootCAsMutex.Lock()
+	defer rootCAsMutex.Unlock()
+	if rootCAs == nil {
+		roots, err := loadRootCerts(cfg.ExtraCADir)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs = roots
+	}
+	return rootCAs, nil
+}
+
+// ReloadRootCerts re-reads the root certs, including the extra-ca-dir. If anything goes wrong,
+// the current certs are left in place. Since the server certs are verified against the current
+// root certs at connection time (see tlsConfig()), running pollers pick up the new certs on their
+// next connection.
+func (cfg *BackendConfiguration) ReloadRootCerts() error {
+	roots, err := loadRootCerts(cfg.ExtraCADir)
+	if err != nil {
+		return err
+	}
+	rootCAsMutex.Lock()
+	rootCAs = roots
+	rootCAsMutex.Unlock()
+	return nil
+}
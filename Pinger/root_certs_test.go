@@ -0,0 +1,145 @@
+package Pinger
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type rootCertsTester struct {
+	suite.Suite
+	dir          string
+	osTrustStore string
+	cert         *x509.Certificate
+	other        *x509.Certificate
+}
+
+func (s *rootCertsTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "rootcerts")
+	s.NoError(err)
+	s.cert = makeTestCert("mail.example.com")
+	s.other = makeTestCert("mail.example.com")
+
+	// fake OS trust store, so we don't depend on the machine we're running on
+	s.osTrustStore = OsTrustStore
+	OsTrustStore = path.Join(s.dir, "ca-bundle.crt")
+	s.writeCert(OsTrustStore, s.cert)
+	err = os.Mkdir(path.Join(s.dir, "extra"), 0700)
+	s.NoError(err)
+	rootCAs = nil
+}
+
+func (s *rootCertsTester) TearDownTest() {
+	OsTrustStore = s.osTrustStore
+	rootCAs = nil
+	os.RemoveAll(s.dir)
+}
+
+func (s *rootCertsTester) writeCert(filename string, cert *x509.Certificate) {
+	err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	s.NoError(err)
+}
+
+func TestRootCerts(t *testing.T) {
+	s := new(rootCertsTester)
+	suite.Run(t, s)
+}
+
+func (s *rootCertsTester) TestLoadExtraCADir() {
+	extra := path.Join(s.dir, "extra")
+	s.writeCert(path.Join(extra, "other.pem"), s.other)
+	err := ioutil.WriteFile(path.Join(extra, "README"), []byte("ignored"), 0600)
+	s.NoError(err)
+	n, err := loadExtraCADir(extra, x509.NewCertPool())
+	s.NoError(err)
+	s.Equal(1, n)
+
+	err = ioutil.WriteFile(path.Join(extra, "broken.crt"), []byte("not a cert"), 0600)
+	s.NoError(err)
+	_, err = loadExtraCADir(extra, x509.NewCertPool())
+	s.Error(err)
+
+	cfg := NewBackendConfiguration()
+	cfg.ExtraCADir = extra
+	s.Error(cfg.validate())
+	cfg.ExtraCADir = path.Join(s.dir, "nosuchdir")
+	s.Error(cfg.validate())
+}
+
+func (s *rootCertsTester) TestReload() {
+	extra := path.Join(s.dir, "extra")
+	cfg := NewBackendConfiguration()
+	cfg.ExtraCADir = extra
+	s.NoError(cfg.validate())
+
+	roots, err := cfg.RootCerts()
+	s.NoError(err)
+	cached, _ := cfg.RootCerts()
+	s.True(roots == cached, "root certs should be cached")
+	s.NoError((*TLSPolicyConfiguration)(nil).verify("mail.example.com", roots, nil, [][]byte{s.cert.Raw}))
+	s.Error((*TLSPolicyConfiguration)(nil).verify("mail.example.com", roots, nil, [][]byte{s.other.Raw}))
+
+	s.writeCert(path.Join(extra, "other.pem"), s.other)
+	s.NoError(cfg.ReloadRootCerts())
+	newRoots, err := cfg.RootCerts()
+	s.NoError(err)
+	s.False(roots == newRoots)
+	s.NoError((*TLSPolicyConfiguration)(nil).verify("mail.example.com", newRoots, nil, [][]byte{s.other.Raw}))
+
+	// a broken file leaves the current certs in place
+	err = ioutil.WriteFile(path.Join(extra, "broken.pem"), []byte("not a cert"), 0600)
+	s.NoError(err)
+	s.Error(cfg.ReloadRootCerts())
+	cached, _ = cfg.RootCerts()
+	s.True(newRoots == cached)
+}
+
+func (s *rootCertsTester) TestLoadError() {
+	OsTrustStore = path.Join(s.dir, "nosuchfile")
+	cfg := NewBackendConfiguration()
+	roots, err := cfg.RootCerts()
+	s.Error(err)
+	s.Nil(roots)
+
+	tlsConfig, err := cfg.tlsConfig("mail.example.com", "")
+	s.NoError(err)
+	s.Error(tlsConfig.VerifyPeerCertificate([][]byte{s.cert.Raw}, nil))
+}
+
+func (s *rootCertsTester) TestReadConfig() {
+	filename := path.Join(s.dir, "pinger.cfg")
+	err := ioutil.WriteFile(filename, []byte(`
+[backend]
+extra-ca-dir = `+path.Join(s.dir, "extra")+`
+
+[server]
+TokenAuthKey = "0123456789abcdef"
+
+[db]
+type = "memory"
+
+[aws]
+regionName = "us-west-2"
+accessKey = "foo"
+secretKey = "bar"
+`), 0600)
+	s.NoError(err)
+	s.writeCert(path.Join(s.dir, "extra", "other.pem"), s.other)
+	// only the backend needs the root certs, so ReadConfig doesn't need a trust store
+	OsTrustStore = path.Join(s.dir, "nosuchfile")
+	config, err := ReadConfig(filename)
+	s.NoError(err)
+	s.Nil(rootCAs, "ReadConfig should not load the root certs")
+	s.Error(config.Backend.ReloadRootCerts())
+
+	// but a broken extra-ca-dir is still noticed
+	err = ioutil.WriteFile(path.Join(s.dir, "extra", "broken.pem"), []byte("not a cert"), 0600)
+	s.NoError(err)
+	_, err = ReadConfig(filename)
+	s.Error(err)
+}
@@ -2,7 +2,6 @@ package Pinger
 
 import (
 	"fmt"
-	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"net"
@@ -12,6 +11,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -78,19 +78,30 @@ type BackendPoller interface {
 	Start(args *StartPollArgs, reply *StartPollingResponse) (err error)
 	Stop(args *StopPollArgs, reply *PollingResponse) (err error)
 	Defer(args *DeferPollArgs, reply *PollingResponse) (err error)
+	reloadConfig() error
 	LockMap()
 	UnlockMap()
 }
 
 type pollMapType map[string]MailClientContextType
 
+// pollMapKeyFor is the key of a device's session in the poll map.
+func pollMapKeyFor(userId, clientContext, deviceId string) string {
+	return fmt.Sprintf("%s--%s--%s", userId, clientContext, deviceId)
+}
+
 var pollingServer *BackendPolling
 
 func StartPollingRPCServer(config *Configuration, debug bool, logger *Logging.Logger) error {
 	if pollingServer != nil {
 		logger.Error("StartPollingRPCServer called multiple times")
 	}
-	var err error
+	// only the backend talks to the mail servers, so it is the only one that needs the root certs.
+	// Load them now, so that a broken trust store is noticed at startup.
+	err := config.Backend.ReloadRootCerts()
+	if err != nil {
+		return fmt.Errorf("Could not load the root certs: %v", err)
+	}
 	pollingServer, err = NewBackendPolling(config, debug, logger)
 	if err != nil {
 		return err
@@ -100,18 +111,48 @@ func StartPollingRPCServer(config *Configuration, debug bool, logger *Logging.Lo
 	rpcServer := rpc.NewServer()
 	rpcServer.Register(pollingServer)
 	go FeedbackListener(logger)
-	go alertAllDevices(pollingServer.dbm, pollingServer.aws, pollingServer.logger)
+	go alertAllDevices(pollingServer.db, pollingServer.aws, pollingServer.logger)
+	go receipts.Runner(time.Minute, logger)
 
 	initReRegisterSignal(logger)
 
 	if config.Backend.PingerUpdater > 0 {
-		pinger, err := newPingerInfo(newPingerInfoSqlHandler(pollingServer.dbm), logger)
+		pinger, err := newPingerInfo(pollingServer.db.pingerInfo(), logger)
 		if err != nil {
 			return err
 		}
 		go pinger.Updater(config.Backend.PingerUpdater)
 	}
 
+	if config.Backend.DeviceJanitorPeriod > 0 {
+		janitor := newDeviceJanitor(pollingServer.db, pollingServer.aws, pollingServer.isActive, logger)
+		go janitor.Runner(config.Backend.DeviceJanitorPeriod)
+	}
+
+	// with the http protocol, the metrics are also served on the RPC port.
+	http.Handle("/metrics", MetricsHandler())
+	if config.Backend.MetricsAddress != "" {
+		go func() {
+			logger.Info("Serving metrics on %s", config.Backend.MetricsAddress)
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", MetricsHandler())
+			err := http.ListenAndServe(config.Backend.MetricsAddress, mux)
+			if err != nil {
+				logger.Error("Could not serve metrics on %s: %s", config.Backend.MetricsAddress, err)
+			}
+		}()
+	}
+
+	if config.Backend.AdminAddress != "" {
+		admin := newAdminServer(pollingServer, &pollingServer.pollMap, pollingServer.db, pollingServer.aws, logger)
+		go func() {
+			err := admin.serve(config.Backend.AdminAddress)
+			if err != nil {
+				logger.Error("Could not serve the admin API on %s: %s", config.Backend.AdminAddress, err)
+			}
+		}()
+	}
+
 	logger.Debug("Starting RPC server on %s|pingerid=%s", config.Rpc.String(), pingerHostId)
 	switch {
 	case config.Rpc.Protocol == RPCProtocolHTTP:
@@ -169,12 +210,23 @@ func signalCatcher(logger *Logging.Logger) {
 		signal := <-signalChannel
 		switch {
 		case signal == syscall.SIGHUP:
-			fallthrough
+			logger.Info("signalCatcher: Received signal %s. Reloading config and root certs|msgCode=RELOAD_CONFIG", signal.String())
+			err := pollingServer.reloadConfig()
+			if err != nil {
+				logger.Error("signalCatcher: Could not reload config: %s|msgCode=RELOAD_CONFIG_FAILED", err)
+			}
+			// reloadConfig doesn't read the trust store, so this is the only place it is re-read.
+			err = globals.getConfig().ReloadRootCerts()
+			if err != nil {
+				logger.Error("signalCatcher: Could not reload root certs: %s|msgCode=RELOAD_ROOT_CERTS_FAILED", err)
+			}
+
 		case signal == syscall.SIGABRT:
 			fallthrough
 		case signal == syscall.SIGINT:
 			logger.Info("signalCatcher: Received signal %s\n", signal.String())
-			alertAllDevices(pollingServer.dbm, pollingServer.aws, pollingServer.logger)
+			alertAllDevices(pollingServer.db, pollingServer.aws, pollingServer.logger)
+			receipts.shutdown(logger)
 			os.Exit(1)
 
 		default:
@@ -191,16 +243,17 @@ type StartPollingResponse struct {
 
 type StartPollArgs struct {
 	MailInfo *MailPingInformation
+	TraceId  string // the trace id of the request. See NewTraceId
 }
 
 func (sa *StartPollArgs) pollMapKey() string {
-	return fmt.Sprintf("%s--%s--%s", sa.MailInfo.UserId, sa.MailInfo.ClientContext, sa.MailInfo.DeviceId)
+	return pollMapKeyFor(sa.MailInfo.UserId, sa.MailInfo.ClientContext, sa.MailInfo.DeviceId)
 }
 
 func (sa *StartPollArgs) getLogPrefix() string {
 	return sa.MailInfo.getLogPrefix()
 }
-func RPCStartPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *StartPollArgs, reply *StartPollingResponse, logger *Logging.Logger) (err error) {
+func RPCStartPoll(t BackendPoller, pollMap *pollMapType, db Storage, args *StartPollArgs, reply *StartPollingResponse, logger *Logging.Logger) (err error) {
 	defer func() {
 		e := Utils.RecoverCrash(logger)
 		if e != nil {
@@ -210,6 +263,7 @@ func RPCStartPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *
 			logger.Error("%s", err.Error())
 		}
 	}()
+	logger = TraceLogger(logger, args.TraceId)
 	logger.Info("%s|Received poll request|msgCode=RPC_REGISTER", args.getLogPrefix())
 	pollMapKey := args.pollMapKey()
 	reply.Code = PollingReplyOK
@@ -262,6 +316,8 @@ func RPCStartPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *
 	}
 	t.UnlockMap()
 	need_unlock = false
+	// the new session logs with the trace id of the request that started it
+	args.MailInfo.traceId = args.TraceId
 	go createNewPingerSession(t, pollMap, pollMapKey, args.MailInfo, logger)
 	return nil
 }
@@ -290,12 +346,14 @@ type StopPollArgs struct {
 	UserId        string
 	ClientContext string
 	DeviceId      string
+	SessionId     string // from the device's auth token. Empty for admin requests, which may stop any session.
+	TraceId       string
 
 	logPrefix string
 }
 
 func (sp *StopPollArgs) pollMapKey() string {
-	return fmt.Sprintf("%s--%s--%s", sp.UserId, sp.ClientContext, sp.DeviceId)
+	return pollMapKeyFor(sp.UserId, sp.ClientContext, sp.DeviceId)
 }
 
 func (sp *StopPollArgs) getLogPrefix() string {
@@ -311,7 +369,7 @@ type PollingResponse struct {
 	Message string
 }
 
-func RPCStopPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *StopPollArgs, reply *PollingResponse, logger *Logging.Logger) (err error) {
+func RPCStopPoll(t BackendPoller, pollMap *pollMapType, db Storage, args *StopPollArgs, reply *PollingResponse, logger *Logging.Logger) (err error) {
 	defer func() {
 		e := Utils.RecoverCrash(logger)
 		if e != nil {
@@ -321,16 +379,21 @@ func RPCStopPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *S
 			logger.Error("Recovering from crash:err=%s", err.Error())
 		}
 	}()
+	logger = TraceLogger(logger, args.TraceId)
 	logger.Info("%sReceived stop request|msgCode=RPC_STOP", args.getLogPrefix())
 	pollMapKey := args.pollMapKey()
 	t.LockMap()
 	defer t.UnlockMap()
 	client, ok := (*pollMap)[pollMapKey]
 	if ok {
-		delete((*pollMap), pollMapKey)
 		if client == nil {
+			delete((*pollMap), pollMapKey)
 			return fmt.Errorf("%sCould not find poll item in map", args.getLogPrefix())
 		}
+		if !sessionMatches(client, args.SessionId, args.getLogPrefix(), logger, reply) {
+			return
+		}
+		delete((*pollMap), pollMapKey)
 		go client.stop()
 		reply.Message = "Stopped"
 	} else {
@@ -344,18 +407,33 @@ func RPCStopPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *S
 	return
 }
 
+// sessionMatches checks that a device's request is for the session its auth token was issued for,
+// and not one that a later registration has replaced. If it is not, it sets the error reply.
+func sessionMatches(client MailClientContextType, sessionId, logPrefix string, logger *Logging.Logger, reply *PollingResponse) bool {
+	if sessionId == "" || sessionId == client.getSessionId() {
+		return true
+	}
+	logger.Warning("%sToken is for another session|session=%s|activeSession=%s|msgCode=RPC_SESSION_MISMATCH",
+		logPrefix, sessionId, client.getSessionId())
+	reply.Code = PollingReplyError
+	reply.Message = "Session has been replaced"
+	return false
+}
+
 type DeferPollArgs struct {
 	UserId        string
 	ClientContext string
 	DeviceId      string
 	Timeout       uint64
 	RequestData   []byte
+	SessionId     string // from the device's auth token. Empty for admin requests, which may defer any session.
+	TraceId       string
 
 	logPrefix string
 }
 
 func (dp *DeferPollArgs) pollMapKey() string {
-	return fmt.Sprintf("%s--%s--%s", dp.UserId, dp.ClientContext, dp.DeviceId)
+	return pollMapKeyFor(dp.UserId, dp.ClientContext, dp.DeviceId)
 }
 
 func (dp *DeferPollArgs) getLogPrefix() string {
@@ -365,7 +443,7 @@ func (dp *DeferPollArgs) getLogPrefix() string {
 	return dp.logPrefix
 }
 
-func RPCDeferPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *DeferPollArgs, reply *PollingResponse, logger *Logging.Logger) (err error) {
+func RPCDeferPoll(t BackendPoller, pollMap *pollMapType, db Storage, args *DeferPollArgs, reply *PollingResponse, logger *Logging.Logger) (err error) {
 	defer func() {
 		e := Utils.RecoverCrash(logger)
 		if e != nil {
@@ -375,7 +453,8 @@ func RPCDeferPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *
 			logger.Error("%s", err.Error())
 		}
 	}()
-	logger.Info("%sReceived defer request|msgCode=RPC_DEFER|timeout=%d", args.getLogPrefix(), args.Timeout)
+	logger = TraceLogger(logger, args.TraceId)
+	logger.Info("%sReceived defer request|timeout=%d|msgCode=RPC_DEFER", args.getLogPrefix(), args.Timeout)
 	reply.Code = PollingReplyOK
 	reply.Message = ""
 	pollMapKey := args.pollMapKey()
@@ -384,6 +463,9 @@ func RPCDeferPoll(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *
 		if client == nil {
 			return fmt.Errorf("%sCould not find poll item in map", args.getLogPrefix())
 		}
+		if !sessionMatches(client, args.SessionId, args.getLogPrefix(), logger, reply) {
+			return nil
+		}
 		status, err := client.Status()
 		if err != nil {
 			return err
@@ -408,6 +490,12 @@ type FindSessionsArgs struct {
 	ClientContext string
 	DeviceId      string
 	MaxSessions   int
+	// if given, these have to match, too. See matches().
+	Status     string // the name of a MailClientStatus, e.g. Active
+	Protocol   string
+	MailServer string // host, or host:port
+	SortBy     SessionSortKey
+	Summary    bool // return the SessionSummary instead of the sessions
 
 	logPrefix string
 }
@@ -416,6 +504,7 @@ type FindSessionsResponse struct {
 	Code         PollingReplyType
 	Message      string
 	SessionInfos []ClientSessionInfo
+	Summary      *SessionSummary
 }
 
 func (fs *FindSessionsArgs) getLogPrefix() string {
@@ -425,7 +514,7 @@ func (fs *FindSessionsArgs) getLogPrefix() string {
 	return fs.logPrefix
 }
 
-func RPCFindActiveSessions(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *FindSessionsArgs, reply *FindSessionsResponse, logger *Logging.Logger) (err error) {
+func RPCFindActiveSessions(t BackendPoller, pollMap *pollMapType, db Storage, args *FindSessionsArgs, reply *FindSessionsResponse, logger *Logging.Logger) (err error) {
 	defer func() {
 		e := Utils.RecoverCrash(logger)
 		if e != nil {
@@ -433,35 +522,88 @@ func RPCFindActiveSessions(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMa
 		}
 	}()
 	logger.Debug("Received findActiveSessions request with options %s", args.getLogPrefix())
+	err = args.validate()
+	if err != nil {
+		reply.Code = PollingReplyError
+		reply.Message = err.Error()
+		return nil
+	}
+	// to sort or count them, we need all the matching sessions, not just the first MaxSessions.
+	all := args.Summary || args.SortBy != SessionSortNone
+	sessions := make([]ClientSessionInfo, 0)
+	t.LockMap()
+	defer t.UnlockMap()
 	for key, poll := range *pollMap {
-		if args.MaxSessions > 0 && len(reply.SessionInfos) >= args.MaxSessions {
-			logger.Debug("Max sessions read (%d). Stopping search.", len(reply.SessionInfos))
+		if !all && args.MaxSessions > 0 && len(sessions) >= args.MaxSessions {
+			logger.Debug("Max sessions read (%d). Stopping search.", len(sessions))
 			break
 		}
+		if poll == nil {
+			continue
+		}
 		session, err := poll.getSessionInfo()
 		if err != nil {
 			logger.Debug("%s: %s", key, err.Error())
 			continue
 		}
+		if session != nil && args.matches(session) {
+			sessions = append(sessions, *session)
+		}
+	}
+	if args.Summary {
+		reply.Summary = summarizeSessions(sessions)
+	} else {
+		sortSessions(sessions, args.SortBy)
+		if args.MaxSessions > 0 && len(sessions) > args.MaxSessions {
+			sessions = sessions[:args.MaxSessions]
+		}
+		reply.SessionInfos = sessions
+	}
+	reply.Code = PollingReplyOK
+	reply.Message = ""
+	return nil
+}
 
-		switch {
-		case args.UserId == "" && args.ClientContext == "" && args.DeviceId == "":
-			reply.SessionInfos = append(reply.SessionInfos, *session)
-
-		case args.UserId != "" && session.UserId == args.UserId:
-			reply.SessionInfos = append(reply.SessionInfos, *session)
-
-		case args.ClientContext != "" && session.ClientContext == args.ClientContext:
-			reply.SessionInfos = append(reply.SessionInfos, *session)
+type SessionHistoryResponse struct {
+	Code      PollingReplyType
+	Message   string
+	Histories []ClientSessionHistory
+}
 
-		case args.DeviceId != "" && session.DeviceId == args.DeviceId:
-			reply.SessionInfos = append(reply.SessionInfos, *session)
+// RPCSessionHistory returns the recent lifecycle events of the sessions matching args. Unlike
+// RPCFindActiveSessions, this includes sessions that have stopped but are still in the poll map.
+func RPCSessionHistory(t BackendPoller, pollMap *pollMapType, db Storage, args *FindSessionsArgs, reply *SessionHistoryResponse, logger *Logging.Logger) (err error) {
+	defer func() {
+		e := Utils.RecoverCrash(logger)
+		if e != nil {
+			err = e
+		}
+	}()
+	logger.Debug("Received sessionHistory request with options %s", args.getLogPrefix())
+	err = args.validate()
+	if err != nil {
+		reply.Code = PollingReplyError
+		reply.Message = err.Error()
+		return nil
+	}
+	t.LockMap()
+	defer t.UnlockMap()
+	for _, poll := range *pollMap {
+		if args.MaxSessions > 0 && len(reply.Histories) >= args.MaxSessions {
+			logger.Debug("Max sessions read (%d). Stopping search.", len(reply.Histories))
+			break
+		}
+		if poll == nil {
+			continue
+		}
+		history := poll.getSessionHistory()
+		if history != nil && args.matches(&history.Session) {
+			reply.Histories = append(reply.Histories, *history)
 		}
 	}
 	reply.Code = PollingReplyOK
 	reply.Message = ""
 	return nil
-
 }
 
 type AliveCheckArgs struct {
@@ -472,7 +614,7 @@ type AliveCheckResponse struct {
 	Message string
 }
 
-func RPCAliveCheck(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args *AliveCheckArgs, reply *AliveCheckResponse, logger *Logging.Logger) (err error) {
+func RPCAliveCheck(t BackendPoller, pollMap *pollMapType, db Storage, args *AliveCheckArgs, reply *AliveCheckResponse, logger *Logging.Logger) (err error) {
 	defer func() {
 		e := Utils.RecoverCrash(logger)
 		if e != nil {
@@ -480,10 +622,10 @@ func RPCAliveCheck(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args
 		}
 	}()
 	logger.Info("Received aliveCheck request||msgCode=RPC_ALIVE_CHECK")
-	if globals.config.PingerUpdater > 0 {
+	if globals.getConfig().PingerUpdater > 0 {
 		logger.Warning("Running both auto-updater and a remote Alive Check")
 	}
-	_, err = newPingerInfo(newPingerInfoSqlHandler(dbm), logger) // this updates the timestamp
+	_, err = newPingerInfo(db.pingerInfo(), logger) // this updates the timestamp
 	if err != nil {
 		return err
 	}
@@ -491,3 +633,101 @@ func RPCAliveCheck(t BackendPoller, pollMap *pollMapType, dbm *gorp.DbMap, args
 	reply.Message = ""
 	return nil
 }
+
+type ReloadRootCertsArgs struct {
+}
+
+type ReloadRootCertsResponse struct {
+	Code    PollingReplyType
+	Message string
+}
+
+func RPCReloadRootCerts(t BackendPoller, pollMap *pollMapType, db Storage, args *ReloadRootCertsArgs, reply *ReloadRootCertsResponse, logger *Logging.Logger) (err error) {
+	defer func() {
+		e := Utils.RecoverCrash(logger)
+		if e != nil {
+			err = e
+		}
+	}()
+	logger.Info("Received reloadRootCerts request|msgCode=RPC_RELOAD_ROOT_CERTS")
+	err = globals.getConfig().ReloadRootCerts()
+	if err != nil {
+		logger.Error("Could not reload root certs: %s|msgCode=RELOAD_ROOT_CERTS_FAILED", err)
+		reply.Code = PollingReplyError
+		reply.Message = err.Error()
+		return nil
+	}
+	reply.Code = PollingReplyOK
+	reply.Message = ""
+	return nil
+}
+
+type ReloadConfigArgs struct {
+}
+
+type ReloadConfigResponse struct {
+	Code    PollingReplyType
+	Message string
+}
+
+func RPCReloadConfig(t BackendPoller, pollMap *pollMapType, db Storage, args *ReloadConfigArgs, reply *ReloadConfigResponse, logger *Logging.Logger) (err error) {
+	defer func() {
+		e := Utils.RecoverCrash(logger)
+		if e != nil {
+			err = e
+		}
+	}()
+	logger.Info("Received reloadConfig request|msgCode=RPC_RELOAD_CONFIG")
+	err = t.reloadConfig()
+	if err != nil {
+		logger.Error("Could not reload config: %s|msgCode=RELOAD_CONFIG_FAILED", err)
+		reply.Code = PollingReplyError
+		reply.Message = err.Error()
+		return nil
+	}
+	reply.Code = PollingReplyOK
+	reply.Message = ""
+	return nil
+}
+
+type AckPushArgs struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	PushId        string // the "id" in the push's meta map
+	Timestamp     int64  // when the device got the push, in unix milliseconds. 0 for now
+	TraceId       string
+
+	logPrefix string
+}
+
+func (ap *AckPushArgs) getLogPrefix() string {
+	if ap.logPrefix == "" {
+		ap.logPrefix = fmt.Sprintf("|device=%s|client=%s|context=%s|message=", ap.DeviceId, ap.UserId, ap.ClientContext)
+	}
+	return ap.logPrefix
+}
+
+// RPCAckPush records that the device got a push. Only the backend that sent the push knows it.
+func RPCAckPush(t BackendPoller, pollMap *pollMapType, db Storage, args *AckPushArgs, reply *PollingResponse, logger *Logging.Logger) (err error) {
+	defer func() {
+		e := Utils.RecoverCrash(logger)
+		if e != nil {
+			err = e
+		}
+	}()
+	logger = TraceLogger(logger, args.TraceId)
+	logger.Debug("%sReceived push ack|pushId=%s|msgCode=RPC_ACK_PUSH", args.getLogPrefix(), args.PushId)
+	var received time.Time
+	if args.Timestamp > 0 {
+		received = time.Unix(0, args.Timestamp*int64(time.Millisecond))
+	}
+	if !receipts.ack(args.PushId, args.UserId, args.DeviceId, received, logger) {
+		reply.Code = PollingReplyWarn
+		reply.Message = "Unknown push"
+		return nil
+	}
+	reply.Code = PollingReplyOK
+	reply.Message = ""
+	return nil
+}
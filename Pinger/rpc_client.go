@@ -2,6 +2,7 @@ package Pinger
 
 import (
 	"net/rpc"
+	"time"
 )
 
 func getRpcClient(rpcConfig *RPCServerConfiguration) (*rpc.Client, error) {
@@ -14,21 +15,27 @@ func getRpcClient(rpcConfig *RPCServerConfiguration) (*rpc.Client, error) {
 	panic("Unknown RPC protocol")
 }
 
-func StartPoll(rpcConfig *RPCServerConfiguration, pi *MailPingInformation) (*StartPollingResponse, error) {
+// callRPC makes the RPC call, and records how long it took.
+func callRPC(rpcClient *rpc.Client, method string, args interface{}, reply interface{}) error {
+	defer metricRPCClientLatency.With(method).ObserveSince(time.Now())
+	return rpcClient.Call(method, args, reply)
+}
+
+func StartPoll(rpcConfig *RPCServerConfiguration, pi *MailPingInformation, traceId string) (*StartPollingResponse, error) {
 	rpcClient, err := getRpcClient(rpcConfig)
 	if err != nil {
 		return nil, err
 	}
 	defer rpcClient.Close()
 	var reply StartPollingResponse
-	err = rpcClient.Call("BackendPolling.Start", &StartPollArgs{MailInfo: pi}, &reply)
+	err = callRPC(rpcClient, "BackendPolling.Start", &StartPollArgs{MailInfo: pi, TraceId: traceId}, &reply)
 	if err != nil {
 		return nil, err
 	}
 	return &reply, nil
 }
 
-func StopPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId string) (*PollingResponse, error) {
+func StopPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId, sessionId, traceId string) (*PollingResponse, error) {
 	rpcClient, err := getRpcClient(rpcConfig)
 	if err != nil {
 		return nil, err
@@ -39,8 +46,10 @@ func StopPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId
 		UserId:        userId,
 		ClientContext: clientContext,
 		DeviceId:      deviceId,
+		SessionId:     sessionId,
+		TraceId:       traceId,
 	}
-	err = rpcClient.Call("BackendPolling.Stop", &args, &reply)
+	err = callRPC(rpcClient, "BackendPolling.Stop", &args, &reply)
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +57,7 @@ func StopPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId
 }
 
 func DeferPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId string,
-	timeout uint64, requestData []byte) (*PollingResponse, error) {
+	timeout uint64, requestData []byte, sessionId, traceId string) (*PollingResponse, error) {
 	rpcClient, err := getRpcClient(rpcConfig)
 	if err != nil {
 		return nil, err
@@ -61,15 +70,17 @@ func DeferPoll(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceI
 		DeviceId:      deviceId,
 		Timeout:       timeout,
 		RequestData:   requestData,
+		SessionId:     sessionId,
+		TraceId:       traceId,
 	}
-	err = rpcClient.Call("BackendPolling.Defer", &args, &reply)
+	err = callRPC(rpcClient, "BackendPolling.Defer", &args, &reply)
 	if err != nil {
 		return nil, err
 	}
 	return &reply, nil
 }
 
-func FindActiveSessions(rpcConfig *RPCServerConfiguration, userId, clientContext, deviceId string, maxSessions int) (*FindSessionsResponse, error) {
+func FindActiveSessions(rpcConfig *RPCServerConfiguration, args *FindSessionsArgs) (*FindSessionsResponse, error) {
 	rpcClient, err := getRpcClient(rpcConfig)
 	if err != nil {
 		return nil, err
@@ -79,13 +90,21 @@ func FindActiveSessions(rpcConfig *RPCServerConfiguration, userId, clientContext
 	}
 	defer rpcClient.Close()
 	var reply FindSessionsResponse
-	args := FindSessionsArgs{
-		UserId:        userId,
-		ClientContext: clientContext,
-		DeviceId:      deviceId,
-		MaxSessions:   maxSessions,
+	err = callRPC(rpcClient, "BackendPolling.FindActiveSessions", args, &reply)
+	if err != nil {
+		return nil, err
 	}
-	err = rpcClient.Call("BackendPolling.FindActiveSessions", &args, &reply)
+	return &reply, nil
+}
+
+func SessionHistory(rpcConfig *RPCServerConfiguration, args *FindSessionsArgs) (*SessionHistoryResponse, error) {
+	rpcClient, err := getRpcClient(rpcConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcClient.Close()
+	var reply SessionHistoryResponse
+	err = callRPC(rpcClient, "BackendPolling.SessionHistory", args, &reply)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +118,49 @@ func AliveCheck(rpcConfig *RPCServerConfiguration) (*AliveCheckResponse, error)
 	}
 	defer rpcClient.Close()
 	var reply AliveCheckResponse
-	err = rpcClient.Call("BackendPolling.AliveCheck", &AliveCheckArgs{}, &reply)
+	err = callRPC(rpcClient, "BackendPolling.AliveCheck", &AliveCheckArgs{}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func ReloadRootCerts(rpcConfig *RPCServerConfiguration) (*ReloadRootCertsResponse, error) {
+	rpcClient, err := getRpcClient(rpcConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcClient.Close()
+	var reply ReloadRootCertsResponse
+	err = callRPC(rpcClient, "BackendPolling.ReloadRootCerts", &ReloadRootCertsArgs{}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func ReloadConfig(rpcConfig *RPCServerConfiguration) (*ReloadConfigResponse, error) {
+	rpcClient, err := getRpcClient(rpcConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcClient.Close()
+	var reply ReloadConfigResponse
+	err = callRPC(rpcClient, "BackendPolling.ReloadConfig", &ReloadConfigArgs{}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func AckPush(rpcConfig *RPCServerConfiguration, args *AckPushArgs) (*PollingResponse, error) {
+	rpcClient, err := getRpcClient(rpcConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer rpcClient.Close()
+	var reply PollingResponse
+	err = callRPC(rpcClient, "BackendPolling.AckPush", args, &reply)
 	if err != nil {
 		return nil, err
 	}
@@ -1,41 +1,64 @@
 package Pinger
 
 import (
-	"github.com/coopernurse/gorp"
+	"fmt"
 	"github.com/nachocove/Pinger/Utils/AWS"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"sync"
+	"time"
 )
 
 type BackendPolling struct {
-	dbm          *gorp.DbMap
+	db           Storage
 	logger       *Logging.Logger
 	loggerLevel  Logging.Level
 	debug        bool
 	pollMap      pollMapType
 	aws          *AWS.AWSHandle
 	pollMapMutex sync.Mutex
+	config       *Configuration
+	configMutex  sync.Mutex
 }
 
 func NewBackendPolling(config *Configuration, debug bool, logger *Logging.Logger) (*BackendPolling, error) {
-	dbm, err := initDB(&config.Db, true, logger)
+	aws := config.Aws.NewHandle()
+	db, err := newStorage(&config.Db, aws, true, logger)
 	if err != nil {
 		return nil, err
 	}
 	backend := &BackendPolling{
-		dbm:          dbm,
+		db:           db,
 		logger:       logger,
 		loggerLevel:  -1,
 		debug:        debug,
 		pollMap:      make(pollMapType),
-		aws:          config.Aws.NewHandle(),
+		aws:          aws,
 		pollMapMutex: sync.Mutex{},
+		config:       config,
 	}
 	return backend, nil
 }
 
 func (t *BackendPolling) newMailClientContext(pi *MailPingInformation, doStats bool) (MailClientContextType, error) {
-	return NewMailClientContext(t.dbm, t.aws, pi, t.debug, false, t.logger)
+	return NewMailClientContext(t.db, t.aws, pi, t.debug, false, t.logger)
+}
+
+// reloadConfig re-reads the config file, and swaps in the settings that are safe to change at runtime.
+// It doesn't touch the root certs, which ReloadRootCerts re-reads.
+func (t *BackendPolling) reloadConfig() error {
+	t.configMutex.Lock()
+	defer t.configMutex.Unlock()
+	if t.config == nil {
+		return fmt.Errorf("No configuration to reload")
+	}
+	newConfig, err := t.config.Reload()
+	if err != nil {
+		return err
+	}
+	newConfig.SetLogLevels(t.logger)
+	globals.swapConfig(&newConfig.Backend)
+	t.config = newConfig
+	return nil
 }
 
 func (t *BackendPolling) LockMap() {
@@ -46,22 +69,55 @@ func (t *BackendPolling) UnlockMap() {
 	t.pollMapMutex.Unlock()
 }
 
+// isActive is true if the device has a session in the poll map.
+func (t *BackendPolling) isActive(di *DeviceInfo) bool {
+	t.LockMap()
+	defer t.UnlockMap()
+	_, ok := t.pollMap[pollMapKeyFor(di.UserId, di.ClientContext, di.DeviceId)]
+	return ok
+}
+
 func (t *BackendPolling) Start(args *StartPollArgs, reply *StartPollingResponse) (err error) {
-	return RPCStartPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	defer metricRPCServerLatency.With("BackendPolling.Start").ObserveSince(time.Now())
+	return RPCStartPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *BackendPolling) Stop(args *StopPollArgs, reply *PollingResponse) (err error) {
-	return RPCStopPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	defer metricRPCServerLatency.With("BackendPolling.Stop").ObserveSince(time.Now())
+	return RPCStopPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *BackendPolling) Defer(args *DeferPollArgs, reply *PollingResponse) (err error) {
-	return RPCDeferPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	defer metricRPCServerLatency.With("BackendPolling.Defer").ObserveSince(time.Now())
+	return RPCDeferPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *BackendPolling) FindActiveSessions(args *FindSessionsArgs, reply *FindSessionsResponse) (err error) {
-	return RPCFindActiveSessions(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	defer metricRPCServerLatency.With("BackendPolling.FindActiveSessions").ObserveSince(time.Now())
+	return RPCFindActiveSessions(t, &t.pollMap, t.db, args, reply, t.logger)
+}
+
+func (t *BackendPolling) SessionHistory(args *FindSessionsArgs, reply *SessionHistoryResponse) (err error) {
+	defer metricRPCServerLatency.With("BackendPolling.SessionHistory").ObserveSince(time.Now())
+	return RPCSessionHistory(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *BackendPolling) AliveCheck(args *AliveCheckArgs, reply *AliveCheckResponse) (err error) {
-	return RPCAliveCheck(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	defer metricRPCServerLatency.With("BackendPolling.AliveCheck").ObserveSince(time.Now())
+	return RPCAliveCheck(t, &t.pollMap, t.db, args, reply, t.logger)
+}
+
+func (t *BackendPolling) ReloadRootCerts(args *ReloadRootCertsArgs, reply *ReloadRootCertsResponse) (err error) {
+	defer metricRPCServerLatency.With("BackendPolling.ReloadRootCerts").ObserveSince(time.Now())
+	return RPCReloadRootCerts(t, &t.pollMap, t.db, args, reply, t.logger)
+}
+
+func (t *BackendPolling) AckPush(args *AckPushArgs, reply *PollingResponse) (err error) {
+	defer metricRPCServerLatency.With("BackendPolling.AckPush").ObserveSince(time.Now())
+	return RPCAckPush(t, &t.pollMap, t.db, args, reply, t.logger)
+}
+
+func (t *BackendPolling) ReloadConfig(args *ReloadConfigArgs, reply *ReloadConfigResponse) (err error) {
+	defer metricRPCServerLatency.With("BackendPolling.ReloadConfig").ObserveSince(time.Now())
+	return RPCReloadConfig(t, &t.pollMap, t.db, args, reply, t.logger)
 }
@@ -38,7 +38,7 @@ func (s *RPCServerTester) SetupSuite() {
 	config.Db.Filename = ":memory:"
 
 	testingBackend := &TestingBackend{BackendPolling{
-		dbm:         s.dbmap,
+		db:          newSqlStorage(s.dbmap),
 		logger:      s.logger,
 		loggerLevel: -1,
 		debug:       true,
@@ -58,6 +58,7 @@ func (s *RPCServerTester) SetupSuite() {
 		DeviceId:      s.testDeviceId,
 		Platform:      s.testPlatform,
 		MailServerUrl: s.testMailServerUrl,
+		SessionId:     s.sessionId,
 	}
 
 }
@@ -80,25 +81,30 @@ type TestingBackend struct {
 
 func (t *TestingBackend) newMailClientContext(pi *MailPingInformation, doStats bool) (MailClientContextType, error) {
 	return &testingMailClientContext{
-		logger: t.logger,
-		status: MailClientStatusPinging,
+		logger:    t.logger,
+		status:    MailClientStatusPinging,
+		sessionId: pi.SessionId,
 	}, nil
 }
 
 func (t *TestingBackend) Start(args *StartPollArgs, reply *StartPollingResponse) (err error) {
-	return RPCStartPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	return RPCStartPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *TestingBackend) Stop(args *StopPollArgs, reply *PollingResponse) (err error) {
-	return RPCStopPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	return RPCStopPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *TestingBackend) Defer(args *DeferPollArgs, reply *PollingResponse) (err error) {
-	return RPCDeferPoll(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	return RPCDeferPoll(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 func (t *TestingBackend) FindActiveSessions(args *FindSessionsArgs, reply *FindSessionsResponse) (err error) {
-	return RPCFindActiveSessions(t, &t.pollMap, t.dbm, args, reply, t.logger)
+	return RPCFindActiveSessions(t, &t.pollMap, t.db, args, reply, t.logger)
+}
+
+func (t *TestingBackend) SessionHistory(args *FindSessionsArgs, reply *SessionHistoryResponse) (err error) {
+	return RPCSessionHistory(t, &t.pollMap, t.db, args, reply, t.logger)
 }
 
 //func (t *TestingBackend) LockMap() {
@@ -192,6 +198,19 @@ func (s *RPCServerTester) TestDeferPoll() {
 	s.Equal(PollingReplyOK, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyOK, reply.Code))
 	s.Equal("", reply.Message)
 
+	// a device can only defer the session its token was issued for
+	args.SessionId = "87654321"
+	err = s.backend.Defer(&args, &reply)
+	s.NoError(err)
+	s.Equal(PollingReplyError, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyError, reply.Code))
+	s.Equal("Session has been replaced", reply.Message)
+
+	args.SessionId = s.sessionId
+	err = s.backend.Defer(&args, &reply)
+	s.NoError(err)
+	s.Equal(PollingReplyOK, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyOK, reply.Code))
+	s.Equal("", reply.Message)
+
 	ctx.setStatus(MailClientStatusStopped, nil)
 	err = s.backend.Defer(&args, &reply)
 	s.NoError(err)
@@ -214,6 +233,16 @@ func (s *RPCServerTester) TestStopPoll() {
 	ctx, err := s.backend.newMailClientContext(s.mailInfo, false)
 	s.backend.pollMap[args.pollMapKey()] = ctx
 	ctx.setStatus(MailClientStatusPinging, nil)
+
+	// a device can only stop the session its token was issued for
+	args.SessionId = "87654321"
+	err = s.backend.Stop(&args, &reply)
+	s.NoError(err)
+	s.Equal(PollingReplyError, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyError, reply.Code))
+	s.Equal("Session has been replaced", reply.Message)
+	s.NotEmpty(s.backend.pollMap[args.pollMapKey()], "Stop should have kept the entry")
+
+	args.SessionId = s.sessionId
 	err = s.backend.Stop(&args, &reply)
 	s.NoError(err)
 	s.Equal(PollingReplyOK, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyOK, reply.Code))
@@ -252,3 +281,105 @@ func (s *RPCServerTester) TestStopPoll() {
 	s.Equal(PollingReplyOK, reply.Code, fmt.Sprintf("Should have gotten %s. Got %s", PollingReplyOK, reply.Code))
 	s.Equal("Stopped", reply.Message)
 }
+
+func (s *RPCServerTester) TestSessionHistory() {
+	history := newSessionHistory(10)
+	history.add(SessionEventTransition, "%s -> %s", FSMInit, FSMDeferred)
+	history.add(SessionEventMailServerError, "Connection refused")
+	s.backend.pollMap["a"] = &testingMailClientContext{
+		logger: s.logger,
+		status: MailClientStatusError,
+		history: &ClientSessionHistory{
+			Session: ClientSessionInfo{UserId: "user1", ClientContext: "context1", DeviceId: "device1", Status: MailClientStatusError},
+			Events:  history.list(),
+		},
+	}
+	s.backend.pollMap["b"] = &testingMailClientContext{
+		logger: s.logger,
+		status: MailClientStatusPinging,
+		history: &ClientSessionHistory{
+			Session: ClientSessionInfo{UserId: "user2", ClientContext: "context2", DeviceId: "device2", Status: MailClientStatusPinging},
+		},
+	}
+
+	reply := SessionHistoryResponse{}
+	err := s.backend.SessionHistory(&FindSessionsArgs{}, &reply)
+	s.NoError(err)
+	s.Equal(PollingReplyOK, reply.Code)
+	s.Len(reply.Histories, 2)
+
+	reply = SessionHistoryResponse{}
+	err = s.backend.SessionHistory(&FindSessionsArgs{DeviceId: "device1"}, &reply)
+	s.NoError(err)
+	s.Len(reply.Histories, 1)
+	s.Equal("user1", reply.Histories[0].Session.UserId)
+	s.Len(reply.Histories[0].Events, 2)
+	s.Equal(SessionEventMailServerError, reply.Histories[0].Events[1].Type)
+	s.Equal("Connection refused", reply.Histories[0].Events[1].Message)
+
+	reply = SessionHistoryResponse{}
+	err = s.backend.SessionHistory(&FindSessionsArgs{UserId: "nosuchuser"}, &reply)
+	s.NoError(err)
+	s.Empty(reply.Histories)
+}
+
+func (s *RPCServerTester) TestFindActiveSessions() {
+	for key, session := range map[string]ClientSessionInfo{
+		"a": {UserId: "user1", ClientContext: "context1", DeviceId: "device1", Protocol: MailClientActiveSync, Status: MailClientStatusPinging, MailServer: "mail.example.com:443"},
+		"b": {UserId: "user2", ClientContext: "context2", DeviceId: "device2", Protocol: MailClientIMAP, Status: MailClientStatusDeferred, MailServer: "imap.example.com:993"},
+		"c": {UserId: "user3", ClientContext: "context3", DeviceId: "device3", Protocol: MailClientActiveSync, Status: MailClientStatusError, MailServer: "mail.example.com:443"},
+	} {
+		info := session
+		s.backend.pollMap[key] = &testingMailClientContext{logger: s.logger, status: info.Status, session: &info}
+	}
+
+	reply := FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{}, &reply))
+	s.Equal(PollingReplyOK, reply.Code)
+	s.Len(reply.SessionInfos, 3)
+	s.Nil(reply.Summary)
+
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{Status: "active"}, &reply))
+	s.Len(reply.SessionInfos, 1)
+	s.Equal("user1", reply.SessionInfos[0].UserId)
+
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{Protocol: MailClientActiveSync, SortBy: SessionSortUser}, &reply))
+	s.Len(reply.SessionInfos, 2)
+	s.Equal("user1", reply.SessionInfos[0].UserId)
+	s.Equal("user3", reply.SessionInfos[1].UserId)
+
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{MailServer: "imap.example.com"}, &reply))
+	s.Len(reply.SessionInfos, 1)
+	s.Equal("user2", reply.SessionInfos[0].UserId)
+
+	// the id's match any, the filters all
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{UserId: "user1", DeviceId: "device3", MailServer: "mail.example.com:443", Status: "Error"}, &reply))
+	s.Len(reply.SessionInfos, 1)
+	s.Equal("user3", reply.SessionInfos[0].UserId)
+
+	// sorted, the limit applies after sorting
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{SortBy: SessionSortStatus, MaxSessions: 2}, &reply))
+	s.Len(reply.SessionInfos, 2)
+	s.Equal(MailClientStatusPinging, reply.SessionInfos[0].Status)
+	s.Equal(MailClientStatusError, reply.SessionInfos[1].Status)
+
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{Summary: true, MaxSessions: 1}, &reply))
+	s.Empty(reply.SessionInfos)
+	s.Equal(3, reply.Summary.Total)
+	s.Equal(map[string]int{"Active": 1, "Waiting": 1, "Error": 1}, reply.Summary.ByStatus)
+	s.Equal(map[string]int{MailClientActiveSync: 2, MailClientIMAP: 1}, reply.Summary.ByProtocol)
+	s.Equal(map[string]int{"mail.example.com:443": 2, "imap.example.com:993": 1}, reply.Summary.ByServer)
+
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{Status: "Sleeping"}, &reply))
+	s.Equal(PollingReplyError, reply.Code)
+	reply = FindSessionsResponse{}
+	s.NoError(s.backend.FindActiveSessions(&FindSessionsArgs{SortBy: "age"}, &reply))
+	s.Equal(PollingReplyError, reply.Code)
+}
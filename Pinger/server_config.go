@@ -2,24 +2,31 @@ package Pinger
 
 import (
 	"crypto/aes"
-	"crypto/hmac"
+	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/asaskevich/govalidator"
 	"net"
 	"strings"
+	"time"
 )
 
 const (
-	DefaultPort           = 443
-	DefaultBindAddress    = "0.0.0.0"
-	DefaultDebugging      = false
-	DefaultServerCertFile = ""
-	DefaultServerKeyFile  = ""
-	DefaultNonTLSPort     = 0
+	DefaultPort            = 443
+	DefaultBindAddress     = "0.0.0.0"
+	DefaultDebugging       = false
+	DefaultServerCertFile  = ""
+	DefaultServerKeyFile   = ""
+	DefaultNonTLSPort      = 0
+	DefaultTokenExpiry     = 7 * 24 // hours
+	DefaultRateLimitIP     = 5.0    // requests per second
+	DefaultRateBurstIP     = 50
+	DefaultRateLimitDevice = 0.1
+	DefaultRateBurstDevice = 10
 )
 
 var DefaultIMAPFolders []string
@@ -36,13 +43,19 @@ type ServerConfiguration struct {
 	ServerCertFile   string
 	ServerKeyFile    string
 	NonTlsPort       int      `gcfg:"non-tls-port"`
-	SessionSecret    string   `gcfg:"session-secret"`
+	SessionSecret    string   `gcfg:"session-secret" secret:"true"`
 	AliveCheckIPList []string `gcfg:"alive-check-ip"`
-	AliveCheckToken  []string `gcfg:"alive-check-token"`
+	AliveCheckToken  []string `gcfg:"alive-check-token" secret:"true"`
 	IMAPFolderNames  []string `gcfg:"imap-folder-name"`
 	DumpRequests     bool
 	Debug            bool
-	TokenAuthKey     string
+	TokenAuthKey     string   `secret:"true"`
+	TokenAuthOldKey  []string `secret:"true"` // earlier TokenAuthKeys, whose tokens are still good
+	TokenExpiry      int      // hours
+	RateLimitIP      float64  `gcfg:"rate-limit-ip"` // requests per second from one address. 0 for no limit
+	RateBurstIP      int      `gcfg:"rate-burst-ip"`
+	RateLimitDevice  float64  `gcfg:"rate-limit-device"` // requests per second for one UserId/DeviceId. 0 for no limit
+	RateBurstDevice  int      `gcfg:"rate-burst-device"`
 
 	aliveCheckCidrList []*net.IPNet `gcfg:"-"`
 }
@@ -57,6 +70,11 @@ func NewServerConfiguration() *ServerConfiguration {
 		IMAPFolderNames: DefaultIMAPFolders,
 		SessionSecret:   "",
 		TokenAuthKey:    "",
+		TokenExpiry:     DefaultTokenExpiry,
+		RateLimitIP:     DefaultRateLimitIP,
+		RateBurstIP:     DefaultRateBurstIP,
+		RateLimitDevice: DefaultRateLimitDevice,
+		RateBurstDevice: DefaultRateBurstDevice,
 	}
 }
 func (cfg *ServerConfiguration) validate() error {
@@ -79,6 +97,27 @@ func (cfg *ServerConfiguration) validate() error {
 	if err != nil {
 		return err
 	}
+	for _, key := range cfg.TokenAuthOldKey {
+		_, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return fmt.Errorf("TokenAuthOldKey: %s", err)
+		}
+	}
+	if cfg.TokenExpiry <= 0 {
+		return fmt.Errorf("TokenExpiry must be more than 0 hours")
+	}
+	if cfg.RateLimitIP < 0 {
+		return fmt.Errorf("rate-limit-ip can not be < 0")
+	}
+	if cfg.RateLimitIP > 0 && cfg.RateBurstIP < 1 {
+		return fmt.Errorf("rate-burst-ip must be >= 1 if rate-limit-ip is set")
+	}
+	if cfg.RateLimitDevice < 0 {
+		return fmt.Errorf("rate-limit-device can not be < 0")
+	}
+	if cfg.RateLimitDevice > 0 && cfg.RateBurstDevice < 1 {
+		return fmt.Errorf("rate-burst-device must be >= 1 if rate-limit-device is set")
+	}
 	if len(cfg.IMAPFolderNames) == 0 {
 		return fmt.Errorf("Need to have at least 1 IMAPFolderName in the config")
 	}
@@ -122,44 +161,94 @@ func (cfg *ServerConfiguration) CheckToken(token string) bool {
 	return foundMatch
 }
 
-func (cfg *ServerConfiguration) CreateAuthToken(userId, clientContext, deviceId string) (string, []byte, error) {
-	key := make256Key()
-	authTokenMAC := makeTokenMAC(makeIdBytes(userId, clientContext, deviceId), key)
-	b64Token := base64.StdEncoding.EncodeToString(authTokenMAC)
-	return b64Token, key, nil
+// The auth token is what the device defers and stops its session with. It needs no state on the
+// webserver: it is the session id and the time it was issued, sealed with AES-GCM under TokenAuthKey,
+// with the user, context and device as the additional data, so it is only good for these. The backend
+// also checks the session id against the device's live session, so the token of a session that a later
+// registration replaced can not defer or stop the new one.
+//
+// To change the key, make the old TokenAuthKey a TokenAuthOldKey until the tokens it issued
+// have expired.
+
+const authTokenVersion = 1
+
+// authTokenClockSkew is how far in the future a token may have been issued, by a webserver whose
+// clock is ahead of ours.
+const authTokenClockSkew = 5 * time.Minute
+
+var (
+	AuthTokenInvalid = errors.New("Token is not valid")
+	AuthTokenExpired = errors.New("Token has expired")
+)
+
+// CreateAuthToken returns the auth token for the device's session.
+func (cfg *ServerConfiguration) CreateAuthToken(userId, clientContext, deviceId, sessionId string) (string, error) {
+	return cfg.createAuthToken(userId, clientContext, deviceId, sessionId, time.Now())
 }
 
-func (cfg *ServerConfiguration) ValidateAuthToken(userId, clientContext, deviceId, tokenb64 string, key []byte) bool {
-	// TODO Check length on token so base64 decoding doesn't blow up
-	token, err := base64.StdEncoding.DecodeString(tokenb64)
+func (cfg *ServerConfiguration) createAuthToken(userId, clientContext, deviceId, sessionId string, issued time.Time) (string, error) {
+	aead, err := newTokenAEAD(cfg.TokenAuthKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
 	if err != nil {
-		return false
+		return "", err
 	}
-	return checkMAC(makeIdBytes(userId, clientContext, deviceId), token, key)
+	plaintext := make([]byte, 9, 9+len(sessionId))
+	plaintext[0] = authTokenVersion
+	binary.BigEndian.PutUint64(plaintext[1:9], uint64(issued.Unix()))
+	plaintext = append(plaintext, sessionId...)
+	token := aead.Seal(nonce, nonce, plaintext, makeIdBytes(userId, clientContext, deviceId))
+	return base64.StdEncoding.EncodeToString(token), nil
 }
 
-func makeIdBytes(userId, clientContext, deviceId string) []byte {
-	str := fmt.Sprintf("%s:%s:%s", userId, clientContext, deviceId)
-	return []byte(str)
+// ValidateAuthToken checks that the token was issued for the device, by us, and has not expired.
+// It returns the session the token was issued for.
+func (cfg *ServerConfiguration) ValidateAuthToken(userId, clientContext, deviceId, tokenb64 string) (string, error) {
+	return cfg.validateAuthToken(userId, clientContext, deviceId, tokenb64, time.Now())
 }
 
-func checkMAC(message, messageMAC, key []byte) bool {
-	expectedMAC := makeTokenMAC(message, key)
-	return hmac.Equal(messageMAC, expectedMAC)
+func (cfg *ServerConfiguration) validateAuthToken(userId, clientContext, deviceId, tokenb64 string, now time.Time) (string, error) {
+	token, err := base64.StdEncoding.DecodeString(tokenb64)
+	if err != nil {
+		return "", AuthTokenInvalid
+	}
+	idBytes := makeIdBytes(userId, clientContext, deviceId)
+	for _, key := range append([]string{cfg.TokenAuthKey}, cfg.TokenAuthOldKey...) {
+		aead, err := newTokenAEAD(key)
+		if err != nil || len(token) < aead.NonceSize() {
+			continue
+		}
+		plaintext, err := aead.Open(nil, token[:aead.NonceSize()], token[aead.NonceSize():], idBytes)
+		if err != nil {
+			continue
+		}
+		if len(plaintext) < 9 || plaintext[0] != authTokenVersion {
+			return "", AuthTokenInvalid
+		}
+		issued := time.Unix(int64(binary.BigEndian.Uint64(plaintext[1:9])), 0)
+		if issued.After(now.Add(authTokenClockSkew)) {
+			return "", AuthTokenInvalid
+		}
+		if now.Sub(issued) > time.Duration(cfg.TokenExpiry)*time.Hour {
+			return "", AuthTokenExpired
+		}
+		return string(plaintext[9:]), nil
+	}
+	return "", AuthTokenInvalid
 }
 
-func make256Key() []byte {
-	key := make([]byte, 256)
-	_, err := rand.Read(key)
+func newTokenAEAD(key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(key))
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return key
+	return cipher.NewGCM(block)
 }
 
-func makeTokenMAC(message, key []byte) []byte {
-	mac := hmac.New(sha256.New, key)
-	mac.Write(message)
-	token := mac.Sum(nil)
-	return token
+func makeIdBytes(userId, clientContext, deviceId string) []byte {
+	str := fmt.Sprintf("%s:%s:%s", userId, clientContext, deviceId)
+	return []byte(str)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/suite"
 	"testing"
+	"time"
 )
 
 type ServerConfigTests struct {
@@ -36,16 +37,97 @@ func (s *ServerConfigTests) TestServerConfigValidation() {
 	s.NoError(err)
 }
 
+func (s *ServerConfigTests) TestRateLimitValidation() {
+	cfg := NewServerConfiguration()
+	cfg.TokenAuthKey = "01234567890123456789012345678901"
+	s.NoError(cfg.validate())
+
+	cfg.RateLimitIP = -1
+	s.EqualError(cfg.validate(), "rate-limit-ip can not be < 0")
+	cfg.RateLimitIP = 1
+	cfg.RateBurstIP = 0
+	s.EqualError(cfg.validate(), "rate-burst-ip must be >= 1 if rate-limit-ip is set")
+	cfg.RateLimitIP = 0
+	s.NoError(cfg.validate())
+
+	cfg.RateLimitDevice = -1
+	s.EqualError(cfg.validate(), "rate-limit-device can not be < 0")
+	cfg.RateLimitDevice = 1
+	cfg.RateBurstDevice = 0
+	s.EqualError(cfg.validate(), "rate-burst-device must be >= 1 if rate-limit-device is set")
+	cfg.RateLimitDevice = 0
+	s.NoError(cfg.validate())
+}
+
 func (s *ServerConfigTests) TestTokenCreationValidation() {
 	s.cfg.TokenAuthKey = "01234567890123456789012345678901"
 	testUserId := "us-east-1:44211d8c-caf6-4b17-80cf-72febe0ebb2d"
 	testClientContext := "123451234512345"
 	testDeviceId := "NchoDC28E565X072CX46B1XBF205"
-	token, key, err := s.cfg.CreateAuthToken(testUserId, testClientContext, testDeviceId)
+	token, err := s.cfg.CreateAuthToken(testUserId, testClientContext, testDeviceId, "0123456789abcdef")
 	s.NoError(err)
 	s.NotEqual("", token)
 	fmt.Printf("%d %s\n", len(token), token)
 
-	isValid := s.cfg.ValidateAuthToken(testUserId, testClientContext, testDeviceId, token, key)
-	s.True(isValid)
+	sessionId, err := s.cfg.ValidateAuthToken(testUserId, testClientContext, testDeviceId, token)
+	s.NoError(err)
+	s.Equal("0123456789abcdef", sessionId)
+
+	// only good for the device it was issued for
+	_, err = s.cfg.ValidateAuthToken(testUserId, testClientContext, "NchoDC28E565X072CX46B1XBF206", token)
+	s.Equal(AuthTokenInvalid, err)
+	_, err = s.cfg.ValidateAuthToken(testUserId, "123451234512346", testDeviceId, token)
+	s.Equal(AuthTokenInvalid, err)
+	_, err = s.cfg.ValidateAuthToken(testUserId, testClientContext, testDeviceId, "not base64!")
+	s.Equal(AuthTokenInvalid, err)
+	_, err = s.cfg.ValidateAuthToken(testUserId, testClientContext, testDeviceId, "")
+	s.Equal(AuthTokenInvalid, err)
+}
+
+func (s *ServerConfigTests) TestTokenExpiry() {
+	cfg := NewServerConfiguration()
+	cfg.TokenAuthKey = "01234567890123456789012345678901"
+	cfg.TokenExpiry = 24
+	now := time.Now()
+	token, err := cfg.createAuthToken("user1", "context1", "device1", "session1", now.Add(-23*time.Hour))
+	s.NoError(err)
+	_, err = cfg.validateAuthToken("user1", "context1", "device1", token, now)
+	s.NoError(err)
+	_, err = cfg.validateAuthToken("user1", "context1", "device1", token, now.Add(2*time.Hour))
+	s.Equal(AuthTokenExpired, err)
+
+	// issued in the future
+	token, err = cfg.createAuthToken("user1", "context1", "device1", "session1", now.Add(time.Hour))
+	s.NoError(err)
+	_, err = cfg.validateAuthToken("user1", "context1", "device1", token, now)
+	s.Equal(AuthTokenInvalid, err)
+}
+
+func (s *ServerConfigTests) TestTokenKeyRotation() {
+	cfg := NewServerConfiguration()
+	cfg.TokenAuthKey = "01234567890123456789012345678901"
+	oldToken, err := cfg.CreateAuthToken("user1", "context1", "device1", "session1")
+	s.NoError(err)
+
+	cfg.TokenAuthKey = "abcdefghijabcdefghijabcdefghijab"
+	_, err = cfg.ValidateAuthToken("user1", "context1", "device1", oldToken)
+	s.Equal(AuthTokenInvalid, err)
+
+	cfg.TokenAuthOldKey = []string{"01234567890123456789012345678901"}
+	s.NoError(cfg.validate())
+	sessionId, err := cfg.ValidateAuthToken("user1", "context1", "device1", oldToken)
+	s.NoError(err)
+	s.Equal("session1", sessionId)
+
+	newToken, err := cfg.CreateAuthToken("user1", "context1", "device1", "session2")
+	s.NoError(err)
+	sessionId, err = cfg.ValidateAuthToken("user1", "context1", "device1", newToken)
+	s.NoError(err)
+	s.Equal("session2", sessionId)
+
+	cfg.TokenAuthOldKey = []string{"tooshort"}
+	s.Error(cfg.validate())
+	cfg.TokenAuthOldKey = nil
+	cfg.TokenExpiry = 0
+	s.EqualError(cfg.validate(), "TokenExpiry must be more than 0 hours")
 }
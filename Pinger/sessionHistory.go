@@ -0,0 +1,77 @@
+package Pinger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type SessionEventType string
+
+const (
+	SessionEventTransition      SessionEventType = "transition"        // FSM state change
+	SessionEventNewMail         SessionEventType = "new-mail"          // the mail server reported new mail
+	SessionEventPushSent        SessionEventType = "push-sent"         // push notification sent
+	SessionEventPushFailed      SessionEventType = "push-failed"       // push notification could not be sent
+	SessionEventPushDeferred    SessionEventType = "push-deferred"     // push notification held back by the device's preferences
+	SessionEventMailServerError SessionEventType = "mail-server-error" // the long poll failed
+	SessionEventDefer           SessionEventType = "defer"             // the device deferred the poll
+	SessionEventReRegister      SessionEventType = "reregister"        // the device was told to re-register
+	SessionEventStop            SessionEventType = "stop"              // the session was stopped
+)
+
+// SessionEvent is something that happened during the lifetime of a session.
+type SessionEvent struct {
+	Time    time.Time
+	Type    SessionEventType
+	Message string
+}
+
+// ClientSessionHistory is a session, with its recent lifecycle events, oldest first.
+type ClientSessionHistory struct {
+	Session ClientSessionInfo
+	Events  []SessionEvent
+}
+
+// sessionHistory is a ring buffer of the most recent events of a session.
+type sessionHistory struct {
+	mutex  sync.Mutex
+	events []SessionEvent
+	next   int  // where the next event goes
+	full   bool // whether we've wrapped around
+}
+
+func newSessionHistory(size int) *sessionHistory {
+	if size <= 0 {
+		size = defaultSessionHistorySize
+	}
+	return &sessionHistory{
+		events: make([]SessionEvent, size),
+	}
+}
+
+func (h *sessionHistory) add(eventType SessionEventType, format string, args ...interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events[h.next] = SessionEvent{
+		Time:    time.Now().UTC(),
+		Type:    eventType,
+		Message: fmt.Sprintf(format, args...),
+	}
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns a copy of the events, oldest first.
+func (h *sessionHistory) list() []SessionEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.full {
+		return append([]SessionEvent(nil), h.events[:h.next]...)
+	}
+	events := make([]SessionEvent, 0, len(h.events))
+	events = append(events, h.events[h.next:]...)
+	return append(events, h.events[:h.next]...)
+}
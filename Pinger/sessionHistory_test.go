@@ -0,0 +1,47 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type sessionHistoryTester struct {
+	suite.Suite
+}
+
+func TestSessionHistory(t *testing.T) {
+	s := new(sessionHistoryTester)
+	suite.Run(t, s)
+}
+
+func (s *sessionHistoryTester) TestRingBuffer() {
+	h := newSessionHistory(3)
+	s.Empty(h.list())
+
+	h.add(SessionEventTransition, "%s -> %s", FSMInit, FSMDeferred)
+	h.add(SessionEventDefer, "Deferred")
+	events := h.list()
+	s.Len(events, 2)
+	s.Equal(SessionEventTransition, events[0].Type)
+	s.Equal("init -> deferred", events[0].Message)
+	s.False(events[0].Time.IsZero())
+
+	for i := 0; i < 4; i++ {
+		h.add(SessionEventPushSent, "push %d", i)
+	}
+	events = h.list()
+	s.Len(events, 3, "only the most recent events are kept")
+	for i, event := range events {
+		s.Equal(fmt.Sprintf("push %d", i+1), event.Message, "oldest first")
+	}
+
+	// list returns a copy
+	events[0].Message = "changed"
+	s.Equal("push 1", h.list()[0].Message)
+}
+
+func (s *sessionHistoryTester) TestDefaultSize() {
+	h := newSessionHistory(0)
+	s.Equal(defaultSessionHistorySize, len(h.events))
+}
@@ -0,0 +1,136 @@
+package Pinger
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// SessionSortKey is the order in which FindActiveSessions returns the sessions.
+type SessionSortKey string
+
+const (
+	SessionSortNone     SessionSortKey = ""         // in no particular order
+	SessionSortUser     SessionSortKey = "user"     // by user, context and device
+	SessionSortStatus   SessionSortKey = "status"   // by status, then user, context and device
+	SessionSortProtocol SessionSortKey = "protocol" // by protocol, then user, context and device
+	SessionSortServer   SessionSortKey = "server"   // by mail server, then user, context and device
+)
+
+func (key SessionSortKey) validate() error {
+	switch key {
+	case SessionSortNone, SessionSortUser, SessionSortStatus, SessionSortProtocol, SessionSortServer:
+		return nil
+	}
+	return fmt.Errorf("Unknown sort key '%s'. Use '%s', '%s', '%s' or '%s'", key, SessionSortUser, SessionSortStatus, SessionSortProtocol, SessionSortServer)
+}
+
+type bySessionKey []ClientSessionInfo
+
+func (s bySessionKey) Len() int      { return len(s) }
+func (s bySessionKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySessionKey) Less(i, j int) bool {
+	if s[i].UserId != s[j].UserId {
+		return s[i].UserId < s[j].UserId
+	}
+	if s[i].ClientContext != s[j].ClientContext {
+		return s[i].ClientContext < s[j].ClientContext
+	}
+	return s[i].DeviceId < s[j].DeviceId
+}
+
+// byField sorts by a field of the session, and then by user, context and device.
+type byField struct {
+	bySessionKey
+	field func(session *ClientSessionInfo) string
+}
+
+func (s byField) Less(i, j int) bool {
+	a, b := s.field(&s.bySessionKey[i]), s.field(&s.bySessionKey[j])
+	if a != b {
+		return a < b
+	}
+	return s.bySessionKey.Less(i, j)
+}
+
+func sortSessions(sessions []ClientSessionInfo, key SessionSortKey) {
+	switch key {
+	case SessionSortUser:
+		sort.Sort(bySessionKey(sessions))
+	case SessionSortStatus:
+		sort.Sort(byField{sessions, func(session *ClientSessionInfo) string { return session.Status.String() }})
+	case SessionSortProtocol:
+		sort.Sort(byField{sessions, func(session *ClientSessionInfo) string { return session.Protocol }})
+	case SessionSortServer:
+		sort.Sort(byField{sessions, func(session *ClientSessionInfo) string { return session.MailServer }})
+	}
+}
+
+// SessionSummary counts the matching sessions, instead of listing them.
+type SessionSummary struct {
+	Total      int
+	ByStatus   map[string]int
+	ByProtocol map[string]int
+	ByServer   map[string]int
+}
+
+func summarizeSessions(sessions []ClientSessionInfo) *SessionSummary {
+	summary := SessionSummary{
+		Total:      len(sessions),
+		ByStatus:   make(map[string]int),
+		ByProtocol: make(map[string]int),
+		ByServer:   make(map[string]int),
+	}
+	for _, session := range sessions {
+		summary.ByStatus[session.Status.String()]++
+		summary.ByProtocol[session.Protocol]++
+		summary.ByServer[session.MailServer]++
+	}
+	return &summary
+}
+
+// validate checks the filters, so a typo doesn't look like there are no matching sessions.
+func (fs *FindSessionsArgs) validate() error {
+	if fs.Status != "" {
+		if _, err := ParseMailClientStatus(fs.Status); err != nil {
+			return err
+		}
+	}
+	return fs.SortBy.validate()
+}
+
+// matches returns true if the session matches any of the user, context and device, or if none are
+// given, and all of the other filters.
+func (fs *FindSessionsArgs) matches(session *ClientSessionInfo) bool {
+	return fs.matchesIds(session) &&
+		(fs.Status == "" || strings.EqualFold(fs.Status, session.Status.String())) &&
+		(fs.Protocol == "" || strings.EqualFold(fs.Protocol, session.Protocol)) &&
+		(fs.MailServer == "" || matchesMailServer(fs.MailServer, session.MailServer))
+}
+
+func (fs *FindSessionsArgs) matchesIds(session *ClientSessionInfo) bool {
+	switch {
+	case fs.UserId == "" && fs.ClientContext == "" && fs.DeviceId == "":
+		return true
+
+	case fs.UserId != "" && session.UserId == fs.UserId:
+		return true
+
+	case fs.ClientContext != "" && session.ClientContext == fs.ClientContext:
+		return true
+
+	case fs.DeviceId != "" && session.DeviceId == fs.DeviceId:
+		return true
+	}
+	return false
+}
+
+// matchesMailServer matches a host, or host:port, against the mail server of a session (see mailServerHost).
+func matchesMailServer(server, sessionServer string) bool {
+	if strings.EqualFold(server, sessionServer) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(sessionServer)
+	return err == nil && strings.EqualFold(server, host)
+}
@@ -0,0 +1,94 @@
+package Pinger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coopernurse/gorp"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"strings"
+)
+
+// Storage is where the pinger keeps the devices, when it last contacted them, and the pingers. The
+// type in the [db] section of the config selects it: sqlite, mysql and postgres are SQL (see db.go),
+// dynamo is DynamoDB (see storage_dynamo.go), and memory keeps everything in the process (see
+// storage_memory.go).
+type Storage interface {
+	deviceInfo() DeviceInfoDbHandler
+	deviceContact() DeviceContactDbHandler
+	pingerInfo() PingerInfoDbHandler
+}
+
+// outOfDateError is what the storages other than SQL return where gorp returns an OptimisticLockError:
+// the object was updated since it was read, or it was deleted.
+func outOfDateError(table string, key interface{}, version int64) error {
+	return fmt.Errorf("%s: %v is out of date (version %d), or deleted", table, key, version)
+}
+
+// joinKey joins the parts of a key, for the storages that need it as one string.
+func joinKey(parts ...string) string {
+	return strings.Join(parts, "|")
+}
+
+// keyFromValues is joinKey for the values of the keys a handler's get is called with.
+func keyFromValues(keys []AWS.DBKeyValue) (string, error) {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k.Comparison != AWS.KeyComparisonEq {
+			return "", errors.New("Can only use KeyComparisonEq for get")
+		}
+		v, ok := k.Value.(string)
+		if !ok {
+			return "", fmt.Errorf("Key %s is not a string", k.Key)
+		}
+		parts = append(parts, v)
+	}
+	return joinKey(parts...), nil
+}
+
+func (di *DeviceInfo) storageKey() string {
+	return joinKey(di.UserId, di.ClientContext, di.DeviceId, di.SessionId)
+}
+
+func (dc *deviceContact) storageKey() string {
+	return joinKey(dc.UserId, dc.ClientContext, dc.DeviceId)
+}
+
+// newStorage connects to the storage the config selects. With init, it creates or updates the tables.
+func newStorage(dbconfig *DBConfiguration, aws AWS.AWSHandler, init bool, logger *Logging.Logger) (Storage, error) {
+	err := dbconfig.Validate()
+	if err != nil {
+		return nil, err
+	}
+	switch dbconfig.Type {
+	case "dynamo":
+		return newDynamoStorage(aws.GetDynamoDbSession(), dbconfig.TablePrefix, init, logger)
+	case "memory":
+		return newMemoryStorage(), nil
+	}
+	dbm, err := initDB(dbconfig, init, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlStorage(dbm), nil
+}
+
+type sqlStorage struct {
+	dbm *gorp.DbMap
+}
+
+func newSqlStorage(dbm *gorp.DbMap) *sqlStorage {
+	return &sqlStorage{dbm: dbm}
+}
+
+func (s *sqlStorage) deviceInfo() DeviceInfoDbHandler {
+	return newDeviceInfoSqlHandler(s.dbm)
+}
+
+func (s *sqlStorage) deviceContact() DeviceContactDbHandler {
+	return newDeviceContactSqlDbHandler(s.dbm)
+}
+
+func (s *sqlStorage) pingerInfo() PingerInfoDbHandler {
+	return newPingerInfoSqlHandler(s.dbm)
+}
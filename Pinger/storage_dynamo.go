@@ -0,0 +1,231 @@
+package Pinger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/gen/dynamodb"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"reflect"
+	"time"
+)
+
+// The DynamoDB tables have the same names as the SQL ones, with the TablePrefix from the config in
+// front, e.g. alpha.pinger.device_info. The attributes are the db tags of the fields.
+//
+// DynamoDB keys have at most two attributes, so the tables keyed by user, context, device (and
+// session) have a 'key' attribute, which is them joined by '|' (see joinKey).
+
+const (
+	dynamoKeyAttribute          = "key"
+	dynamoDeviceInfoPingerIndex = "pinger-index"
+	dynamoTableThroughput       = 10
+	dynamoTableCreateTimeout    = 5 * time.Minute
+)
+
+type dynamoStorage struct {
+	dynamo *AWS.DynamoDb
+	prefix string
+}
+
+func newDynamoStorage(dynamo *AWS.DynamoDb, prefix string, init bool, logger *Logging.Logger) (*dynamoStorage, error) {
+	if dynamo == nil {
+		return nil, errors.New("No DynamoDb session. Check the aws section of the config")
+	}
+	s := &dynamoStorage{dynamo: dynamo, prefix: prefix}
+	if init {
+		err := s.createTables(logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *dynamoStorage) tableName(name string) string {
+	return s.prefix + name
+}
+
+func (s *dynamoStorage) deviceInfo() DeviceInfoDbHandler {
+	return newDeviceInfoDynamoDbHandler(s)
+}
+
+func (s *dynamoStorage) deviceContact() DeviceContactDbHandler {
+	return newDeviceContactDynamoDbHandler(s)
+}
+
+func (s *dynamoStorage) pingerInfo() PingerInfoDbHandler {
+	return newPingerInfoDynamoDbHandler(s)
+}
+
+// createTables creates the tables that don't exist yet.
+func (s *dynamoStorage) createTables(logger *Logging.Logger) error {
+	throughput := AWS.ThroughPut{Read: dynamoTableThroughput, Write: dynamoTableThroughput}
+
+	deviceInfoReq := s.dynamo.CreateTableReq(s.tableName(deviceTableName),
+		[]AWS.DBAttrDefinition{
+			{Name: dynamoKeyAttribute, Type: AWS.String},
+			{Name: pingerColumn, Type: AWS.String},
+		},
+		[]AWS.DBKeyType{{Name: dynamoKeyAttribute, Type: AWS.KeyTypeHash}},
+		throughput)
+	// for findByPingerId
+	err := s.dynamo.AddGlobalSecondaryIndexStruct(deviceInfoReq, dynamoDeviceInfoPingerIndex,
+		[]AWS.DBKeyType{{Name: pingerColumn, Type: AWS.KeyTypeHash}},
+		throughput)
+	if err != nil {
+		return err
+	}
+
+	deviceContactReq := s.dynamo.CreateTableReq(s.tableName(deviceContactTableName),
+		[]AWS.DBAttrDefinition{{Name: dynamoKeyAttribute, Type: AWS.String}},
+		[]AWS.DBKeyType{{Name: dynamoKeyAttribute, Type: AWS.KeyTypeHash}},
+		throughput)
+
+	pingerInfoReq := s.dynamo.CreateTableReq(s.tableName(PingerTableName),
+		[]AWS.DBAttrDefinition{{Name: "pinger", Type: AWS.String}},
+		[]AWS.DBKeyType{{Name: "pinger", Type: AWS.KeyTypeHash}},
+		throughput)
+
+	for _, createReq := range []struct {
+		name string
+		req  *dynamodb.CreateTableInput
+	}{
+		{s.tableName(deviceTableName), deviceInfoReq},
+		{s.tableName(deviceContactTableName), deviceContactReq},
+		{s.tableName(PingerTableName), pingerInfoReq},
+	} {
+		exists, err := s.dynamo.TableExists(createReq.name)
+		if err != nil {
+			return fmt.Errorf("Could not describe DynamoDB table %s: %s", createReq.name, err)
+		}
+		if exists {
+			continue
+		}
+		err = s.dynamo.CreateTable(createReq.req)
+		if err != nil {
+			return fmt.Errorf("Could not create DynamoDB table %s: %s", createReq.name, err)
+		}
+		err = s.dynamo.WaitForTable(createReq.name, dynamoTableCreateTimeout)
+		if err != nil {
+			return err
+		}
+		logger.Info("Created DynamoDB table %s|msgCode=DYNAMO_TABLE_CREATED", createReq.name)
+	}
+	return nil
+}
+
+// The items are written like gorp writes the rows: insert fails if the key exists, and the tables
+// with a version column (see SetVersionCol), device_info and device_contact, are versioned by id. An
+// insert starts at version 1, and update and delete fail on an out-of-date version. Unversioned, they
+// return 0 if there is no item.
+
+func (s *dynamoStorage) insertItem(tableName string, item map[string]interface{}, keyAttribute string) error {
+	err := s.dynamo.PutIf(tableName, item, []AWS.DBExpected{{Key: keyAttribute}})
+	if AWS.IsConditionFailed(err) {
+		return fmt.Errorf("%s: %s %v already exists", tableName, keyAttribute, item[keyAttribute])
+	}
+	return err
+}
+
+// updateItem updates the item, if there is one with the key.
+func (s *dynamoStorage) updateItem(tableName string, item map[string]interface{}, keyAttribute string) (int64, error) {
+	err := s.dynamo.PutIf(tableName, item, []AWS.DBExpected{{Key: keyAttribute, Value: item[keyAttribute]}})
+	if err != nil {
+		if AWS.IsConditionFailed(err) {
+			return 0, nil
+		}
+		return -1, err
+	}
+	return 1, nil
+}
+
+func (s *dynamoStorage) deleteItem(tableName string, key map[string]interface{}, keyAttribute string) (int64, error) {
+	err := s.dynamo.DeleteIf(tableName, key, []AWS.DBExpected{{Key: keyAttribute, Value: key[keyAttribute]}})
+	if err != nil {
+		if AWS.IsConditionFailed(err) {
+			return 0, nil
+		}
+		return -1, err
+	}
+	return 1, nil
+}
+
+// updateVersioned bumps the version, and writes the item that item() returns, if the one in the table
+// is at the previous version.
+func (s *dynamoStorage) updateVersioned(tableName string, version *int64, item func() map[string]interface{}) (int64, error) {
+	existing := *version
+	*version = existing + 1
+	itemMap := item()
+	err := s.dynamo.PutIf(tableName, itemMap, []AWS.DBExpected{{Key: "id", Value: existing}})
+	if err != nil {
+		*version = existing
+		if AWS.IsConditionFailed(err) {
+			if existing == 0 {
+				return 0, nil
+			}
+			return -1, outOfDateError(tableName, itemMap[dynamoKeyAttribute], existing)
+		}
+		return -1, err
+	}
+	return 1, nil
+}
+
+func (s *dynamoStorage) deleteVersioned(tableName string, key string, version int64) (int64, error) {
+	err := s.dynamo.DeleteIf(tableName, map[string]interface{}{dynamoKeyAttribute: key}, []AWS.DBExpected{{Key: "id", Value: version}})
+	if err != nil {
+		if AWS.IsConditionFailed(err) {
+			if version == 0 {
+				return 0, nil
+			}
+			return -1, outOfDateError(tableName, key, version)
+		}
+		return -1, err
+	}
+	return 1, nil
+}
+
+// dynamoItem returns the fields of obj, a pointer to a struct, by their db tags.
+func dynamoItem(obj interface{}) map[string]interface{} {
+	item := make(map[string]interface{})
+	v := reflect.ValueOf(obj).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("db")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.String:
+			item[tag] = f.String()
+		case reflect.Int64:
+			item[tag] = f.Int()
+		default:
+			panic(fmt.Sprintf("Can not store %s.%s in DynamoDB", t.Name(), t.Field(i).Name))
+		}
+	}
+	return item
+}
+
+// fromDynamoItem sets the fields of obj, a pointer to a struct, from the attributes named by their db tags.
+// Missing attributes, e.g. empty strings, which DynamoDB doesn't store, leave the fields as they are.
+func fromDynamoItem(item map[string]interface{}, obj interface{}) {
+	v := reflect.ValueOf(obj).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("db")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		switch value := item[tag].(type) {
+		case string:
+			if v.Field(i).Kind() == reflect.String {
+				v.Field(i).SetString(value)
+			}
+		case int64:
+			if v.Field(i).Kind() == reflect.Int64 {
+				v.Field(i).SetInt(value)
+			}
+		}
+	}
+}
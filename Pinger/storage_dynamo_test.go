@@ -0,0 +1,199 @@
+package Pinger
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type dynamoStorageTester struct {
+	suite.Suite
+	logger   *Logging.Logger
+	server   *AWS.TestDynamoDbServer
+	aws      *AWS.TestAwsHandler
+	dbconfig DBConfiguration
+	db       Storage
+}
+
+func TestDynamoStorage(t *testing.T) {
+	s := new(dynamoStorageTester)
+	suite.Run(t, s)
+}
+
+func (s *dynamoStorageTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *dynamoStorageTester) SetupTest() {
+	var err error
+	s.server = AWS.NewTestDynamoDbServer()
+	s.aws = AWS.NewTestAwsHandler()
+	s.aws.SetDynamoDb(s.server.Session())
+	s.dbconfig = DBConfiguration{Type: "dynamo", TablePrefix: "unittest.pinger."}
+	s.db, err = newStorage(&s.dbconfig, s.aws, true, s.logger)
+	require.NoError(s.T(), err)
+	globals = nil
+	setGlobal(NewBackendConfiguration())
+}
+
+func (s *dynamoStorageTester) TearDownTest() {
+	s.server.Close()
+	globals = nil
+}
+
+func (s *dynamoStorageTester) newDevice(userId, clientContext, deviceId, sessionId string) *DeviceInfo {
+	pushToken := fmt.Sprintf("%064x", []byte(userId+deviceId))[:64]
+	di, err := newDeviceInfo(userId, clientContext, deviceId, pushToken, "APNS", "ios", "8.1", "0.9", "", sessionId, s.aws, s.db.deviceInfo(), s.logger)
+	require.NoError(s.T(), err)
+	di.AWSEndpointArn = "12345"
+	s.NoError(di.insert(nil))
+	return di
+}
+
+func (s *dynamoStorageTester) TestCreateTables() {
+	s.Equal([]string{"unittest.pinger.device_contact", "unittest.pinger.device_info", "unittest.pinger.pinger_info"}, s.server.Tables())
+
+	// the tables exist now
+	_, err := newStorage(&s.dbconfig, s.aws, true, s.logger)
+	s.NoError(err)
+
+	// and without a session, there's nothing to talk to
+	s.aws.SetDynamoDb(nil)
+	_, err = newStorage(&s.dbconfig, s.aws, true, s.logger)
+	s.Error(err)
+}
+
+func (s *dynamoStorageTester) TestNoMigrations() {
+	_, _, err := MigrateDB(&s.dbconfig, s.logger)
+	s.Error(err)
+}
+
+func (s *dynamoStorageTester) TestDeviceInfo() {
+	di := s.newDevice("user1", "context1", "device1", "session1")
+	s.NotEqual(int64(0), di.Created)
+	s.Equal(pingerHostId, di.Pinger)
+
+	di2, err := getDeviceInfo(s.db.deviceInfo(), s.aws, "user1", "context1", "device1", "session1", s.logger)
+	s.NoError(err)
+	require.NotNil(s.T(), di2)
+	s.Equal(di.PushToken, di2.PushToken)
+	s.Equal(di.AWSEndpointArn, di2.AWSEndpointArn)
+	s.Equal(di.Created, di2.Created)
+	s.Equal("", di2.AppBuildNumber, "empty strings are not stored, and read back as empty")
+
+	changed, err := di2.updateDeviceInfo("", "APNS", di2.PushToken, "ios", "8.2", "0.9", "", di2.notificationPreferences())
+	s.NoError(err)
+	s.True(changed)
+	di3, err := getDeviceInfo(s.db.deviceInfo(), s.aws, "user1", "context1", "device1", "session1", s.logger)
+	s.NoError(err)
+	s.Equal("8.2", di3.OSVersion)
+
+	di4, err := getDeviceInfo(s.db.deviceInfo(), s.aws, "user1", "context1", "device1", "session2", s.logger)
+	s.NoError(err)
+	s.Nil(di4)
+
+	n, err := di3.delete()
+	s.NoError(err)
+	s.Equal(int64(1), n)
+	di4, err = getDeviceInfo(s.db.deviceInfo(), s.aws, "user1", "context1", "device1", "session1", s.logger)
+	s.NoError(err)
+	s.Nil(di4)
+}
+
+func (s *dynamoStorageTester) TestFind() {
+	s.newDevice("user1", "context1", "device1", "session1")
+	s.newDevice("user1", "context2", "device1", "session1")
+	s.newDevice("user2", "context3", "device2", "session1")
+	other := s.newDevice("user3", "context4", "device3", "session1")
+	other.Pinger = "some-other-pinger"
+	other.update()
+
+	// more than one page
+	s.server.PageSize = 1
+
+	devices, err := getAllMyDeviceInfo(s.db.deviceInfo(), s.aws, s.logger)
+	s.NoError(err)
+	s.Len(devices, 3)
+
+	devices, err = findDevices(s.db, s.aws, &deviceFilter{UserId: "user1"}, s.logger)
+	s.NoError(err)
+	s.Len(devices, 2)
+
+	devices, err = findDevices(s.db, s.aws, &deviceFilter{UserId: "user1", ClientContext: "context2", Pinger: pingerHostId}, s.logger)
+	s.NoError(err)
+	require.Len(s.T(), devices, 1)
+	s.Equal("context2", devices[0].ClientContext)
+
+	devices, err = findDevices(s.db, s.aws, &deviceFilter{Pinger: "some-other-pinger"}, s.logger)
+	s.NoError(err)
+	require.Len(s.T(), devices, 1)
+	s.Equal("user3", devices[0].UserId)
+
+	devices, err = findDevices(s.db, s.aws, &deviceFilter{}, s.logger)
+	s.NoError(err)
+	s.Len(devices, 4)
+}
+
+func (s *dynamoStorageTester) TestAlertDevices() {
+	s.newDevice("user1", "context1", "device1", "session1")
+	s.newDevice("user1", "context2", "device1", "session1")
+	s.newDevice("user2", "context3", "device2", "session1")
+
+	n := alertAllDevices(s.db, s.aws, s.logger)
+	s.Equal(2, n) // both contexts are on the same device
+
+	pushes, err := alertDevices(s.db, s.aws, &deviceFilter{UserId: "user2"}, s.logger)
+	s.NoError(err)
+	s.Equal(1, pushes)
+}
+
+func (s *dynamoStorageTester) TestDeviceContact() {
+	di := s.newDevice("user1", "context1", "device1", "session1")
+
+	lastContact, lastContactRequest, err := di.getContactInfo(false)
+	s.NoError(err)
+	s.NotEqual(int64(0), lastContact)
+	s.Equal(int64(0), lastContactRequest)
+
+	s.NoError(di.updateLastContactRequest())
+	_, lastContactRequest, err = di.getContactInfo(false)
+	s.NoError(err)
+	s.NotEqual(int64(0), lastContactRequest)
+
+	s.NoError(di.updateLastContact())
+	lastContact2, _, err := di.getContactInfo(false)
+	s.NoError(err)
+	s.True(lastContact2 >= lastContact)
+
+	dc, err := deviceContactGet(s.db.deviceContact(), "user1", "context1", "device2")
+	s.NoError(err)
+	s.Nil(dc)
+}
+
+func (s *dynamoStorageTester) TestPingerInfo() {
+	pinger, err := newPingerInfo(s.db.pingerInfo(), s.logger)
+	s.NoError(err)
+	require.NotNil(s.T(), pinger)
+	s.Equal(pingerHostId, pinger.Pinger)
+	created := pinger.Created
+	s.NotEqual(int64(0), created)
+
+	// the second time, it's updated
+	pinger, err = newPingerInfo(s.db.pingerInfo(), s.logger)
+	s.NoError(err)
+	s.Equal(created, pinger.Created)
+	s.True(pinger.Updated >= created)
+
+	n, err := s.db.pingerInfo().delete(pinger)
+	s.NoError(err)
+	s.Equal(int64(1), n)
+}
+
+func (s *dynamoStorageTester) TestSqlStorage() {
+	db, err := newStorage(&DBConfiguration{Type: "sqlite", Filename: ":memory:"}, s.aws, true, s.logger)
+	s.NoError(err)
+	s.IsType(&sqlStorage{}, db)
+}
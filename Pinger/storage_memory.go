@@ -0,0 +1,48 @@
+package Pinger
+
+import (
+	"sync"
+)
+
+// memoryStorage keeps everything in maps, for the tests and for a single pinger in development.
+// Nothing survives a restart, and nothing is shared with other pingers. The handlers store and
+// return copies, so, like with the other storages, a change is only seen once it is written.
+type memoryStorage struct {
+	mutex    sync.Mutex
+	devices  map[string]DeviceInfo
+	contacts map[string]deviceContact
+	pingers  map[string]PingerInfo
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		devices:  make(map[string]DeviceInfo),
+		contacts: make(map[string]deviceContact),
+		pingers:  make(map[string]PingerInfo),
+	}
+}
+
+func (s *memoryStorage) deviceInfo() DeviceInfoDbHandler {
+	return &DeviceInfoMemoryHandler{storage: s}
+}
+
+func (s *memoryStorage) deviceContact() DeviceContactDbHandler {
+	return &DeviceContactMemoryHandler{storage: s}
+}
+
+func (s *memoryStorage) pingerInfo() PingerInfoDbHandler {
+	return &PingerInfoMemoryHandler{storage: s}
+}
+
+// checkVersion does what gorp does with the version column, for a write of an object at version to
+// what is stored (exists false if nothing is). It returns 1 if the write can go ahead, and otherwise
+// what the handler returns: 0 rows for a new object, or an out of date error.
+func checkVersion(table, key string, exists bool, stored, version int64) (int64, error) {
+	if exists && stored == version {
+		return 1, nil
+	}
+	if version == 0 {
+		return 0, nil
+	}
+	return -1, outOfDateError(table, key, version)
+}
@@ -0,0 +1,31 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Logging"
+)
+
+// testStorageTypes are the storages the handler suites run against.
+var testStorageTypes = []string{"sqlite", "memory", "dynamo"}
+
+// newTestStorage returns an empty storage of the type, and a function to release it. dynamo talks
+// to an in-memory DynamoDB stand-in, which it sets on aws.
+func newTestStorage(dbType string, aws *AWS.TestAwsHandler, logger *Logging.Logger) (Storage, func()) {
+	dbconfig := DBConfiguration{Type: dbType}
+	closer := func() {}
+	switch dbType {
+	case "sqlite":
+		dbconfig.Filename = ":memory:"
+	case "dynamo":
+		server := AWS.NewTestDynamoDbServer()
+		aws.SetDynamoDb(server.Session())
+		dbconfig.TablePrefix = "unittest.pinger."
+		closer = server.Close
+	}
+	db, err := newStorage(&dbconfig, aws, true, logger)
+	if err != nil {
+		closer()
+		panic("Could not create " + dbType + " storage: " + err.Error())
+	}
+	return db, closer
+}
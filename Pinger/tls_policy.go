@@ -0,0 +1,251 @@
+package Pinger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// TLSPolicyConfiguration is the trust policy for the mail servers in a domain. It is read from
+// the [tls-policy "<domain>"] sections of the config file, and applies to the domain and all
+// its sub-domains. A [tls-policy] section without a domain applies to all mail servers not
+// covered by a more specific section.
+type TLSPolicyConfiguration struct {
+	Pin             []string `gcfg:"pin"`               // SPKI pins, in the form sha256/<base64 of the sha256 of the SubjectPublicKeyInfo>
+	ExtraCA         []string `gcfg:"extra-ca"`          // PEM files with CA's trusted for this domain only
+	MinVersion      string   `gcfg:"min-version"`       // 1.0, 1.1, 1.2 or 1.3
+	Cipher          []string `gcfg:"cipher"`            // allowed cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	AllowDeviceCert bool     `gcfg:"allow-device-cert"` // accept a (self-signed) cert the device vouched for at registration
+
+	// private
+	pins         map[string]bool
+	extraCAs     []*x509.Certificate
+	minVersion   uint16
+	cipherSuites []uint16
+	mutex        sync.Mutex
+	rootBase     *x509.CertPool // the root certs rootCAs was built from
+	rootCAs      *x509.CertPool
+}
+
+var CertificatePinMismatch error
+
+func init() {
+	CertificatePinMismatch = fmt.Errorf("x509: certificate pin mismatch")
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (policy *TLSPolicyConfiguration) validate(domain string) error {
+	policy.pins = make(map[string]bool)
+	for _, pin := range policy.Pin {
+		if !strings.HasPrefix(pin, "sha256/") {
+			return fmt.Errorf("tls-policy %s: pin %s must start with sha256/", domain, pin)
+		}
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("tls-policy %s: pin %s is not a base64 encoded sha256 hash", domain, pin)
+		}
+		policy.pins[pin] = true
+	}
+	policy.extraCAs = nil
+	for _, file := range policy.ExtraCA {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("tls-policy %s: %s", domain, err)
+		}
+		n := len(policy.extraCAs)
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("tls-policy %s: %s: %s", domain, file, err)
+			}
+			policy.extraCAs = append(policy.extraCAs, cert)
+		}
+		if len(policy.extraCAs) == n {
+			return fmt.Errorf("tls-policy %s: Could not read PEM file %s", domain, file)
+		}
+	}
+	if policy.MinVersion != "" {
+		version, ok := tlsVersions[policy.MinVersion]
+		if !ok {
+			return fmt.Errorf("tls-policy %s: Unknown min-version %s", domain, policy.MinVersion)
+		}
+		policy.minVersion = version
+	}
+	if len(policy.Cipher) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range policy.Cipher {
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("tls-policy %s: Unknown or insecure cipher %s", domain, name)
+			}
+			policy.cipherSuites = append(policy.cipherSuites, id)
+		}
+	}
+	return nil
+}
+
+// tlsPolicyFor returns the most specific policy for the host, or nil if there is none.
+func (cfg *BackendConfiguration) tlsPolicyFor(host string) *TLSPolicyConfiguration {
+	_, policy := cfg.tlsPolicyMatch(host)
+	return policy
+}
+
+// tlsPolicyName names the policy for the host in log messages: the domain of its section,
+// "default" for the [tls-policy] section without a domain, or "none".
+func (cfg *BackendConfiguration) tlsPolicyName(host string) string {
+	domain, policy := cfg.tlsPolicyMatch(host)
+	switch {
+	case policy == nil:
+		return "none"
+	case domain == "":
+		return "default"
+	}
+	return domain
+}
+
+func (cfg *BackendConfiguration) tlsPolicyMatch(host string) (string, *TLSPolicyConfiguration) {
+	host = strings.ToLower(host)
+	var policy *TLSPolicyConfiguration
+	var policyDomain string
+	matched := -1
+	for domain, p := range cfg.tlsPolicies {
+		if domain == "" || host == domain || strings.HasSuffix(host, "."+domain) {
+			if len(domain) > matched {
+				policy = p
+				policyDomain = domain
+				matched = len(domain)
+			}
+		}
+	}
+	return policyDomain, policy
+}
+
+// roots returns the root certs for the domain, i.e. base plus the policy's extra CA's.
+func (policy *TLSPolicyConfiguration) roots(base *x509.CertPool) *x509.CertPool {
+	if policy == nil || len(policy.extraCAs) == 0 {
+		return base
+	}
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if policy.rootCAs == nil || policy.rootBase != base {
+		// the root certs were (re)loaded. Rebuild ours.
+		roots := base.Clone()
+		for _, cert := range policy.extraCAs {
+			roots.AddCert(cert)
+		}
+		policy.rootBase = base
+		policy.rootCAs = roots
+	}
+	return policy.rootCAs
+}
+
+// spkiPin returns the pin for the cert's public key, in the same form as the pins in the config.
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// parseDeviceCert parses the PEM encoded mail server certificate the device sent us.
+func parseDeviceCert(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("Could not decode PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// verify does the server certificate verification for a host. This replaces the verification
+// done by the tls package, since we need to be able to accept the device's cert, check the pins
+// against the verified chains, and pick up reloaded root certs. policy may be nil, in which case
+// we do the same verification the tls package would.
+func (policy *TLSPolicyConfiguration) verify(host string, roots *x509.CertPool, deviceCert *x509.Certificate, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("x509: server sent no certificates")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if deviceCert != nil && bytes.Equal(certs[0].Raw, deviceCert.Raw) {
+		return nil
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	if policy == nil || len(policy.pins) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if policy.pins[spkiPin(cert)] {
+				return nil
+			}
+		}
+	}
+	return CertificatePinMismatch
+}
+
+// tlsConfig returns the tls.Config to use when talking to the mail server host, with the
+// trust policy for the host applied. deviceCert is the PEM cert the device vouched for at
+// registration, if any. It is ignored unless the policy allows it.
+func (cfg *BackendConfiguration) tlsConfig(host string, deviceCert string) (*tls.Config, error) {
+	policy := cfg.tlsPolicyFor(host)
+	tlsConfig := &tls.Config{
+		ServerName: host,
+	}
+	var cert *x509.Certificate
+	if policy != nil {
+		tlsConfig.MinVersion = policy.minVersion
+		tlsConfig.CipherSuites = policy.cipherSuites
+		if policy.AllowDeviceCert && deviceCert != "" {
+			var err error
+			cert, err = parseDeviceCert(deviceCert)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// We do the verification ourselves in verify(), against the root certs current at the
+	// time of the handshake, so that reloaded root certs are used by running pollers.
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		roots, err := cfg.RootCerts()
+		if err != nil {
+			return err
+		}
+		return policy.verify(host, policy.roots(roots), cert, rawCerts)
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,170 @@
+package Pinger
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type tlsPolicyTester struct {
+	suite.Suite
+	cert  *x509.Certificate
+	other *x509.Certificate
+	roots *x509.CertPool
+}
+
+func makeTestCert(host string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func (s *tlsPolicyTester) SetupSuite() {
+	s.cert = makeTestCert("mail.example.com")
+	s.other = makeTestCert("mail.example.com")
+	s.roots = x509.NewCertPool()
+	s.roots.AddCert(s.cert)
+}
+
+func TestTLSPolicy(t *testing.T) {
+	s := new(tlsPolicyTester)
+	suite.Run(t, s)
+}
+
+func (s *tlsPolicyTester) TestValidate() {
+	policy := &TLSPolicyConfiguration{Pin: []string{spkiPin(s.cert)}, MinVersion: "1.2", Cipher: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+	s.NoError(policy.validate("example.com"))
+	s.True(policy.pins[spkiPin(s.cert)])
+	s.Equal(uint16(tls.VersionTLS12), policy.minVersion)
+	s.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, policy.cipherSuites)
+
+	s.Error((&TLSPolicyConfiguration{Pin: []string{"md5/foo"}}).validate("example.com"))
+	s.Error((&TLSPolicyConfiguration{Pin: []string{"sha256/Zm9v"}}).validate("example.com"))
+	s.Error((&TLSPolicyConfiguration{MinVersion: "2.0"}).validate("example.com"))
+	s.Error((&TLSPolicyConfiguration{Cipher: []string{"TLS_RSA_WITH_RC4_128_SHA"}}).validate("example.com"))
+	s.Error((&TLSPolicyConfiguration{ExtraCA: []string{"/no/such/file.pem"}}).validate("example.com"))
+}
+
+func (s *tlsPolicyTester) TestPolicyFor() {
+	def := &TLSPolicyConfiguration{}
+	example := &TLSPolicyConfiguration{}
+	mail := &TLSPolicyConfiguration{}
+	cfg := NewBackendConfiguration()
+	s.Nil(cfg.tlsPolicyFor("mail.example.com"))
+
+	cfg.tlsPolicies = map[string]*TLSPolicyConfiguration{"example.com": example, "mail.example.com": mail}
+	s.True(mail == cfg.tlsPolicyFor("Mail.Example.com"))
+	s.True(example == cfg.tlsPolicyFor("imap.example.com"))
+	s.True(example == cfg.tlsPolicyFor("example.com"))
+	s.Nil(cfg.tlsPolicyFor("badexample.com"))
+	s.Equal("example.com", cfg.tlsPolicyName("imap.example.com"))
+	s.Equal("none", cfg.tlsPolicyName("badexample.com"))
+
+	cfg.tlsPolicies[""] = def
+	s.True(def == cfg.tlsPolicyFor("badexample.com"))
+	s.True(mail == cfg.tlsPolicyFor("mail.example.com"))
+	s.Equal("default", cfg.tlsPolicyName("badexample.com"))
+}
+
+func (s *tlsPolicyTester) TestVerifyPins() {
+	policy := &TLSPolicyConfiguration{Pin: []string{spkiPin(s.cert)}}
+	s.NoError(policy.validate("example.com"))
+	s.NoError(policy.verify("mail.example.com", s.roots, nil, [][]byte{s.cert.Raw}))
+	s.Error(policy.verify("imap.example.com", s.roots, nil, [][]byte{s.cert.Raw}), "wrong host name")
+	s.Error(policy.verify("mail.example.com", s.roots, nil, [][]byte{s.other.Raw}), "unknown authority")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+	roots.AddCert(s.other)
+	s.Equal(CertificatePinMismatch, policy.verify("mail.example.com", roots, nil, [][]byte{s.other.Raw}))
+}
+
+func (s *tlsPolicyTester) TestDeviceCert() {
+	deviceCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.other.Raw}))
+	cert, err := parseDeviceCert(deviceCert)
+	s.NoError(err)
+	_, err = parseDeviceCert("foo")
+	s.Error(err)
+
+	policy := &TLSPolicyConfiguration{AllowDeviceCert: true}
+	s.NoError(policy.validate("example.com"))
+	s.NoError(policy.verify("mail.example.com", s.roots, cert, [][]byte{s.other.Raw}))
+	s.Error(policy.verify("mail.example.com", x509.NewCertPool(), cert, [][]byte{s.cert.Raw}))
+
+	rootCAs = s.roots
+	defer func() { rootCAs = nil }()
+	cfg := NewBackendConfiguration()
+	cfg.tlsPolicies = map[string]*TLSPolicyConfiguration{"example.com": policy}
+	tlsConfig, err := cfg.tlsConfig("mail.example.com", deviceCert)
+	s.NoError(err)
+	s.True(tlsConfig.InsecureSkipVerify)
+	s.NoError(tlsConfig.VerifyPeerCertificate([][]byte{s.other.Raw}, nil))
+	s.NoError(tlsConfig.VerifyPeerCertificate([][]byte{s.cert.Raw}, nil))
+
+	policy.AllowDeviceCert = false
+	tlsConfig, err = cfg.tlsConfig("mail.example.com", deviceCert)
+	s.NoError(err)
+	s.Error(tlsConfig.VerifyPeerCertificate([][]byte{s.other.Raw}, nil))
+	s.NoError(tlsConfig.VerifyPeerCertificate([][]byte{s.cert.Raw}, nil))
+}
+
+func (s *tlsPolicyTester) TestExtraCA() {
+	dir, err := ioutil.TempDir("", "tlspolicy")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.other.Raw}), 0600)
+	s.NoError(err)
+
+	policy := &TLSPolicyConfiguration{ExtraCA: []string{file}}
+	s.NoError(policy.validate("example.com"))
+	s.Equal(1, len(policy.extraCAs))
+
+	roots := policy.roots(s.roots)
+	s.NoError(policy.verify("mail.example.com", roots, nil, [][]byte{s.cert.Raw}))
+	s.NoError(policy.verify("mail.example.com", roots, nil, [][]byte{s.other.Raw}))
+	s.Error(policy.verify("mail.example.com", s.roots, nil, [][]byte{s.other.Raw}), "extra CA's should not leak into the base roots")
+	s.True(roots == policy.roots(s.roots))
+
+	// new base roots, e.g. after a reload
+	base := x509.NewCertPool()
+	roots = policy.roots(base)
+	s.Error(policy.verify("mail.example.com", roots, nil, [][]byte{s.cert.Raw}))
+	s.NoError(policy.verify("mail.example.com", roots, nil, [][]byte{s.other.Raw}))
+
+	err = ioutil.WriteFile(file, []byte("not a cert"), 0600)
+	s.NoError(err)
+	s.Error(policy.validate("example.com"))
+}
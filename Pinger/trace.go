@@ -0,0 +1,43 @@
+package Pinger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"regexp"
+)
+
+// A trace id identifies a client request on its way from the webserver, through the RPC to
+// the backend, and on to the mail client session and the pushes it sends. It is logged as
+// the 'trace' field, and returned to the client, so client-side bug reports can be matched
+// with our logs.
+
+// TraceIdHeader is the HTTP header the trace id is returned in. Clients can also send one.
+const TraceIdHeader = "X-Pinger-Trace-Id"
+
+const traceIdLogKey = "trace"
+
+var traceIdRegexp = regexp.MustCompile("^[a-zA-Z0-9-]{8,64}$")
+
+// NewTraceId creates a random trace id.
+func NewTraceId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidTraceId checks a trace id sent by a client, so we don't log just anything.
+func ValidTraceId(traceId string) bool {
+	return traceIdRegexp.MatchString(traceId)
+}
+
+// TraceLogger returns a logger that adds the trace id to all messages.
+func TraceLogger(logger *Logging.Logger, traceId string) *Logging.Logger {
+	if traceId == "" {
+		return logger
+	}
+	return logger.With(traceIdLogKey, traceId)
+}
@@ -0,0 +1,42 @@
+package Pinger
+
+import (
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type traceTester struct {
+	suite.Suite
+}
+
+func TestTrace(t *testing.T) {
+	s := new(traceTester)
+	suite.Run(t, s)
+}
+
+func (s *traceTester) TestTraceId() {
+	traceId := NewTraceId()
+	s.Len(traceId, 16)
+	s.True(ValidTraceId(traceId))
+	s.NotEqual(traceId, NewTraceId())
+	s.True(ValidTraceId("client-trace-1234"))
+	s.False(ValidTraceId(""))
+	s.False(ValidTraceId("short"))
+	s.False(ValidTraceId("has spaces|and=pipes"))
+}
+
+func (s *traceTester) TestLogFields() {
+	pi := &MailPingInformation{DeviceId: "NchoXYZ", SessionId: "abcd"}
+	fields := pi.logFields()
+	for _, f := range fields {
+		s.NotEqual(traceIdLogKey, f.Key)
+	}
+	pi.traceId = "0123456789abcdef"
+	fields = pi.logFields()
+	s.Equal(Logging.String(traceIdLogKey, "0123456789abcdef"), fields[len(fields)-1])
+
+	logger := Logging.InitLogging("unittest", "", Logging.DEBUG, false, Logging.DEBUG, nil, true)
+	s.Equal(logger, TraceLogger(logger, ""))
+	s.NotEqual(logger, TraceLogger(logger, "0123456789abcdef"))
+}
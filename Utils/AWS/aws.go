@@ -9,7 +9,7 @@ const (
 )
 
 type AWSHandler interface {
-	RegisterEndpointArn(service, token, customerData string) (string, error)
+	RegisterEndpointArn(platformArn, service, token, customerData string) (string, error)
 	GetEndpointAttributes(endpointArn string) (map[string]string, error)
 	SetEndpointAttributes(endpointArn string, attributes map[string]string) error
 	DeleteEndpointArn(endpointArn string) error
@@ -3,13 +3,14 @@ package AWS
 import (
 	"fmt"
 	"github.com/awslabs/aws-sdk-go/aws"
+	"net/url"
 )
 
 // AWSConfiguration is used by Pinger/config.go to read the aws config section
 type AWSConfiguration struct {
 	RegionName                string
-	AccessKey                 string
-	SecretKey                 string
+	AccessKey                 string `secret:"true"`
+	SecretKey                 string `secret:"true"`
 	SnsRegionName             string
 	SnsIOSPlatformArn         string
 	CognitoIdentityRegionName string
@@ -17,6 +18,7 @@ type AWSConfiguration struct {
 	S3RegionName              string
 	IgnorePushFailure         bool
 	DynamoDbRegionName        string
+	DynamoDbEndpoint          string // e.g. http://localhost:8000 for DynamoDB Local. The region's endpoint if empty.
 }
 
 // NewHandle creates a new AWSHandle from the information from the config file.
@@ -42,5 +44,11 @@ func (config *AWSConfiguration) Validate() error {
 	if config.DynamoDbRegionName == "" {
 		config.DynamoDbRegionName = config.RegionName
 	}
+	if config.DynamoDbEndpoint != "" {
+		u, err := url.Parse(config.DynamoDbEndpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("DynamoDbEndpoint %s is not a URL", config.DynamoDbEndpoint)
+		}
+	}
 	return nil
 }
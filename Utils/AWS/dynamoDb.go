@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/gen/dynamodb"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type DynamoDb struct {
@@ -90,12 +94,51 @@ type ThroughPut struct {
 	Write int64
 }
 
-func newDynamoDbSession(accessKey, secretKey, region string) *DynamoDb {
-	return &DynamoDb{session: dynamodb.New(aws.Creds(accessKey, secretKey, ""), region, nil)}
+// endpointTransport sends the requests to another endpoint, e.g. DynamoDB Local, instead of the one
+// the SDK looked up for the region.
+type endpointTransport struct {
+	endpoint *url.URL
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	u := *req.URL
+	u.Scheme = t.endpoint.Scheme
+	u.Host = t.endpoint.Host
+	r.URL = &u
+	r.Host = t.endpoint.Host
+	return http.DefaultTransport.RoundTrip(&r)
+}
+
+// newDynamoDbSession creates a session for the region. If endpoint is set, the requests go there instead.
+func newDynamoDbSession(accessKey, secretKey, region, endpoint string) (*DynamoDb, error) {
+	var client *http.Client
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("DynamoDb endpoint %s needs a scheme and a host", endpoint)
+		}
+		client = &http.Client{Transport: &endpointTransport{endpoint: u}}
+	}
+	return &DynamoDb{session: dynamodb.New(aws.Creds(accessKey, secretKey, ""), region, client)}, nil
 }
 
 func (ah *AWSHandle) GetDynamoDbSession() *DynamoDb {
-	return newDynamoDbSession(ah.AccessKey, ah.SecretKey, ah.DynamoDbRegionName)
+	// the endpoint was checked in Validate
+	dynamo, err := newDynamoDbSession(ah.AccessKey, ah.SecretKey, ah.DynamoDbRegionName, ah.DynamoDbEndpoint)
+	if err != nil {
+		panic(err)
+	}
+	return dynamo
+}
+
+// IsNotFound returns true if the error says the table or index does not exist.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(aws.APIError)
+	return ok && strings.HasSuffix(apiErr.Type, "ResourceNotFoundException")
 }
 
 func (d *DynamoDb) Get(tableName string, keys []DBKeyValue) (*map[string]interface{}, error) {
@@ -114,44 +157,128 @@ func (d *DynamoDb) Get(tableName string, keys []DBKeyValue) (*map[string]interfa
 	if err != nil {
 		return nil, err
 	}
+	if len(getResp.Item) == 0 {
+		// no such item
+		return nil, nil
+	}
 	return awsAttributeMapToGo(&getResp.Item), nil
 }
 
+func conditions(attributes []DBKeyValue) map[string]dynamodb.Condition {
+	conditions := make(map[string]dynamodb.Condition)
+	for _, attr := range attributes {
+		conditions[attr.Key] = dynamodb.Condition{
+			AttributeValueList: []dynamodb.AttributeValue{goTypeToAttributeValue(attr.Value)},
+			ComparisonOperator: attr.Comparison.awsComparison(),
+		}
+	}
+	return conditions
+}
+
+// Search queries the table by its key.
 func (d *DynamoDb) Search(tableName string, attributes []DBKeyValue) ([]map[string]interface{}, error) {
+	return d.SearchIndex(tableName, "", attributes)
+}
+
+// SearchIndex queries the table by the key of a global secondary index, or by the key of the table if
+// indexName is empty. It returns all pages of the result.
+func (d *DynamoDb) SearchIndex(tableName, indexName string, attributes []DBKeyValue) ([]map[string]interface{}, error) {
 	req := dynamodb.QueryInput{
 		TableName:      aws.String(tableName),
 		ConsistentRead: aws.Boolean(false),
+		KeyConditions:  conditions(attributes),
 	}
-
-	// TODO Need to map the keys passed in to an Indexname, if appropriate
-	indexName := ""
 	if indexName != "" {
 		req.IndexName = aws.String(indexName)
 	}
 
-	req.KeyConditions = make(map[string]dynamodb.Condition)
-	for _, attr := range attributes {
-		req.KeyConditions[attr.Key] = dynamodb.Condition{
-			AttributeValueList: []dynamodb.AttributeValue{goTypeToAttributeValue(attr.Value)},
-			ComparisonOperator: attr.Comparison.awsComparison(),
+	items := make([]map[string]interface{}, 0, 1)
+	for {
+		queResp, err := d.session.Query(&req)
+		if err != nil {
+			return nil, err
 		}
+		for _, item := range queResp.Items {
+			items = append(items, *awsAttributeMapToGo(&item))
+		}
+		if len(queResp.LastEvaluatedKey) == 0 {
+			break
+		}
+		req.ExclusiveStartKey = queResp.LastEvaluatedKey
 	}
-	queResp, err := d.session.Query(&req)
-	if err != nil {
-		return nil, err
+	return items, nil
+}
+
+// Scan reads the whole table, and returns the items matching all the filters. All of them if there
+// are none. Use Search if you can.
+func (d *DynamoDb) Scan(tableName string, filters []DBKeyValue) ([]map[string]interface{}, error) {
+	req := dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+	if len(filters) > 0 {
+		req.ScanFilter = conditions(filters)
 	}
 
 	items := make([]map[string]interface{}, 0, 1)
-	for _, item := range queResp.Items {
-		items = append(items, *awsAttributeMapToGo(&item))
+	for {
+		scanResp, err := d.session.Scan(&req)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range scanResp.Items {
+			items = append(items, *awsAttributeMapToGo(&item))
+		}
+		if len(scanResp.LastEvaluatedKey) == 0 {
+			break
+		}
+		req.ExclusiveStartKey = scanResp.LastEvaluatedKey
 	}
 	return items, nil
 }
 
+// DBExpected is a condition for a conditional write: the item in the table has the attribute Key
+// with the Value. With a nil Value, the item must not have the attribute, e.g. because there is no item.
+type DBExpected struct {
+	Key   string
+	Value interface{}
+}
+
+func expectedValues(expected []DBExpected) map[string]dynamodb.ExpectedAttributeValue {
+	if len(expected) == 0 {
+		return nil
+	}
+	awsExpected := make(map[string]dynamodb.ExpectedAttributeValue)
+	for _, e := range expected {
+		if e.Value == nil {
+			awsExpected[e.Key] = dynamodb.ExpectedAttributeValue{Exists: aws.False()}
+		} else {
+			v := goTypeToAttributeValue(e.Value)
+			awsExpected[e.Key] = dynamodb.ExpectedAttributeValue{Value: &v}
+		}
+	}
+	return awsExpected
+}
+
+// IsConditionFailed returns true if the error says the conditions of a conditional write weren't met.
+func IsConditionFailed(err error) bool {
+	apiErr, ok := err.(aws.APIError)
+	return ok && strings.HasSuffix(apiErr.Type, "ConditionalCheckFailedException")
+}
+
 func (d *DynamoDb) Insert(tableName string, entry map[string]interface{}) error {
+	return d.PutIf(tableName, entry, nil)
+}
+
+func (d *DynamoDb) Update(tableName string, entry map[string]interface{}) error {
+	return d.PutIf(tableName, entry, nil)
+}
+
+// PutIf writes the item if the item in the table meets all the expectations. See IsConditionFailed.
+func (d *DynamoDb) PutIf(tableName string, entry map[string]interface{}, expected []DBExpected) error {
 	req := dynamodb.PutItemInput{
 		TableName: aws.StringValue(&tableName),
 		Item:      *goMaptoAwsAttributeMap(&entry),
+		Expected:  expectedValues(expected),
 	}
 	_, err := d.session.PutItem(&req)
 	if err != nil {
@@ -160,14 +287,16 @@ func (d *DynamoDb) Insert(tableName string, entry map[string]interface{}) error
 	return nil
 }
 
-func (d *DynamoDb) Update(tableName string, entry map[string]interface{}) error {
-	return d.Insert(tableName, entry)
+func (d *DynamoDb) Delete(tableName string, entry map[string]interface{}) error {
+	return d.DeleteIf(tableName, entry, nil)
 }
 
-func (d *DynamoDb) Delete(tableName string, entry map[string]interface{}) error {
+// DeleteIf deletes the item if it meets all the expectations. See IsConditionFailed.
+func (d *DynamoDb) DeleteIf(tableName string, entry map[string]interface{}, expected []DBExpected) error {
 	req := dynamodb.DeleteItemInput{
 		TableName: aws.StringValue(&tableName),
 		Key:       *goMaptoAwsAttributeMap(&entry),
+		Expected:  expectedValues(expected),
 	}
 	_, err := d.session.DeleteItem(&req)
 	if err != nil {
@@ -229,6 +358,41 @@ func (d *DynamoDb) DescribeTable(tableName string) (*dynamodb.TableDescription,
 	return descResp.Table, nil
 }
 
+// TableExists returns true if the table exists. Unlike DescribeTable, a missing table is not an error.
+func (d *DynamoDb) TableExists(tableName string) (bool, error) {
+	_, err := d.DescribeTable(tableName)
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// WaitForTable waits until a table, e.g. one that was just created, can be used.
+func (d *DynamoDb) WaitForTable(tableName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		table, err := d.DescribeTable(tableName)
+		if err != nil {
+			return err
+		}
+		if table.TableStatus != nil && *table.TableStatus == dynamodb.TableStatusActive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Table %s is not active after %s", tableName, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (d *DynamoDb) DeleteTable(tableName string) error {
+	_, err := d.session.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(tableName)})
+	return err
+}
+
 func awsAttributeValueToGo(a *dynamodb.AttributeValue) interface{} {
 	switch {
 	case a.S != nil:
@@ -268,9 +432,14 @@ func goTypeToAttributeValue(v interface{}) dynamodb.AttributeValue {
 	return a
 }
 
+// goMaptoAwsAttributeMap leaves out empty strings, which DynamoDB does not allow. They read back as
+// missing attributes.
 func goMaptoAwsAttributeMap(x *map[string]interface{}) *map[string]dynamodb.AttributeValue {
 	awsMap := make(map[string]dynamodb.AttributeValue)
 	for k, v := range *x {
+		if str, ok := v.(string); ok && str == "" {
+			continue
+		}
 		awsMap[k] = goTypeToAttributeValue(v)
 	}
 	return &awsMap
@@ -24,7 +24,11 @@ func (s *awsDynamoDbTester) SetupSuite() {
 	readyCh := make(chan int)
 	go s.doJavaDynamoLocal(readyCh)
 	<-readyCh
-	s.dynDb = newDynamoDbSession("", "", "local")
+	var err error
+	s.dynDb, err = newDynamoDbSession("", "", "local", "")
+	if err != nil {
+		panic(err)
+	}
 	s.clientRecord = map[string]interface{}{
 		"id":           int64(1),
 		"client":       "foo12334",
@@ -16,10 +16,13 @@ func (ah *AWSHandle) getSNSSession() (*sns.SNS, error) {
 	return snsSession, nil
 }
 
-func (ah *AWSHandle) RegisterEndpointArn(service, token, customerData string) (string, error) {
-	var platformArn string
+// RegisterEndpointArn creates an endpoint for the token in the SNS platform application, or the
+// configured SnsIOSPlatformArn if platformArn is empty.
+func (ah *AWSHandle) RegisterEndpointArn(platformArn, service, token, customerData string) (string, error) {
 	if strings.EqualFold(service, PushServiceAPNS) {
-		platformArn = ah.SnsIOSPlatformArn
+		if platformArn == "" {
+			platformArn = ah.SnsIOSPlatformArn
+		}
 	} else {
 		return "", fmt.Errorf("Unsupported platform service %s", service)
 	}
@@ -0,0 +1,384 @@
+package AWS
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/gen/dynamodb"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TestDynamoDbServer is an in-memory stand-in for DynamoDB, for the unit tests. It implements the calls
+// the pinger makes: CreateTable, DescribeTable, DeleteTable, PutItem and DeleteItem (with Expected
+// conditions), GetItem, and Query and Scan with EQ conditions.
+type TestDynamoDbServer struct {
+	// PageSize is the number of items per page of a Query or Scan. 0 returns everything in one page.
+	PageSize int
+
+	server *httptest.Server
+	mutex  sync.Mutex
+	tables map[string]*testDynamoTable
+}
+
+type testDynamoTable struct {
+	description dynamodb.TableDescription
+	items       map[string]map[string]dynamodb.AttributeValue
+}
+
+func NewTestDynamoDbServer() *TestDynamoDbServer {
+	d := &TestDynamoDbServer{tables: make(map[string]*testDynamoTable)}
+	d.server = httptest.NewServer(d)
+	return d
+}
+
+func (d *TestDynamoDbServer) Close() {
+	d.server.Close()
+}
+
+// Session returns a session that talks to the stand-in.
+func (d *TestDynamoDbServer) Session() *DynamoDb {
+	dynamo, err := newDynamoDbSession("key", "secret", "us-west-2", d.server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return dynamo
+}
+
+// Tables returns the names of the tables.
+func (d *TestDynamoDbServer) Tables() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	names := make([]string, 0, len(d.tables))
+	for name := range d.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type testDynamoError struct {
+	errType string
+	message string
+}
+
+func (d *TestDynamoDbServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	op := target[strings.LastIndex(target, ".")+1:]
+	var resp interface{}
+	var dErr *testDynamoError
+	d.mutex.Lock()
+	switch op {
+	case "CreateTable":
+		req := dynamodb.CreateTableInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.createTable(&req)
+		}
+	case "DescribeTable":
+		req := dynamodb.DescribeTableInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.describeTable(&req)
+		}
+	case "DeleteTable":
+		req := dynamodb.DeleteTableInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.deleteTable(&req)
+		}
+	case "PutItem":
+		req := dynamodb.PutItemInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.putItem(&req)
+		}
+	case "GetItem":
+		req := dynamodb.GetItemInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.getItem(&req)
+		}
+	case "DeleteItem":
+		req := dynamodb.DeleteItemInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.deleteItem(&req)
+		}
+	case "Query":
+		req := dynamodb.QueryInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.query(&req)
+		}
+	case "Scan":
+		req := dynamodb.ScanInput{}
+		if dErr = decodeTestDynamo(r, &req); dErr == nil {
+			resp, dErr = d.scan(&req)
+		}
+	default:
+		dErr = &testDynamoError{"UnknownOperationException", fmt.Sprintf("%s is not implemented", op)}
+	}
+	d.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if dErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "com.amazonaws.dynamodb.v20120810#" + dErr.errType,
+			"message": dErr.message,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func decodeTestDynamo(r *http.Request, req interface{}) *testDynamoError {
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return &testDynamoError{"SerializationException", err.Error()}
+	}
+	return nil
+}
+
+func (d *TestDynamoDbServer) table(name aws.StringValue) (*testDynamoTable, *testDynamoError) {
+	if name == nil {
+		return nil, &testDynamoError{"ValidationException", "No TableName"}
+	}
+	table, ok := d.tables[*name]
+	if !ok {
+		return nil, &testDynamoError{"ResourceNotFoundException", fmt.Sprintf("Requested resource not found: Table: %s not found", *name)}
+	}
+	return table, nil
+}
+
+func (d *TestDynamoDbServer) createTable(req *dynamodb.CreateTableInput) (interface{}, *testDynamoError) {
+	if req.TableName == nil || len(req.KeySchema) == 0 {
+		return nil, &testDynamoError{"ValidationException", "TableName and KeySchema are required"}
+	}
+	if _, ok := d.tables[*req.TableName]; ok {
+		return nil, &testDynamoError{"ResourceInUseException", fmt.Sprintf("Table already exists: %s", *req.TableName)}
+	}
+	table := &testDynamoTable{
+		description: dynamodb.TableDescription{
+			TableName:            req.TableName,
+			AttributeDefinitions: req.AttributeDefinitions,
+			KeySchema:            req.KeySchema,
+			TableStatus:          aws.String(dynamodb.TableStatusActive),
+		},
+		items: make(map[string]map[string]dynamodb.AttributeValue),
+	}
+	for _, gsi := range req.GlobalSecondaryIndexes {
+		table.description.GlobalSecondaryIndexes = append(table.description.GlobalSecondaryIndexes, dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: aws.String(dynamodb.IndexStatusActive),
+		})
+	}
+	d.tables[*req.TableName] = table
+	return &dynamodb.CreateTableOutput{TableDescription: &table.description}, nil
+}
+
+func (d *TestDynamoDbServer) describeTable(req *dynamodb.DescribeTableInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: &table.description}, nil
+}
+
+func (d *TestDynamoDbServer) deleteTable(req *dynamodb.DeleteTableInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(d.tables, *req.TableName)
+	return &dynamodb.DeleteTableOutput{TableDescription: &table.description}, nil
+}
+
+func (d *TestDynamoDbServer) putItem(req *dynamodb.PutItemInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := table.key(req.Item)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTestDynamoExpected(table.items[key], req.Expected)
+	if err != nil {
+		return nil, err
+	}
+	table.items[key] = req.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *TestDynamoDbServer) getItem(req *dynamodb.GetItemInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := table.key(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: table.items[key]}, nil
+}
+
+func (d *TestDynamoDbServer) deleteItem(req *dynamodb.DeleteItemInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := table.key(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTestDynamoExpected(table.items[key], req.Expected)
+	if err != nil {
+		return nil, err
+	}
+	delete(table.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (d *TestDynamoDbServer) query(req *dynamodb.QueryInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	keySchema := table.description.KeySchema
+	if req.IndexName != nil {
+		keySchema = nil
+		for _, gsi := range table.description.GlobalSecondaryIndexes {
+			if *gsi.IndexName == *req.IndexName {
+				keySchema = gsi.KeySchema
+			}
+		}
+		if keySchema == nil {
+			return nil, &testDynamoError{"ValidationException", fmt.Sprintf("The table does not have the specified index: %s", *req.IndexName)}
+		}
+	}
+	for attr := range req.KeyConditions {
+		isKey := false
+		for _, k := range keySchema {
+			if *k.AttributeName == attr {
+				isKey = true
+			}
+		}
+		if !isKey {
+			return nil, &testDynamoError{"ValidationException", fmt.Sprintf("Query condition missed key schema element: %s", attr)}
+		}
+	}
+	items, lastKey, err := d.page(table, req.KeyConditions, req.ExclusiveStartKey, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: aws.Integer(len(items)), LastEvaluatedKey: lastKey}, nil
+}
+
+func (d *TestDynamoDbServer) scan(req *dynamodb.ScanInput) (interface{}, *testDynamoError) {
+	table, err := d.table(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	items, lastKey, err := d.page(table, req.ScanFilter, req.ExclusiveStartKey, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{Items: items, Count: aws.Integer(len(items)), LastEvaluatedKey: lastKey}, nil
+}
+
+// page returns the items matching the conditions, in the order of their keys, starting after startKey.
+func (d *TestDynamoDbServer) page(table *testDynamoTable, conditions map[string]dynamodb.Condition, startKey map[string]dynamodb.AttributeValue, limit aws.IntegerValue) ([]map[string]dynamodb.AttributeValue, map[string]dynamodb.AttributeValue, *testDynamoError) {
+	for attr, c := range conditions {
+		if c.ComparisonOperator == nil || *c.ComparisonOperator != "EQ" || len(c.AttributeValueList) != 1 {
+			return nil, nil, &testDynamoError{"ValidationException", fmt.Sprintf("Only EQ with one value is implemented (%s)", attr)}
+		}
+	}
+	start := ""
+	if len(startKey) > 0 {
+		var err *testDynamoError
+		start, err = table.key(startKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	keys := make([]string, 0, len(table.items))
+	for key := range table.items {
+		if key > start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pageSize := d.PageSize
+	if limit != nil && (pageSize == 0 || *limit < pageSize) {
+		pageSize = *limit
+	}
+	items := make([]map[string]dynamodb.AttributeValue, 0, len(keys))
+	for i, key := range keys {
+		if pageSize > 0 && i >= pageSize {
+			// the page is full. The next one starts after the last item we looked at.
+			lastKey := make(map[string]dynamodb.AttributeValue)
+			for _, k := range table.description.KeySchema {
+				lastKey[*k.AttributeName] = table.items[keys[i-1]][*k.AttributeName]
+			}
+			return items, lastKey, nil
+		}
+		item := table.items[key]
+		if testDynamoMatches(item, conditions) {
+			items = append(items, item)
+		}
+	}
+	return items, nil, nil
+}
+
+// checkTestDynamoExpected checks the conditions of a conditional write. item is nil if there is none.
+func checkTestDynamoExpected(item map[string]dynamodb.AttributeValue, expected map[string]dynamodb.ExpectedAttributeValue) *testDynamoError {
+	for attr, e := range expected {
+		v, ok := item[attr]
+		switch {
+		case e.Value != nil:
+			ok = ok && testDynamoString(v) == testDynamoString(*e.Value)
+		case e.Exists != nil && !*e.Exists:
+			ok = !ok
+		default:
+			return &testDynamoError{"ValidationException", fmt.Sprintf("Only Value and Exists=false are implemented (%s)", attr)}
+		}
+		if !ok {
+			return &testDynamoError{"ConditionalCheckFailedException", "The conditional request failed"}
+		}
+	}
+	return nil
+}
+
+func testDynamoMatches(item map[string]dynamodb.AttributeValue, conditions map[string]dynamodb.Condition) bool {
+	for attr, c := range conditions {
+		v, ok := item[attr]
+		if !ok || testDynamoString(v) != testDynamoString(c.AttributeValueList[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func testDynamoString(v dynamodb.AttributeValue) string {
+	switch {
+	case v.S != nil:
+		return "S:" + *v.S
+	case v.N != nil:
+		return "N:" + *v.N
+	}
+	return ""
+}
+
+// key returns the primary key of the item as a string.
+func (table *testDynamoTable) key(item map[string]dynamodb.AttributeValue) (string, *testDynamoError) {
+	parts := make([]string, 0, len(table.description.KeySchema))
+	for _, k := range table.description.KeySchema {
+		v, ok := item[*k.AttributeName]
+		if !ok {
+			return "", &testDynamoError{"ValidationException", fmt.Sprintf("Missing the key %s in the item", *k.AttributeName)}
+		}
+		parts = append(parts, testDynamoString(v))
+	}
+	return strings.Join(parts, "\x00"), nil
+}
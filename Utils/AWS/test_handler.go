@@ -5,6 +5,7 @@ import ()
 type TestAwsHandler struct {
 	registeredEndpoint    string
 	registeredEndpointErr error
+	registeredPlatformArn string
 
 	returnGetAttributes    map[string]string
 	returnGetAttributesErr error
@@ -20,6 +21,11 @@ type TestAwsHandler struct {
 	returnPutFileError error
 
 	ignorePushFailure bool
+
+	dynamoDb *DynamoDb
+
+	deletedEndpoints []string
+	sentPushMessages []string
 }
 
 func NewTestAwsHandler() *TestAwsHandler {
@@ -67,9 +73,20 @@ func (ah *TestAwsHandler) SetPutFileError(err error) {
 	ah.returnPutFileError = err
 }
 
-func (ah *TestAwsHandler) RegisterEndpointArn(service, token, customerData string) (string, error) {
+// SetDynamoDb sets the session GetDynamoDbSession returns, e.g. one from a TestDynamoDbServer.
+func (ah *TestAwsHandler) SetDynamoDb(dynamoDb *DynamoDb) {
+	ah.dynamoDb = dynamoDb
+}
+
+func (ah *TestAwsHandler) RegisterEndpointArn(platformArn, service, token, customerData string) (string, error) {
+	ah.registeredPlatformArn = platformArn
 	return ah.registeredEndpoint, ah.registeredEndpointErr
 }
+
+// RegisteredPlatformArn returns the platform application the last RegisterEndpointArn was for.
+func (ah *TestAwsHandler) RegisteredPlatformArn() string {
+	return ah.registeredPlatformArn
+}
 func (ah *TestAwsHandler) GetEndpointAttributes(endpointArn string) (map[string]string, error) {
 	return ah.returnGetAttributes, ah.returnGetAttributesErr
 }
@@ -77,11 +94,27 @@ func (ah *TestAwsHandler) SetEndpointAttributes(endpointArn string, attributes m
 	return ah.returnSetAttributesErr
 }
 func (ah *TestAwsHandler) DeleteEndpointArn(endpointArn string) error {
+	if ah.returnDeleteAttributesErr == nil {
+		ah.deletedEndpoints = append(ah.deletedEndpoints, endpointArn)
+	}
 	return ah.returnDeleteAttributesErr
 }
+
+// DeletedEndpoints returns the endpoints DeleteEndpointArn deleted, in order.
+func (ah *TestAwsHandler) DeletedEndpoints() []string {
+	return ah.deletedEndpoints
+}
 func (ah *TestAwsHandler) SendPushNotification(endpointArn, message string) error {
+	if ah.returnPushNotificationError == nil {
+		ah.sentPushMessages = append(ah.sentPushMessages, message)
+	}
 	return ah.returnPushNotificationError
 }
+
+// SentPushMessages returns the messages SendPushNotification sent, in order.
+func (ah *TestAwsHandler) SentPushMessages() []string {
+	return ah.sentPushMessages
+}
 func (ah *TestAwsHandler) ValidateCognitoID(userId string) error {
 	return ah.returnValidateCognitoIdError
 }
@@ -93,5 +126,5 @@ func (ah *TestAwsHandler) IgnorePushFailures() bool {
 }
 
 func (ah *TestAwsHandler) GetDynamoDbSession() *DynamoDb {
-	return nil
+	return ah.dynamoDb
 }
@@ -0,0 +1,179 @@
+package Logging
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/Redact"
+	"strings"
+	"time"
+)
+
+// MsgCodeKey is the key of the msgCode field, which identifies the kind of log message.
+const MsgCodeKey = "msgCode"
+
+// Field is a key/value pair attached to a log message, e.g. the device and session a
+// message is about. Use the typed constructors below to create them.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Int64(key string, value int64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Duration(key string, value time.Duration) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err creates an 'err' field. A nil error gives an empty field.
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "err", Value: ""}
+	}
+	return Field{Key: "err", Value: err.Error()}
+}
+
+func MsgCode(code string) Field {
+	return Field{Key: MsgCodeKey, Value: code}
+}
+
+// Any creates a field from any value. Values that aren't numbers, strings or booleans
+// are logged as strings.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// plainValue returns the value as it goes into JSON and telemetry: numbers, strings and
+// booleans as they are, everything else as its string representation.
+func (f Field) plainValue() interface{} {
+	switch v := f.Value.(type) {
+	case nil:
+		return nil
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.000Z")
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// redactFields returns the fields with the personal information and secrets removed from the values.
+func redactFields(fields []Field) []Field {
+	var redacted []Field
+	for i, f := range fields {
+		value, ok := f.plainValue().(string)
+		if !ok || f.Key == MsgCodeKey {
+			continue
+		}
+		if r := Redact.Value(f.Key, value); r != value {
+			if redacted == nil {
+				redacted = append([]Field(nil), fields...)
+			}
+			redacted[i].Value = r
+		}
+	}
+	if redacted == nil {
+		return fields
+	}
+	return redacted
+}
+
+// splitMsgCode takes the msgCode off the end of a format string, i.e. the
+// "...|msgCode=SOME_CODE" convention used all over the code, so it can be logged as a field.
+func splitMsgCode(format string) (string, string) {
+	i := strings.LastIndex(format, "|"+MsgCodeKey+"=")
+	if i < 0 {
+		return format, ""
+	}
+	code := format[i+len(MsgCodeKey)+2:]
+	if code == "" || strings.ContainsAny(code, "|% ") {
+		return format, ""
+	}
+	return strings.TrimRight(format[:i], "|"), code
+}
+
+// Entry is a log message with its fields, as handed to the Backends.
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Module  string
+	Message string
+	Fields  []Field
+}
+
+// MsgCode returns the msgCode of the entry, if any.
+func (entry *Entry) MsgCode() string {
+	for _, f := range entry.Fields {
+		if f.Key == MsgCodeKey {
+			s, _ := f.Value.(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// FieldMap returns the fields of the entry as a map. Later fields win over earlier ones.
+func (entry *Entry) FieldMap() map[string]interface{} {
+	if len(entry.Fields) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(entry.Fields))
+	for _, f := range entry.Fields {
+		m[f.Key] = f.plainValue()
+	}
+	return m
+}
+
+// text formats the entry for the text backends (file and screen) the way we always have:
+// |key=value|...|message=<message>|msgCode=<code>
+func (entry *Entry) text() string {
+	if len(entry.Fields) == 0 {
+		return entry.Message
+	}
+	var buf bytes.Buffer
+	hasFields := false
+	for _, f := range entry.Fields {
+		if f.Key == MsgCodeKey {
+			continue
+		}
+		fmt.Fprintf(&buf, "|%s=%v", f.Key, f.plainValue())
+		hasFields = true
+	}
+	if hasFields {
+		buf.WriteString("|message=")
+	}
+	buf.WriteString(entry.Message)
+	if code := entry.MsgCode(); code != "" {
+		fmt.Fprintf(&buf, "|%s=%s", MsgCodeKey, code)
+	}
+	return buf.String()
+}
+
+// Backend receives log entries with their fields, as opposed to the (text-only) go-logging backends.
+type Backend interface {
+	LogEntry(entry *Entry) error
+}
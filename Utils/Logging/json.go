@@ -0,0 +1,101 @@
+package Logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"sync"
+)
+
+// Format is the output format of a log file.
+type Format string
+
+const (
+	FormatText Format = "text" // the go-logging text format
+	FormatJSON Format = "json" // one JSON object per line, with the fields as keys
+)
+
+func LogFormat(format string) (Format, error) {
+	switch Format(format) {
+	case FormatText, FormatJSON:
+		return Format(format), nil
+	case "":
+		return FormatText, nil
+	}
+	return "", fmt.Errorf("Unknown log format '%s'. Use '%s' or '%s'", format, FormatText, FormatJSON)
+}
+
+// jsonReservedKeys are the keys jsonBackend writes for every entry. Fields with the same
+// name are written with a 'field_' prefix.
+var jsonReservedKeys = map[string]bool{
+	"time":    true,
+	"level":   true,
+	"module":  true,
+	"message": true,
+}
+
+// jsonBackend writes entries as JSON lines, e.g.
+// {"time":"2015-06-01T12:00:00.000Z","level":"INFO","module":"pinger-backend","message":"...","device":"...","msgCode":"PUSH_SENT"}
+//
+// It is also added to the go-logging backends, so its level is set (and toggled) like the level
+// of the text log file. The text records it gets from go-logging are ignored.
+type jsonBackend struct {
+	mutex   sync.Mutex
+	writer  io.Writer
+	leveled logging.LeveledBackend
+}
+
+func newJSONBackend(writer io.Writer, level Level) *jsonBackend {
+	b := &jsonBackend{writer: writer}
+	b.leveled = logging.AddModuleLevel(b)
+	b.leveled.SetLevel(logging.Level(level), "")
+	return b
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	return nil
+}
+
+func (b *jsonBackend) LogEntry(entry *Entry) error {
+	if b.writer == nil || !b.leveled.IsEnabledFor(logging.Level(entry.Level), entry.Module) {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, err := b.writer.Write(formatJSON(entry))
+	return err
+}
+
+func formatJSON(entry *Entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	writeJSONPair(&buf, "time", entry.Time.UTC().Format("2006-01-02T15:04:05.000Z"), true)
+	writeJSONPair(&buf, "level", logging.Level(entry.Level).String(), false)
+	writeJSONPair(&buf, "module", entry.Module, false)
+	writeJSONPair(&buf, "message", entry.Message, false)
+	for _, f := range entry.Fields {
+		key := f.Key
+		if jsonReservedKeys[key] {
+			key = "field_" + key
+		}
+		writeJSONPair(&buf, key, f.plainValue(), false)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONPair(buf *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		buf.WriteString(",")
+	}
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteString(":")
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprintf("%v", value))
+	}
+	buf.Write(v)
+}
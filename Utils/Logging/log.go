@@ -2,9 +2,12 @@ package Logging
 
 import (
 	"fmt"
+	"github.com/nachocove/Pinger/Utils/Redact"
 	"github.com/nachocove/Pinger/Utils/Telemetry"
 	"github.com/op/go-logging"
 	"os"
+	"sync"
+	"time"
 )
 
 type Level logging.Level
@@ -14,6 +17,10 @@ func LogLevel(level string) (Level, error) {
 	return Level(levelInt), err
 }
 
+func (level Level) String() string {
+	return logging.Level(level).String()
+}
+
 const (
 	ERROR    Level = Level(logging.ERROR)
 	WARNING  Level = Level(logging.WARNING)
@@ -24,26 +31,100 @@ const (
 
 type Logger struct {
 	logger *logging.Logger
+	fields []Field // fields added to every message, see With()
 }
 
 func (log *Logger) Info(format string, args ...interface{}) {
-	log.logger.Info(format, args...)
+	log.log(INFO, format, args...)
 }
 
 func (log *Logger) Warning(format string, args ...interface{}) {
-	log.logger.Warning(format, args...)
+	log.log(WARNING, format, args...)
 }
 
 func (log *Logger) Error(format string, args ...interface{}) {
-	log.logger.Error(format, args...)
+	log.log(ERROR, format, args...)
 }
 
 func (log *Logger) Debug(format string, args ...interface{}) {
-	log.logger.Debug(format, args...)
+	log.log(DEBUG, format, args...)
 }
 
 func (log *Logger) Fatalf(format string, args ...interface{}) {
-	log.logger.Fatalf(format, args...)
+	log.log(CRITICAL, format, args...)
+	os.Exit(1)
+}
+
+// With returns a copy of the logger that adds the key/value to every message.
+func (log *Logger) With(key string, value interface{}) *Logger {
+	return log.WithFields(Any(key, value))
+}
+
+// WithFields returns a copy of the logger that adds the fields to every message.
+// Like the messages, the values are redacted (see the Redact package).
+func (log *Logger) WithFields(fields ...Field) *Logger {
+	loggerCopy := log.Copy()
+	loggerCopy.fields = make([]Field, 0, len(log.fields)+len(fields))
+	loggerCopy.fields = append(loggerCopy.fields, log.fields...)
+	loggerCopy.fields = append(loggerCopy.fields, redactFields(fields)...)
+	return loggerCopy
+}
+
+// WithMsgCode returns a copy of the logger that logs the msgCode with every message.
+// A msgCode at the end of the format string ("...|msgCode=SOME_CODE") works, too.
+func (log *Logger) WithMsgCode(code string) *Logger {
+	return log.WithFields(MsgCode(code))
+}
+
+// log formats the message, hands the text to the go-logging backends (file, screen) and the
+// entry, with its fields, to the structured backends (json file, telemetry).
+func (log *Logger) log(level Level, format string, args ...interface{}) {
+	backendsMutex.Lock()
+	backends := entryBackends[log.logger.Module]
+	backendsMutex.Unlock()
+	// the structured backends do their own level checks
+	if len(backends) == 0 && !log.logger.IsEnabledFor(logging.Level(level)) {
+		return
+	}
+	fields := log.fields
+	format, code := splitMsgCode(format)
+	if code != "" {
+		fields = append(fields[:len(fields):len(fields)], MsgCode(code))
+	}
+	copied := false
+	for i, arg := range args {
+		if redactor, ok := arg.(logging.Redactor); ok {
+			if !copied {
+				// the args belong to the caller
+				args = append([]interface{}(nil), args...)
+				copied = true
+			}
+			args[i] = redactor.Redacted()
+		}
+	}
+	entry := &Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Module:  log.logger.Module,
+		Message: Redact.String(fmt.Sprintf(format, args...)),
+		Fields:  fields,
+	}
+	text := entry.text()
+	switch level {
+	case DEBUG:
+		log.logger.Debug("%s", text)
+	case INFO:
+		log.logger.Info("%s", text)
+	case WARNING:
+		log.logger.Warning("%s", text)
+	case ERROR:
+		log.logger.Error("%s", text)
+	default:
+		log.logger.Critical("%s", text)
+	}
+	for _, backend := range backends {
+		backend.LogEntry(entry)
+	}
 }
 
 func (log *Logger) formatLogString(format string, args ...interface{}) string {
@@ -53,19 +134,46 @@ func (log *Logger) formatLogString(format string, args ...interface{}) string {
 // TODO: Can we cache and do a more python-logging type thing where we have a global array of loggers and can
 // just fetch them at any time, rather than passing around the logger everywhere?
 
-// TODO: Add telemetry pushing to logging
-
 const (
 	debugFormatStr  = "%{time:2006-01-02T15:04:05.000} %{level} %{shortfile}:%{shortfunc} %{message}"
 	normalFormatStr = "%{time:2006-01-02T15:04:05.000} %{level} %{shortfunc} %{message}"
 )
 
 var loggerCache map[string]*Logger
+var fileBackends map[string]logging.LeveledBackend
+var screenBackends map[string]logging.LeveledBackend
+var entryBackends map[string][]Backend // the structured backends by logger (module) name
+var backendsMutex sync.Mutex
 
 func init() {
 	loggerCache = make(map[string]*Logger)
+	fileBackends = make(map[string]logging.LeveledBackend)
+	screenBackends = make(map[string]logging.LeveledBackend)
+	entryBackends = make(map[string][]Backend)
+}
+
+// telemetryBackend passes the entries with their fields to the telemetry writer.
+type telemetryBackend struct {
+	writer *Telemetry.TelemetryWriter
+}
+
+func (b telemetryBackend) LogEntry(entry *Entry) error {
+	return b.writer.LogFields(logging.Level(entry.Level), entry.Module, entry.Message, entry.FieldMap(), entry.Time)
+}
+
+// AddBackend adds a structured backend to the logger with the given name.
+func AddBackend(loggerName string, backend Backend) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	entryBackends[loggerName] = append(entryBackends[loggerName], backend)
 }
+
 func InitLogging(loggerName string, logFileName string, fileLevel Level, screen bool, screenLevel Level, telemetryWriter *Telemetry.TelemetryWriter, debug bool) *Logger {
+	return InitLoggingFormat(loggerName, logFileName, fileLevel, FormatText, screen, screenLevel, telemetryWriter, debug)
+}
+
+// InitLoggingFormat is InitLogging with a choice of format for the log file.
+func InitLoggingFormat(loggerName string, logFileName string, fileLevel Level, fileFormat Format, screen bool, screenLevel Level, telemetryWriter *Telemetry.TelemetryWriter, debug bool) *Logger {
 	_, ok := loggerCache[loggerName]
 	if !ok {
 		var logFile *os.File
@@ -91,16 +199,28 @@ func InitLogging(loggerName string, logFileName string, fileLevel Level, screen
 		var screenLogger logging.LeveledBackend
 		var loggers = make([]logging.Backend, 0, 3)
 		format := logging.MustStringFormatter(formatStr)
-		fileLogger = logging.AddModuleLevel(logging.NewLogBackend(logFile, "", 0))
-		fileLogger.SetLevel(logging.Level(fileLevel), "")
-		loggers = append(loggers, fileLogger)
+		if fileFormat == FormatJSON {
+			jsonLogger := newJSONBackend(nil, fileLevel)
+			if logFile != nil { // don't turn a nil *os.File into a non-nil io.Writer
+				jsonLogger.writer = logFile
+			}
+			fileBackends[loggerName] = jsonLogger.leveled
+			loggers = append(loggers, jsonLogger.leveled)
+			AddBackend(loggerName, jsonLogger)
+		} else {
+			fileLogger = logging.AddModuleLevel(logging.NewLogBackend(logFile, "", 0))
+			fileLogger.SetLevel(logging.Level(fileLevel), "")
+			fileBackends[loggerName] = fileLogger
+			loggers = append(loggers, fileLogger)
+		}
 		if screen {
 			screenLogger = logging.AddModuleLevel(logging.NewLogBackend(os.Stdout, "", 0))
 			screenLogger.SetLevel(logging.Level(screenLevel), "")
+			screenBackends[loggerName] = screenLogger
 			loggers = append(loggers, screenLogger)
 		}
 		if telemetryWriter != nil {
-			loggers = append(loggers, telemetryWriter)
+			AddBackend(loggerName, telemetryBackend{writer: telemetryWriter})
 		}
 		logging.SetBackend(loggers...)
 		logging.SetFormatter(format)
@@ -123,12 +243,59 @@ func (logger *Logger) Copy() *Logger {
 	return &loggerCopy
 }
 
+// SetCallDepth sets how many stack frames the caller is above the logging call, for wrappers
+// like MailClientContext.Info(). Two frames (Info() and log()) are always skipped.
 func (logger *Logger) SetCallDepth(depth int) {
-	logger.logger.ExtraCalldepth = depth + 1
+	logger.logger.ExtraCalldepth = depth + 2
 }
 
 func (logger *Logger) GetCallDepth() int {
-	return logger.logger.ExtraCalldepth - 1
+	return logger.logger.ExtraCalldepth - 2
+}
+
+// SetFileLevel changes the level of the log file of the logger, e.g. after a config reload.
+func SetFileLevel(logger *Logger, level Level) {
+	fileLogger, ok := fileBackends[logger.logger.Module]
+	if !ok {
+		return
+	}
+	if fileLogger.GetLevel("") != logging.Level(level) {
+		fileLogger.SetLevel(logging.Level(level), "")
+		logger.Warning("Logger-%s: Setting file logging to %s\n", logger.logger.Module, logging.Level(level))
+	}
+}
+
+// SetScreenLevel changes the level of the screen output of the logger, if it logs to the screen.
+func SetScreenLevel(logger *Logger, level Level) {
+	screenLogger, ok := screenBackends[logger.logger.Module]
+	if !ok {
+		return
+	}
+	if screenLogger.GetLevel("") != logging.Level(level) {
+		screenLogger.SetLevel(logging.Level(level), "")
+		logger.Warning("Logger-%s: Setting screen logging to %s\n", logger.logger.Module, logging.Level(level))
+	}
+}
+
+// SetTelemetryDebug changes whether the debug messages of the logger go to telemetry.
+func SetTelemetryDebug(logger *Logger, include bool) {
+	backendsMutex.Lock()
+	backends := entryBackends[logger.logger.Module]
+	backendsMutex.Unlock()
+	for _, backend := range backends {
+		if b, ok := backend.(telemetryBackend); ok {
+			b.writer.SetIncludeDebug(include)
+		}
+	}
+}
+
+// GetFileLevel returns the level of the log file of the logger. False if it has no log file.
+func GetFileLevel(logger *Logger) (Level, bool) {
+	fileLogger, ok := fileBackends[logger.logger.Module]
+	if !ok {
+		return 0, false
+	}
+	return Level(fileLogger.GetLevel("")), true
 }
 
 func ToggleLogging(logger *Logger, previousLevel Level) Level {
@@ -0,0 +1,169 @@
+package Logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type loggingTester struct {
+	suite.Suite
+	logger  *Logger
+	entries *testBackend
+}
+
+// testBackend remembers the entries it gets.
+type testBackend struct {
+	entries []*Entry
+}
+
+func (b *testBackend) LogEntry(entry *Entry) error {
+	b.entries = append(b.entries, entry)
+	return nil
+}
+
+func (b *testBackend) last() *Entry {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	return b.entries[len(b.entries)-1]
+}
+
+func TestLogging(t *testing.T) {
+	s := new(loggingTester)
+	suite.Run(t, s)
+}
+
+func (s *loggingTester) SetupSuite() {
+	s.logger = InitLogging("unittest", "", DEBUG, false, DEBUG, nil, true)
+	s.entries = &testBackend{}
+	AddBackend("unittest", s.entries)
+}
+
+func (s *loggingTester) SetupTest() {
+	s.entries.entries = nil
+}
+
+func (s *loggingTester) TestWith() {
+	s.logger.Info("plain message %d", 1)
+	entry := s.entries.last()
+	s.NotNil(entry)
+	s.Equal("plain message 1", entry.Message)
+	s.Empty(entry.Fields)
+	s.Equal("plain message 1", entry.text())
+
+	logger := s.logger.With("device", "NchoXYZ").WithFields(String("client", "user1"), Int("count", 2))
+	logger.Warning("Something happened: %s", "boom")
+	entry = s.entries.last()
+	s.Equal(WARNING, entry.Level)
+	s.Equal("unittest", entry.Module)
+	s.Equal("Something happened: boom", entry.Message)
+	s.Equal(map[string]interface{}{"device": "NchoXYZ", "client": "user1", "count": 2}, entry.FieldMap())
+	s.Equal("|device=NchoXYZ|client=user1|count=2|message=Something happened: boom", entry.text())
+
+	// the original logger is unchanged
+	s.logger.Info("again")
+	s.Empty(s.entries.last().Fields)
+}
+
+func (s *loggingTester) TestMsgCode() {
+	s.logger.Info("Received poll request|msgCode=RPC_REGISTER")
+	entry := s.entries.last()
+	s.Equal("Received poll request", entry.Message)
+	s.Equal("RPC_REGISTER", entry.MsgCode())
+	s.Equal("Received poll request|msgCode=RPC_REGISTER", entry.text())
+
+	s.logger.With("device", "NchoXYZ").Info("Invalid token|count=%d||msgCode=INVALID_PUSH_TOKEN", 3)
+	entry = s.entries.last()
+	s.Equal("Invalid token|count=3", entry.Message)
+	s.Equal("INVALID_PUSH_TOKEN", entry.MsgCode())
+	s.Equal("|device=NchoXYZ|message=Invalid token|count=3|msgCode=INVALID_PUSH_TOKEN", entry.text())
+
+	s.logger.WithMsgCode("PUSH_SENT").Info("Newmail notification sent")
+	s.Equal("PUSH_SENT", s.entries.last().MsgCode())
+
+	// not at the end, so it's just text
+	s.logger.Info("Received defer request|msgCode=RPC_DEFER|timeout=%d", 10)
+	entry = s.entries.last()
+	s.Equal("", entry.MsgCode())
+	s.Equal("Received defer request|msgCode=RPC_DEFER|timeout=10", entry.Message)
+}
+
+func (s *loggingTester) TestJSON() {
+	f, err := ioutil.TempFile("", "logtest")
+	s.NoError(err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	logger := InitLoggingFormat("jsontest", f.Name(), INFO, FormatJSON, false, DEBUG, nil, false)
+	logger.With("device", "NchoXYZ").With("time", "not the timestamp").With("duration", 90*time.Second).Info("Got %s|msgCode=NEW_MAIL", "mail")
+	logger.Debug("not logged")
+	logger.Error("%d errors", 2)
+
+	f, err = os.Open(f.Name())
+	s.NoError(err)
+	defer f.Close()
+	lines := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := make(map[string]interface{})
+		s.NoError(json.Unmarshal(scanner.Bytes(), &line), fmt.Sprintf("Could not parse %s", scanner.Text()))
+		lines = append(lines, line)
+	}
+	s.Len(lines, 2)
+	s.Equal("INFO", lines[0]["level"])
+	s.Equal("jsontest", lines[0]["module"])
+	s.Equal("Got mail", lines[0]["message"])
+	s.Equal("NchoXYZ", lines[0]["device"])
+	s.Equal("NEW_MAIL", lines[0]["msgCode"])
+	s.Equal("1m30s", lines[0]["duration"])
+	s.Equal("not the timestamp", lines[0]["field_time"])
+	s.NotEqual("not the timestamp", lines[0]["time"])
+	s.Equal("ERROR", lines[1]["level"])
+	s.Equal("2 errors", lines[1]["message"])
+
+	_, err = LogFormat("xml")
+	s.Error(err)
+	format, err := LogFormat("")
+	s.NoError(err)
+	s.Equal(FormatText, format)
+}
+
+func (s *loggingTester) TestRedaction() {
+	secrets := []string{"someone@company.com", "hunter2", "6f1ed002ab5595859014ebf0951522d9d6b0b9ad47e0b4ca6d2f7ba91a0b7d8f"}
+	for _, format := range []Format{FormatText, FormatJSON} {
+		f, err := ioutil.TempFile("", "logtest")
+		s.NoError(err)
+		f.Close()
+
+		logger := InitLoggingFormat("redacttest-"+string(format), f.Name(), DEBUG, format, false, DEBUG, nil, false)
+		logger.Info("Could not validate user %s|password=%s", secrets[0], secrets[1])
+		logger.With("token", secrets[2]).With("client", secrets[0]).Warning("Invalid token reported by Apple")
+
+		data, err := ioutil.ReadFile(f.Name())
+		s.NoError(err)
+		os.Remove(f.Name())
+		s.Contains(string(data), "Invalid token reported by Apple")
+		for _, secret := range secrets {
+			s.NotContains(string(data), secret, fmt.Sprintf("%s found in the %s log", secret, format))
+		}
+	}
+}
+
+type secretArg string
+
+func (secret secretArg) Redacted() interface{} {
+	return "****"
+}
+
+func (s *loggingTester) TestRedactorArgs() {
+	args := []interface{}{secretArg("hunter2"), 1}
+	s.logger.Info("password %s, attempt %d", args...)
+	s.Equal("password ****, attempt 1", s.entries.last().Message)
+	s.Equal(secretArg("hunter2"), args[0], "the caller's args are not modified")
+}
@@ -0,0 +1,398 @@
+// Metrics implements counters, gauges and histograms, exported in the Prometheus text format.
+//
+// We only need a small part of what the Prometheus client library does, so rather than pulling
+// in the library and its dependencies, this implements just that part of the text exposition
+// format (version 0.0.4, https://prometheus.io/docs/instrumenting/exposition_formats/).
+package Metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram buckets for things that usually take well under a second, like RPC calls.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type metric interface {
+	desc() *metricDesc
+	write(w io.Writer)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	mtype  metricType
+	labels []string
+}
+
+func (d *metricDesc) desc() *metricDesc {
+	return d
+}
+
+func (d *metricDesc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(strings.Replace(d.help, "\\", "\\\\", -1), "\n", "\\n", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.mtype)
+}
+
+// key returns the map key for a set of label values.
+func (d *metricDesc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// labelString formats the labels as {a="x",b="y"}, with extra appended (used for the histogram 'le').
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Registry is a set of metrics that are exported together.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// DefaultRegistry is the registry used by the package level New* functions and Handler().
+var DefaultRegistry *Registry
+
+func init() {
+	DefaultRegistry = NewRegistry()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := m.desc().name
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the registry in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.desc().writeHeader(bw)
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns the http.Handler serving the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "UNKNOWN METHOD", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		r.Write(w)
+	})
+}
+
+// Handler returns the http.Handler serving the metrics in the DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// valueVec is the part common to counters and gauges: a float per set of label values.
+type valueVec struct {
+	metricDesc
+	mutex       sync.Mutex
+	values      map[string]*Value
+	labelValues map[string][]string
+}
+
+// Value is a single counter or gauge, i.e. a metric with a specific set of label values.
+type Value struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (v *Value) Add(delta float64) {
+	v.mutex.Lock()
+	v.value += delta
+	v.mutex.Unlock()
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Get() float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.value
+}
+
+func (vec *valueVec) with(labelValues []string) *Value {
+	key := vec.key(labelValues)
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	v, ok := vec.values[key]
+	if !ok {
+		v = &Value{}
+		vec.values[key] = v
+		vec.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	return v
+}
+
+func (vec *valueVec) write(w io.Writer) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", vec.name, labelString(vec.labels, vec.labelValues[key]), formatFloat(vec.values[key].Get()))
+	}
+}
+
+func newValueVec(name, help string, mtype metricType, labels []string) valueVec {
+	return valueVec{
+		metricDesc:  metricDesc{name: name, help: help, mtype: mtype, labels: labels},
+		values:      make(map[string]*Value),
+		labelValues: make(map[string][]string),
+	}
+}
+
+// CounterVec is a counter, partitioned by labels. Counters only go up.
+type CounterVec struct {
+	valueVec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newValueVec(name, help, counterType, labels)}
+	r.register(c)
+	return c
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+// With returns the counter for the label values, which must be given in the order of the labels.
+func (c *CounterVec) With(labelValues ...string) *Value {
+	return c.with(labelValues)
+}
+
+// GaugeVec is a gauge, partitioned by labels.
+type GaugeVec struct {
+	valueVec
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newValueVec(name, help, gaugeType, labels)}
+	r.register(g)
+	return g
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+// With returns the gauge for the label values, which must be given in the order of the labels.
+func (g *GaugeVec) With(labelValues ...string) *Value {
+	return g.with(labelValues)
+}
+
+// Set sets the gauge for the label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	v := g.with(labelValues)
+	v.mutex.Lock()
+	v.value = value
+	v.mutex.Unlock()
+}
+
+// GaugeFunc is a gauge whose values are collected by calling a function at export time. Useful
+// for values we already keep track of elsewhere, like queue lengths.
+type GaugeFunc struct {
+	metricDesc
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge with the given labels. At export time, collect is called, and
+// must call set for each set of label values.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(set func(value float64, labelValues ...string))) *GaugeFunc {
+	g := &GaugeFunc{
+		metricDesc: metricDesc{name: name, help: help, mtype: gaugeType, labels: labels},
+		collect:    collect,
+	}
+	r.register(g)
+	return g
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect func(set func(value float64, labelValues ...string))) *GaugeFunc {
+	return DefaultRegistry.NewGaugeFunc(name, help, labels, collect)
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := make(map[string]float64)
+	labelValues := make(map[string][]string)
+	g.collect(func(value float64, lv ...string) {
+		key := g.key(lv)
+		values[key] += value
+		labelValues[key] = lv
+	})
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelString(g.labels, labelValues[key]), formatFloat(values[key]))
+	}
+}
+
+// HistogramVec is a histogram, partitioned by labels.
+type HistogramVec struct {
+	metricDesc
+	buckets     []float64
+	mutex       sync.Mutex
+	histograms  map[string]*Histogram
+	labelValues map[string][]string
+}
+
+// Histogram is a single histogram, i.e. one with a specific set of label values.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64 // non-cumulative, one per bucket
+	count   uint64
+	sum     float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &HistogramVec{
+		metricDesc:  metricDesc{name: name, help: help, mtype: histogramType, labels: labels},
+		buckets:     b,
+		histograms:  make(map[string]*Histogram),
+		labelValues: make(map[string][]string),
+	}
+	r.register(h)
+	return h
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// With returns the histogram for the label values, which must be given in the order of the labels.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	key := h.key(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &Histogram{
+			buckets: h.buckets,
+			counts:  make([]uint64, len(h.buckets)),
+		}
+		h.histograms[key] = hist
+		h.labelValues[key] = append([]string(nil), labelValues...)
+	}
+	return hist
+}
+
+// Observe adds a data point to the histogram.
+func (hist *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(hist.buckets, value)
+	hist.mutex.Lock()
+	defer hist.mutex.Unlock()
+	if i < len(hist.counts) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// ObserveSince adds the time since start, in seconds, to the histogram.
+func (hist *Histogram) ObserveSince(start time.Time) {
+	hist.Observe(time.Since(start).Seconds())
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.histograms[key]
+		labelValues := h.labelValues[key]
+		hist.mutex.Lock()
+		var cumulative uint64
+		for i, upper := range hist.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, labelValues, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, labelValues), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, labelValues), hist.count)
+		hist.mutex.Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+package Metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type metricsTester struct {
+	suite.Suite
+	registry *Registry
+}
+
+func (s *metricsTester) SetupTest() {
+	s.registry = NewRegistry()
+}
+
+func TestMetrics(t *testing.T) {
+	s := new(metricsTester)
+	suite.Run(t, s)
+}
+
+func (s *metricsTester) output() string {
+	buf := new(bytes.Buffer)
+	err := s.registry.Write(buf)
+	s.NoError(err)
+	return buf.String()
+}
+
+func (s *metricsTester) TestCounter() {
+	c := s.registry.NewCounterVec("test_total", "A test counter.", "service", "result")
+	c.With("APNS", "sent").Inc()
+	c.With("APNS", "sent").Inc()
+	c.With("GCM", "failed").Add(0.5)
+	s.Equal(2.0, c.With("APNS", "sent").Get())
+	s.Equal("# HELP test_total A test counter.\n"+
+		"# TYPE test_total counter\n"+
+		"test_total{service=\"APNS\",result=\"sent\"} 2\n"+
+		"test_total{service=\"GCM\",result=\"failed\"} 0.5\n", s.output())
+
+	s.Panics(func() { c.With("APNS") }, "wrong number of label values")
+	s.Panics(func() { s.registry.NewCounterVec("test_total", "Again") }, "registered twice")
+}
+
+func (s *metricsTester) TestGauge() {
+	g := s.registry.NewGaugeVec("test_gauge", "A test gauge.")
+	g.Set(3)
+	g.With().Add(-1)
+	s.Equal("# HELP test_gauge A test gauge.\n"+
+		"# TYPE test_gauge gauge\n"+
+		"test_gauge 2\n", s.output())
+}
+
+func (s *metricsTester) TestGaugeFunc() {
+	s.registry.NewGaugeFunc("test_clients", "Clients by status.", []string{"status"},
+		func(set func(float64, ...string)) {
+			set(1, "Active")
+			set(1, "Waiting")
+			set(1, "Active")
+			set(1, "with \"quotes\"\nand a newline")
+		})
+	s.Equal("# HELP test_clients Clients by status.\n"+
+		"# TYPE test_clients gauge\n"+
+		"test_clients{status=\"Active\"} 2\n"+
+		"test_clients{status=\"Waiting\"} 1\n"+
+		"test_clients{status=\"with \\\"quotes\\\"\\nand a newline\"} 1\n", s.output())
+}
+
+func (s *metricsTester) TestHistogram() {
+	h := s.registry.NewHistogramVec("test_seconds", "A test histogram.", []float64{1, 0.1}, "method")
+	h.With("Start").Observe(0.05)
+	h.With("Start").Observe(0.1)
+	h.With("Start").Observe(0.5)
+	h.With("Start").Observe(20)
+	s.Equal("# HELP test_seconds A test histogram.\n"+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{method=\"Start\",le=\"0.1\"} 2\n"+
+		"test_seconds_bucket{method=\"Start\",le=\"1\"} 3\n"+
+		"test_seconds_bucket{method=\"Start\",le=\"+Inf\"} 4\n"+
+		"test_seconds_sum{method=\"Start\"} 20.65\n"+
+		"test_seconds_count{method=\"Start\"} 4\n", s.output())
+}
+
+func (s *metricsTester) TestHandler() {
+	s.registry.NewCounterVec("test_total", "A test counter.").With().Inc()
+	response := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://localhost/metrics", nil)
+	s.NoError(err)
+	s.registry.Handler().ServeHTTP(response, req)
+	s.Equal(200, response.Code)
+	s.Equal(ContentType, response.Header().Get("Content-Type"))
+	s.Contains(response.Body.String(), "test_total 1\n")
+
+	response = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", "http://localhost/metrics", nil)
+	s.NoError(err)
+	s.registry.Handler().ServeHTTP(response, req)
+	s.Equal(http.StatusMethodNotAllowed, response.Code)
+}
@@ -0,0 +1,30 @@
+package Metrics
+
+import (
+	"runtime"
+)
+
+// RegisterRuntimeMetrics registers gauges for the number of goroutines and the memory in use,
+// i.e. the numbers Utils.MemStats prints.
+func (r *Registry) RegisterRuntimeMetrics() {
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil,
+		func(set func(float64, ...string)) {
+			set(float64(runtime.NumGoroutine()))
+		})
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", nil,
+		func(set func(float64, ...string)) {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			set(float64(m.Alloc))
+		})
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.", nil,
+		func(set func(float64, ...string)) {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			set(float64(m.Sys))
+		})
+}
+
+func RegisterRuntimeMetrics() {
+	DefaultRegistry.RegisterRuntimeMetrics()
+}
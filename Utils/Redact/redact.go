@@ -0,0 +1,155 @@
+// Redact removes personal information and secrets from log and telemetry messages.
+package Redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Replacement is what redacted text is replaced with.
+const Replacement = "<redacted>"
+
+// Rule is a named regular expression. Whatever it matches is replaced with Replace, in which
+// $1 etc. refer to the submatches (see regexp.ReplaceAllString).
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+func NewRule(name, pattern, replace string) (*Rule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Bad redaction pattern %s: %s", pattern, err)
+	}
+	return &Rule{Name: name, Pattern: re, Replace: replace}, nil
+}
+
+func mustRule(name, pattern, replace string) *Rule {
+	rule, err := NewRule(name, pattern, replace)
+	if err != nil {
+		panic(err.Error())
+	}
+	return rule
+}
+
+// builtinRules are applied in order. The key=value rules come first, so that e.g. User=me@example.com
+// becomes User=<redacted> rather than User=<redacted-email>.
+var builtinRules = []*Rule{
+	// Authorization headers, in request dumps or errors.
+	mustRule("authorization-headers", `(?i)\b((?:Proxy-)?Authorization|Cookie|Set-Cookie):[ \t]*[^\r\n|]+`, "${1}: "+Replacement),
+	// Credentials and auth blobs: key=value pairs, the IMAP LOGIN and AUTHENTICATE commands.
+	mustRule("auth", `(?i)\b(User|Password|Passwd|Pwd|Secret|AuthToken|Auth_Token|AccessKey|SecretKey|SessionSecret|Credentials)=[^&\s|,]+`, "${1}="+Replacement),
+	mustRule("auth", `\b(LOGIN) ("[^"]*"|\S+) ("[^"]*"|\S+)`, "${1} "+Replacement+" "+Replacement),
+	mustRule("auth", `\b(AUTHENTICATE [A-Z0-9\-]+) \S+`, "${1} "+Replacement),
+	// Push tokens: after a token key, and the bare APNS formats (64 hex digits, or 32 bytes base64 encoded).
+	mustRule("push-tokens", `(?i)\b((?:push)?token[s]?(?:=|: ?| '))[^|&\s',]+`, "${1}"+Replacement),
+	mustRule("push-tokens", `\b[0-9A-Fa-f]{64}\b`, Replacement),
+	mustRule("push-tokens", `[A-Za-z0-9+/]{43}=`, Replacement),
+	// Bodies of dumped HTTP requests and responses (see DumpRequests), and the WBXML we log.
+	mustRule("http-bodies", `(?s)((?:HTTP/1\.[01] \d{3}|[A-Z]+ \S+ HTTP/1\.[01])[^\r\n]*\r?\n(?:[^\r\n]+\r?\n)*\r?\n).+`, "${1}"+Replacement),
+	mustRule("http-bodies", `\b(WBXML) [A-Za-z0-9+/=]+`, "${1} "+Replacement),
+	// Email addresses anywhere.
+	mustRule("emails", `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`, "<redacted-email>"),
+}
+
+// RuleNames returns the names of the builtin rules, which can be disabled in NewRedactor.
+func RuleNames() []string {
+	names := make([]string, 0, len(builtinRules))
+	seen := make(map[string]bool)
+	for _, rule := range builtinRules {
+		if !seen[rule.Name] {
+			names = append(names, rule.Name)
+			seen[rule.Name] = true
+		}
+	}
+	return names
+}
+
+// Redactor applies a list of rules to strings.
+type Redactor struct {
+	rules []*Rule
+}
+
+// NewRedactor creates a redactor with the builtin rules, except the ones named in disable,
+// and a rule for each of the patterns. Whatever the patterns match is replaced completely.
+func NewRedactor(disable []string, patterns []string) (*Redactor, error) {
+	disabled := make(map[string]bool)
+	for _, name := range disable {
+		found := false
+		for _, rule := range builtinRules {
+			if rule.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown redaction rule %s. Known rules: %v", name, RuleNames())
+		}
+		disabled[name] = true
+	}
+	r := &Redactor{}
+	for _, rule := range builtinRules {
+		if !disabled[rule.Name] {
+			r.rules = append(r.rules, rule)
+		}
+	}
+	for _, pattern := range patterns {
+		rule, err := NewRule("custom", pattern, Replacement)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// String returns s with everything the rules match replaced.
+func (r *Redactor) String(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	for _, rule := range r.rules {
+		s = rule.Pattern.ReplaceAllString(s, rule.Replace)
+	}
+	return s
+}
+
+var current *Redactor
+var currentMutex sync.RWMutex
+
+func init() {
+	var err error
+	current, err = NewRedactor(nil, nil)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+// Set replaces the redactor used by String. By default, all builtin rules are applied.
+func Set(r *Redactor) {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	current = r
+}
+
+// String applies the current redactor to s.
+func String(s string) string {
+	currentMutex.RLock()
+	r := current
+	currentMutex.RUnlock()
+	return r.String(s)
+}
+
+// Value redacts the value of a key/value pair, so that the rules that look at the key
+// (e.g. token=...) apply to it, too.
+func Value(key, value string) string {
+	prefix := key + "="
+	redacted := String(prefix + value)
+	if strings.HasPrefix(redacted, prefix) {
+		return redacted[len(prefix):]
+	}
+	return String(value)
+}
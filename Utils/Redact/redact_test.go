@@ -0,0 +1,83 @@
+package Redact
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type redactTester struct {
+	suite.Suite
+	redactor *Redactor
+}
+
+func (s *redactTester) SetupTest() {
+	var err error
+	s.redactor, err = NewRedactor(nil, nil)
+	s.NoError(err)
+}
+
+func TestRedact(t *testing.T) {
+	s := new(redactTester)
+	suite.Run(t, s)
+}
+
+const (
+	testHexToken    = "6f1ed002ab5595859014ebf0951522d9d6b0b9ad47e0b4ca6d2f7ba91a0b7d8f"
+	testBase64Token = "bx7QAqtVlYWQFOvwlRUi2dawua1H4LTKbS97qRoLfY8="
+)
+
+func (s *redactTester) TestRules() {
+	tests := map[string]string{
+		// emails
+		"Could not validate someone@company.com": "Could not validate <redacted-email>",
+		// auth
+		"https://mail.example.com/Microsoft-Server-ActiveSync?Cmd=Ping&User=someUser@company.fr&DeviceId=Ncho1": "https://mail.example.com/Microsoft-Server-ActiveSync?Cmd=Ping&User=<redacted>&DeviceId=Ncho1",
+		"config|password=hunter2|SessionSecret=abc":                                                             "config|password=<redacted>|SessionSecret=<redacted>",
+		"Sending IMAP Command to server|command=A1 LOGIN me@example.com \"my pass\"":                            "Sending IMAP Command to server|command=A1 LOGIN <redacted> <redacted>",
+		"A2 AUTHENTICATE PLAIN AGZvbwBiYXI=":                                                                    "A2 AUTHENTICATE PLAIN <redacted>",
+		// authorization headers
+		"POST /foo HTTP/1.1\r\nAuthorization: Basic Zm9vOmJhcg==\r\nHost: example.com\r\n": "POST /foo HTTP/1.1\r\nAuthorization: <redacted>\r\nHost: example.com\r\n",
+		"request failed|Authorization: Bearer abc.def|status=401":                          "request failed|Authorization: <redacted>|status=401",
+		// push tokens
+		"Sending push message to AWS|pushToken=APNS/" + testBase64Token + "|AWSEndpointArn:arn": "Sending push message to AWS|pushToken=<redacted>|AWSEndpointArn:arn",
+		"Invalid Token reported by Apple for token '" + testHexToken + "'.Deleting device":      "Invalid Token reported by Apple for token '<redacted>'.Deleting device",
+		"Registering APNS:" + testBase64Token + " with AWS.":                                    "Registering APNS:<redacted> with AWS.",
+		"Registering APNS:" + testHexToken + " with AWS.":                                       "Registering APNS:<redacted> with AWS.",
+		// bodies
+		"response:\nHTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello\nmore": "response:\nHTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n<redacted>",
+		"reply WBXML AwFqAAANRUcDMQABAQ==":                                   "reply WBXML <redacted>",
+		// nothing to redact
+		"Received poll request|msgCode=RPC_REGISTER|device=Ncho1|client=us-east-1:abc": "Received poll request|msgCode=RPC_REGISTER|device=Ncho1|client=us-east-1:abc",
+	}
+	for message, expected := range tests {
+		s.Equal(expected, s.redactor.String(message))
+		s.Equal(expected, s.redactor.String(expected), "redacting twice changes nothing")
+	}
+}
+
+func (s *redactTester) TestConfiguration() {
+	r, err := NewRedactor([]string{"emails"}, []string{"acct-[0-9]+"})
+	s.NoError(err)
+	s.Equal("someone@company.com has <redacted>", r.String("someone@company.com has acct-1234"))
+	s.Equal("token=<redacted>", r.String("token=abc"))
+
+	_, err = NewRedactor([]string{"nosuchrule"}, nil)
+	s.Error(err)
+	_, err = NewRedactor(nil, []string{"(unclosed"})
+	s.Error(err)
+
+	s.Equal([]string{"authorization-headers", "auth", "push-tokens", "http-bodies", "emails"}, RuleNames())
+}
+
+func (s *redactTester) TestDefault() {
+	s.Equal("<redacted-email>", String("me@example.com"))
+	s.Equal("<redacted>", Value("token", "abc"))
+	s.Equal("<redacted-email>", Value("client", "me@example.com"))
+	s.Equal("Ncho1", Value("device", "Ncho1"))
+
+	r, err := NewRedactor(RuleNames(), nil)
+	s.NoError(err)
+	Set(r)
+	defer Set(s.redactor)
+	s.Equal("me@example.com", String("me@example.com"))
+}
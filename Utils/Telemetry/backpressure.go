@@ -0,0 +1,155 @@
+package Telemetry
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/Metrics"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Logging must never wait for telemetry. When the DB writer falls behind (a slow disk, a locked DB),
+// messages are sampled and then dropped, and when uploads fail for a long time, the oldest messages
+// and files are evicted so the DB and the pending files stay below their configured sizes.
+
+var (
+	metricDropped *Metrics.CounterVec
+	metricEvicted *Metrics.CounterVec
+)
+
+func init() {
+	metricDropped = Metrics.NewCounterVec("pinger_telemetry_dropped_total",
+		"Telemetry messages dropped before they got to the DB, by reason (queue-full or sampled) and event type.",
+		"reason", "event_type")
+	metricEvicted = Metrics.NewCounterVec("pinger_telemetry_evicted_total",
+		"Telemetry data evicted to stay within the size limits, by what (messages or files).", "what")
+}
+
+// underPressure is true when the channel to the DB writer is at least half full.
+func (writer *TelemetryWriter) underPressure() bool {
+	return len(writer.telemetryCh)*2 >= cap(writer.telemetryCh)
+}
+
+// sample decides whether to keep a message. Under pressure, only 1 in sampleRate DEBUG and INFO
+// messages is kept. Warnings and errors are always kept.
+func (writer *TelemetryWriter) sample(eventType telemetryLogEventType) bool {
+	if writer.sampleRate <= 1 || !writer.underPressure() {
+		return true
+	}
+	if eventType != telemetryLogEventDebug && eventType != telemetryLogEventInfo {
+		return true
+	}
+	if atomic.AddUint64(&writer.sampleCount, 1)%writer.sampleRate == 0 {
+		return true
+	}
+	metricDropped.With("sampled", eventType.String()).Inc()
+	return false
+}
+
+// enqueue hands the message to the DB writer, or drops it if the channel is full.
+func (writer *TelemetryWriter) enqueue(msg telemetryLogMsg) bool {
+	select {
+	case writer.telemetryCh <- msg:
+		return true
+	default:
+		metricDropped.With("queue-full", msg.EventType.String()).Inc()
+		return false
+	}
+}
+
+// dbSize returns the bytes in use in the DB. Deleted rows free up pages, which sqlite reuses,
+// so this is what we limit rather than the size of the file.
+func (writer *TelemetryWriter) dbSize() (int64, error) {
+	pageSize, err := writer.dbmap.SelectInt("pragma page_size")
+	if err != nil {
+		return 0, err
+	}
+	pageCount, err := writer.dbmap.SelectInt("pragma page_count")
+	if err != nil {
+		return 0, err
+	}
+	freePages, err := writer.dbmap.SelectInt("pragma freelist_count")
+	if err != nil {
+		return 0, err
+	}
+	return (pageCount - freePages) * pageSize, nil
+}
+
+// enforceDbLimit deletes the oldest messages, a tenth at a time, until the DB is below maxDbSize.
+func (writer *TelemetryWriter) enforceDbLimit() error {
+	if writer.maxDbSize <= 0 {
+		return nil
+	}
+	for {
+		size, err := writer.dbSize()
+		if err != nil {
+			return err
+		}
+		if size <= writer.maxDbSize {
+			return nil
+		}
+		count, err := writer.dbmap.SelectInt(fmt.Sprintf("select count(*) from %s", telemetryLogTableName))
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		evict := count/10 + 1
+		result, err := writer.dbmap.Exec(fmt.Sprintf("delete from %s where id in (select id from %s order by timestamp limit ?)",
+			telemetryLogTableName, telemetryLogTableName), evict)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		metricEvicted.With("messages").Add(float64(n))
+		if writer.debug {
+			writer.logger.Printf("DB is %d bytes. Evicted the %d oldest messages", size, n)
+		}
+	}
+}
+
+// enforceFileLimit deletes the oldest files waiting for upload until they're below maxFileSize.
+func (writer *TelemetryWriter) enforceFileLimit() error {
+	if writer.maxFileSize <= 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(writer.fileLocationPrefix)
+	if err != nil {
+		return err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), "plog-") {
+			files = append(files, entry)
+			total += entry.Size()
+		}
+	}
+	// the names contain the timestamp, so this is oldest first
+	sort.Sort(byName(files))
+	for i := 0; total > writer.maxFileSize && i < len(files); i++ {
+		err = os.Remove(path.Join(writer.fileLocationPrefix, files[i].Name()))
+		if err != nil {
+			return err
+		}
+		total -= files[i].Size()
+		metricEvicted.With("files").Inc()
+		if writer.debug {
+			writer.logger.Printf("Pending files over the limit. Evicted %s", files[i].Name())
+		}
+	}
+	return nil
+}
+
+type byName []os.FileInfo
+
+func (f byName) Len() int           { return len(f) }
+func (f byName) Less(i, j int) bool { return f[i].Name() < f[j].Name() }
+func (f byName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,129 @@
+package Telemetry
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type backpressureTester struct {
+	suite.Suite
+	dir    string
+	writer *TelemetryWriter
+}
+
+func TestBackpressure(t *testing.T) {
+	s := new(backpressureTester)
+	suite.Run(t, s)
+}
+
+func (s *backpressureTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "telemetry")
+	s.NoError(err)
+	// no dbWriter and uploader goroutines, so nothing drains the channel
+	s.writer = &TelemetryWriter{
+		fileLocationPrefix: s.dir,
+		telemetryCh:        make(chan telemetryLogMsg, 10),
+		logger:             log.New(os.Stderr, "telemetryWriter", log.LstdFlags|log.Lshortfile),
+	}
+}
+
+func (s *backpressureTester) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *backpressureTester) TestNonBlocking() {
+	dropped := metricDropped.With("queue-full", "WARN").Get()
+	done := make(chan int)
+	go func() {
+		for i := 0; i < 15; i++ {
+			s.writer.LogFields(logging.WARNING, "test", fmt.Sprintf("message %d", i), nil, time.Now())
+		}
+		done <- 1
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.Fail("Logging blocked on a full telemetry queue")
+	}
+	s.Equal(10, s.writer.QueueLength())
+	s.Equal(dropped+5, metricDropped.With("queue-full", "WARN").Get())
+}
+
+func (s *backpressureTester) TestSampling() {
+	s.writer.sampleRate = 3
+	for i := 0; i < 4; i++ {
+		s.writer.LogFields(logging.INFO, "test", "no pressure yet", nil, time.Now())
+	}
+	s.Equal(4, s.writer.QueueLength())
+
+	// after the warning, the queue is half full: only every third INFO makes it, but errors always do.
+	sampled := metricDropped.With("sampled", "INFO").Get()
+	s.writer.LogFields(logging.WARNING, "test", "pressure", nil, time.Now())
+	for i := 0; i < 6; i++ {
+		s.writer.LogFields(logging.INFO, "test", "sampled", nil, time.Now())
+	}
+	s.writer.LogFields(logging.ERROR, "test", "pressure", nil, time.Now())
+	s.Equal(4+1+2+1, s.writer.QueueLength())
+	s.Equal(sampled+4, metricDropped.With("sampled", "INFO").Get())
+}
+
+func (s *backpressureTester) TestDbLimit() {
+	err := s.writer.initDb()
+	s.NoError(err)
+	start := time.Now().Add(-time.Hour).Round(time.Millisecond).UTC()
+	message := strings.Repeat("x", 2000)
+	for i := 0; i < 500; i++ {
+		msg := NewTelemetryMsg(telemetryLogEventInfo, "test", message, start.Add(time.Duration(i)*time.Second))
+		err = s.writer.dbmap.Insert(&msg)
+		s.NoError(err)
+	}
+	size, err := s.writer.dbSize()
+	s.NoError(err)
+	s.True(size > 500*2000)
+
+	evicted := metricEvicted.With("messages").Get()
+	s.writer.maxDbSize = 256 * 1024
+	err = s.writer.enforceDbLimit()
+	s.NoError(err)
+	size, err = s.writer.dbSize()
+	s.NoError(err)
+	s.True(size <= s.writer.maxDbSize, fmt.Sprintf("DB is still %d bytes", size))
+
+	messages, err := s.writer.getAllMessagesSince(time.Time{}, telemetryLogEventAll)
+	s.NoError(err)
+	s.True(len(messages) > 0)
+	s.True(len(messages) < 500)
+	s.Equal(evicted+float64(500-len(messages)), metricEvicted.With("messages").Get())
+	// the newest messages are kept
+	s.Equal(start.Add(499*time.Second), messages[len(messages)-1].Timestamp.UTC())
+	s.Equal(start.Add(time.Duration(500-len(messages))*time.Second), messages[0].Timestamp.UTC())
+}
+
+func (s *backpressureTester) TestFileLimit() {
+	for i := 1; i <= 5; i++ {
+		err := ioutil.WriteFile(path.Join(s.dir, fmt.Sprintf("plog-2015060112000000%d.gz", i)), make([]byte, 1000), 0600)
+		s.NoError(err)
+	}
+	err := ioutil.WriteFile(path.Join(s.dir, "telemetry.db"), make([]byte, 5000), 0600)
+	s.NoError(err)
+
+	s.writer.maxFileSize = 2500
+	err = s.writer.enforceFileLimit()
+	s.NoError(err)
+	entries, err := ioutil.ReadDir(s.dir)
+	s.NoError(err)
+	names := make([]string, 0)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	s.Equal([]string{"plog-20150601120000004.gz", "plog-20150601120000005.gz", "telemetry.db"}, names)
+}
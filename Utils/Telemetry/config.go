@@ -2,14 +2,21 @@ package Telemetry
 
 import (
 	"fmt"
+	"net/url"
 )
 
 // TelemetryConfiguration The telemetry configuration section in a file
 type TelemetryConfiguration struct {
 	FileLocationPrefix   string
-	UploadLocationPrefix string
+	UploadLocationPrefix string // where to upload to. The scheme (s3, file, http(s), syslog) selects the sink
+	UploadUser           string // basic auth for the http(s) sink
+	UploadPassword       string `secret:"true"`
 	IncludeDebug         bool
 	UploadInterval       int64
+	MaxDbSizeMB          int64  // the max size of the messages buffered in the DB
+	MaxFileSizeMB        int64  // the max size of the files waiting for upload
+	SampleRate           int    // when the queue fills up, keep 1 in SampleRate DEBUG and INFO messages
+	UploadFormat         string // the format of the records in the files: json or msgpack
 }
 
 // NewTelemetryConfiguration creates a new TelemetryConfiguration
@@ -17,6 +24,10 @@ func NewTelemetryConfiguration() *TelemetryConfiguration {
 	return &TelemetryConfiguration{
 		IncludeDebug:   false,
 		UploadInterval: 10,
+		MaxDbSizeMB:    100,
+		MaxFileSizeMB:  500,
+		SampleRate:     10,
+		UploadFormat:   string(UploadFormatJSON),
 	}
 }
 
@@ -25,5 +36,29 @@ func (config *TelemetryConfiguration) Validate() error {
 	if config.UploadInterval <= 0 {
 		return fmt.Errorf("UploadInterval can not be <= 0")
 	}
+	if config.MaxDbSizeMB <= 0 || config.MaxFileSizeMB <= 0 {
+		return fmt.Errorf("MaxDbSizeMB and MaxFileSizeMB must be > 0")
+	}
+	if config.SampleRate < 1 {
+		return fmt.Errorf("SampleRate can not be < 1")
+	}
+	if _, err := NewUploadFormat(config.UploadFormat); err != nil {
+		return err
+	}
+	if config.UploadLocationPrefix != "" {
+		u, err := url.Parse(config.UploadLocationPrefix)
+		if err != nil {
+			return fmt.Errorf("UploadLocationPrefix: %s", err)
+		}
+		if u.User != nil {
+			// the URL is not a secret, so it would show up in 'pinger-config check'
+			return fmt.Errorf("UploadLocationPrefix: put the user and password in UploadUser and UploadPassword, not in the URL")
+		}
+		switch u.Scheme {
+		case "s3", "file", "http", "https", "syslog", "syslog+udp", "syslog+tcp":
+		default:
+			return fmt.Errorf("UploadLocationPrefix: unsupported scheme '%s'. Use s3, file, http(s) or syslog", u.Scheme)
+		}
+	}
 	return nil
 }
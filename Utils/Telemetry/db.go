@@ -3,6 +3,7 @@ package Telemetry
 import (
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"github.com/coopernurse/gorp"
 	_ "github.com/mattn/go-sqlite3"
@@ -35,6 +36,14 @@ func (writer *TelemetryWriter) initDb() error {
 	if err != nil {
 		panic(fmt.Sprintf("Create tables failed: %s", err))
 	}
+	// the telemetry DB survives restarts, so it may predate the fields column.
+	_, err = writer.dbmap.Exec(fmt.Sprintf("select fields from %s limit 1", telemetryLogTableName))
+	if err != nil {
+		_, err = writer.dbmap.Exec(fmt.Sprintf("alter table %s add column fields varchar(255)", telemetryLogTableName))
+		if err != nil {
+			panic(fmt.Sprintf("Could not add the fields column to %s: %s", telemetryLogTableName, err))
+		}
+	}
 	return nil
 }
 
@@ -46,6 +55,36 @@ func (t telemetryLogEventType) Value() (driver.Value, error) {
 	return string(t), nil
 }
 
+func (f *telemetryLogFields) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*f = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("Can not scan %T into telemetry fields", value)
+	}
+	if len(data) == 0 {
+		*f = nil
+		return nil
+	}
+	return json.Unmarshal(data, f)
+}
+func (f telemetryLogFields) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
 var getAllMessagesSQLwithType string
 var getAllMessagesSQL string
 
@@ -0,0 +1,250 @@
+package Telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// UploadFormat is the format of the records in the telemetry files. Either way, the files are gzip'ed,
+// with the version and format in the comment of the gzip header, e.g.
+// {"pinger-telemetry-version":1,"format":"json"}
+// JSON files are one record per line, as they always were, so existing consumers can read them.
+// Other formats also start with the header as a line of its own.
+type UploadFormat string
+
+const (
+	UploadFormatJSON    UploadFormat = "json"    // one JSON object per line
+	UploadFormatMsgPack UploadFormat = "msgpack" // a stream of msgpack records, each preceded by its length (4 bytes, big-endian)
+)
+
+// telemetryFileVersion is the version of the file layout. Bump it when the layout of the records changes.
+const telemetryFileVersion = 1
+
+// maxMsgPackRecord guards against reading garbage as a record length.
+const maxMsgPackRecord = 16 * 1024 * 1024
+
+func NewUploadFormat(format string) (UploadFormat, error) {
+	switch UploadFormat(format) {
+	case UploadFormatJSON, UploadFormatMsgPack:
+		return UploadFormat(format), nil
+	case "":
+		return UploadFormatJSON, nil
+	}
+	return "", fmt.Errorf("Unknown upload format '%s'. Use '%s' or '%s'", format, UploadFormatJSON, UploadFormatMsgPack)
+}
+
+type telemetryFileHeader struct {
+	Version int          `json:"pinger-telemetry-version"`
+	Format  UploadFormat `json:"format"`
+}
+
+// fileHeaderComment returns the header for the comment of the gzip header.
+func fileHeaderComment(format UploadFormat) (string, error) {
+	header, err := json.Marshal(telemetryFileHeader{Version: telemetryFileVersion, Format: format})
+	if err != nil {
+		return "", err
+	}
+	return string(header), nil
+}
+
+// writeFileHeader writes the header line, for the formats that need one. JSON gets none, and
+// only has the header in the gzip header (see fileHeaderComment).
+func writeFileHeader(buffer *bytes.Buffer, format UploadFormat) error {
+	if format == UploadFormatJSON {
+		return nil
+	}
+	header, err := fileHeaderComment(format)
+	if err != nil {
+		return err
+	}
+	buffer.WriteString(header)
+	buffer.WriteString("\n")
+	return nil
+}
+
+// readFileHeader returns the header if the line (or gzip comment) is one. JSON files have no header
+// line, and have a record as their first line, so they're read as JSON.
+func readFileHeader(line []byte) (*telemetryFileHeader, bool) {
+	header := telemetryFileHeader{}
+	if json.Unmarshal(line, &header) != nil || header.Version == 0 {
+		return nil, false
+	}
+	return &header, true
+}
+
+// fileHeader returns the header of a telemetry file: the one in the gzip header, or else the header
+// line. Files from before there were headers are JSON files of version 0.
+func fileHeader(filePath string) (*telemetryFileHeader, error) {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	if header, ok := readFileHeader([]byte(gz.Header.Comment)); ok {
+		return header, nil
+	}
+	line, err := bufio.NewReader(gz).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if header, ok := readFileHeader(line); ok {
+		return header, nil
+	}
+	return &telemetryFileHeader{Format: UploadFormatJSON}, nil
+}
+
+// fileFormat returns the format of a telemetry file, from its header.
+func fileFormat(filePath string) (UploadFormat, error) {
+	header, err := fileHeader(filePath)
+	if err != nil {
+		return "", err
+	}
+	return header.Format, nil
+}
+
+func writeJSONRecord(buffer *bytes.Buffer, msg *telemetryLogMsg) error {
+	jsonString, err := json.Marshal(msg.toMap())
+	if err != nil {
+		return err
+	}
+	jsonString = bytes.Replace(jsonString, CR, []byte("<CR>"), -1)
+	jsonString = bytes.Replace(jsonString, NL, []byte("<NL>"), -1)
+	buffer.Write(jsonString)
+	buffer.WriteString("\n")
+	return nil
+}
+
+func writeMsgPackRecord(buffer *bytes.Buffer, msg *telemetryLogMsg) error {
+	err := msg.prepareForUpload()
+	if err != nil {
+		return err
+	}
+	packed, err := msg.encodeMsgPack()
+	if err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(packed)))
+	buffer.Write(length[:])
+	buffer.Write(packed)
+	return nil
+}
+
+// ReadTelemetryFile reads a gzip'ed telemetry file, in either format, and calls fn with each record
+// as a JSON object. Files we append to contain several gzip streams, each with its own header.
+func ReadTelemetryFile(r io.Reader, fn func(record []byte) error) error {
+	reader := bufio.NewReader(r)
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	for {
+		gz.Multistream(false)
+		if header, ok := readFileHeader([]byte(gz.Header.Comment)); ok && header.Version > telemetryFileVersion {
+			return fmt.Errorf("Unsupported telemetry file version %d", header.Version)
+		}
+		err = readTelemetryStream(bufio.NewReader(gz), fn)
+		if err != nil {
+			return err
+		}
+		err = gz.Reset(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readTelemetryStream(reader *bufio.Reader, fn func(record []byte) error) error {
+	line, err := reader.ReadBytes('\n')
+	if len(line) == 0 {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	format := UploadFormatJSON
+	if header, ok := readFileHeader(line); ok {
+		if header.Version > telemetryFileVersion {
+			return fmt.Errorf("Unsupported telemetry file version %d", header.Version)
+		}
+		format = header.Format
+		line = nil
+	}
+	switch format {
+	case UploadFormatJSON:
+		return readJSONRecords(reader, line, fn)
+	case UploadFormatMsgPack:
+		return readMsgPackRecords(reader, fn)
+	}
+	return fmt.Errorf("Unknown telemetry file format '%s'", format)
+}
+
+func readJSONRecords(reader *bufio.Reader, line []byte, fn func(record []byte) error) error {
+	for {
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			err := fn(line)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func readMsgPackRecords(reader *bufio.Reader, fn func(record []byte) error) error {
+	var length [4]byte
+	for {
+		_, err := io.ReadFull(reader, length[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n > maxMsgPackRecord {
+			return fmt.Errorf("msgpack record of %d bytes is too large", n)
+		}
+		packed := make([]byte, n)
+		_, err = io.ReadFull(reader, packed)
+		if err != nil {
+			return err
+		}
+		msgMap, err := decodeMsgPackRecord(packed)
+		if err != nil {
+			return err
+		}
+		record, err := json.Marshal(msgMap)
+		if err != nil {
+			return err
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package Telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/nachocove/Pinger/Utils/HostId"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type formatTester struct {
+	suite.Suite
+	dir    string
+	writer *TelemetryWriter
+}
+
+func TestFormats(t *testing.T) {
+	s := new(formatTester)
+	suite.Run(t, s)
+}
+
+func (s *formatTester) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "formattest")
+	s.NoError(err)
+	s.writer = &TelemetryWriter{
+		fileLocationPrefix: s.dir,
+		logger:             log.New(os.Stderr, "formatTester", log.LstdFlags),
+	}
+}
+
+func (s *formatTester) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *formatTester) messages() []telemetryLogMsg {
+	now := time.Now().Round(time.Millisecond).UTC()
+	return []telemetryLogMsg{
+		NewTelemetryMsg(telemetryLogEventInfo, "foo", "first|client=user1", now.Add(-time.Second)),
+		NewTelemetryMsgWithFields(telemetryLogEventWarning, "foo", "second",
+			map[string]interface{}{"device": "NchoXYZ", "count": 2, "msgCode": "TEST"}, now),
+	}
+}
+
+// readFiles reads all the telemetry files back, and returns the records
+func (s *formatTester) readFiles() []map[string]interface{} {
+	files, err := filepath.Glob(path.Join(s.dir, "plog-*.gz"))
+	s.NoError(err)
+	s.NotEmpty(files)
+	records := make([]map[string]interface{}, 0)
+	for _, file := range files {
+		fp, err := os.Open(file)
+		s.NoError(err)
+		err = ReadTelemetryFile(fp, func(record []byte) error {
+			m := make(map[string]interface{})
+			err := json.Unmarshal(record, &m)
+			records = append(records, m)
+			return err
+		})
+		s.NoError(err)
+		fp.Close()
+	}
+	return records
+}
+
+func (s *formatTester) TestRoundTrip() {
+	for _, format := range []UploadFormat{UploadFormatJSON, UploadFormatMsgPack} {
+		s.SetupTest()
+		s.writer.uploadFormat = format
+		messages := s.messages()
+		s.NoError(s.writer.createFilesFromMessages(&messages))
+		s.Equal(format, s.fileFormat())
+
+		records := s.readFiles()
+		s.Len(records, 2, string(format))
+		s.Equal(messages[0].Id, records[0]["id"])
+		s.Equal("INFO", records[0]["event_type"])
+		s.Equal("first", records[0]["message"])
+		s.Equal("user1", records[0]["client"])
+		s.Equal(HostId.HostId(), records[0]["pinger"])
+		s.Equal(messages[1].Timestamp.Format("2006-01-02 15:04:05.999"), records[1]["timestamp"])
+		s.Equal("NchoXYZ", records[1]["device"])
+		s.Equal(float64(2), records[1]["count"])
+		s.Equal("TEST", records[1]["msgCode"])
+		s.Equal("second", records[1]["message"])
+		s.TearDownTest()
+	}
+}
+
+func (s *formatTester) fileFormat() UploadFormat {
+	return s.fileHeader().Format
+}
+
+func (s *formatTester) fileHeader() *telemetryFileHeader {
+	files, err := filepath.Glob(path.Join(s.dir, "plog-*.gz"))
+	s.NoError(err)
+	s.Len(files, 1)
+	header, err := fileHeader(files[0])
+	s.NoError(err)
+	return header
+}
+
+func (s *formatTester) TestAppendedFile() {
+	// the same file name twice, in different formats, gives a file with two gzip streams
+	s.writer.uploadFormat = UploadFormatMsgPack
+	messages := s.messages()
+	s.NoError(s.writer.createFilesFromMessages(&messages))
+	s.writer.uploadFormat = UploadFormatJSON
+	s.NoError(s.writer.createFilesFromMessages(&messages))
+	s.Len(s.readFiles(), 4)
+}
+
+func (s *formatTester) TestJSONHasNoHeader() {
+	// existing consumers read JSON files line by line, so every line must be a record.
+	// The version is in the gzip header instead.
+	s.writer.uploadFormat = UploadFormatJSON
+	messages := s.messages()
+	s.NoError(s.writer.createFilesFromMessages(&messages))
+	files, err := filepath.Glob(path.Join(s.dir, "plog-*.gz"))
+	s.NoError(err)
+	s.Len(files, 1)
+	fp, err := os.Open(files[0])
+	s.NoError(err)
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	s.NoError(err)
+	data, err := ioutil.ReadAll(gz)
+	s.NoError(err)
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	s.Len(lines, 2)
+	for _, line := range lines {
+		m := make(map[string]interface{})
+		s.NoError(json.Unmarshal(line, &m))
+		_, ok := m["pinger-telemetry-version"]
+		s.False(ok)
+		s.NotEmpty(m["message"])
+	}
+}
+
+func (s *formatTester) TestJSONVersion() {
+	s.writer.uploadFormat = UploadFormatJSON
+	messages := s.messages()
+	s.NoError(s.writer.createFilesFromMessages(&messages))
+	header := s.fileHeader()
+	s.Equal(telemetryFileVersion, header.Version)
+	s.Equal(UploadFormatJSON, header.Format)
+	s.Len(s.readFiles(), 2)
+}
+
+func (s *formatTester) TestUnsupportedVersion() {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Comment = "{\"pinger-telemetry-version\":99,\"format\":\"json\"}"
+	w.Write([]byte("{\"message\":\"first\"}\n"))
+	w.Close()
+	err := ReadTelemetryFile(&buf, func(record []byte) error { return nil })
+	s.Error(err)
+}
+
+func (s *formatTester) TestNoHeader() {
+	// JSON files, including the ones from before there was a header
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("{\"message\":\"first\"}\n{\"message\":\"second\"}\n"))
+	w.Close()
+	s.NoError(ioutil.WriteFile(path.Join(s.dir, "plog-20150601120000000.gz"), buf.Bytes(), 0600))
+	records := s.readFiles()
+	s.Len(records, 2)
+	s.Equal("second", records[1]["message"])
+	s.Equal(UploadFormatJSON, s.fileFormat())
+}
+
+func (s *formatTester) TestUploadFormat() {
+	format, err := NewUploadFormat("")
+	s.NoError(err)
+	s.Equal(UploadFormatJSON, format)
+	_, err = NewUploadFormat("xml")
+	s.Error(err)
+
+	config := NewTelemetryConfiguration()
+	s.NoError(config.Validate())
+	config.UploadFormat = "protobuf"
+	s.Error(config.Validate())
+}
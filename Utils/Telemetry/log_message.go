@@ -31,8 +31,12 @@ type telemetryLogMsg struct {
 	UploadedAt time.Time             `db:"-"`
 	Module     string                `db:"module"`
 	Message    string                `db:"message"`
+	Fields     telemetryLogFields    `db:"fields"`
 }
 
+// telemetryLogFields the structured fields of a log message. Stored in the DB as JSON.
+type telemetryLogFields map[string]interface{}
+
 func (msg *telemetryLogMsg) prepareForUpload() error {
 	msg.UploadedAt = time.Now().Round(time.Millisecond).UTC()
 	return nil
@@ -47,7 +51,31 @@ func newId() string {
 
 func (msg *telemetryLogMsg) toMap() telemetryLogMsgMap {
 	msg.prepareForUpload()
+	return msg.uploadMap(HostId.HostId())
+}
+
+// uploadMap returns the message as it is uploaded, as coming from the given pinger.
+func (msg *telemetryLogMsg) uploadMap(pinger string) telemetryLogMsgMap {
 	msgMap := make(telemetryLogMsgMap)
+	if len(msg.Fields) > 0 {
+		for k, v := range msg.Fields {
+			msgMap[k] = v
+		}
+		msgMap["message"] = msg.Message
+	} else {
+		// messages logged without fields may still have hand-built |key=value| parts
+		msg.parseMessage(msgMap)
+	}
+	msgMap["id"] = msg.Id
+	msgMap["event_type"] = string(msg.EventType)
+	msgMap["timestamp"] = msg.Timestamp.Format("2006-01-02 15:04:05.999")
+	msgMap["uploaded_at"] = msg.UploadedAt.Format("2006-01-02 15:04:05.999")
+	msgMap["module"] = msg.Module
+	msgMap["pinger"] = pinger
+	return msgMap
+}
+
+func (msg *telemetryLogMsg) parseMessage(msgMap telemetryLogMsgMap) {
 	tokens := strings.Split(msg.Message, "|")
 	var rawMessage string
 	for _, token := range tokens {
@@ -69,13 +97,6 @@ func (msg *telemetryLogMsg) toMap() telemetryLogMsgMap {
 			msgMap["message"] = rawMessage
 		}
 	}
-	msgMap["id"] = msg.Id
-	msgMap["event_type"] = string(msg.EventType)
-	msgMap["timestamp"] = msg.Timestamp.Format("2006-01-02 15:04:05.999")
-	msgMap["uploaded_at"] = msg.UploadedAt.Format("2006-01-02 15:04:05.999")
-	msgMap["module"] = msg.Module
-	msgMap["pinger"] = HostId.HostId()
-	return msgMap
 }
 
 // NewTelemetryMsg Create a new telemetry message instance
@@ -89,18 +110,9 @@ func NewTelemetryMsg(eventType telemetryLogEventType, module, message string, ti
 	}
 }
 
-// NewTelemetryMsg2 Create a new telemetry message instance
-func NewTelemetryMsg2(eventType telemetryLogEventType, module, client, device, session, context, message, hostId string, timestamp time.Time) telemetryLogMsg {
-	return telemetryLogMsg{
-		Id:        newId(),
-		EventType: eventType,
-		Timestamp: timestamp,
-		Module:    module,
-		//		Client:        client,
-		//		DeviceId:      device,
-		//		SessionId:     session,
-		//		ClientContext: context,
-		Message: message,
-		//		Pinger:        hostId,
-	}
+// NewTelemetryMsgWithFields Create a new telemetry message instance with structured fields
+func NewTelemetryMsgWithFields(eventType telemetryLogEventType, module, message string, fields map[string]interface{}, timestamp time.Time) telemetryLogMsg {
+	msg := NewTelemetryMsg(eventType, module, message, timestamp)
+	msg.Fields = fields
+	return msg
 }
@@ -20,3 +20,40 @@ func TestMsgCreate(t *testing.T) {
 	assert.NoError(err)
 	assert.NotEqual(time.Time{}, msg.UploadedAt)
 }
+
+func TestMsgFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// hand-built fields are parsed out of the message
+	msg := NewTelemetryMsg(telemetryLogEventInfo, "foo", "|device=NchoXYZ|message=Got mail|msgCode=NEW_MAIL",
+		time.Now().Round(time.Millisecond).UTC())
+	msgMap := msg.toMap()
+	assert.Equal("NchoXYZ", msgMap["device"])
+	assert.Equal("Got mail", msgMap["message"])
+	assert.Equal("NEW_MAIL", msgMap["msgCode"])
+
+	// structured fields are used as they are, and the message is left alone
+	fields := map[string]interface{}{"device": "NchoXYZ", "msgCode": "NEW_MAIL", "count": 2}
+	msg = NewTelemetryMsgWithFields(telemetryLogEventInfo, "foo", "Got mail|rearm=a=b",
+		fields, time.Now().Round(time.Millisecond).UTC())
+	msgMap = msg.toMap()
+	assert.Equal("NchoXYZ", msgMap["device"])
+	assert.Equal("NEW_MAIL", msgMap["msgCode"])
+	assert.Equal(2, msgMap["count"])
+	assert.Equal("Got mail|rearm=a=b", msgMap["message"])
+	assert.Nil(msgMap["rearm"])
+	assert.Equal("foo", msgMap["module"])
+
+	value, err := msg.Fields.Value()
+	assert.NoError(err)
+	var scanned telemetryLogFields
+	assert.NoError(scanned.Scan([]byte(value.(string))))
+	assert.Equal("NchoXYZ", scanned["device"])
+	assert.Equal(2.0, scanned["count"])
+
+	value, err = telemetryLogFields(nil).Value()
+	assert.NoError(err)
+	assert.Nil(value)
+	assert.NoError(scanned.Scan(nil))
+	assert.Nil(scanned)
+}
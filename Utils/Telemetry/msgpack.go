@@ -2,11 +2,11 @@ package Telemetry
 
 import (
 	"fmt"
+	"github.com/nachocove/Pinger/Utils/HostId"
 	"github.com/ugorji/go/codec"
 )
 
-// An attempt at using MsgPack for encoding of the telemetry messages. We opted for json instead.
-// This is here in case we need it later. Could be deleted.
+// MsgPack encoding of the telemetry messages, for the msgpack upload format (see UploadFormatMsgPack).
 
 type telemetryPackKey int
 
@@ -17,6 +17,8 @@ const (
 	telemetryLogMsgPackUploadedAt telemetryPackKey = 3
 	telemetryLogMsgPackModule     telemetryPackKey = 4
 	telemetryLogMsgPackMessage    telemetryPackKey = 5
+	telemetryLogMsgPackFields     telemetryPackKey = 6
+	telemetryLogMsgPackPinger     telemetryPackKey = 7
 )
 
 const (
@@ -64,6 +66,10 @@ func (msg *telemetryLogMsg) encodeMsgPack() ([]byte, error) {
 	pack[telemetryLogMsgPackUploadedAt] = telemetryTimefromTime(msg.UploadedAt)
 	pack[telemetryLogMsgPackModule] = msg.Module
 	pack[telemetryLogMsgPackMessage] = msg.Message
+	if len(msg.Fields) > 0 {
+		pack[telemetryLogMsgPackFields] = map[string]interface{}(msg.Fields)
+	}
+	pack[telemetryLogMsgPackPinger] = HostId.HostId()
 
 	buffer := make([]byte, 0, 64)
 	var h codec.Handle = new(codec.MsgpackHandle)
@@ -77,12 +83,38 @@ func (msg *telemetryLogMsg) encodeMsgPack() ([]byte, error) {
 }
 
 func (msg *telemetryLogMsg) decodeMsgPack(in []byte) error {
-	pack := make(telemetryLogMsgPackType)
+	_, err := msg.decodePack(in)
+	return err
+}
+
+// decodeMsgPackRecord decodes a record of a msgpack telemetry file into the map that
+// would have been uploaded in the json format.
+func decodeMsgPackRecord(in []byte) (telemetryLogMsgMap, error) {
+	msg := &telemetryLogMsg{}
+	pack, err := msg.decodePack(in)
+	if err != nil {
+		return nil, err
+	}
+	var pinger string
+	if b, ok := pack[telemetryLogMsgPackPinger].([]byte); ok {
+		pinger = string(b)
+	}
+	return msg.uploadMap(pinger), nil
+}
+
+func (msg *telemetryLogMsg) decodePack(in []byte) (pack telemetryLogMsgPackType, err error) {
+	defer func() {
+		// the type assertions panic on records that aren't ours
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Could not decode msgpack record: %v", r)
+		}
+	}()
+	pack = make(telemetryLogMsgPackType)
 	var h codec.Handle = new(codec.MsgpackHandle)
 	dec := codec.NewDecoderBytes(in, h)
-	err := dec.Decode(&pack)
+	err = dec.Decode(&pack)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	msg.Id = string(pack[telemetryLogMsgPackId].([]byte))
 	msg.EventType = telemetryPackEventTypeToMsg(pack[telemetryLogMsgPackEventType].(int64))
@@ -90,5 +122,31 @@ func (msg *telemetryLogMsg) decodeMsgPack(in []byte) error {
 	msg.UploadedAt = telemetryTime(pack[telemetryLogMsgPackUploadedAt].(uint64)).time()
 	msg.Module = string(pack[telemetryLogMsgPackModule].([]byte))
 	msg.Message = string(pack[telemetryLogMsgPackMessage].([]byte))
-	return nil
+	if fields, ok := pack[telemetryLogMsgPackFields].(map[interface{}]interface{}); ok {
+		msg.Fields = make(telemetryLogFields, len(fields))
+		for k, v := range fields {
+			msg.Fields[fmt.Sprintf("%s", k)] = msgPackValue(v)
+		}
+	}
+	return pack, nil
+}
+
+// msgPackValue turns the raw bytes the decoder gives us for strings back into strings.
+func msgPackValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case []byte:
+		return string(value)
+	case []interface{}:
+		for i := range value {
+			value[i] = msgPackValue(value[i])
+		}
+		return value
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprintf("%s", k)] = msgPackValue(v)
+		}
+		return m
+	}
+	return v
 }
@@ -1,22 +1,40 @@
 package Telemetry
 
 import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"log"
+	"net/url"
 	"path"
 )
 
-func (writer *TelemetryWriter) pushToS3(fileName string) error {
-	if writer.uploadLocationPrefixUrl != nil {
-		bucket := writer.uploadLocationPrefixUrl.Host
-		srcPath := path.Join(writer.fileLocationPrefix, fileName)
-		datePrefix := fileName[5:13]
-		destPath := path.Join("/", writer.uploadLocationPrefixUrl.Path, "/", datePrefix, "/", fileName)
-		if writer.debug {
-			writer.logger.Printf("Uploading %s to s3://%s%s", srcPath, bucket, destPath)
-		}
-		err := writer.aws.PutFile(bucket, srcPath, destPath)
-		if err != nil {
-			return err
-		}
+// s3Sink uploads the files to s3://bucket/prefix/<date>/<file>
+type s3Sink struct {
+	bucket string
+	prefix string
+	aws    AWS.AWSHandler
+	logger *log.Logger
+	debug  bool
+}
+
+func newS3Sink(u *url.URL, aws AWS.AWSHandler, logger *log.Logger, debug bool) *s3Sink {
+	return &s3Sink{
+		bucket: u.Host,
+		prefix: u.Path,
+		aws:    aws,
+		logger: logger,
+		debug:  debug,
 	}
-	return nil
+}
+
+func (sink *s3Sink) Upload(filePath, fileName string) error {
+	destPath := path.Join("/", sink.prefix, "/", fileDate(fileName), "/", fileName)
+	if sink.debug {
+		sink.logger.Printf("Uploading %s to s3://%s%s", filePath, sink.bucket, destPath)
+	}
+	return sink.aws.PutFile(sink.bucket, filePath, destPath)
+}
+
+func (sink *s3Sink) String() string {
+	return fmt.Sprintf("s3://%s%s", sink.bucket, sink.prefix)
 }
@@ -0,0 +1,57 @@
+package Telemetry
+
+import (
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/AWS"
+	"log"
+	"net/url"
+)
+
+// Sink is where the telemetry files go once they're written. A file is gzip'ed JSON,
+// one record per line, and is named plog-<timestamp>.gz. The file is deleted after a
+// successful Upload.
+type Sink interface {
+	Upload(filePath, fileName string) error
+	String() string
+}
+
+// newSink creates the sink for the UploadLocationPrefix. The scheme selects the sink:
+//
+//	s3://bucket/prefix             the S3 bucket, under prefix/<date>/ (needs AWS)
+//	file:///some/dir               a local directory, under <date>/
+//	http://host/path, https://...  POSTed to the URL, with UploadUser and UploadPassword, if set
+//	syslog://host:port             sent line by line to a syslog server over UDP.
+//	syslog+tcp://host:port         the same over TCP. syslog:/// uses the local syslog.
+func newSink(config *TelemetryConfiguration, aws AWS.AWSHandler, logger *log.Logger, debug bool) (Sink, error) {
+	uploadLocationPrefix := config.UploadLocationPrefix
+	u, err := url.Parse(uploadLocationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		if aws == nil {
+			// not an error. We just keep the files locally, like we always have.
+			return nil, nil
+		}
+		return newS3Sink(u, aws, logger, debug), nil
+
+	case "file":
+		return newDirSink(u.Path)
+
+	case "http", "https":
+		return newHTTPSink(u, config.UploadUser, config.UploadPassword), nil
+
+	case "syslog", "syslog+udp", "syslog+tcp":
+		return newSyslogSink(u)
+	}
+	return nil, fmt.Errorf("Unsupported telemetry upload location %s", uploadLocationPrefix)
+}
+
+// fileDate returns the date part of a telemetry file name, e.g. 20150601 for plog-20150601120000000.gz.
+func fileDate(fileName string) string {
+	if len(fileName) < 13 {
+		return ""
+	}
+	return fileName[5:13]
+}
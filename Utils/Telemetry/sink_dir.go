@@ -0,0 +1,58 @@
+package Telemetry
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// dirSink copies the files to a local directory, e.g. one a log shipper watches, under <date>/<file>.
+type dirSink struct {
+	dir string
+}
+
+func newDirSink(dir string) (*dirSink, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("No directory given for the telemetry upload location")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &dirSink{dir: dir}, nil
+}
+
+func (sink *dirSink) Upload(filePath, fileName string) error {
+	destDir := path.Join(sink.dir, fileDate(fileName))
+	err := os.MkdirAll(destDir, 0700)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	// write to a temp file and rename it, so whoever watches the directory never sees half a file.
+	destPath := path.Join(destDir, fileName)
+	tmpPath := path.Join(destDir, "."+fileName+".tmp")
+	dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, src)
+	if err == nil {
+		err = dest.Sync()
+	}
+	dest.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
+
+func (sink *dirSink) String() string {
+	return "file://" + sink.dir
+}
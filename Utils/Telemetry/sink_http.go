@@ -0,0 +1,74 @@
+package Telemetry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const httpSinkTimeout = 60 * time.Second
+
+// httpSink POSTs the files, as gzip'ed newline-delimited JSON, to a URL, e.g. the ingest
+// URL of an ELK or Loki setup. The user and password, if given, are sent as basic auth.
+// Files in the msgpack format are POSTed as they are, as application/x-msgpack.
+type httpSink struct {
+	url      *url.URL
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newHTTPSink(u *url.URL, user, password string) *httpSink {
+	return &httpSink{
+		url:      u,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: httpSinkTimeout},
+	}
+}
+
+func (sink *httpSink) Upload(filePath, fileName string) error {
+	format, err := fileFormat(filePath)
+	if err != nil {
+		return err
+	}
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	req, err := http.NewRequest("POST", sink.url.String(), fp)
+	if err != nil {
+		return err
+	}
+	if format == UploadFormatMsgPack {
+		req.Header.Set("Content-Type", "application/x-msgpack")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Pinger-Telemetry-File", fileName)
+	if sink.user != "" || sink.password != "" {
+		req.SetBasicAuth(sink.user, sink.password)
+	}
+	response, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Uploading %s to %s failed: %s", fileName, sink, response.Status)
+	}
+	return nil
+}
+
+func (sink *httpSink) String() string {
+	u := *sink.url
+	u.User = nil // no passwords in log messages
+	return u.String()
+}
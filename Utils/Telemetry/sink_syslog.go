@@ -0,0 +1,56 @@
+package Telemetry
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+)
+
+const syslogTag = "pinger-telemetry"
+
+// syslogSink sends every record of the files as a syslog message, as JSON.
+type syslogSink struct {
+	network string // udp or tcp. Empty for the local syslog
+	address string
+}
+
+func newSyslogSink(u *url.URL) (*syslogSink, error) {
+	sink := &syslogSink{}
+	if u.Host != "" {
+		sink.network = "udp"
+		if u.Scheme == "syslog+tcp" {
+			sink.network = "tcp"
+		}
+		sink.address = u.Host
+		if u.Port() == "" {
+			sink.address = net.JoinHostPort(u.Hostname(), "514")
+		}
+	}
+	return sink, nil
+}
+
+func (sink *syslogSink) Upload(filePath, fileName string) error {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	w, err := syslog.Dial(sink.network, sink.address, syslog.LOG_INFO|syslog.LOG_LOCAL0, syslogTag)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	// msgpack records are sent as JSON, too
+	return ReadTelemetryFile(fp, func(record []byte) error {
+		return w.Info(string(record))
+	})
+}
+
+func (sink *syslogSink) String() string {
+	if sink.network == "" {
+		return "syslog (local)"
+	}
+	return fmt.Sprintf("syslog+%s://%s", sink.network, sink.address)
+}
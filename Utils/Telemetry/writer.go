@@ -4,19 +4,19 @@ package Telemetry
 import (
 	"bytes"
 	"compress/gzip"
-	"encoding/json"
 	"fmt"
 	"github.com/coopernurse/gorp"
 	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/nachocove/Pinger/Utils/Redact"
 	"github.com/op/go-logging"
 	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,22 +29,26 @@ import (
 //
 // A separate goroutine listens on the channel and writes the record to a local sqlite3 db
 // (/tmp/telemetry/telemetry.db), which is essentially a buffer. Yea another go-routine periodically wakes
-// up, reads all records from the sqlite3 DB, formats them into json-formatted files, gzip's the files,
-// and uploads it to s3.
+// up, reads all records from the sqlite3 DB, formats them into json (or msgpack) files, gzip's the files,
+// and uploads it to the sink (s3, by default. See newSink).
 type TelemetryWriter struct {
 	fileLocationPrefix      string               // where to store tempfiles which are written to s3
-	uploadLocationPrefixUrl *url.URL             // prefix in the s3 bucket where to store the file
+	sink                    Sink                 // where to upload the files to. nil if they stay local
 	uploadInterval          int64                // how often (in minutes) to upload to s3
 	dbmap                   *gorp.DbMap          // the Gorp handle
 	lastRead                time.Time            // timestamp when we last read from the DB.
 	telemetryCh             chan telemetryLogMsg // the channel the .Log() method writes to
 	doUploadNow             chan int             // a channel to make the background 'task' write immediately (used when an error is encountered, for example).
-	aws                     AWS.AWSHandler       // the AWS methods
 	logger                  *log.Logger          // the logger
-	includeDebug            bool                 // whether to also upload debugs. Used for debugging.
+	includeDebug            int32                // whether to also upload debugs (1 or 0). Used for debugging. See SetIncludeDebug
 	debug                   bool                 // whether to debug the telemetry writer (to debug we use printfs, so there's no logging loop)
 	msgCount                int64                // the message count. Keeps track of how many messages we have buffered. We upload every 100.
 	mutex                   sync.Mutex
+	maxDbSize               int64                // the max bytes of messages in the DB. The oldest messages are evicted beyond that.
+	maxFileSize             int64                // the max bytes of files waiting for upload. The oldest files are evicted beyond that.
+	sampleRate              uint64               // keep 1 in sampleRate DEBUG and INFO messages when the channel fills up
+	sampleCount             uint64               // the DEBUG and INFO messages seen under pressure. Accessed atomically.
+	uploadFormat            UploadFormat         // the format of the records in the files
 }
 
 var NL, CR []byte
@@ -63,23 +67,29 @@ func NewTelemetryWriter(config *TelemetryConfiguration, aws AWS.AWSHandler, debu
 		fileLocationPrefix: config.FileLocationPrefix,
 		telemetryCh:        make(chan telemetryLogMsg, 1024),
 		doUploadNow:        make(chan int, 5),
-		aws:                aws,
 		logger:             log.New(os.Stderr, "telemetryWriter", log.LstdFlags|log.Lshortfile),
-		includeDebug:       config.IncludeDebug,
 		debug:              debug,
 		mutex:              sync.Mutex{},
 		uploadInterval:     config.UploadInterval,
+		maxDbSize:          config.MaxDbSizeMB * 1024 * 1024,
+		maxFileSize:        config.MaxFileSizeMB * 1024 * 1024,
+		sampleRate:         uint64(config.SampleRate),
 	}
-	err := writer.makeFileLocationPrefix()
+	writer.SetIncludeDebug(config.IncludeDebug)
+	var err error
+	writer.uploadFormat, err = NewUploadFormat(config.UploadFormat)
 	if err != nil {
 		return nil, err
 	}
-	if config.UploadLocationPrefix != "" && aws != nil {
-		u, err := url.Parse(config.UploadLocationPrefix)
+	err = writer.makeFileLocationPrefix()
+	if err != nil {
+		return nil, err
+	}
+	if config.UploadLocationPrefix != "" {
+		writer.sink, err = newSink(config, aws, writer.logger, debug)
 		if err != nil {
 			return nil, err
 		}
-		writer.uploadLocationPrefixUrl = u
 	}
 	err = writer.initDb()
 	if err != nil {
@@ -92,6 +102,12 @@ func NewTelemetryWriter(config *TelemetryConfiguration, aws AWS.AWSHandler, debu
 
 // Log Implements the logging Interface so this can be used as a logger backend.
 func (writer *TelemetryWriter) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	return writer.LogFields(level, rec.Module, rec.Message(), nil, rec.Time)
+}
+
+// LogFields queues a log message with its structured fields (device, session, msgCode, etc).
+// The fields are uploaded as keys of the telemetry record.
+func (writer *TelemetryWriter) LogFields(level logging.Level, module, message string, fields map[string]interface{}, timestamp time.Time) error {
 	var eventType telemetryLogEventType
 	switch {
 	case level == logging.DEBUG:
@@ -109,13 +125,46 @@ func (writer *TelemetryWriter) Log(level logging.Level, calldepth int, rec *logg
 	default:
 		eventType = telemetryLogEventWarning
 	}
-	if writer.includeDebug || eventType == telemetryLogEventWarning || eventType == telemetryLogEventError || eventType == telemetryLogEventInfo {
-		msg := NewTelemetryMsg(eventType, rec.Module, rec.Message(), rec.Time.Round(time.Millisecond).UTC())
-		writer.telemetryCh <- msg
+	if atomic.LoadInt32(&writer.includeDebug) == 1 || eventType == telemetryLogEventWarning || eventType == telemetryLogEventError || eventType == telemetryLogEventInfo {
+		if !writer.sample(eventType) {
+			return nil
+		}
+		msg := NewTelemetryMsgWithFields(eventType, module, Redact.String(message), redactFields(fields), timestamp.Round(time.Millisecond).UTC())
+		writer.enqueue(msg)
 	}
 	return nil
 }
 
+// SetIncludeDebug changes whether the debug messages are uploaded, e.g. after a config reload.
+func (writer *TelemetryWriter) SetIncludeDebug(include bool) {
+	var value int32
+	if include {
+		value = 1
+	}
+	atomic.StoreInt32(&writer.includeDebug, value)
+}
+
+// redactFields returns a copy of the fields with the personal information and secrets removed.
+// Messages from the Logging package are already redacted, but not everything logs through it.
+func redactFields(fields map[string]interface{}) map[string]interface{} {
+	if len(fields) == 0 {
+		return fields
+	}
+	redacted := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if s, ok := v.(string); ok && k != "msgCode" {
+			v = Redact.Value(k, s)
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// QueueLength returns the number of messages waiting to be written to the DB.
+func (writer *TelemetryWriter) QueueLength() int {
+	return len(writer.telemetryCh)
+}
+
 // dbWriter the Goroutine responsible for reading from the channel and writing to the DB.
 // this avoids any contention to the DB. This is the only place we write to the DB.
 func (writer *TelemetryWriter) dbWriter() {
@@ -128,7 +177,15 @@ func (writer *TelemetryWriter) dbWriter() {
 		writer.mutex.Lock()
 		writer.msgCount++
 		if writer.msgCount > 100 {
-			writer.doUploadNow <- 1
+			err = writer.enforceDbLimit()
+			if err != nil {
+				writer.logger.Printf("Could not enforce the DB size limit: %v\n", err)
+			}
+			select {
+			case writer.doUploadNow <- 1:
+			default:
+				// the uploader has plenty to do already. Don't wait for it.
+			}
 			writer.msgCount = 0
 		}
 		writer.mutex.Unlock()
@@ -202,6 +259,11 @@ func (writer *TelemetryWriter) createFilesAndUpload() error {
 	if err != nil {
 		return err
 	}
+	// if the uploads fail, the files pile up. Don't let them fill the disk.
+	err = writer.enforceFileLimit()
+	if err != nil {
+		return err
+	}
 	err = writer.upload()
 	if err != nil {
 		return err
@@ -212,29 +274,42 @@ func (writer *TelemetryWriter) createFilesAndUpload() error {
 func (writer *TelemetryWriter) createFilesFromMessages(messages *[]telemetryLogMsg) error {
 	var buffer bytes.Buffer
 	if len(*messages) > 0 {
+		format := writer.uploadFormat
+		if format == "" {
+			format = UploadFormatJSON
+		}
+		writeRecord := writeJSONRecord
+		if format == UploadFormatMsgPack {
+			writeRecord = writeMsgPackRecord
+		}
+		err := writeFileHeader(&buffer, format)
+		if err != nil {
+			return err
+		}
 		var prevTime time.Time
-		for _, msg := range *messages {
+		for i := range *messages {
+			msg := &(*messages)[i]
 			if prevTime.IsZero() {
 				prevTime = msg.Timestamp
 			} else if prevTime.Day() != msg.Timestamp.Day() {
 				writer.logger.Printf("Date changed. Writing out collected messages at : %s", prevTime)
-				err := writer.writeOutFile(buffer, prevTime)
+				err := writer.writeOutFile(buffer, prevTime, format)
 				if err != nil {
 					return err
 				}
 				buffer.Reset()
+				err = writeFileHeader(&buffer, format)
+				if err != nil {
+					return err
+				}
 			}
 			prevTime = msg.Timestamp
-			jsonString, err := json.Marshal(msg.toMap())
-			jsonString = bytes.Replace(jsonString, CR, []byte("<CR>"), -1)
-			jsonString = bytes.Replace(jsonString, NL, []byte("<NL>"), -1)
+			err := writeRecord(&buffer, msg)
 			if err != nil {
 				return err
 			}
-			buffer.Write(jsonString)
-			buffer.WriteString("\n")
 		}
-		err := writer.writeOutFile(buffer, prevTime)
+		err = writer.writeOutFile(buffer, prevTime, format)
 		if err != nil {
 			return err
 		}
@@ -242,7 +317,7 @@ func (writer *TelemetryWriter) createFilesFromMessages(messages *[]telemetryLogM
 	return nil
 }
 
-func (writer *TelemetryWriter) writeOutFile(fileString bytes.Buffer, endTime time.Time) error {
+func (writer *TelemetryWriter) writeOutFile(fileString bytes.Buffer, endTime time.Time, format UploadFormat) error {
 	var teleFile string
 	dateString := strings.Replace(endTime.Format("20060102150405.999"), ".", "", 1)
 	teleFile = fmt.Sprintf("%s/plog-%s.gz",
@@ -258,6 +333,10 @@ func (writer *TelemetryWriter) writeOutFile(fileString bytes.Buffer, endTime tim
 	}
 	w := gzip.NewWriter(fp)
 	defer w.Close()
+	w.Comment, err = fileHeaderComment(format)
+	if err != nil {
+		return err
+	}
 	_, err = fileString.WriteTo(w)
 	if err != nil {
 		return err
@@ -302,9 +381,9 @@ func (writer *TelemetryWriter) createFiles() error {
 	return nil
 }
 
-// upload upload any files found to s3
+// upload upload any files found to the sink
 func (writer *TelemetryWriter) upload() error {
-	if writer.uploadLocationPrefixUrl != nil {
+	if writer.sink != nil {
 		// Read all entries in the telemetry directory, look for any json files, and upload them
 		entries, err := ioutil.ReadDir(writer.fileLocationPrefix)
 		if err != nil {
@@ -316,7 +395,7 @@ func (writer *TelemetryWriter) upload() error {
 			}
 			name := entry.Name()
 			if strings.HasPrefix(name, "plog-") {
-				err := writer.pushToS3(name)
+				err := writer.sink.Upload(path.Join(writer.fileLocationPrefix, name), name)
 				if err != nil {
 					return err
 				}
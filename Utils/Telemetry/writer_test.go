@@ -1,8 +1,16 @@
 package Telemetry
 
 import (
+	"bytes"
+	"compress/gzip"
 	"github.com/nachocove/Pinger/Utils/AWS"
+	"github.com/op/go-logging"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -102,3 +110,105 @@ func (s *writerTester) TestFileCreation() {
 	err = writer.createFilesFromMessages(&messages)
 	s.NoError(err)
 }
+
+func (s *writerTester) TestFieldsInDb() {
+	dir, err := ioutil.TempDir("", "telemetry")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+	// no uploader goroutine, which would move the message out of the DB
+	writer := &TelemetryWriter{
+		fileLocationPrefix: dir,
+		logger:             log.New(os.Stderr, "telemetryWriter", log.LstdFlags|log.Lshortfile),
+	}
+	err = writer.initDb()
+	s.NoError(err)
+
+	since := time.Now().Add(time.Duration(-1) * time.Second).UTC()
+	msg := NewTelemetryMsgWithFields(
+		telemetryLogEventWarning,
+		"fieldsTest",
+		"some message",
+		map[string]interface{}{"device": "NchoXYZ", "msgCode": "TEST"},
+		time.Now().Round(time.Millisecond).UTC(),
+	)
+	err = writer.dbmap.Insert(&msg)
+	s.NoError(err)
+	messages, err := writer.getAllMessagesSince(since, telemetryLogEventWarning)
+	s.NoError(err)
+	var found *telemetryLogMsg
+	for i := range messages {
+		if messages[i].Id == msg.Id {
+			found = &messages[i]
+		}
+	}
+	s.NotNil(found)
+	s.Equal("NchoXYZ", found.Fields["device"])
+	s.Equal("TEST", found.Fields["msgCode"])
+}
+
+func (s *writerTester) TestRedaction() {
+	dir, err := ioutil.TempDir("", "telemetry")
+	s.NoError(err)
+	defer os.RemoveAll(dir)
+	// no dbWriter and uploader goroutines, so we control when things happen
+	writer := &TelemetryWriter{
+		fileLocationPrefix: dir,
+		telemetryCh:        make(chan telemetryLogMsg, 10),
+		logger:             log.New(os.Stderr, "telemetryWriter", log.LstdFlags|log.Lshortfile),
+	}
+	err = writer.initDb()
+	s.NoError(err)
+
+	secrets := []string{"someone@company.com", "hunter2", "6f1ed002ab5595859014ebf0951522d9d6b0b9ad47e0b4ca6d2f7ba91a0b7d8f"}
+	err = writer.LogFields(logging.WARNING, "redactTest", "Invalid token|User=someone@company.com|password=hunter2",
+		map[string]interface{}{"token": secrets[2], "client": secrets[0]}, time.Now())
+	s.NoError(err)
+	// go-logging records go through the same redaction
+	logger := logging.MustGetLogger("redactTest")
+	logger.SetBackend(logging.AddModuleLevel(writer))
+	logger.Error("Could not log in as %s", secrets[0])
+
+	s.Equal(2, writer.QueueLength())
+	for writer.QueueLength() > 0 {
+		msg := <-writer.telemetryCh
+		err = writer.dbmap.Insert(&msg)
+		s.NoError(err)
+	}
+	err = writer.createFiles()
+	s.NoError(err)
+
+	files, err := filepath.Glob(path.Join(dir, "plog-*.gz"))
+	s.NoError(err)
+	s.NotEmpty(files)
+	var output bytes.Buffer
+	for _, file := range files {
+		fp, err := os.Open(file)
+		s.NoError(err)
+		r, err := gzip.NewReader(fp)
+		s.NoError(err)
+		_, err = output.ReadFrom(r)
+		s.NoError(err)
+		fp.Close()
+	}
+	s.Contains(output.String(), "Invalid token")
+	s.Contains(output.String(), "Could not log in as")
+	for _, secret := range secrets {
+		s.NotContains(output.String(), secret)
+	}
+}
+
+func (s *writerTester) TestIncludeDebug() {
+	// no dbWriter and uploader goroutines, so the messages stay in the channel
+	writer := &TelemetryWriter{
+		telemetryCh: make(chan telemetryLogMsg, 10),
+		logger:      log.New(os.Stderr, "telemetryWriter", log.LstdFlags|log.Lshortfile),
+	}
+	s.NoError(writer.LogFields(logging.DEBUG, "debugTest", "not uploaded", nil, time.Now()))
+	s.Equal(0, writer.QueueLength())
+	writer.SetIncludeDebug(true)
+	s.NoError(writer.LogFields(logging.DEBUG, "debugTest", "uploaded", nil, time.Now()))
+	s.Equal(1, writer.QueueLength())
+	writer.SetIncludeDebug(false)
+	s.NoError(writer.LogFields(logging.DEBUG, "debugTest", "not uploaded", nil, time.Now()))
+	s.Equal(1, writer.QueueLength())
+}
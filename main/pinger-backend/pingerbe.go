@@ -6,6 +6,7 @@ import (
 	"github.com/nachocove/Pinger/Pinger"
 	"github.com/nachocove/Pinger/Utils"
 	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/nachocove/Pinger/Utils/Metrics"
 	"github.com/nachocove/Pinger/Utils/Telemetry"
 	"os"
 	"path"
@@ -35,6 +36,7 @@ func main() {
 	var debug bool
 	var verbose bool
 	var configFile string
+	var migrate bool
 
 	flag.BoolVar(&debug, "d", false, "Debugging")
 	flag.BoolVar(&verbose, "v", false, "Verbose")
@@ -42,6 +44,7 @@ func main() {
 	flag.BoolVar(&printMem, "m", false, "print memory mode")
 	flag.IntVar(&printMemPeriodic, "mem", 0, "print memory periodically mode in seconds")
 	flag.StringVar(&configFile, "c", "", "The configuration file. Required.")
+	flag.BoolVar(&migrate, "migrate", false, "Bring the schema of the DB up to date, and exit. The backend also does this on startup.")
 
 	flag.Parse()
 	if help {
@@ -85,8 +88,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	if migrate {
+		from, to, err := Pinger.MigrateDB(&config.Db, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migrating the DB: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "DB schema version %d -> %d\n", from, to)
+		os.Exit(0)
+	}
+
 	Utils.InitCpuProfileSignal()
 
+	Metrics.RegisterRuntimeMetrics()
+	if telemetryWriter != nil {
+		Metrics.NewGaugeFunc("pinger_telemetry_queue_length", "Telemetry messages waiting to be written to the telemetry DB.", nil,
+			func(set func(float64, ...string)) {
+				set(float64(telemetryWriter.QueueLength()))
+			})
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	logger.Debug("Running with %d Processors", runtime.NumCPU())
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/nachocove/Pinger/Pinger"
+	"os"
+	"path"
+)
+
+var usage = func() {
+	fmt.Printf("USAGE: %s <flags> check\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Printf("\n  check: read and validate the configuration, with the PINGER_<SECTION>_<KEY> env-variable\n")
+	fmt.Printf("  overrides and file:// secrets applied, and print the effective configuration with secrets redacted.\n")
+}
+
+func main() {
+	var help bool
+	var configFile string
+
+	flag.BoolVar(&help, "h", false, "Help")
+	flag.StringVar(&configFile, "c", "", "The configuration file (overrides the PINGER_CONFIG env-variable).")
+
+	flag.Parse()
+	if help {
+		usage()
+		os.Exit(0)
+	}
+	if flag.NArg() != 1 || flag.Arg(0) != "check" {
+		usage()
+		os.Exit(1)
+	}
+
+	if configFile == "" {
+		configFile = os.Getenv("PINGER_CONFIG")
+	}
+	if configFile == "" {
+		fmt.Fprintf(os.Stderr, "Need configuration file. Use -c or set env variable PINGER_CONFIG\n")
+		os.Exit(1)
+	}
+	config, err := Pinger.ReadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reading config: %s\n", err)
+		os.Exit(1)
+	}
+	err = config.WriteRedacted(os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Writing config: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Configuration %s is valid\n", configFile)
+}
@@ -2,19 +2,212 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/nachocove/Pinger/Pinger"
 	"os"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 var usage = func() {
 	fmt.Printf("USAGE: %s <flags> <connection string>\n", path.Base(os.Args[0]))
 	flag.PrintDefaults()
-	fmt.Printf("\n  If no '-client', '-context', or '-device' is given, all active sessions are returned.\n")
+	fmt.Printf("\n  If no '-user', '-context', or '-device' is given, all active sessions are returned, otherwise the ones\n")
+	fmt.Printf("  matching any of them. The sessions also have to match all of '-status', '-protocol' and '-server', if given.\n")
+	fmt.Printf("  With '-history', the recent lifecycle events of each session are shown, including sessions that have stopped.\n")
+	fmt.Printf("  With '-summary', the matching sessions are counted by status, protocol and mail server.\n")
+}
+
+const (
+	formatText   = "text"  // multi-line
+	formatTable  = "table" // aligned columns
+	formatCSV    = "csv"
+	formatJSON   = "json"
+	formatSingle = "s" // ';' delimited, with -s
+)
+
+// column is a column of the single-line, table and csv formats. The header and the rows
+// are made from the same list, so they can't get out of order.
+type column struct {
+	name  string
+	value func(info *Pinger.ClientSessionInfo) string
+}
+
+var sessionColumns = []column{
+	{"Status", func(info *Pinger.ClientSessionInfo) string { return info.Status.String() }},
+	{"UserId", func(info *Pinger.ClientSessionInfo) string { return info.UserId }},
+	{"ClientContext", func(info *Pinger.ClientSessionInfo) string { return info.ClientContext }},
+	{"DeviceId", func(info *Pinger.ClientSessionInfo) string { return info.DeviceId }},
+	{"SessionId", func(info *Pinger.ClientSessionInfo) string { return info.SessionId }},
+	{"Error", func(info *Pinger.ClientSessionInfo) string { return info.Error }},
+	{"MailServer", func(info *Pinger.ClientSessionInfo) string { return info.MailServer }},
+	{"MailServerState", func(info *Pinger.ClientSessionInfo) string {
+		if info.ServerLimiter == nil {
+			return ""
+		}
+		return string(info.ServerLimiter.State)
+	}},
+	{"Protocol", func(info *Pinger.ClientSessionInfo) string { return info.Protocol }},
+}
+
+func sessionHeader() []string {
+	header := make([]string, len(sessionColumns))
+	for i, col := range sessionColumns {
+		header[i] = col.name
+	}
+	return header
+}
+
+func sessionRow(info *Pinger.ClientSessionInfo) []string {
+	row := make([]string, len(sessionColumns))
+	for i, col := range sessionColumns {
+		row[i] = col.value(info)
+	}
+	return row
+}
+
+// writeRows writes the rows in the table, csv or single-line format. The single-line format only has
+// a header if verbose, like it always has.
+func writeRows(format string, header []string, rows [][]string, verbose bool) error {
+	switch format {
+	case formatCSV:
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+
+	case formatTable:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+
+	case formatSingle:
+		if verbose {
+			fmt.Fprintln(os.Stdout, strings.Join(header, ";"))
+		}
+		for _, row := range rows {
+			fmt.Fprintln(os.Stdout, strings.Join(row, ";"))
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown format %s", format)
+}
+
+func writeJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// printSession prints the session in the multi-line format.
+func printSession(info *Pinger.ClientSessionInfo) {
+	fmt.Fprintf(os.Stdout, "UserId:%s\nClientContext:%s\nDeviceId:%s\nSessionId:%s\nProtocol:%s\nStatus:%s\nMailServer:%s\n",
+		info.UserId, info.ClientContext, info.DeviceId, info.SessionId, info.Protocol, info.Status, info.MailServer)
+	if info.Status == Pinger.MailClientStatusError {
+		fmt.Fprintf(os.Stdout, "Error:%s\n", info.Error)
+	}
+	if info.ServerLimiter != nil {
+		fmt.Fprintf(os.Stdout, "MailServerState:%s\nMailServerFailures:%d\nMailServerTrips:%d\n",
+			info.ServerLimiter.State, info.ServerLimiter.Failures, info.ServerLimiter.Trips)
+		if info.ServerLimiter.State == Pinger.HostLimiterOpen {
+			fmt.Fprintf(os.Stdout, "MailServerOpenUntil:%s\n", info.ServerLimiter.OpenUntil)
+		}
+	}
+}
+
+func printSessions(reply *Pinger.FindSessionsResponse, format string, verbose bool) error {
+	switch format {
+	case formatJSON:
+		return writeJSON(reply.SessionInfos)
+
+	case formatText:
+		if verbose {
+			fmt.Fprintf(os.Stdout, "Found %d sessions.\n", len(reply.SessionInfos))
+		}
+		for _, info := range reply.SessionInfos {
+			printSession(&info)
+			fmt.Fprintf(os.Stdout, "\n")
+		}
+		return nil
+	}
+	rows := make([][]string, 0, len(reply.SessionInfos))
+	for _, info := range reply.SessionInfos {
+		rows = append(rows, sessionRow(&info))
+	}
+	return writeRows(format, sessionHeader(), rows, verbose)
+}
+
+// printSummary prints the counts, sorted by what is counted and its name, e.g. status;Active;12
+func printSummary(summary *Pinger.SessionSummary, format string, verbose bool) error {
+	if format == formatJSON {
+		return writeJSON(summary)
+	}
+	rows := [][]string{{"total", "", strconv.Itoa(summary.Total)}}
+	for _, counts := range []struct {
+		by     string
+		counts map[string]int
+	}{
+		{"status", summary.ByStatus},
+		{"protocol", summary.ByProtocol},
+		{"server", summary.ByServer},
+	} {
+		names := make([]string, 0, len(counts.counts))
+		for name := range counts.counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rows = append(rows, []string{counts.by, name, strconv.Itoa(counts.counts[name])})
+		}
+	}
+	if format == formatText {
+		format = formatTable
+	}
+	return writeRows(format, []string{"By", "Name", "Count"}, rows, verbose)
+}
+
+func printHistory(reply *Pinger.SessionHistoryResponse, format string, verbose bool) error {
+	switch format {
+	case formatJSON:
+		return writeJSON(reply.Histories)
+
+	case formatText:
+		if verbose {
+			fmt.Fprintf(os.Stdout, "Found %d sessions.\n", len(reply.Histories))
+		}
+		for _, history := range reply.Histories {
+			printSession(&history.Session)
+			fmt.Fprintf(os.Stdout, "History:\n")
+			for _, event := range history.Events {
+				fmt.Fprintf(os.Stdout, "  %s %-17s %s\n", event.Time.Format(time.RFC3339), event.Type, event.Message)
+			}
+			fmt.Fprintf(os.Stdout, "\n")
+		}
+		return nil
+	}
+	rows := make([][]string, 0)
+	for _, history := range reply.Histories {
+		info := history.Session
+		for _, event := range history.Events {
+			rows = append(rows, []string{event.Time.Format(time.RFC3339), info.UserId, info.ClientContext, info.DeviceId, info.SessionId, string(event.Type), event.Message})
+		}
+	}
+	return writeRows(format, []string{"Time", "UserId", "ClientContext", "DeviceId", "SessionId", "Event", "Message"}, rows, verbose)
 }
 
 func makeContext(protoEmailString string) (string, error) {
@@ -40,22 +233,29 @@ func main() {
 	var debug bool
 	var verbose bool
 	var configFile string
-	var userId string
-	var clientContext string
-	var deviceId string
 	var singleLine bool
-	var maxSessions int
+	var history bool
+	var format string
+	var sortBy string
+	args := Pinger.FindSessionsArgs{}
 
 	flag.BoolVar(&debug, "d", false, "Debugging")
 	flag.BoolVar(&verbose, "v", false, "Verbose")
 	flag.BoolVar(&help, "h", false, "Help")
 	flag.StringVar(&configFile, "c", "", "The configuration file (overrides the PINGER_CONFIG env-variable).")
 
-	flag.StringVar(&userId, "user", "", "The User ID to search for.")
-	flag.StringVar(&clientContext, "context", "", "The Client Context to search for.")
-	flag.StringVar(&deviceId, "device", "", "The Device ID to search for.")
-	flag.BoolVar(&singleLine, "s", false, "Write results on a single line for easier grepping. Field delimiter is ';'")
-	flag.IntVar(&maxSessions, "n", 100, "Max number of sessions to pull back. Default: 100. Use 0 for 'all'")
+	flag.StringVar(&args.UserId, "user", "", "The User ID to search for.")
+	flag.StringVar(&args.ClientContext, "context", "", "The Client Context to search for.")
+	flag.StringVar(&args.DeviceId, "device", "", "The Device ID to search for.")
+	flag.StringVar(&args.Status, "status", "", "Only sessions with this status: Active, Waiting, Rearmed, Initialized, Error or Stopped.")
+	flag.StringVar(&args.Protocol, "protocol", "", "Only sessions with this protocol: ActiveSync or IMAP.")
+	flag.StringVar(&args.MailServer, "server", "", "Only sessions talking to this mail server (host or host:port).")
+	flag.StringVar(&format, "format", formatText, "Output format: text, table, csv or json.")
+	flag.BoolVar(&singleLine, "s", false, "Write results on a single line for easier grepping. Field delimiter is ';'. Overrides '-format'.")
+	flag.IntVar(&args.MaxSessions, "n", 100, "Max number of sessions to pull back. Default: 100. Use 0 for 'all'")
+	flag.StringVar(&sortBy, "sort", "", "Sort the sessions by user (user, context and device), status, protocol or server. The first '-n' sessions in that order are returned.")
+	flag.BoolVar(&args.Summary, "summary", false, "Only show the number of matching sessions, by status, protocol and mail server.")
+	flag.BoolVar(&history, "history", false, "Show the recent lifecycle events (state changes, pushes, errors, defers) of the sessions.")
 
 	flag.Parse()
 	if help {
@@ -63,6 +263,27 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch format {
+	case formatText, formatTable, formatCSV, formatJSON:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format '%s'. Use text, table, csv or json\n", format)
+		os.Exit(1)
+	}
+	if singleLine {
+		format = formatSingle
+	}
+	if args.Status != "" {
+		if _, err := Pinger.ParseMailClientStatus(args.Status); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+	args.SortBy = Pinger.SessionSortKey(sortBy)
+	if history && (args.Summary || sortBy != "") {
+		fmt.Fprintf(os.Stderr, "'-summary' and '-sort' can not be used with '-history'\n")
+		os.Exit(1)
+	}
+
 	if configFile == "" {
 		configFile = os.Getenv("PINGER_CONFIG")
 	}
@@ -76,19 +297,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	if clientContext != "" {
+	if args.ClientContext != "" {
 		switch {
-		case contextRegex.MatchString(clientContext):
+		case contextRegex.MatchString(args.ClientContext):
 			// nothing to do. Just use it.
 
-		case protoEmailRegex.MatchString(clientContext):
+		case protoEmailRegex.MatchString(args.ClientContext):
 			var err error
-			clientContext, err = makeContext(clientContext)
+			args.ClientContext, err = makeContext(args.ClientContext)
 			if err != nil {
 				panic(err)
 			}
 			if verbose || debug {
-				fmt.Printf("INFO: Converted context to %s\n", clientContext)
+				fmt.Printf("INFO: Converted context to %s\n", args.ClientContext)
 			}
 		default:
 			fmt.Fprintf(os.Stderr, "Unknown format for client context. Valid formats are '%s' and '%s'\n", contextRegex, protoEmailRegex)
@@ -97,9 +318,29 @@ func main() {
 	}
 	if debug {
 		fmt.Fprintf(os.Stdout, "Contacting RPC server at %s\n", config.Rpc.String())
-		fmt.Fprintf(os.Stdout, "Arguments: UserId:%s, ClientContext:%s, DeviceId:%s, maxSessions:%d\n", userId, clientContext, deviceId, maxSessions)
+		fmt.Fprintf(os.Stdout, "Arguments: %+v\n", args)
+	}
+	if history {
+		reply, err := Pinger.SessionHistory(&config.Rpc, &args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not call SessionHistory: %s\n", err)
+			os.Exit(1)
+		}
+		if debug {
+			fmt.Fprintf(os.Stdout, "Reply is %+v\n", reply)
+		}
+		if reply.Code != Pinger.PollingReplyOK {
+			fmt.Fprintf(os.Stderr, "Error fetching session history: %s\n", reply.Message)
+			os.Exit(1)
+		}
+		err = printHistory(reply, format, verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not print the history: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	reply, err := Pinger.FindActiveSessions(&config.Rpc, userId, clientContext, deviceId, maxSessions)
+	reply, err := Pinger.FindActiveSessions(&config.Rpc, &args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not call FindActiveSessions: %s\n", err)
 		os.Exit(1)
@@ -114,27 +355,16 @@ func main() {
 
 	case reply.Code == Pinger.PollingReplyOK || reply.Code == Pinger.PollingReplyWarn:
 		if reply.Code == Pinger.PollingReplyWarn {
-			fmt.Fprintf(os.Stdout, "Warning: %s\n", reply.Message)
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", reply.Message)
 		}
-		if verbose {
-			if singleLine {
-				fmt.Fprintf(os.Stdout, "UserId;ClientContext;DeviceId;SessionId;Status;Error\n")
-			} else {
-				fmt.Fprintf(os.Stdout, "Found %d sessions.\n", len(reply.SessionInfos))
-			}
+		if args.Summary {
+			err = printSummary(reply.Summary, format, verbose)
+		} else {
+			err = printSessions(reply, format, verbose)
 		}
-		for _, info := range reply.SessionInfos {
-			if singleLine {
-				fmt.Fprintf(os.Stdout, "%s;%s;%s;%s;%s;%s\n",
-					info.Status, info.UserId, info.ClientContext, info.DeviceId, info.SessionId, info.Error)
-			} else {
-				fmt.Fprintf(os.Stdout, "UserId:%s\nClientContext:%s\nDeviceId:%s\nSessionId:%s\nStatus:%s\n",
-					info.UserId, info.ClientContext, info.DeviceId, info.SessionId, info.Status)
-				if info.Status == Pinger.MailClientStatusError {
-					fmt.Fprintf(os.Stdout, "Error:%s\n", info.Error)
-				}
-				fmt.Fprintf(os.Stdout, "\n")
-			}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not print the sessions: %s\n", err)
+			os.Exit(1)
 		}
 
 	default:
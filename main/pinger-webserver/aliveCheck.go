@@ -6,15 +6,11 @@ import (
 	"github.com/nachocove/Pinger/Pinger"
 	"net"
 	"net/http"
-	"regexp"
 	"strings"
 )
 
-var ipv6Regex *regexp.Regexp
-
 func init() {
 	httpsRouter.HandleFunc("/1/alive", aliveCheck)
-	ipv6Regex = regexp.MustCompile("^\\[(?P<ip6>.+)\\]:(?P<port>\\d+)$")
 }
 
 func aliveCheck(w http.ResponseWriter, r *http.Request) {
@@ -25,66 +21,11 @@ func aliveCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	XFF := r.Header.Get("X-Forwarded-For")
-	var rIp string
-	if XFF == "" {
-		rIp = r.RemoteAddr
-	} else {
-		rIps := strings.Split(XFF, ",")
-		if len(rIps) == 0 {
-			rIp = r.RemoteAddr
-		} else {
-			rIp = strings.Trim(rIps[len(rIps)-1], " ")
-		}
-	}
-	// Try parsing the IP. For IPv6, the address will look like this: [::1] (for localhost, i.e. with brackets)
-	var remoteIP net.IP
-	if ipv6Regex.MatchString(rIp) {
-		replaceString := fmt.Sprintf("${%s}", ipv6Regex.SubexpNames()[1])
-		ip6 := ipv6Regex.ReplaceAllString(rIp, replaceString)
-		remoteIP = net.ParseIP(ip6)
-	} else {
-		// Split the port from the IP
-		ipParts := strings.Split(rIp, ":")
-		if len(ipParts) < 1 {
-			context.Logger.Error("Could not split remote address %s", rIp)
-			http.Error(w, "INTERNAL ERROR", http.StatusInternalServerError)
-			return
-		}
-		context.Logger.Info("ipparts [%s]", ipParts[0])
-		remoteIP = net.ParseIP(ipParts[0])
-	}
-	if remoteIP == nil {
-		context.Logger.Error("Could not parse remote address %s", rIp)
-		http.Error(w, "INTERNAL ERROR", http.StatusInternalServerError)
-		return
-	}
-	err := r.ParseForm()
-	if err != nil {
-		context.Logger.Warning("Could not parse form")
-		http.Error(w, "INTERNAL ERROR", http.StatusInternalServerError)
-		return
-	}
-	token := r.FormValue("Token")
-	if token == "" {
-		token = r.FormValue("token")
-	}
-	if token == "" {
-		context.Logger.Warning("No token provided")
-		http.Error(w, "NO TOKEN", http.StatusForbidden)
-		return
-	}
-	if !context.Config.Server.CheckToken(token) {
-		context.Logger.Error("tokens do not match")
-		http.Error(w, "TOKEN MISMATCH", http.StatusForbidden)
+	config, ok := checkAliveAccess(w, r, context)
+	if !ok {
 		return
 	}
-	if !context.Config.Server.CheckIP(remoteIP) {
-		context.Logger.Error("remote address did not match any valid IPrange from the list %s", context.Config.Server.CheckIPListString())
-		http.Error(w, "BAD IP", http.StatusForbidden)
-		return
-	}
-	reply, err := Pinger.AliveCheck(&context.Config.Rpc)
+	reply, err := Pinger.AliveCheck(&config.Rpc)
 	if err != nil {
 		context.Logger.Warning("Could not check for aliveness: %v", err)
 		responseError(w, RPCServerError, "")
@@ -121,3 +62,71 @@ func aliveCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(responseJson))
 	return
 }
+
+// checkAliveAccess checks that the request comes from one of the alive-check-ip ranges, and has one
+// of the alive-check-tokens. If not, it writes the error response and returns false.
+func checkAliveAccess(w http.ResponseWriter, r *http.Request, context *Context) (*Pinger.Configuration, bool) {
+	remoteIP, err := getRemoteIP(r)
+	if err != nil {
+		context.Logger.Error("%s", err)
+		http.Error(w, "INTERNAL ERROR", http.StatusInternalServerError)
+		return nil, false
+	}
+	err = r.ParseForm()
+	if err != nil {
+		context.Logger.Warning("Could not parse form")
+		http.Error(w, "INTERNAL ERROR", http.StatusInternalServerError)
+		return nil, false
+	}
+	token := r.FormValue("Token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	if token == "" {
+		context.Logger.Warning("No token provided")
+		http.Error(w, "NO TOKEN", http.StatusForbidden)
+		return nil, false
+	}
+	config := context.GetConfig()
+	if !config.Server.CheckToken(token) {
+		context.Logger.Error("tokens do not match")
+		http.Error(w, "TOKEN MISMATCH", http.StatusForbidden)
+		return nil, false
+	}
+	if !config.Server.CheckIP(remoteIP) {
+		context.Logger.Error("remote address did not match any valid IPrange from the list %s", config.Server.CheckIPListString())
+		http.Error(w, "BAD IP", http.StatusForbidden)
+		return nil, false
+	}
+	return config, true
+}
+
+// getRemoteIP returns the address of the client. Behind a load balancer, that is the last address in
+// X-Forwarded-For, which is the one the load balancer added.
+func getRemoteIP(r *http.Request) (net.IP, error) {
+	XFF := r.Header.Get("X-Forwarded-For")
+	var rIp string
+	if XFF == "" {
+		rIp = r.RemoteAddr
+	} else {
+		rIps := strings.Split(XFF, ",")
+		if len(rIps) == 0 {
+			rIp = r.RemoteAddr
+		} else {
+			rIp = strings.Trim(rIps[len(rIps)-1], " ")
+		}
+	}
+	// X-Forwarded-For has bare addresses, which for IPv6 contain colons (2001:db8::1), so try the
+	// address as it is first. RemoteAddr has a port: 10.1.1.1:5000, or [::1]:5000 for IPv6.
+	remoteIP := net.ParseIP(rIp)
+	if remoteIP == nil {
+		host, _, err := net.SplitHostPort(rIp)
+		if err == nil {
+			remoteIP = net.ParseIP(host)
+		}
+	}
+	if remoteIP == nil {
+		return nil, fmt.Errorf("Could not parse remote address %s", rIp)
+	}
+	return remoteIP, nil
+}
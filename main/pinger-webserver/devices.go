@@ -1,7 +1,7 @@
 package main
 
 import (
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -38,22 +38,24 @@ const (
 	MAX_HTTP_REQUEST_SIZE             = 102400 // average size of requests is less than 2K
 )
 
-var authTokenKeys map[string][]byte
-
 var clientIdRegex *regexp.Regexp
 var deviceIdRegex *regexp.Regexp
 var contextRegex *regexp.Regexp
 var pushTokenRegex *regexp.Regexp
+var appIdRegex *regexp.Regexp
+var pushIdRegex *regexp.Regexp
 
 func init() {
 	clientIdRegex = regexp.MustCompile("^(?P<client>us-[a-z]+-[0-9]+:[a-z\\-0-9]+).*$")
 	deviceIdRegex = regexp.MustCompile("^(?P<device>Ncho[0-9A-Z]{24})$")
 	contextRegex = regexp.MustCompile("^(?P<context>[a-z0-9A-Z]+)$")
 	pushTokenRegex = regexp.MustCompile("^(?P<pushtoken>[0-9A-Z]{64})$")
+	appIdRegex = regexp.MustCompile("^(?P<app>[a-zA-Z0-9._-]{1,64})$")
+	pushIdRegex = regexp.MustCompile("^(?P<push>[0-9a-f]{16})$")
 	httpsRouter.HandleFunc("/1/register", registerDevice)
 	httpsRouter.HandleFunc("/1/defer", deferPolling)
 	httpsRouter.HandleFunc("/1/stop", stopPolling)
-	authTokenKeys = make(map[string][]byte)
+	httpsRouter.HandleFunc("/1/ack", ackPush)
 }
 
 //const SessionVarUserId = "UserId"
@@ -87,6 +89,8 @@ type registerPostData struct {
 	OSVersion              string
 	AppBuildNumber         string
 	AppBuildVersion        string
+	AppId                  string                         // optional: the app, for the pingers that push for more than one
+	Notifications          Pinger.NotificationPreferences // optional: time zone, quiet hours, push style, minimum push interval
 	IMAPAuthenticationBlob string
 	IMAPFolderName         string
 	IMAPSupportsIdle       bool
@@ -94,6 +98,7 @@ type registerPostData struct {
 	IMAPEXISTSCount        uint32
 	IMAPUIDNEXT            uint32
 	ASIsSyncRequest        bool
+	MailServerCertificate  string // optional PEM cert of the mail server, if the user accepted an untrusted one
 }
 
 func getScrubbedLogPrefix(deviceId, userId, context string) string {
@@ -172,6 +177,16 @@ func isValidPushToken(pushService, pushToken string) bool {
 	return true
 }
 
+// isValidAppId checks the format of the app id. Whether the backend knows the app is up to the backend.
+func isValidAppId(appId string) bool {
+	return appId == "" || appIdRegex.MatchString(appId)
+}
+
+// isValidPushId checks the format of the id of a push, the "id" in the meta map of the push.
+func isValidPushId(pushId string) bool {
+	return pushIdRegex.MatchString(pushId)
+}
+
 func isValidMailServerCredentials(userName, password string) bool {
 	if !govalidator.StringLength(userName, "1", "64") { // is this enough? what regex can we use
 		return false
@@ -290,6 +305,14 @@ func (pd *registerPostData) validate(context *Context) (bool, []string) {
 		ok = false
 		invalidFields = append(invalidFields, "AppBuildNumber")
 	}
+	if !isValidAppId(pd.AppId) {
+		ok = false
+		invalidFields = append(invalidFields, "AppId")
+	}
+	if err := pd.Notifications.Validate(); err != nil {
+		ok = false
+		invalidFields = append(invalidFields, "Notifications")
+	}
 	if strings.EqualFold(pd.Protocol, Pinger.MailClientActiveSync) {
 		if !isValidMailServerCredentials(pd.MailServerCredentials.Username, pd.MailServerCredentials.Password) {
 			ok = false
@@ -328,7 +351,7 @@ func (pd *registerPostData) validate(context *Context) (bool, []string) {
 			ok = false
 			invalidFields = append(invalidFields, "IMAPAuthenticationBlob")
 		}
-		if !isValidFolderName(pd.IMAPFolderName, context.Config.Server.IMAPFolderNames) {
+		if !isValidFolderName(pd.IMAPFolderName, context.GetConfig().Server.IMAPFolderNames) {
 			ok = false
 			invalidFields = append(invalidFields, "IMAPFolderName")
 		}
@@ -424,6 +447,8 @@ func (pd *registerPostData) AsMailInfo(sessionId string) *Pinger.MailPingInforma
 	pi.OSVersion = pd.OSVersion
 	pi.AppBuildNumber = pd.AppBuildNumber
 	pi.AppBuildVersion = pd.AppBuildVersion
+	pi.AppId = pd.AppId
+	pi.Notifications = pd.Notifications
 	pi.IMAPAuthenticationBlob = pd.IMAPAuthenticationBlob
 	pi.IMAPFolderName = pd.IMAPFolderName
 	pi.IMAPSupportsIdle = pd.IMAPSupportsIdle
@@ -431,32 +456,35 @@ func (pd *registerPostData) AsMailInfo(sessionId string) *Pinger.MailPingInforma
 	pi.IMAPEXISTSCount = pd.IMAPEXISTSCount
 	pi.IMAPUIDNEXT = pd.IMAPUIDNEXT
 	pi.ASIsSyncRequest = pd.ASIsSyncRequest
+	pi.MailServerCertificate = pd.MailServerCertificate
 
 	pi.SessionId = sessionId
 
 	return &pi
 }
 
-func makeSessionId(token string) (string, error) {
-	ha := sha256.Sum256([]byte(token))
-	myId := make([]byte, 16)
-	n := hex.Encode(myId, ha[0:8])
-	if n <= 0 {
-		return "", fmt.Errorf("Could not encode to hex string")
+// makeSessionId returns a random id for a new session. The session's auth token carries it.
+func makeSessionId() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	return string(myId), nil
+	return hex.EncodeToString(b), nil
 }
 
 func registerDevice(w http.ResponseWriter, r *http.Request) {
 	context := GetContext(r)
+	traceId := GetTraceId(r)
+	logger := Pinger.TraceLogger(context.Logger, traceId)
 	if r.Method != "POST" {
-		context.Logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
+		logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
 		http.Error(w, "UNKNOWN METHOD", http.StatusBadRequest)
 		return
 	}
 	//	session, err := context.SessionStore.Get(r, "pinger-session")
 	//	if err != nil {
-	//		context.Logger.Warning("Could not get session")
+	//		logger.Warning("Could not get session")
 	//		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	//		return
 	//	}
@@ -470,49 +498,53 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&postInfo)
 		if err != nil {
-			context.Logger.Error("Could not parse json %s", err)
+			logger.Error("Could not parse json %s", err)
 			http.Error(w, "Could not parse json", http.StatusBadRequest)
 			return
 		}
 
 	default:
-		context.Logger.Debug("Bad encoding %s", encodingStr)
+		logger.Debug("Bad encoding %s", encodingStr)
 		http.Error(w, "UNKNOWN Encoding", http.StatusBadRequest)
 		return
 	}
-	ok, missingFields := postInfo.checkForMissingFields(context.Logger)
+	ok, missingFields := postInfo.checkForMissingFields(logger)
 	if ok == false {
-		context.Logger.Warning("%s: Missing non-optional data: %s", postInfo.getLogPrefix(), strings.Join(missingFields, ","))
+		logger.Warning("%s: Missing non-optional data: %s", postInfo.getLogPrefix(), strings.Join(missingFields, ","))
 		responseError(w, InvalidData, strings.Join(missingFields, ","))
 		return
 	}
 	ok, invalidFields := postInfo.validate(context)
 	if ok == false {
-		context.Logger.Warning("%s: Invalid data: %s", postInfo.getLogPrefix(), strings.Join(invalidFields, ","))
+		logger.Warning("%s: Invalid data: %s", postInfo.getLogPrefix(), strings.Join(invalidFields, ","))
 		responseError(w, InvalidData, strings.Join(invalidFields, ","))
 		return
 	}
-	token, key, err := context.Config.Server.CreateAuthToken(postInfo.UserId, postInfo.ClientContext, postInfo.DeviceId)
+	sessionId, err := makeSessionId()
 	if err != nil {
-		context.Logger.Error("%s: error creating token %s", postInfo.getLogPrefix(), err.Error())
+		logger.Error("%s: error creating session id %s", postInfo.getLogPrefix(), err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := context.GetConfig().Server.CreateAuthToken(postInfo.UserId, postInfo.ClientContext, postInfo.DeviceId, sessionId)
+	if err != nil {
+		logger.Error("%s: error creating token %s", postInfo.getLogPrefix(), err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	authTokenKeys[token] = key
 
 	//	session.Values[SessionVarUserId] = postInfo.UserId
-	sessionId, err := makeSessionId(token)
-	reply, err := Pinger.StartPoll(&context.Config.Rpc, postInfo.AsMailInfo(sessionId))
+	reply, err := Pinger.StartPoll(&context.GetConfig().Rpc, postInfo.AsMailInfo(sessionId), traceId)
 	if err != nil {
-		context.Logger.Warning("%s: Could not re/start polling for device: %s", postInfo.getLogPrefix(), err)
+		logger.Warning("%s: Could not re/start polling for device: %s", postInfo.getLogPrefix(), err)
 		responseError(w, RPCServerError, "")
 		return
 	}
-	context.Logger.Debug("%s: Re/Started Polling", postInfo.getLogPrefix())
+	logger.Debug("%s: Re/Started Polling", postInfo.getLogPrefix())
 
 	//	err = session.Save(r, w)
 	//	if err != nil {
-	//		context.Logger.Warning("Could not save session")
+	//		logger.Warning("Could not save session")
 	//		responseError(w, SaveSessionError, "")
 	//		return
 	//	}
@@ -534,14 +566,17 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		responseData["Message"] = reply.Message
 
 	default:
-		context.Logger.Error("%s: Unknown PollingReply Code %d", postInfo.getLogPrefix(), reply.Code)
+		logger.Error("%s: Unknown PollingReply Code %d", postInfo.getLogPrefix(), reply.Code)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if traceId != "" {
+		responseData["TraceId"] = traceId
+	}
 	responseJson, err := json.Marshal(responseData)
 	if err != nil {
-		context.Logger.Warning("%s: Could not json encode reply: %v", postInfo.getLogPrefix(), responseData)
+		logger.Warning("%s: Could not json encode reply: %v", postInfo.getLogPrefix(), responseData)
 		responseError(w, JSONEncodeError, "")
 		return
 	}
@@ -597,103 +632,25 @@ func (dp *deferPost) validate(context *Context) (bool, []string) {
 
 func deferPolling(w http.ResponseWriter, r *http.Request) {
 	context := GetContext(r)
-	if r.Method != "POST" {
-		context.Logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
-		http.Error(w, "UNKNOWN METHOD", http.StatusBadRequest)
-		return
-	}
-	//	session, err := context.SessionStore.Get(r, "pinger-session")
-	//	if err != nil {
-	//		context.Logger.Warning("Could not get session")
-	//		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-	//		return
-	//	}
-	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, "UNKNOWN Encoding", http.StatusBadRequest)
-		return
-	}
-
+	traceId := GetTraceId(r)
+	logger := Pinger.TraceLogger(context.Logger, traceId)
 	deferData := deferPost{}
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_HTTP_REQUEST_SIZE)
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&deferData)
-	if err != nil {
-		context.Logger.Error("Could not parse json %s", err)
-		http.Error(w, "Could not parse json", http.StatusBadRequest)
+	if !decodePost(w, r, logger, &deferData) {
 		return
 	}
-
-	var reply *Pinger.PollingResponse
 	if deferData.UserId == "" && deferData.ClientId != "" { // old client
 		deferData.UserId = deferData.ClientId
-		context.Logger.Info("%s: Old client using ClientId (%s) instead of UserId.", deferData.getLogPrefix(), deferData.ClientId)
+		logger.Info("%s: Old client using ClientId (%s) instead of UserId.", deferData.getLogPrefix(), deferData.ClientId)
 	}
-	ok, invalidFields := deferData.validate(context)
-	if ok == false {
-		context.Logger.Warning("%s: Invalid data: %s", deferData.getLogPrefix(), strings.Join(invalidFields, ","))
-		responseError(w, InvalidData, strings.Join(invalidFields, ","))
+	if !validatePost(w, context, logger, &deferData) {
 		return
 	}
-	key, ok := authTokenKeys[deferData.Token]
-	if !ok {
-		reply = &Pinger.PollingResponse{
-			Code:    Pinger.PollingReplyError,
-			Message: "Token is not valid",
-		}
-	} else {
-		valid := context.Config.Server.ValidateAuthToken(deferData.UserId, deferData.ClientContext,
-			deferData.DeviceId, deferData.Token, key)
-		if !valid {
-			reply = &Pinger.PollingResponse{
-				Code:    Pinger.PollingReplyError,
-				Message: "Token is not valid",
-			}
-		} else {
-			//	if session.Values[SessionVarUserId] != deferData.UserId {
-			//		context.Logger.Error("Client ID %s does not match session", deferData.UserId)
-			//		http.Error(w, "Unknown Client ID", http.StatusForbidden)
-			//		return
-			//	}
-			context.Logger.Debug("%s: Token is valid", deferData.getLogPrefix())
+	relayPost(w, r, context, logger, traceId, &deferData, deferData.Token, "deferring poll",
+		func(sessionId string) (*Pinger.PollingResponse, error) {
 			// deferData.Timeout is not sent by the client. It defaults to 0
-			reply, err = Pinger.DeferPoll(&context.Config.Rpc, deferData.UserId, deferData.ClientContext,
-				deferData.DeviceId, deferData.Timeout, deferData.RequestData)
-			if err != nil {
-				context.Logger.Error("%s: Error deferring poll %s", deferData.getLogPrefix(), err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-	}
-	responseData := make(map[string]string)
-	switch {
-	case reply.Code == Pinger.PollingReplyError:
-		responseData["Status"] = "ERROR"
-		responseData["Message"] = reply.Message
-
-	case reply.Code == Pinger.PollingReplyOK:
-		responseData["Status"] = "OK"
-		responseData["Message"] = ""
-
-	case reply.Code == Pinger.PollingReplyWarn:
-		responseData["Status"] = "WARN"
-		responseData["Message"] = reply.Message
-
-	default:
-		context.Logger.Error("%s: Unknown PollingReply Code %d", deferData.getLogPrefix(), reply.Code)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	responseJson, err := json.Marshal(responseData)
-	if err != nil {
-		context.Logger.Warning("%s: Could not json encode reply: %v", deferData.getLogPrefix(), responseData)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Add("Content-Type", "application/json")
-	fmt.Fprintf(w, string(responseJson))
-	return
+			return Pinger.DeferPoll(&context.GetConfig().Rpc, deferData.UserId, deferData.ClientContext,
+				deferData.DeviceId, deferData.Timeout, deferData.RequestData, sessionId, traceId)
+		})
 }
 
 type stopPost struct {
@@ -731,70 +688,168 @@ func (sp *stopPost) getLogPrefix() string {
 
 func stopPolling(w http.ResponseWriter, r *http.Request) {
 	context := GetContext(r)
+	traceId := GetTraceId(r)
+	logger := Pinger.TraceLogger(context.Logger, traceId)
+	stopData := stopPost{}
+	if !decodePost(w, r, logger, &stopData) {
+		return
+	}
+	if stopData.UserId == "" && stopData.ClientId != "" { // old client
+		stopData.UserId = stopData.ClientId
+		logger.Info("%s: Old client using ClientId (%s) instead of UserId.", stopData.getLogPrefix(), stopData.ClientId)
+	}
+	if !validatePost(w, context, logger, &stopData) {
+		return
+	}
+	relayPost(w, r, context, logger, traceId, &stopData, stopData.Token, "stopping poll",
+		func(sessionId string) (*Pinger.PollingResponse, error) {
+			return Pinger.StopPoll(&context.GetConfig().Rpc, stopData.UserId, stopData.ClientContext, stopData.DeviceId, sessionId, traceId)
+		})
+}
+
+type ackPost struct {
+	UserId        string
+	ClientContext string
+	DeviceId      string
+	Token         string
+	PushId        string // the "id" in the meta map of the push
+	Timestamp     int64  // when the device got the push, in unix milliseconds. Optional
+}
+
+// Validate validate the structure/information to make sure required information exists.
+func (ap *ackPost) validate(context *Context) (bool, []string) {
+	ok := true
+	invalidFields := []string{}
+	if !isValidUserId(ap.UserId) {
+		ok = false
+		invalidFields = append(invalidFields, "UserId")
+	}
+	if !isValidDeviceId(ap.DeviceId) {
+		ok = false
+		invalidFields = append(invalidFields, "DeviceId")
+	}
+	if !isValidClientContext(ap.ClientContext) {
+		ok = false
+		invalidFields = append(invalidFields, "ClientContextId")
+	}
+	if !isValidPushId(ap.PushId) {
+		ok = false
+		invalidFields = append(invalidFields, "PushId")
+	}
+	if ap.Timestamp < 0 {
+		ok = false
+		invalidFields = append(invalidFields, "Timestamp")
+	}
+	return ok, invalidFields
+}
+
+func (ap *ackPost) getLogPrefix() string {
+	return getScrubbedLogPrefix(ap.DeviceId, ap.UserId, ap.ClientContext)
+}
+
+// ackPush is called by the app when it gets a push, so we know how many pushes arrive, and how fast.
+func ackPush(w http.ResponseWriter, r *http.Request) {
+	context := GetContext(r)
+	traceId := GetTraceId(r)
+	logger := Pinger.TraceLogger(context.Logger, traceId)
+	ackData := ackPost{}
+	if !decodePost(w, r, logger, &ackData) {
+		return
+	}
+	if !validatePost(w, context, logger, &ackData) {
+		return
+	}
+	relayPost(w, r, context, logger, traceId, &ackData, ackData.Token, "acknowledging push",
+		func(sessionId string) (*Pinger.PollingResponse, error) {
+			return Pinger.AckPush(&context.GetConfig().Rpc, &Pinger.AckPushArgs{
+				UserId:        ackData.UserId,
+				ClientContext: ackData.ClientContext,
+				DeviceId:      ackData.DeviceId,
+				PushId:        ackData.PushId,
+				Timestamp:     ackData.Timestamp,
+				TraceId:       traceId,
+			})
+		})
+}
+
+// devicePost is the JSON body of a request that a device makes about its own (token protected) polling session.
+type devicePost interface {
+	validate(context *Context) (bool, []string)
+	getLogPrefix() string
+	getDevice() (userId, clientContext, deviceId string)
+}
+
+func (dp *deferPost) getDevice() (string, string, string) {
+	return dp.UserId, dp.ClientContext, dp.DeviceId
+}
+
+func (sp *stopPost) getDevice() (string, string, string) {
+	return sp.UserId, sp.ClientContext, sp.DeviceId
+}
+
+func (ap *ackPost) getDevice() (string, string, string) {
+	return ap.UserId, ap.ClientContext, ap.DeviceId
+}
+
+// decodePost checks that the request is a JSON POST and decodes its body into data.
+// On failure it has already replied to the client.
+func decodePost(w http.ResponseWriter, r *http.Request, logger *Logging.Logger, data devicePost) bool {
 	if r.Method != "POST" {
-		context.Logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
+		logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
 		http.Error(w, "UNKNOWN METHOD", http.StatusBadRequest)
-		return
+		return false
 	}
-	//	session, err := context.SessionStore.Get(r, "pinger-session")
-	//	if err != nil {
-	//		context.Logger.Warning("Could not get session")
-	//		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-	//		return
-	//	}
 	if r.Header.Get("Content-Type") != "application/json" {
 		http.Error(w, "UNKNOWN Encoding", http.StatusBadRequest)
-		return
+		return false
 	}
-
-	stopData := stopPost{}
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_HTTP_REQUEST_SIZE)
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&stopData)
+	err := decoder.Decode(data)
 	if err != nil {
-		context.Logger.Error("Could not parse json %s", err)
+		logger.Error("Could not parse json %s", err)
 		http.Error(w, "Could not parse json", http.StatusBadRequest)
-		return
+		return false
 	}
+	return true
+}
 
-	var reply *Pinger.PollingResponse
-	if stopData.UserId == "" && stopData.ClientId != "" { // old client
-		stopData.UserId = stopData.ClientId
-		context.Logger.Info("%s: Old client using ClientId (%s) instead of UserId.", stopData.getLogPrefix(), stopData.ClientId)
-	}
-	ok, invalidFields := stopData.validate(context)
+// validatePost validates data, and replies with the invalid fields if it is not valid.
+func validatePost(w http.ResponseWriter, context *Context, logger *Logging.Logger, data devicePost) bool {
+	ok, invalidFields := data.validate(context)
 	if ok == false {
-		context.Logger.Warning("%s: Invalid data: %s", stopData.getLogPrefix(), strings.Join(invalidFields, ","))
+		logger.Warning("%s: Invalid data: %s", data.getLogPrefix(), strings.Join(invalidFields, ","))
 		responseError(w, InvalidData, strings.Join(invalidFields, ","))
-		return
+		return false
 	}
-	key, ok := authTokenKeys[stopData.Token]
-	if !ok {
+	return true
+}
+
+// relayPost checks the device's auth token, makes the RPC call to the backend with the token's session id,
+// and writes the reply as JSON. A bad token is reported to the client without calling the backend.
+// Only calls with a valid token count towards the device's rate limit (see limitDevice).
+func relayPost(w http.ResponseWriter, r *http.Request, context *Context, logger *Logging.Logger, traceId string, data devicePost,
+	token string, action string, call func(sessionId string) (*Pinger.PollingResponse, error)) {
+	var reply *Pinger.PollingResponse
+	userId, clientContext, deviceId := data.getDevice()
+	sessionId, tokenErr := context.GetConfig().Server.ValidateAuthToken(userId, clientContext, deviceId, token)
+	if tokenErr != nil {
+		logger.Info("%s: %s", data.getLogPrefix(), tokenErr)
 		reply = &Pinger.PollingResponse{
 			Code:    Pinger.PollingReplyError,
-			Message: "Token is not valid",
+			Message: tokenErr.Error(),
 		}
 	} else {
-		valid := context.Config.Server.ValidateAuthToken(stopData.UserId, stopData.ClientContext, stopData.DeviceId, stopData.Token, key)
-		if !valid {
-			reply = &Pinger.PollingResponse{
-				Code:    Pinger.PollingReplyError,
-				Message: "Token is not valid",
-			}
-		} else {
-			//	if session.Values[SessionVarUserId] != stopData.UserId {
-			//		context.Logger.Error("User ID %s does not match session", stopData.UserId)
-			//		http.Error(w, "Unknown User ID", http.StatusForbidden)
-			//		return
-			//	}
-			context.Logger.Debug("%s: Deleting key for token %s", stopData.getLogPrefix(), stopData.Token)
-			delete(authTokenKeys, stopData.Token)
-			reply, err = Pinger.StopPoll(&context.Config.Rpc, stopData.UserId, stopData.ClientContext, stopData.DeviceId)
-			if err != nil {
-				context.Logger.Error("%s: Error stopping poll %s", stopData.getLogPrefix(), err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		logger.Debug("%s: Token is valid|session=%s", data.getLogPrefix(), sessionId)
+		if !limitDevice(w, r, logger, userId, deviceId) {
+			return
+		}
+		var err error
+		reply, err = call(sessionId)
+		if err != nil {
+			logger.Error("%s: Error %s %s", data.getLogPrefix(), action, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 	responseData := make(map[string]string)
@@ -812,18 +867,20 @@ func stopPolling(w http.ResponseWriter, r *http.Request) {
 		responseData["Message"] = reply.Message
 
 	default:
-		context.Logger.Error("%s: Unknown PollingReply Code %d", stopData.getLogPrefix(), reply.Code)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Error("%s: Unknown PollingReply Code %d", data.getLogPrefix(), reply.Code)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	if traceId != "" {
+		responseData["TraceId"] = traceId
+	}
 	responseJson, err := json.Marshal(responseData)
 	if err != nil {
-		context.Logger.Warning("%s: Could not json encode reply: %v", stopData.getLogPrefix(), responseData)
+		logger.Warning("%s: Could not json encode reply: %v", data.getLogPrefix(), responseData)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
-	fmt.Fprintf(w, string(responseJson))
-	return
+	w.Write(responseJson)
 }
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
 	"github.com/nachocove/Pinger/Pinger"
 	"github.com/nachocove/Pinger/Utils/Logging"
 	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 type devicesTester struct {
@@ -24,6 +35,7 @@ type devicesTester struct {
 	config          *Pinger.Configuration
 	registerJson    string
 	rpcTestPort     int
+	osTrustStore    string
 }
 
 func (s *devicesTester) SetupSuite() {
@@ -46,13 +58,55 @@ func (s *devicesTester) SetupSuite() {
 
 	s.mx = mux.NewRouter()
 	s.mx.HandleFunc(s.registerPath, registerDevice)
+	s.mx.HandleFunc("/ack", ackPush)
 	s.config = Pinger.NewConfiguration()
 	s.config.Rpc = rpcConfig
-	s.n = negroni.New(NewContextMiddleWare(&Context{Logger: s.logger, Config: s.config}))
+	s.n = negroni.New(NewTraceMiddleWare(), NewContextMiddleWare(&Context{Logger: s.logger, Config: s.config}))
 	s.n.UseHandler(s.mx)
+
+	// the backend needs a trust store, and the machine we're running on may not have one where
+	// OsTrustStore says.
+	s.osTrustStore = Pinger.OsTrustStore
+	Pinger.OsTrustStore = writeTestTrustStore()
 	go s.startRpc()
 }
 
+func (s *devicesTester) TearDownSuite() {
+	os.Remove(Pinger.OsTrustStore)
+	Pinger.OsTrustStore = s.osTrustStore
+}
+
+// writeTestTrustStore writes a self-signed cert to a temp file, and returns its name.
+func writeTestTrustStore() string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	f, err := ioutil.TempFile("", "ca-bundle")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err != nil {
+		panic(err)
+	}
+	return f.Name()
+}
+
 func (s *devicesTester) SetupTest() {
 }
 
@@ -83,6 +137,44 @@ func (s *devicesTester) TestRegisterGet() {
 	s.Contains(response.Body.String(), "UNKNOWN METHOD")
 }
 
+func (s *devicesTester) TestValidAppId() {
+	s.True(isValidAppId(""))
+	s.True(isValidAppId("com.example.brand-x_2"))
+	s.False(isValidAppId("brand x"))
+	s.False(isValidAppId("brand/x"))
+	s.False(isValidAppId(strings.Repeat("x", 65)))
+}
+
+func (s *devicesTester) TestValidPushId() {
+	s.True(isValidPushId("a1b2c3d4e5f60718"))
+	s.False(isValidPushId(""))
+	s.False(isValidPushId("A1B2C3D4E5F60718"))
+	s.False(isValidPushId("a1b2c3d4e5f607189"))
+}
+
+func (s *devicesTester) TestAckInvalid() {
+	ackJson := `{"UserId": "us-east-1:0005d365-c8ea-470f-8a61-a7f44f145efb", "ClientContext": "12345", "DeviceId": "NchoDC28E565X072CX46B1XBF205", "PushId": "%s", "Timestamp": %d}`
+	for _, body := range []string{fmt.Sprintf(ackJson, "nosuchpush", 0), fmt.Sprintf(ackJson, "a1b2c3d4e5f60718", -1)} {
+		req, err := http.NewRequest("POST", s.fakeUrl+"/ack", strings.NewReader(body))
+		s.NoError(err)
+		req.Header.Add("Content-Type", "application/json")
+
+		response := httptest.NewRecorder()
+		s.n.ServeHTTP(response, req)
+		s.Equal(400, response.Code)
+		s.Contains(response.Body.String(), "INVALID_DATA")
+	}
+
+	// a valid ack, with a token we did not hand out
+	req, err := http.NewRequest("POST", s.fakeUrl+"/ack", strings.NewReader(fmt.Sprintf(ackJson, "a1b2c3d4e5f60718", 0)))
+	s.NoError(err)
+	req.Header.Add("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	s.n.ServeHTTP(response, req)
+	s.Equal(200, response.Code)
+	s.Contains(response.Body.String(), "Token is not valid")
+}
+
 func (s *devicesTester) TestRegisterEncodingFail() {
 	req, err := http.NewRequest("POST", s.fakeRegisterUrl, strings.NewReader(""))
 	s.NoError(err)
@@ -136,6 +228,29 @@ func (s *devicesTester) TestRegisterRPCFail() {
 	s.Contains(response.Body.String(), "RPC_SERVER_ERROR")
 }
 
+func (s *devicesTester) TestTraceId() {
+	for _, traceId := range []string{"client-trace-1234", "", "not a trace id"} {
+		req, err := http.NewRequest("POST", s.fakeRegisterUrl, strings.NewReader("{}"))
+		s.NoError(err)
+		req.Header.Add("Content-Type", "application/json")
+		if traceId != "" {
+			req.Header.Add(Pinger.TraceIdHeader, traceId)
+		}
+
+		response := httptest.NewRecorder()
+		s.n.ServeHTTP(response, req)
+		s.Equal(400, response.Code)
+		returned := response.Header().Get(Pinger.TraceIdHeader)
+		s.True(Pinger.ValidTraceId(returned), returned)
+		if Pinger.ValidTraceId(traceId) {
+			s.Equal(traceId, returned)
+		} else {
+			s.NotEqual(traceId, returned)
+		}
+		s.Contains(response.Body.String(), fmt.Sprintf("\"TraceId\":\"%s\"", returned))
+	}
+}
+
 //func (s *devicesTester) TestRegisterContentSuccess() {
 //  config.Rpc.Port = rpcTestPort
 //	req, err := http.NewRequest("POST", fakeRegisterUrl, strings.NewReader(registerJson))
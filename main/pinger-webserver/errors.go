@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/nachocove/Pinger/Pinger"
 	"net/http"
 )
 
@@ -27,6 +28,7 @@ const (
 	RPCServerError   ResponseErrorString = "RPC_SERVER_ERROR"
 	SaveSessionError ResponseErrorString = "SAVE_SESSION_ERROR"
 	JSONEncodeError  ResponseErrorString = "JSON_ENCODE_ERROR"
+	TooManyRequests  ResponseErrorString = "TOO_MANY_REQUESTS"
 )
 
 func init() {
@@ -35,6 +37,7 @@ func init() {
 	addResponseError(RPCServerError, "Could not reach RPC server", http.StatusInternalServerError)
 	addResponseError(SaveSessionError, "Could not save session", http.StatusInternalServerError)
 	addResponseError(JSONEncodeError, "Could not encode json reply", http.StatusInternalServerError)
+	addResponseError(TooManyRequests, "Too many requests. Try again after Retry-After seconds", http.StatusTooManyRequests)
 }
 
 func responseError(w http.ResponseWriter, errCode ResponseErrorString, extra string) {
@@ -49,6 +52,9 @@ func responseError(w http.ResponseWriter, errCode ResponseErrorString, extra str
 	if extra != "" {
 		responseData["Extra"] = extra
 	}
+	if traceId := w.Header().Get(Pinger.TraceIdHeader); traceId != "" {
+		responseData["TraceId"] = traceId
+	}
 
 	responseJson, err := json.Marshal(responseData)
 	if err != nil {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/nachocove/Pinger/Pinger"
+	"github.com/nachocove/Pinger/Utils/Metrics"
+	"net/http"
+)
+
+var metricRateLimited *Metrics.CounterVec
+
+func init() {
+	httpsRouter.HandleFunc("/metrics", metrics)
+	metricRateLimited = Metrics.NewCounterVec("pinger_web_rate_limited_total",
+		"Requests turned away with 429 Too Many Requests, by path and limit (ip or device).", "path", "limit")
+}
+
+// metrics serves the Prometheus metrics. Access is restricted the same way as the alive-check:
+// the scraper must be in one of the alive-check-ip ranges, and pass one of the alive-check-tokens.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	context := GetContext(r)
+	if r.Method != "GET" {
+		context.Logger.Warning("Received %s method call from %s", r.Method, r.RemoteAddr)
+		http.Error(w, "UNKNOWN METHOD", http.StatusBadRequest)
+		return
+	}
+	_, ok := checkAliveAccess(w, r, context)
+	if !ok {
+		return
+	}
+	Pinger.MetricsHandler().ServeHTTP(w, r)
+}
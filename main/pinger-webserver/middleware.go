@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/gorilla/context"
+	"github.com/nachocove/Pinger/Pinger"
 	"net/http"
 )
 
@@ -10,6 +11,8 @@ type contextKey int
 // Define keys that support equality.
 const (
 	serverContext contextKey = iota
+	traceIdContext
+	rateLimitContext
 )
 
 // GetServerConfig get the server config from the context
@@ -41,3 +44,43 @@ func (c *ContextMiddleWare) ServeHTTP(rw http.ResponseWriter, r *http.Request, n
 func NewContextMiddleWare(context *Context) *ContextMiddleWare {
 	return &ContextMiddleWare{context: context}
 }
+
+// GetTraceId get the trace id of the request. Empty if there is no TraceMiddleWare.
+func GetTraceId(r *http.Request) string {
+	val, ok := context.GetOk(r, traceIdContext)
+	if !ok {
+		return ""
+	}
+	traceId, _ := val.(string)
+	return traceId
+}
+
+// getRateLimiter returns the RateLimitMiddleWare the request went through. nil if there is none.
+func getRateLimiter(r *http.Request) *RateLimitMiddleWare {
+	val, ok := context.GetOk(r, rateLimitContext)
+	if !ok {
+		return nil
+	}
+	rl, _ := val.(*RateLimitMiddleWare)
+	return rl
+}
+
+// TraceMiddleWare gives each request a trace id, which is passed on to the backend and logged
+// along the way. A client can send its own in the X-Pinger-Trace-Id header. Either way, it is
+// returned in the same header.
+type TraceMiddleWare struct{}
+
+func (t *TraceMiddleWare) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	traceId := r.Header.Get(Pinger.TraceIdHeader)
+	if !Pinger.ValidTraceId(traceId) {
+		traceId = Pinger.NewTraceId()
+	}
+	context.Set(r, traceIdContext, traceId)
+	rw.Header().Set(Pinger.TraceIdHeader, traceId)
+	next(rw, r)
+}
+
+// NewTraceMiddleWare create new TraceMiddleWare
+func NewTraceMiddleWare() *TraceMiddleWare {
+	return &TraceMiddleWare{}
+}
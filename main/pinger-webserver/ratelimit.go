@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/context"
+	"github.com/nachocove/Pinger/Pinger"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitedPaths are the calls the devices make. Each of them costs an RPC to the backend, and a
+// register also a Cognito lookup and a new connection to the mail server.
+var rateLimitedPaths = map[string]bool{
+	"/1/register": true,
+	"/1/defer":    true,
+	"/1/stop":     true,
+	"/1/ack":      true,
+}
+
+type rateBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key. The rate and burst are passed in with each
+// request, so that a config reload takes effect right away.
+type rateLimiter struct {
+	mutex      sync.Mutex
+	buckets    map[string]*rateBucket
+	lastExpire time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:    make(map[string]*rateBucket),
+		lastExpire: time.Now(),
+	}
+}
+
+// reserve tries to take a token from the bucket of the key. It returns 0 if the caller may proceed,
+// or how long until there is a token. A rate of 0 means no limit.
+func (rl *rateLimiter) reserve(key string, rate float64, burst int, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.expireLocked(now, rate, burst)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(burst), lastRefill: now}
+		rl.buckets[key] = b
+	}
+	if now.After(b.lastRefill) {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.lastRefill).Seconds()*rate)
+		b.lastRefill = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// expireLocked forgets the buckets that have filled up again, since a new bucket would be just the
+// same. It looks at most once a minute.
+func (rl *rateLimiter) expireLocked(now time.Time, rate float64, burst int) {
+	if now.Sub(rl.lastExpire) < time.Minute {
+		return
+	}
+	rl.lastExpire = now
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.lastRefill) >= refill {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleWare limits the requests to the rateLimitedPaths per client address (see
+// getRemoteIP), and a register also per address and UserId/DeviceId in the posted json. The other
+// calls carry an auth token, so they are limited per UserId/DeviceId only once the token checks
+// out (see limitDevice), and nobody else can use up a device's requests. A request over a limit
+// gets a 429, with a Retry-After header.
+type RateLimitMiddleWare struct {
+	byIP     *rateLimiter
+	byDevice *rateLimiter
+}
+
+func (rl *RateLimitMiddleWare) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !rateLimitedPaths[r.URL.Path] {
+		next(rw, r)
+		return
+	}
+	context.Set(r, rateLimitContext, rl) // for limitDevice
+	context := GetContext(r)
+	config := context.GetConfig()
+	logger := Pinger.TraceLogger(context.Logger, GetTraceId(r))
+	now := time.Now()
+
+	remote := ""
+	remoteIP, err := getRemoteIP(r)
+	if err != nil {
+		logger.Warning("Not rate limiting by address: %s", err)
+	} else {
+		remote = remoteIP.String()
+		wait := rl.byIP.reserve(remote, config.Server.RateLimitIP, config.Server.RateBurstIP, now)
+		if wait > 0 {
+			logger.Debug("Too many requests to %s from %s|msgCode=RATE_LIMITED", r.URL.Path, remoteIP)
+			metricRateLimited.With(r.URL.Path, "ip").Inc()
+			tooManyRequests(rw, wait)
+			return
+		}
+	}
+
+	// a register has no token yet, so anyone could send one for any device. Keep the
+	// address in the key, so that they don't lock the device out.
+	if r.URL.Path == "/1/register" && r.Method == "POST" && config.Server.RateLimitDevice > 0 {
+		userId, deviceId := peekDevice(r)
+		if userId != "" && deviceId != "" && !rl.reserveDevice(rw, r, logger, remote+"/"+userId+"/"+deviceId, userId, deviceId) {
+			return
+		}
+	}
+	next(rw, r)
+}
+
+// reserveDevice takes a token from the device's bucket for the key. If there is none, it replies
+// with a 429 and returns false.
+func (rl *RateLimitMiddleWare) reserveDevice(rw http.ResponseWriter, r *http.Request, logger *Logging.Logger, key, userId, deviceId string) bool {
+	config := GetContext(r).GetConfig()
+	wait := rl.byDevice.reserve(key, config.Server.RateLimitDevice, config.Server.RateBurstDevice, time.Now())
+	if wait > 0 {
+		logger.Debug("%s: Too many requests to %s|msgCode=RATE_LIMITED", getScrubbedLogPrefix(deviceId, userId, ""), r.URL.Path)
+		metricRateLimited.With(r.URL.Path, "device").Inc()
+		tooManyRequests(rw, wait)
+		return false
+	}
+	return true
+}
+
+// limitDevice limits the token-protected calls per UserId/DeviceId. Call it once the token is
+// valid. If the device is over the limit, it replies with a 429 and returns false.
+func limitDevice(rw http.ResponseWriter, r *http.Request, logger *Logging.Logger, userId, deviceId string) bool {
+	rl := getRateLimiter(r)
+	if rl == nil {
+		return true
+	}
+	return rl.reserveDevice(rw, r, logger, userId+"/"+deviceId, userId, deviceId)
+}
+
+// peekDevice returns the UserId and DeviceId of the posted json, leaving the body for the handler.
+// The handler deals with bodies that are too large or not json.
+func peekDevice(r *http.Request) (string, string) {
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, MAX_HTTP_REQUEST_SIZE+1))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	device := struct {
+		UserId   string
+		DeviceId string
+	}{}
+	err := json.Unmarshal(body, &device)
+	if err != nil {
+		return "", ""
+	}
+	return device.UserId, device.DeviceId
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	responseError(w, TooManyRequests, "")
+}
+
+// NewRateLimitMiddleWare create new RateLimitMiddleWare
+func NewRateLimitMiddleWare() *RateLimitMiddleWare {
+	return &RateLimitMiddleWare{
+		byIP:     newRateLimiter(),
+		byDevice: newRateLimiter(),
+	}
+}
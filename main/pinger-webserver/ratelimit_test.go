@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/nachocove/Pinger/Pinger"
+	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rateLimitTester struct {
+	suite.Suite
+	logger *Logging.Logger
+	config *Pinger.Configuration
+	n      *negroni.Negroni
+}
+
+func (s *rateLimitTester) SetupSuite() {
+	s.logger = Logging.InitLogging("unittest", "", Logging.DEBUG, true, Logging.DEBUG, nil, true)
+}
+
+func (s *rateLimitTester) SetupTest() {
+	s.config = Pinger.NewConfiguration()
+	s.config.Server.RateLimitIP = 1
+	s.config.Server.RateBurstIP = 3
+	s.config.Server.RateLimitDevice = 1
+	s.config.Server.RateBurstDevice = 1
+	s.config.Server.TokenAuthKey = "01234567890123456789012345678901"
+	s.config.Rpc.Port = 10 // nothing there, so the calls with a valid token fail
+
+	mx := mux.NewRouter()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		s.NoError(err)
+		w.Write(body)
+	}
+	mx.HandleFunc("/1/register", echo)
+	mx.HandleFunc("/1/defer", echo)
+	mx.HandleFunc("/1/stop", stopPolling)
+	mx.HandleFunc("/1/alive", echo)
+	s.n = negroni.New(NewTraceMiddleWare(), NewContextMiddleWare(&Context{Logger: s.logger, Config: s.config}), NewRateLimitMiddleWare())
+	s.n.UseHandler(mx)
+}
+
+func TestRateLimit(t *testing.T) {
+	s := new(rateLimitTester)
+	suite.Run(t, s)
+}
+
+func (s *rateLimitTester) post(path, forwardedFor, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "http://mypinger.com"+path, strings.NewReader(body))
+	require.NoError(s.T(), err)
+	req.RemoteAddr = "10.1.1.1:5000"
+	req.Header.Set("Content-Type", "application/json")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	resp := httptest.NewRecorder()
+	s.n.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *rateLimitTester) requireTooMany(resp *httptest.ResponseRecorder) {
+	require.Equal(s.T(), http.StatusTooManyRequests, resp.Code)
+	s.Equal("1", resp.Header().Get("Retry-After"))
+	var reply map[string]string
+	require.NoError(s.T(), json.Unmarshal(resp.Body.Bytes(), &reply))
+	s.Equal(string(TooManyRequests), reply["Status"])
+	s.Equal(resp.Header().Get(Pinger.TraceIdHeader), reply["TraceId"])
+}
+
+func (s *rateLimitTester) TestReserve() {
+	rl := newRateLimiter()
+	now := time.Now()
+	s.Equal(time.Duration(0), rl.reserve("a", 2, 2, now))
+	s.Equal(time.Duration(0), rl.reserve("a", 2, 2, now))
+	s.Equal(500*time.Millisecond, rl.reserve("a", 2, 2, now))
+	s.Equal(time.Duration(0), rl.reserve("b", 2, 2, now))
+	s.Equal(time.Duration(0), rl.reserve("a", 2, 2, now.Add(500*time.Millisecond)))
+
+	// no limit
+	for i := 0; i < 10; i++ {
+		s.Equal(time.Duration(0), rl.reserve("c", 0, 0, now))
+	}
+	s.Len(rl.buckets, 2)
+}
+
+func (s *rateLimitTester) TestExpire() {
+	rl := newRateLimiter()
+	now := time.Now()
+	rl.reserve("a", 1, 10, now.Add(-time.Minute))
+	rl.reserve("b", 1, 10, now.Add(-time.Second))
+	s.Len(rl.buckets, 2)
+
+	rl.lastExpire = now.Add(-time.Minute)
+	rl.reserve("c", 1, 10, now)
+	s.Len(rl.buckets, 2)
+	_, ok := rl.buckets["a"]
+	s.False(ok)
+}
+
+func (s *rateLimitTester) TestLimitByIP() {
+	for i := 0; i < 3; i++ {
+		s.Equal(http.StatusOK, s.post("/1/defer", "", "").Code)
+	}
+	s.requireTooMany(s.post("/1/defer", "", ""))
+
+	// behind a load balancer, the client is the last forwarded address
+	for i := 0; i < 3; i++ {
+		s.Equal(http.StatusOK, s.post("/1/defer", "10.9.9.9, 192.168.1.1", "").Code)
+	}
+	s.requireTooMany(s.post("/1/defer", "10.8.8.8, 192.168.1.1", ""))
+
+	// IPv6 clients are limited, too
+	for i := 0; i < 3; i++ {
+		s.Equal(http.StatusOK, s.post("/1/defer", "2001:db8::1", "").Code)
+	}
+	s.requireTooMany(s.post("/1/defer", "10.9.9.9, 2001:db8::1", ""))
+
+	// only the device calls are limited
+	s.Equal(http.StatusOK, s.post("/1/alive", "", "").Code)
+}
+
+func (s *rateLimitTester) TestLimitByDevice() {
+	// a register is limited per address and device, so others can't lock the device out
+	body := `{"UserId": "us-east-1:0005d365-c8ea-470f-8a61-a7f44f145efb", "DeviceId": "NchoDC28E565X072CX46B1XBF205"}`
+	resp := s.post("/1/register", "192.168.1.1", body)
+	s.Equal(http.StatusOK, resp.Code)
+	s.Equal(body, resp.Body.String())
+	s.requireTooMany(s.post("/1/register", "192.168.1.1", body))
+	s.Equal(http.StatusOK, s.post("/1/register", "192.168.1.2", body).Code)
+
+	other := `{"UserId": "us-east-1:0005d365-c8ea-470f-8a61-a7f44f145efb", "DeviceId": "NchoDC28E565X072CX46B1XBF206"}`
+	s.Equal(http.StatusOK, s.post("/1/register", "192.168.1.1", other).Code)
+
+	// not json is for the handler to deal with
+	s.Equal(http.StatusOK, s.post("/1/register", "192.168.1.4", "foo").Code)
+
+	// the other calls are limited once the token checks out (see TestLimitByToken)
+	s.Equal(http.StatusOK, s.post("/1/defer", "192.168.1.3", body).Code)
+	s.Equal(http.StatusOK, s.post("/1/defer", "192.168.1.3", body).Code)
+}
+
+func (s *rateLimitTester) TestLimitByToken() {
+	userId := "us-east-1:0005d365-c8ea-470f-8a61-a7f44f145efb"
+	deviceId := "NchoDC28E565X072CX46B1XBF205"
+	stop := `{"UserId": "` + userId + `", "ClientContext": "12345", "DeviceId": "` + deviceId + `", "Token": "%s"}`
+
+	// a bad token doesn't count
+	for i := 0; i < 3; i++ {
+		resp := s.post("/1/stop", fmt.Sprintf("192.168.2.%d", i), fmt.Sprintf(stop, "bm90IGEgdG9rZW4="))
+		s.Equal(http.StatusOK, resp.Code)
+		s.Contains(resp.Body.String(), "ERROR")
+	}
+
+	token, err := s.config.Server.CreateAuthToken(userId, "12345", deviceId, "session1")
+	require.NoError(s.T(), err)
+	s.Equal(http.StatusInternalServerError, s.post("/1/stop", "192.168.2.10", fmt.Sprintf(stop, token)).Code)
+	s.requireTooMany(s.post("/1/stop", "192.168.2.11", fmt.Sprintf(stop, token)))
+}
+
+func (s *rateLimitTester) TestRemoteIP() {
+	req, err := http.NewRequest("GET", "http://mypinger.com/1/alive", nil)
+	require.NoError(s.T(), err)
+	req.RemoteAddr = "10.1.1.1:5000"
+	ip, err := getRemoteIP(req)
+	s.NoError(err)
+	s.Equal("10.1.1.1", ip.String())
+
+	req.RemoteAddr = "[::1]:5000"
+	ip, err = getRemoteIP(req)
+	s.NoError(err)
+	s.Equal("::1", ip.String())
+
+	req.Header.Set("X-Forwarded-For", "10.2.2.2, 10.3.3.3")
+	ip, err = getRemoteIP(req)
+	s.NoError(err)
+	s.Equal("10.3.3.3", ip.String())
+
+	req.Header.Set("X-Forwarded-For", "10.2.2.2, 2001:db8::1")
+	ip, err = getRemoteIP(req)
+	s.NoError(err)
+	s.Equal("2001:db8::1", ip.String())
+
+	req.Header.Set("X-Forwarded-For", "10.2.2.2:6000")
+	ip, err = getRemoteIP(req)
+	s.NoError(err)
+	s.Equal("10.2.2.2", ip.String())
+
+	req.Header.Set("X-Forwarded-For", "nonsense")
+	_, err = getRemoteIP(req)
+	s.EqualError(err, "Could not parse remote address nonsense")
+}
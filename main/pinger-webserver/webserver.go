@@ -9,10 +9,14 @@ import (
 	"github.com/nachocove/Pinger/Pinger"
 	"github.com/nachocove/Pinger/Utils"
 	"github.com/nachocove/Pinger/Utils/Logging"
+	"github.com/nachocove/Pinger/Utils/Metrics"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"sync"
+	"syscall"
 )
 
 func usage() {
@@ -25,6 +29,7 @@ type Context struct {
 	Logger       *Logging.Logger
 	loggerLevel  Logging.Level
 	SessionStore *sessions.CookieStore
+	configMutex  sync.RWMutex
 }
 
 func NewContext(
@@ -40,6 +45,41 @@ func NewContext(
 	}
 }
 
+// GetConfig returns the current configuration. A config reload swaps in a new configuration
+// rather than modifying the current one, so a request should call GetConfig() once if it
+// needs a consistent set of values.
+func (context *Context) GetConfig() *Pinger.Configuration {
+	context.configMutex.RLock()
+	defer context.configMutex.RUnlock()
+	return context.Config
+}
+
+// reloadConfig re-reads the config file, and swaps in the settings that are safe to change at runtime.
+func (context *Context) reloadConfig() error {
+	context.configMutex.Lock()
+	defer context.configMutex.Unlock()
+	newConfig, err := context.Config.Reload()
+	if err != nil {
+		return err
+	}
+	newConfig.SetLogLevels(context.Logger)
+	context.Config = newConfig
+	return nil
+}
+
+// reloadOnSignal reloads the config whenever we get a SIGHUP.
+func (context *Context) reloadOnSignal() {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	for sig := range signalChannel {
+		context.Logger.Info("Received signal %s. Reloading config|msgCode=RELOAD_CONFIG", sig)
+		err := context.reloadConfig()
+		if err != nil {
+			context.Logger.Error("Could not reload config: %s|msgCode=RELOAD_CONFIG_FAILED", err)
+		}
+	}
+}
+
 func (context *Context) ToggleDebug() {
 	context.loggerLevel = Logging.ToggleLogging(context.Logger, context.loggerLevel)
 }
@@ -47,11 +87,13 @@ func (context *Context) ToggleDebug() {
 var httpsRouter = mux.NewRouter()
 
 func (context *Context) run() error {
-	config := context.Config
+	config := context.GetConfig()
 	httpsMiddlewares := negroni.New(
 		Utils.NewRecovery("Pinger-web", config.Server.Debug),
+		NewTraceMiddleWare(),
 		Utils.NewLogger(context.Logger),
-		NewContextMiddleWare(context))
+		NewContextMiddleWare(context),
+		NewRateLimitMiddleWare())
 
 	httpsMiddlewares.UseHandler(httpsRouter)
 
@@ -151,6 +193,9 @@ func main() {
 		fmt.Sprintf("%s:%d", config.Rpc.Hostname, config.Rpc.Port),
 		sessions.NewCookieStore([]byte(config.Server.SessionSecret)))
 
+	go context.reloadOnSignal()
+	Metrics.RegisterRuntimeMetrics()
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	logger.Debug("Running with %d Processors", runtime.NumCPU())
 
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nachocove/Pinger/Utils/Telemetry"
+	"os"
+	"path"
+)
+
+var usage = func() {
+	fmt.Printf("USAGE: %s <flags> [<file> ...]\n", path.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Printf("\n  Prints the records of telemetry files (plog-*.gz), in the json or msgpack upload format,\n")
+	fmt.Printf("  as one JSON object per line. Reads stdin if no files are given.\n")
+}
+
+func main() {
+	var help bool
+	var pretty bool
+
+	flag.BoolVar(&help, "h", false, "Help")
+	flag.BoolVar(&pretty, "pretty", false, "Indent the JSON.")
+
+	flag.Parse()
+	if help {
+		usage()
+		os.Exit(0)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	dump := func(record []byte) error {
+		if pretty {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, record, "", "  "); err != nil {
+				return err
+			}
+			record = buf.Bytes()
+		}
+		_, err := out.Write(append(record, '\n'))
+		return err
+	}
+
+	if flag.NArg() == 0 {
+		if err := Telemetry.ReadTelemetryFile(os.Stdin, dump); err != nil {
+			fmt.Fprintf(os.Stderr, "Reading stdin: %s\n", err)
+			out.Flush()
+			os.Exit(1)
+		}
+		return
+	}
+	failed := false
+	for _, fileName := range flag.Args() {
+		fp, err := os.Open(fileName)
+		if err == nil {
+			err = Telemetry.ReadTelemetryFile(fp, dump)
+			fp.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reading %s: %s\n", fileName, err)
+			failed = true
+		}
+	}
+	out.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}